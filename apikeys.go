@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/server"
+)
+
+const apiKeysUsage = `usage: appts apikeys <command>
+
+Commands:
+  create NAME [ROLE]  create a key for admin (the default) or front-desk and print
+                     it; it can't be shown again
+  list               list keys that haven't been revoked
+  revoke ID          revoke a key`
+
+// apiKeys runs the apikeys subcommand against the configured database.
+func apiKeys(config *server.Config, args []string) {
+	if len(args) == 0 {
+		log.Fatal(apiKeysUsage)
+	}
+
+	if config.Storage == server.StorageMemory {
+		log.Fatal("The memory store doesn't outlive the command; use BOOTSTRAP_API_KEY instead")
+	}
+
+	s, err := server.OpenStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	switch args[0] {
+	case "create":
+		if len(args) != 2 && len(args) != 3 {
+			log.Fatal(apiKeysUsage)
+		}
+
+		role := auth.RoleAdmin
+		if len(args) == 3 {
+			role = args[2]
+		}
+
+		stored, key, err := server.CreateAPIKey(s, args[1], role)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(os.Stderr, "Created API key %d\n", stored.ID)
+		fmt.Println(key)
+	case "list":
+		var keys []models.APIKey
+		if err := s.APIKeys().List(&keys); err != nil {
+			log.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tROLE\tPREFIX\tCREATED")
+		for _, k := range keys {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Role, k.Prefix, k.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+		}
+		w.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			log.Fatal(apiKeysUsage)
+		}
+
+		id, err := strconv.ParseUint(args[1], 10, 0)
+		if err != nil {
+			log.Fatalf("revoke: ID must be a number, got %q", args[1])
+		}
+
+		if err := s.APIKeys().Delete(uint(id)); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Revoked API key %d\n", id)
+	default:
+		log.Fatal(apiKeysUsage)
+	}
+}
@@ -0,0 +1,162 @@
+// Package auth authenticates API clients, either by API key or by JWT bearer token, and carries
+// the authenticated principal through a request's context.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Authentication methods
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+
+	// Roles
+	RoleAdmin     = "admin"
+	RoleFrontDesk = "front-desk"
+	RoleTrainer   = "trainer"
+	RoleClient    = "client"
+
+	// APIKeyPrefix starts every API key, so that keys are easy to recognize, e.g. by secret
+	// scanners.
+	APIKeyPrefix = "appts_"
+
+	// tokenBytes is the number of random bytes in a key or token.
+	tokenBytes = 32
+	// displayPrefixLength is how much of a key is kept to tell it apart from others.
+	displayPrefixLength = len(APIKeyPrefix) + 6
+)
+
+// Principal is who made a request.
+type Principal struct {
+	// Subject identifies the principal: the JWT's sub claim, or "api-key:" and the key's ID.
+	Subject string
+	// Method is how the principal authenticated: MethodAPIKey or MethodJWT.
+	Method string
+	// Role is one of the Role constants, and decides what the principal may do.
+	Role string
+	// UserID is the user a client acts as.
+	UserID uint
+	// TrainerID is the trainer a trainer acts as.
+	TrainerID uint
+	// Claims are the JWT's claims, or nil for an API key.
+	Claims Claims
+}
+
+// ValidRole reports whether role is one of the Role constants.
+func ValidRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleFrontDesk, RoleTrainer, RoleClient:
+		return true
+	}
+
+	return false
+}
+
+// HasRole reports whether the principal has one of roles. A nil principal has none.
+func (p *Principal) HasRole(roles ...string) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, role := range roles {
+		if p.Role == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PrincipalFromClaims returns the principal a verified JWT identifies. The role claim is
+// required; clients also need a user_id claim and trainers a trainer_id claim.
+func PrincipalFromClaims(claims Claims) (*Principal, error) {
+	p := &Principal{Subject: claims.Subject(), Method: MethodJWT, Claims: claims}
+	p.Role, _ = claims["role"].(string)
+	if !ValidRole(p.Role) {
+		return nil, fmt.Errorf("%w: unknown role %q", ErrInvalidToken, p.Role)
+	}
+
+	var err error
+	switch p.Role {
+	case RoleClient:
+		p.UserID, err = claimID(claims, "user_id")
+	case RoleTrainer:
+		p.TrainerID, err = claimID(claims, "trainer_id")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// claimID returns the claim as an ID, which must be a positive whole number.
+func claimID(claims Claims, name string) (uint, error) {
+	value, ok := claims[name].(float64)
+	if !ok || value < 1 || value != float64(uint(value)) {
+		return 0, fmt.Errorf("%w: missing or invalid %s", ErrInvalidToken, name)
+	}
+
+	return uint(value), nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying p.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal carried by ctx, or nil if there isn't one.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(contextKey{}).(*Principal)
+	return p
+}
+
+// NewAPIKey returns a new random API key.
+func NewAPIKey() (string, error) {
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	return APIKeyPrefix + token, nil
+}
+
+// NewToken returns a new random opaque token, such as a refresh token.
+func NewToken() (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hash under which an API key or other opaque token is stored. Tokens are
+// random, so a slow hash isn't needed.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyDisplayPrefix returns the start of key, which is stored to tell keys apart.
+func APIKeyDisplayPrefix(key string) string {
+	if len(key) < displayPrefixLength {
+		return key
+	}
+
+	return key[:displayPrefixLength]
+}
+
+// IsJWT reports whether a bearer token looks like a JWT rather than an API key.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPrincipalFromClaims(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims Claims
+		want   *Principal
+	}{
+		{"Admin", Claims{"sub": "a", "role": RoleAdmin}, &Principal{Subject: "a", Role: RoleAdmin}},
+		{"Client", Claims{"sub": "c", "role": RoleClient, "user_id": 7.0}, &Principal{Subject: "c", Role: RoleClient, UserID: 7}},
+		{"Trainer", Claims{"sub": "t", "role": RoleTrainer, "trainer_id": 3.0}, &Principal{Subject: "t", Role: RoleTrainer, TrainerID: 3}},
+		{"No role", Claims{"sub": "a"}, nil},
+		{"Unknown role", Claims{"sub": "a", "role": "owner"}, nil},
+		{"Client without user_id", Claims{"sub": "c", "role": RoleClient}, nil},
+		{"Fractional trainer_id", Claims{"sub": "t", "role": RoleTrainer, "trainer_id": 1.5}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := PrincipalFromClaims(test.claims)
+			if test.want == nil {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Errorf("Expected %v, got %v", ErrInvalidToken, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if got.Subject != test.want.Subject || got.Role != test.want.Role ||
+				got.UserID != test.want.UserID || got.TrainerID != test.want.TrainerID {
+				t.Errorf("Expected %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/marcuscarr/appts/clock"
+)
+
+const (
+	// Signing algorithms
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+)
+
+// ErrInvalidToken is wrapped by every error for a token that can't be trusted.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are a JWT's payload. Numbers are decoded as float64.
+type Claims map[string]interface{}
+
+// Subject returns the sub claim, or "" if it isn't a string.
+func (c Claims) Subject() string {
+	sub, _ := c["sub"].(string)
+	return sub
+}
+
+// JWTConfig selects which JWTs are accepted. A token must be signed with one of the configured
+// keys; if neither is set, no JWTs are accepted.
+type JWTConfig struct {
+	// HS256Secret verifies tokens signed with HMAC SHA-256.
+	HS256Secret []byte
+	// RS256Key verifies tokens signed with RSA SHA-256.
+	RS256Key *rsa.PublicKey
+	// Issuer, if set, must equal the iss claim.
+	Issuer string
+	// Audience, if set, must be the aud claim or one of its values.
+	Audience string
+	// Leeway allows for clock skew when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// Enabled reports whether any key is configured.
+func (c JWTConfig) Enabled() bool {
+	return len(c.HS256Secret) > 0 || c.RS256Key != nil
+}
+
+// JWTVerifier checks JWTs' signatures and registered claims.
+type JWTVerifier struct {
+	config JWTConfig
+	clock  clock.Clock
+}
+
+// NewJWTVerifier returns a verifier for config, which checks expiry against c.
+func NewJWTVerifier(config JWTConfig, c clock.Clock) *JWTVerifier {
+	return &JWTVerifier{config, c}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Verify returns the claims of token if it is signed with a configured key, hasn't expired, and
+// was issued by the configured issuer for the configured audience. Tokens must have exp and sub
+// claims.
+func (v *JWTVerifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	header, err := parseHeader(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	// The algorithm comes from the token, so only accept it for the kind of key it applies to;
+	// otherwise a public key could be used as an HMAC secret, or "none" skip the check.
+	switch {
+	case header.Alg == AlgHS256 && len(v.config.HS256Secret) > 0:
+		if !hmac.Equal(signature, hmacSHA256(v.config.HS256Secret, signed)) {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	case header.Alg == AlgRS256 && v.config.RS256Key != nil:
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(v.config.RS256Key, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported alg %q", ErrInvalidToken, header.Alg)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// parseHeader decodes the header of a token split into its three parts.
+func parseHeader(parts []string) (*jwtHeader, error) {
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+
+	return &header, nil
+}
+
+func (v *JWTVerifier) checkClaims(claims Claims) error {
+	now := v.clock.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing exp", ErrInvalidToken)
+	}
+	if !now.Before(unixTime(exp).Add(v.config.Leeway)) {
+		return fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.config.Leeway).Before(unixTime(nbf)) {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+
+	if v.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.config.Issuer {
+			return fmt.Errorf("%w: wrong issuer %q", ErrInvalidToken, iss)
+		}
+	}
+
+	if v.config.Audience != "" && !hasAudience(claims["aud"], v.config.Audience) {
+		return fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+	}
+
+	if claims.Subject() == "" {
+		return fmt.Errorf("%w: missing sub", ErrInvalidToken)
+	}
+
+	return nil
+}
+
+// hasAudience reports whether aud, which may be a string or an array of them, includes want.
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// SignJWT returns a token with claims, signed with HS256 if key is a []byte secret, or RS256 if
+// it is an *rsa.PrivateKey.
+func SignJWT(claims Claims, key interface{}) (string, error) {
+	return SignJWTWithKeyID(claims, key, "")
+}
+
+// SignJWTWithKeyID is SignJWT, and names the key with a kid header so that verifiers holding a
+// set of keys know which one to use.
+func SignJWTWithKeyID(claims Claims, key interface{}, kid string) (string, error) {
+	var alg string
+	switch key.(type) {
+	case []byte:
+		alg = AlgHS256
+	case *rsa.PrivateKey:
+		alg = AlgRS256
+	default:
+		return "", fmt.Errorf("unsupported signing key %T", key)
+	}
+
+	header, err := encodeSegment(jwtHeader{Alg: alg, Typ: "JWT", Kid: kid})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := header + "." + payload
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		signature = hmacSHA256(key, []byte(signed))
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// ParseRSAPublicKey parses a PEM-encoded RSA public key, in either PKIX or PKCS #1 form.
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an RSA key, got %T", key)
+	}
+
+	return rsaKey, nil
+}
+
+func hmacSHA256(secret, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func encodeSegment(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
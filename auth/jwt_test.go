@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcuscarr/appts/clock"
+)
+
+func TestJWTVerify(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	secret := []byte("secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := JWTConfig{
+		HS256Secret: secret,
+		RS256Key:    &rsaKey.PublicKey,
+		Issuer:      "https://issuer.example",
+		Audience:    "appts",
+		Leeway:      time.Minute,
+	}
+
+	claims := func(changes Claims) Claims {
+		c := Claims{
+			"sub": "42",
+			"iss": "https://issuer.example",
+			"aud": "appts",
+			"exp": float64(now.Add(time.Hour).Unix()),
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		claims Claims
+		key    interface{}
+		valid  bool
+	}{
+		{"HS256", claims(nil), secret, true},
+		{"RS256", claims(nil), rsaKey, true},
+		{"Audience list", claims(Claims{"aud": []interface{}{"other", "appts"}}), secret, true},
+		{"Within leeway", claims(Claims{"exp": float64(now.Add(-30 * time.Second).Unix())}), secret, true},
+		{"Wrong secret", claims(nil), []byte("wrong"), false},
+		{"Wrong RSA key", claims(nil), otherKey, false},
+		{"Expired", claims(Claims{"exp": float64(now.Add(-time.Hour).Unix())}), secret, false},
+		{"No exp", claims(Claims{"exp": nil}), secret, false},
+		{"Not valid yet", claims(Claims{"nbf": float64(now.Add(time.Hour).Unix())}), secret, false},
+		{"Wrong issuer", claims(Claims{"iss": "https://other.example"}), secret, false},
+		{"Wrong audience", claims(Claims{"aud": "other"}), secret, false},
+		{"No sub", claims(Claims{"sub": nil}), secret, false},
+	}
+
+	verifier := NewJWTVerifier(config, clock.NewFake(now))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := SignJWT(test.claims, test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := verifier.Verify(token)
+			if test.valid {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				if got.Subject() != "42" {
+					t.Errorf("Expected %v, got %v", "42", got.Subject())
+				}
+			} else if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Expected %v, got %v", ErrInvalidToken, err)
+			}
+		})
+	}
+}
+
+func TestJWTVerifyAlg(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	claims := Claims{"sub": "42", "exp": float64(now.Add(time.Hour).Unix())}
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER := x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)
+
+	// A token signed with the RSA public key as an HMAC secret mustn't pass as RS256.
+	forged, err := SignJWT(claims, publicDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"None", "eyJhbGciOiJub25lIn0." + payload + "."},
+		{"HS256 with only an RSA key", forged},
+		{"Malformed", "not-a-token"},
+	}
+
+	verifier := NewJWTVerifier(JWTConfig{RS256Key: &rsaKey.PublicKey}, clock.NewFake(now))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := verifier.Verify(test.token); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Expected %v, got %v", ErrInvalidToken, err)
+			}
+		})
+	}
+}
+
+func TestParseRSAPublicKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := []*pem.Block{
+		{Type: "PUBLIC KEY", Bytes: pkix},
+		{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)},
+	}
+	for _, block := range blocks {
+		t.Run(block.Type, func(t *testing.T) {
+			parsed, err := ParseRSAPublicKey(pem.EncodeToMemory(block))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !parsed.Equal(&key.PublicKey) {
+				t.Errorf("Expected the generated key, got %v", parsed)
+			}
+		})
+	}
+}
+
+func TestNewAPIKey(t *testing.T) {
+	key, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		t.Errorf("Expected prefix %v, got %v", APIKeyPrefix, key)
+	}
+
+	if b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(key, APIKeyPrefix)); err != nil || len(b) != tokenBytes {
+		t.Errorf("Expected %v random bytes, got %v (%v)", tokenBytes, len(b), err)
+	}
+
+	if IsJWT(key) {
+		t.Errorf("Expected %v not to look like a JWT", key)
+	}
+}
@@ -0,0 +1,391 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcuscarr/appts/clock"
+)
+
+const (
+	// discoveryPath is where a provider's metadata is found, relative to its issuer.
+	discoveryPath = "/.well-known/openid-configuration"
+
+	defaultJWKSCacheTTL = time.Hour
+	// minJWKSRefresh limits how often keys are fetched for tokens signed with an unknown key, so
+	// that such tokens can't be used to flood the provider.
+	minJWKSRefresh = time.Minute
+)
+
+var defaultOIDCScopes = []string{"openid", "email", "profile"}
+
+// OIDCConfig configures logging in with an OpenID Connect provider.
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL, under which its metadata is discovered.
+	Issuer string
+	// ClientID and ClientSecret are the credentials the provider issued to this server.
+	// ClientSecret may be empty for a public client, which PKCE protects instead.
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back to after they log in.
+	RedirectURL string
+	// Scopes are requested when logging in. Defaults to openid, email and profile.
+	Scopes []string
+	// JWKSCacheTTL is how long the provider's signing keys are cached. Defaults to an hour.
+	JWKSCacheTTL time.Duration
+	// Leeway allows for clock skew when checking ID tokens' expiry.
+	Leeway time.Duration
+}
+
+// Enabled reports whether a provider is configured.
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != ""
+}
+
+// providerMetadata is the part of a provider's discovery document the relying party uses.
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider logs users in with an OpenID Connect provider, using the authorization code flow
+// with PKCE. The provider's metadata is discovered on first use, and its signing keys are cached.
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+	clock  clock.Clock
+
+	mu       sync.Mutex
+	metadata *providerMetadata
+	// keys are the provider's RSA signing keys by ID, fetched at keysFetchedAt.
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+// NewOIDCProvider returns a relying party for config, which calls the provider with client and
+// checks tokens' expiry against c.
+func NewOIDCProvider(config OIDCConfig, client *http.Client, c clock.Clock) *OIDCProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = defaultOIDCScopes
+	}
+	if config.JWKSCacheTTL == 0 {
+		config.JWKSCacheTTL = defaultJWKSCacheTTL
+	}
+
+	return &OIDCProvider{config: config, client: client, clock: c}
+}
+
+// Issuer returns the provider's issuer URL.
+func (p *OIDCProvider) Issuer() string {
+	return p.config.Issuer
+}
+
+// NewPKCEVerifier returns a random PKCE code verifier.
+func NewPKCEVerifier() (string, error) {
+	return NewToken()
+}
+
+// PKCEChallenge returns the S256 code challenge for verifier.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL to send the user to to log in. state and nonce are random values
+// checked when they come back, and verifier is the PKCE code verifier later given to Exchange.
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("authorization endpoint: %w", err)
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", p.config.RedirectURL)
+	q.Set("scope", strings.Join(p.config.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", PKCEChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange redeems the authorization code the provider sent back for an ID token.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.do(req, &tokens)
+	if err != nil {
+		return "", fmt.Errorf("token endpoint: %w", err)
+	}
+
+	if status != http.StatusOK {
+		// The provider rejects bad or reused codes and verifiers with invalid_grant.
+		if tokens.Error == "invalid_grant" {
+			return "", fmt.Errorf("%w: %s", ErrInvalidToken, tokens.ErrorDescription)
+		}
+
+		return "", fmt.Errorf("token endpoint: %d %s %s", status, tokens.Error, tokens.ErrorDescription)
+	}
+
+	if tokens.IDToken == "" {
+		return "", errors.New("token endpoint: no id_token")
+	}
+
+	return tokens.IDToken, nil
+}
+
+// VerifyIDToken returns the claims of an ID token if the provider signed it for this client,
+// it hasn't expired, and it carries nonce.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, token, nonce string) (Claims, error) {
+	header, err := parseHeader(strings.Split(token, "."))
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Alg != AlgRS256 {
+		return nil, fmt.Errorf("%w: unsupported alg %q", ErrInvalidToken, header.Alg)
+	}
+
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := NewJWTVerifier(JWTConfig{
+		RS256Key: key,
+		Issuer:   metadata.Issuer,
+		Audience: p.config.ClientID,
+		Leeway:   p.config.Leeway,
+	}, p.clock)
+	claims, err := verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := claims["iat"].(float64); !ok {
+		return nil, fmt.Errorf("%w: missing iat", ErrInvalidToken)
+	}
+
+	// A token for several audiences must name this client as the party it was issued to.
+	azp, hasAzp := claims["azp"].(string)
+	if aud, ok := claims["aud"].([]interface{}); ok && len(aud) > 1 && !hasAzp {
+		return nil, fmt.Errorf("%w: missing azp", ErrInvalidToken)
+	}
+	if hasAzp && azp != p.config.ClientID {
+		return nil, fmt.Errorf("%w: wrong azp %q", ErrInvalidToken, azp)
+	}
+
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, fmt.Errorf("%w: wrong nonce", ErrInvalidToken)
+	}
+
+	return claims, nil
+}
+
+// discover returns the provider's metadata, fetching it the first time.
+func (p *OIDCProvider) discover(ctx context.Context) (*providerMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.config.Issuer, "/")+discoveryPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata providerMetadata
+	status, err := p.do(req, &metadata)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("status %d", status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("discovering provider: %w", err)
+	}
+
+	// The issuer is trusted for the keys it names, so it must be the configured one.
+	if metadata.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("discovering provider: issuer %q doesn't match %q", metadata.Issuer, p.config.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("discovering provider: missing endpoints")
+	}
+
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// key returns the provider's signing key with the ID kid. Keys are fetched again once the cache
+// expires, or when a token names a key that isn't cached, as happens when the provider rotates
+// its keys.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	age := p.clock.Now().Sub(p.keysFetchedAt)
+	key := p.cachedKey(kid)
+	if key != nil && age < p.config.JWKSCacheTTL {
+		return key, nil
+	}
+
+	if p.keys == nil || age >= minJWKSRefresh {
+		if err := p.fetchKeys(ctx, metadata.JWKSURI); err != nil {
+			return nil, err
+		}
+		key = p.cachedKey(kid)
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+
+	return key, nil
+}
+
+// cachedKey returns the cached key with the ID, or the only one if the token didn't name one.
+func (p *OIDCProvider) cachedKey(kid string) *rsa.PublicKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+
+	return p.keys[kid]
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (p *OIDCProvider) fetchKeys(ctx context.Context, uri string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	status, err := p.do(req, &set)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("status %d", status)
+	}
+	if err != nil {
+		return fmt.Errorf("fetching keys: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		key, err := k.rsaKey()
+		if err != nil {
+			return fmt.Errorf("fetching keys: key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	p.keys = keys
+	p.keysFetchedAt = p.clock.Now()
+	return nil
+}
+
+func (k jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("exponent too large")
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+// do sends req and decodes the JSON response into v, returning the status.
+func (p *OIDCProvider) do(req *http.Request, v interface{}) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Responses are small, so a large one is a misbehaving provider.
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("decoding response: %w", err)
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,176 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/auth/oidctest"
+	"github.com/marcuscarr/appts/clock"
+)
+
+// The tests are outside the auth package so that they can use oidctest, which imports it.
+
+func TestOIDCLogin(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewFake(now)
+	idp := oidctest.NewProvider(c, "appts", "secret")
+	defer idp.Close()
+	idp.SetIdentity(auth.Claims{"sub": "alice", "email": "alice@example.com"})
+
+	p := auth.NewOIDCProvider(auth.OIDCConfig{
+		Issuer:       idp.Issuer(),
+		ClientID:     "appts",
+		ClientSecret: "secret",
+		RedirectURL:  "https://appts.example/callback",
+	}, http.DefaultClient, c)
+
+	verifier, err := auth.NewPKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	authURL, err := p.AuthCodeURL(ctx, "state", "nonce", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stand-in logs in at once and redirects back with a code.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := callback.Query().Get("state"); got != "state" {
+		t.Errorf("Expected %v, got %v", "state", got)
+	}
+
+	code := callback.Query().Get("code")
+	if _, err := p.Exchange(ctx, code, "wrong verifier"); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("Expected %v with the wrong verifier, got %v", auth.ErrInvalidToken, err)
+	}
+
+	// The failed attempt used up the code, so log in again.
+	resp, err = client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ = url.Parse(resp.Header.Get("Location"))
+
+	idToken, err := p.Exchange(ctx, callback.Query().Get("code"), verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := p.VerifyIDToken(ctx, idToken, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject() != "alice" || claims["email"] != "alice@example.com" {
+		t.Errorf("Expected alice's claims, got %v", claims)
+	}
+
+	if _, err := p.VerifyIDToken(ctx, idToken, "other nonce"); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("Expected %v for the wrong nonce, got %v", auth.ErrInvalidToken, err)
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewFake(now)
+	idp := oidctest.NewProvider(c, "appts", "")
+	defer idp.Close()
+
+	p := auth.NewOIDCProvider(auth.OIDCConfig{Issuer: idp.Issuer(), ClientID: "appts"}, http.DefaultClient, c)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		claims auth.Claims
+		valid  bool
+	}{
+		{"Valid", auth.Claims{"sub": "alice", "nonce": "n"}, true},
+		{"Other audience", auth.Claims{"sub": "alice", "nonce": "n", "aud": "other"}, false},
+		{"Several audiences without azp", auth.Claims{"sub": "alice", "nonce": "n", "aud": []string{"appts", "other"}}, false},
+		{"Other authorized party", auth.Claims{"sub": "alice", "nonce": "n", "azp": "other"}, false},
+		{"Other issuer", auth.Claims{"sub": "alice", "nonce": "n", "iss": "https://other.example"}, false},
+		{"Expired", auth.Claims{"sub": "alice", "nonce": "n", "exp": now.Add(-time.Minute).Unix()}, false},
+		{"No iat", auth.Claims{"sub": "alice", "nonce": "n", "iat": nil}, false},
+		{"No nonce", auth.Claims{"sub": "alice"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := p.VerifyIDToken(ctx, idp.IDToken(test.claims), "n")
+			if test.valid && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if !test.valid && !errors.Is(err, auth.ErrInvalidToken) {
+				t.Errorf("Expected %v, got %v", auth.ErrInvalidToken, err)
+			}
+		})
+	}
+
+	// Only RS256 tokens, signed with the provider's keys, are accepted.
+	hs256, err := auth.SignJWT(auth.Claims{"sub": "alice", "nonce": "n"}, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.VerifyIDToken(ctx, hs256, "n"); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("Expected %v, got %v", auth.ErrInvalidToken, err)
+	}
+}
+
+func TestOIDCKeyCache(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewFake(now)
+	idp := oidctest.NewProvider(c, "appts", "")
+	defer idp.Close()
+
+	p := auth.NewOIDCProvider(auth.OIDCConfig{Issuer: idp.Issuer(), ClientID: "appts"}, http.DefaultClient, c)
+	ctx := context.Background()
+	verify := func() {
+		t.Helper()
+		if _, err := p.VerifyIDToken(ctx, idp.IDToken(auth.Claims{"sub": "alice", "nonce": "n"}), "n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		name     string
+		rotate   bool
+		advance  time.Duration
+		requests int
+	}{
+		{"First token fetches the keys", false, 0, 1},
+		{"Cached", false, 0, 1},
+		{"Rotated key is fetched", true, 2 * time.Minute, 2},
+		{"Cache expires", false, 2 * time.Hour, 3},
+	}
+
+	for _, step := range steps {
+		if step.rotate {
+			idp.RotateKey()
+		}
+		c.Set(c.Now().Add(step.advance))
+
+		verify()
+		if got := idp.JWKSRequests(); got != step.requests {
+			t.Errorf("%s: Expected %d requests, got %d", step.name, step.requests, got)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Package oidctest runs a stand-in OpenID Connect provider, so that logging in with one can be
+// tested without a real identity provider.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+)
+
+// Provider is a provider serving discovery, authorization, token and JWKS endpoints. Its
+// authorization endpoint logs in the identity given to SetIdentity without asking, and redirects
+// straight back with a code.
+type Provider struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+
+	clock clock.Clock
+
+	mu       sync.Mutex
+	identity auth.Claims
+	keys     map[string]*rsa.PrivateKey
+	kid      string
+	codes    map[string]grant
+	// jwksRequests counts the requests for the keys.
+	jwksRequests int
+}
+
+// grant is an authorization code waiting to be exchanged.
+type grant struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+	identity    auth.Claims
+}
+
+// NewProvider starts a provider for the client, which issues tokens at the time on c. Close it
+// when done.
+func NewProvider(c clock.Clock, clientID, clientSecret string) *Provider {
+	p := &Provider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		clock:        c,
+		identity:     auth.Claims{},
+		keys:         map[string]*rsa.PrivateKey{},
+		codes:        map[string]grant{},
+	}
+	p.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", p.jwks)
+	p.Server = httptest.NewServer(mux)
+
+	return p
+}
+
+// Issuer returns the provider's issuer URL.
+func (p *Provider) Issuer() string {
+	return p.URL
+}
+
+// SetIdentity sets the claims, such as sub and email, of the user who logs in next.
+func (p *Provider) SetIdentity(claims auth.Claims) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.identity = claims
+}
+
+// RotateKey signs later tokens with a new key. The old keys are still published.
+func (p *Provider) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.kid = fmt.Sprintf("key-%d", len(p.keys)+1)
+	p.keys[p.kid] = key
+}
+
+// JWKSRequests returns how many times the keys have been fetched.
+func (p *Provider) JWKSRequests() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.jwksRequests
+}
+
+// IDToken returns an ID token for the client, signed with the current key, with claims added to
+// the standard ones.
+func (p *Provider) IDToken(claims auth.Claims) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.idToken(claims)
+}
+
+func (p *Provider) idToken(claims auth.Claims) string {
+	now := p.clock.Now()
+	signed := auth.Claims{
+		"iss": p.URL,
+		"aud": p.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		signed[k] = v
+	}
+
+	token, err := auth.SignJWTWithKeyID(signed, p.keys[p.kid], p.kid)
+	if err != nil {
+		panic(err)
+	}
+
+	return token
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{auth.AlgRS256},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != p.ClientID ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("redirect_uri") == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code, err := auth.NewToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p.mu.Lock()
+	p.codes[code] = grant{
+		redirectURI: redirect.String(),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		identity:    p.identity,
+	}
+	p.mu.Unlock()
+
+	back := redirect.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Confidential clients authenticate with basic auth, and public ones only name themselves.
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = r.PostFormValue("client_id")
+	}
+	if id != p.ClientID || secret != p.ClientSecret {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Codes can only be used once.
+	code := r.PostFormValue("code")
+	g, ok := p.codes[code]
+	delete(p.codes, code)
+	if !ok || g.redirectURI != r.PostFormValue("redirect_uri") ||
+		auth.PKCEChallenge(r.PostFormValue("code_verifier")) != g.challenge {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	claims := auth.Claims{}
+	for k, v := range g.identity {
+		claims[k] = v
+	}
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "opaque",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     p.idToken(claims),
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.jwksRequests++
+	var keys []map[string]string
+	for kid, key := range p.keys {
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"alg": auth.AlgRS256,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+func tokenError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrWrongPassword is returned by CheckPassword for a password that doesn't match.
+var ErrWrongPassword = errors.New("wrong password")
+
+// HashPassword returns the bcrypt hash of password with the given cost, or bcrypt's default if
+// cost is 0.
+func HashPassword(password string, cost int) (string, error) {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// CheckPassword returns nil if password matches hash, or ErrWrongPassword if it doesn't.
+func CheckPassword(hash, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrWrongPassword
+	}
+
+	return err
+}
@@ -0,0 +1,23 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckPassword(hash, "correct horse"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if err := CheckPassword(hash, "battery staple"); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected %v, got %v", ErrWrongPassword, err)
+	}
+}
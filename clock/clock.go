@@ -0,0 +1,135 @@
+// Package clock tells the time, so that code that depends on it can be given a different clock
+// in tests.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the current time and schedules periodic work.
+type Clock interface {
+	Now() time.Time
+	// NewTicker returns a ticker that sends the time on its channel every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the system clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// Fake is a Clock whose time only changes when it is set or advanced, firing any tickers that
+// are due. It is safe for concurrent use.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFake returns a fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+// Set moves the clock to t. Tickers are sent each tick they were due up to t, in order,
+// dropping ticks for slow receivers as time.Ticker does.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = t
+	for {
+		due := f.due()
+		if due == nil {
+			return
+		}
+
+		select {
+		case due.c <- due.next:
+		default:
+		}
+		due.next = due.next.Add(due.period)
+	}
+}
+
+// Advance moves the clock forward by d.
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// due returns the ticker with the earliest tick at or before now, or nil if none is due.
+func (f *Fake) due() *fakeTicker {
+	sort.SliceStable(f.tickers, func(i, j int) bool { return f.tickers[i].next.Before(f.tickers[j].next) })
+	if len(f.tickers) == 0 || f.tickers[0].next.After(f.now) {
+		return nil
+	}
+
+	return f.tickers[0]
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTicker{clock: f, c: make(chan time.Time, 1), period: d, next: f.now.Add(d)}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+type fakeTicker struct {
+	clock  *Fake
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, ticker := range t.clock.tickers {
+		if ticker == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAdvance(t *testing.T) {
+	start := time.Date(2020, 3, 8, 1, 30, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	f.Advance(90 * time.Minute)
+	if e := start.Add(90 * time.Minute); !f.Now().Equal(e) {
+		t.Errorf("Expected %v, got %v", e, f.Now())
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	ticker := f.NewTicker(time.Hour)
+
+	f.Advance(59 * time.Minute)
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("Expected no tick before the period, got %v", tick)
+	default:
+	}
+
+	// Ticks missed by a slow receiver are dropped, leaving the first.
+	f.Advance(3 * time.Hour)
+	if tick := <-ticker.C(); !tick.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected %v, got %v", start.Add(time.Hour), tick)
+	}
+
+	ticker.Stop()
+	f.Advance(time.Hour)
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("Expected no tick after Stop, got %v", tick)
+	default:
+	}
+}
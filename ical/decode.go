@@ -0,0 +1,204 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrInvalid is wrapped by the errors returned for malformed iCalendar data.
+var ErrInvalid = errors.New("invalid iCalendar data")
+
+// Decode reads a component, such as a VCALENDAR, from iCalendar data. Lines may end in CRLF or
+// LF, and folded lines are unfolded.
+func Decode(r io.Reader) (*Component, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var root *Component
+	var open []*Component
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		p, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalid, i+1, err)
+		}
+
+		switch {
+		case p.Name == "BEGIN":
+			c := &Component{Name: strings.ToUpper(p.Value)}
+			if len(open) > 0 {
+				parent := open[len(open)-1]
+				parent.Components = append(parent.Components, c)
+			} else if root == nil {
+				root = c
+			} else {
+				return nil, fmt.Errorf("%w: line %d: more than one component", ErrInvalid, i+1)
+			}
+			open = append(open, c)
+		case p.Name == "END":
+			if len(open) == 0 || open[len(open)-1].Name != strings.ToUpper(p.Value) {
+				return nil, fmt.Errorf("%w: line %d: unexpected END:%s", ErrInvalid, i+1, p.Value)
+			}
+			open = open[:len(open)-1]
+		case len(open) == 0:
+			return nil, fmt.Errorf("%w: line %d: property outside a component", ErrInvalid, i+1)
+		default:
+			c := open[len(open)-1]
+			c.Properties = append(c.Properties, p)
+		}
+	}
+
+	if root == nil || len(open) > 0 {
+		return nil, fmt.Errorf("%w: missing BEGIN or END", ErrInvalid)
+	}
+
+	return root, nil
+}
+
+// unfold returns the content lines of r, joining folded lines.
+func unfold(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if len(lines) > 0 && line != "" && (line[0] == ' ' || line[0] == '\t') {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
+
+// parseLine parses a content line such as DTSTART;TZID="America/Los_Angeles":20200102T090000.
+func parseLine(line string) (Property, error) {
+	end := strings.IndexAny(line, ";:")
+	if end <= 0 {
+		return Property{}, errors.New("missing name")
+	}
+
+	p := Property{Name: strings.ToUpper(line[:end])}
+	rest := line[end:]
+	for rest[0] == ';' {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return Property{}, fmt.Errorf("%s: parameter without a value", p.Name)
+		}
+		name := strings.ToUpper(rest[1:eq])
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			closing := strings.IndexByte(rest[1:], '"')
+			if closing < 0 {
+				return Property{}, fmt.Errorf("%s: unterminated quote", p.Name)
+			}
+			value, rest = rest[1:closing+1], rest[closing+2:]
+		} else {
+			stop := strings.IndexAny(rest, ";:")
+			if stop < 0 {
+				return Property{}, fmt.Errorf("%s: missing value", p.Name)
+			}
+			value, rest = rest[:stop], rest[stop:]
+		}
+
+		if p.Params == nil {
+			p.Params = map[string]string{}
+		}
+		p.Params[name] = value
+
+		if rest == "" {
+			return Property{}, fmt.Errorf("%s: missing value", p.Name)
+		}
+	}
+
+	if rest[0] != ':' {
+		return Property{}, fmt.Errorf("%s: missing value", p.Name)
+	}
+	p.Value = rest[1:]
+
+	return p, nil
+}
+
+// UnescapeText reverses EscapeText.
+func UnescapeText(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(s)
+}
+
+// Times parses a DATE or DATE-TIME property, which may hold a comma-separated list. Times are in
+// the location named by the TZID parameter, in UTC if they end in Z, and otherwise in loc, which
+// is also used if TZID names a location that isn't known. It reports whether the values are
+// dates.
+func (p *Property) Times(loc *time.Location) ([]time.Time, bool, error) {
+	if tzid := p.Params["TZID"]; tzid != "" {
+		if named, err := time.LoadLocation(strings.TrimPrefix(tzid, "/")); err == nil {
+			loc = named
+		}
+	}
+
+	isDate := strings.EqualFold(p.Params["VALUE"], "DATE")
+	var times []time.Time
+	for _, value := range strings.Split(p.Value, ",") {
+		t, date, err := parseTime(value, loc)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %s: %v", ErrInvalid, p.Name, err)
+		}
+
+		isDate = isDate || date
+		times = append(times, t)
+	}
+
+	return times, isDate, nil
+}
+
+// Time parses a DATE or DATE-TIME property holding a single value, like Times.
+func (p *Property) Time(loc *time.Location) (time.Time, bool, error) {
+	times, isDate, err := p.Times(loc)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	if len(times) != 1 {
+		return time.Time{}, false, fmt.Errorf("%w: %s: expected one value", ErrInvalid, p.Name)
+	}
+
+	return times[0], isDate, nil
+}
+
+func parseTime(value string, loc *time.Location) (time.Time, bool, error) {
+	switch {
+	case len(value) == len(dateFormat):
+		t, err := time.ParseInLocation(dateFormat, value, loc)
+		return t, true, err
+	case strings.HasSuffix(value, "Z"):
+		t, err := time.Parse(utcDateTimeFormat, value)
+		return t, false, err
+	default:
+		t, err := time.ParseInLocation(dateTimeFormat, value, loc)
+		return t, false, err
+	}
+}
+
+// ParseUTC parses a UTC date-time value such as 20200102T170000Z, the form of CalDAV's
+// time-range bounds.
+func ParseUTC(value string) (time.Time, error) {
+	t, err := time.Parse(utcDateTimeFormat, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	return t, nil
+}
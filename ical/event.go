@@ -0,0 +1,302 @@
+package ical
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Period is a span of time, from Start up to but not including End.
+type Period struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Event is a VEVENT's timing.
+type Event struct {
+	UID string
+	// Start and End are the first occurrence's. Every occurrence lasts as long.
+	Start time.Time
+	End   time.Time
+	// AllDay events have dates rather than date-times, and their occurrences last whole days.
+	AllDay bool
+	// Rule is the event's RRULE, or nil if it doesn't recur by rule.
+	Rule *Rule
+	// RDates are extra starts, and ExDates starts left out.
+	RDates  []time.Time
+	ExDates []time.Time
+	// RecurrenceID, if set, is the start of the occurrence of the recurring event with the same
+	// UID that this event replaces.
+	RecurrenceID time.Time
+	// Free is set on events that don't take up time: cancelled ones, and those marked
+	// TRANSP:TRANSPARENT.
+	Free bool
+}
+
+// Events returns the VEVENTs of a calendar. Floating times, and times in locations that aren't
+// known, are read in loc.
+func Events(cal *Component, loc *time.Location) ([]Event, error) {
+	var events []Event
+	for _, c := range cal.Components {
+		if c.Name != "VEVENT" {
+			continue
+		}
+
+		e, err := event(c, loc)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+func event(c *Component, loc *time.Location) (Event, error) {
+	var e Event
+	if p := c.Get("UID"); p != nil {
+		e.UID = p.Value
+	}
+
+	dtstart := c.Get("DTSTART")
+	if dtstart == nil {
+		return e, fmt.Errorf("%w: event %q has no DTSTART", ErrInvalid, e.UID)
+	}
+
+	var err error
+	if e.Start, e.AllDay, err = dtstart.Time(loc); err != nil {
+		return e, err
+	}
+
+	switch {
+	case c.Get("DTEND") != nil:
+		if e.End, _, err = c.Get("DTEND").Time(loc); err != nil {
+			return e, err
+		}
+	case c.Get("DURATION") != nil:
+		d, err := parseDuration(c.Get("DURATION").Value)
+		if err != nil {
+			return e, err
+		}
+		e.End = e.Start.Add(d)
+	case e.AllDay:
+		e.End = e.Start.AddDate(0, 0, 1)
+	default:
+		e.End = e.Start
+	}
+
+	if p := c.Get("RRULE"); p != nil {
+		if e.Rule, err = ParseRule(p.Value, loc); err != nil {
+			return e, err
+		}
+	}
+
+	for _, p := range c.Properties {
+		var times []time.Time
+		if p.Name == "RDATE" || p.Name == "EXDATE" {
+			if times, _, err = p.Times(loc); err != nil {
+				return e, err
+			}
+		}
+
+		switch p.Name {
+		case "RDATE":
+			e.RDates = append(e.RDates, times...)
+		case "EXDATE":
+			e.ExDates = append(e.ExDates, times...)
+		case "RECURRENCE-ID":
+			if e.RecurrenceID, _, err = p.Time(loc); err != nil {
+				return e, err
+			}
+		case "STATUS":
+			e.Free = e.Free || strings.EqualFold(p.Value, "CANCELLED")
+		case "TRANSP":
+			e.Free = e.Free || strings.EqualFold(p.Value, "TRANSPARENT")
+		}
+	}
+
+	return e, nil
+}
+
+// parseDuration parses a DURATION value such as PT1H30M or P1D.
+func parseDuration(value string) (time.Duration, error) {
+	s := strings.TrimPrefix(strings.TrimPrefix(value, "+"), "-")
+	if !strings.HasPrefix(s, "P") {
+		return 0, fmt.Errorf("%w: DURATION: %q", ErrInvalid, value)
+	}
+
+	units := map[byte]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour, 'H': time.Hour, 'M': time.Minute, 'S': time.Second}
+	var d time.Duration
+	n := -1
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == 'T':
+		case c >= '0' && c <= '9':
+			if n < 0 {
+				n = 0
+			}
+			n = n*10 + int(c-'0')
+		case units[c] != 0 && n >= 0:
+			d += time.Duration(n) * units[c]
+			n = -1
+		default:
+			return 0, fmt.Errorf("%w: DURATION: %q", ErrInvalid, value)
+		}
+	}
+
+	if n >= 0 {
+		return 0, fmt.Errorf("%w: DURATION: %q", ErrInvalid, value)
+	}
+
+	if strings.HasPrefix(value, "-") {
+		d = -d
+	}
+
+	return d, nil
+}
+
+// Busy returns the periods in which the events' occurrences overlap [start, end), ordered by
+// start. Free events and those without a duration are left out, and so are occurrences replaced
+// by an event with the same UID and a RECURRENCE-ID, which stands in for them.
+func Busy(events []Event, start, end time.Time) []Period {
+	replaced := map[string]map[int64]bool{}
+	for _, e := range events {
+		if !e.RecurrenceID.IsZero() {
+			if replaced[e.UID] == nil {
+				replaced[e.UID] = map[int64]bool{}
+			}
+			replaced[e.UID][e.RecurrenceID.Unix()] = true
+		}
+	}
+
+	var busy []Period
+	for _, e := range events {
+		if e.Free {
+			continue
+		}
+
+		for _, s := range e.occurrences(start, end) {
+			if e.RecurrenceID.IsZero() && replaced[e.UID][s.Unix()] {
+				continue
+			}
+
+			if period := (Period{Start: s, End: e.endOf(s)}); period.End.After(period.Start) {
+				busy = append(busy, period)
+			}
+		}
+	}
+
+	sort.Slice(busy, func(i, j int) bool { return busy[i].Start.Before(busy[j].Start) })
+	return busy
+}
+
+// Merge returns the periods joined where they overlap or meet, ordered by start.
+func Merge(periods []Period) []Period {
+	sorted := append([]Period(nil), periods...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Before(sorted[j].Start) })
+
+	var merged []Period
+	for _, p := range sorted {
+		if n := len(merged); n > 0 && !p.Start.After(merged[n-1].End) {
+			if p.End.After(merged[n-1].End) {
+				merged[n-1].End = p.End
+			}
+			continue
+		}
+
+		merged = append(merged, p)
+	}
+
+	return merged
+}
+
+// Subtract returns the parts of the periods that none of others overlap. Both must be ordered
+// by start and not overlap among themselves, as Merge returns them.
+func Subtract(periods, others []Period) []Period {
+	var rest []Period
+	for _, p := range periods {
+		for _, o := range others {
+			if !o.End.After(p.Start) {
+				continue
+			}
+			if !o.Start.Before(p.End) {
+				break
+			}
+
+			if o.Start.After(p.Start) {
+				rest = append(rest, Period{Start: p.Start, End: o.Start})
+			}
+			p.Start = o.End
+		}
+
+		if p.End.After(p.Start) {
+			rest = append(rest, p)
+		}
+	}
+
+	return rest
+}
+
+// FormatPeriods returns the periods as a FREEBUSY value: UTC starts and ends, separated by
+// slashes and the periods by commas.
+func FormatPeriods(periods []Period) string {
+	values := make([]string, len(periods))
+	for i, p := range periods {
+		values[i] = FormatUTC(p.Start) + "/" + FormatUTC(p.End)
+	}
+
+	return strings.Join(values, ",")
+}
+
+// occurrences returns the starts of the event's occurrences that overlap [start, end).
+func (e Event) occurrences(start, end time.Time) []time.Time {
+	// Occurrences starting up to a duration before start still overlap it.
+	from := start.Add(-e.End.Sub(e.Start))
+	if e.AllDay {
+		from = start.AddDate(0, 0, -int(dateOf(e.End).Sub(dateOf(e.Start)).Hours()/24))
+	}
+
+	var starts []time.Time
+	if e.Rule != nil && e.RecurrenceID.IsZero() {
+		starts = e.Rule.Starts(e.Start, from, end)
+	} else if e.Start.Before(end) && !e.Start.Before(from) {
+		starts = []time.Time{e.Start}
+	}
+
+	for _, t := range e.RDates {
+		if t.Before(end) && !t.Before(from) {
+			starts = append(starts, t)
+		}
+	}
+
+	var occurrences []time.Time
+	for _, s := range starts {
+		if !e.excluded(s) && e.endOf(s).After(start) {
+			occurrences = append(occurrences, s)
+		}
+	}
+
+	return occurrences
+}
+
+func (e Event) excluded(s time.Time) bool {
+	for _, ex := range e.ExDates {
+		if ex.Equal(s) || (e.AllDay && dateOf(ex).Equal(dateOf(s))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// endOf returns the end of the occurrence starting at s.
+func (e Event) endOf(s time.Time) time.Time {
+	if e.AllDay {
+		return s.AddDate(0, 0, int(dateOf(e.End).Sub(dateOf(e.Start)).Hours()/24))
+	}
+
+	return s.Add(e.End.Sub(e.Start))
+}
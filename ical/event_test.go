@@ -0,0 +1,235 @@
+package ical
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	data := "BEGIN:VCALENDAR\n" +
+		"VERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:1@example.com\r\n" +
+		"DTSTART;TZID=\"America/New_York\":20200102T090000\r\n" +
+		"SUMMARY:Legs\\, core\r\n" +
+		"DESCRIPTION:A long\r\n" +
+		"  description\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	cal, err := Decode(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cal.Name != "VCALENDAR" || len(cal.Components) != 1 || cal.Components[0].Name != "VEVENT" {
+		t.Fatalf("Expected a calendar with an event, got %+v", cal)
+	}
+
+	event := cal.Components[0]
+	testCases := []struct {
+		name  string
+		value string
+	}{
+		{"UID", "1@example.com"},
+		{"DESCRIPTION", "A long description"},
+	}
+	for _, tc := range testCases {
+		if got := event.Get(tc.name); got == nil || got.Value != tc.value {
+			t.Errorf("%s: Expected %q, got %+v", tc.name, tc.value, got)
+		}
+	}
+
+	if got := UnescapeText(event.Get("SUMMARY").Value); got != "Legs, core" {
+		t.Errorf("Expected %q, got %q", "Legs, core", got)
+	}
+
+	start, isDate, err := event.Get("DTSTART").Time(time.UTC)
+	if err != nil || isDate || !start.Equal(time.Date(2020, 1, 2, 14, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected 9:00 in New York, got %v, %v, %v", start, isDate, err)
+	}
+
+	invalid := []string{
+		"",
+		"BEGIN:VCALENDAR\r\n",
+		"BEGIN:VCALENDAR\r\nEND:VEVENT\r\n",
+		"VERSION:2.0\r\n",
+		"BEGIN:VCALENDAR\r\nNOVALUE\r\nEND:VCALENDAR\r\n",
+		"BEGIN:VCALENDAR\r\nX;Y=\"unterminated:1\r\nEND:VCALENDAR\r\n",
+	}
+	for _, data := range invalid {
+		if _, err := Decode(strings.NewReader(data)); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%q: Expected %v, got %v", data, ErrInvalid, err)
+		}
+	}
+}
+
+func TestRuleStarts(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Thursday, January 2, 2020, 9:00.
+	dtstart := time.Date(2020, 1, 2, 9, 0, 0, 0, la)
+	testCases := []struct {
+		rule     string
+		from, to time.Time
+		e        []string
+	}{
+		{
+			"FREQ=DAILY;COUNT=3", dtstart, dtstart.AddDate(0, 1, 0),
+			[]string{"2020-01-02", "2020-01-03", "2020-01-04"},
+		},
+		{
+			"FREQ=WEEKLY;BYDAY=TU,TH", dtstart, dtstart.AddDate(0, 0, 9),
+			[]string{"2020-01-02", "2020-01-07", "2020-01-09"},
+		},
+		{
+			"FREQ=WEEKLY;INTERVAL=2;UNTIL=20200130", dtstart, dtstart.AddDate(0, 2, 0),
+			[]string{"2020-01-02", "2020-01-16", "2020-01-30"},
+		},
+		{
+			// The count is numbered from the start, even when expanding later.
+			"FREQ=WEEKLY;COUNT=3", dtstart.AddDate(0, 0, 10), dtstart.AddDate(0, 2, 0),
+			[]string{"2020-01-16"},
+		},
+		{
+			// Far from the start, without a count.
+			"FREQ=DAILY;INTERVAL=3", time.Date(2030, 1, 1, 0, 0, 0, 0, la), time.Date(2030, 1, 7, 0, 0, 0, 0, la),
+			[]string{"2030-01-03", "2030-01-06"},
+		},
+		{
+			"FREQ=MONTHLY;BYDAY=-1FR", dtstart, dtstart.AddDate(0, 3, 0),
+			[]string{"2020-01-02", "2020-01-31", "2020-02-28", "2020-03-27"},
+		},
+		{
+			"FREQ=MONTHLY;BYMONTHDAY=-1", dtstart, dtstart.AddDate(0, 2, 0),
+			[]string{"2020-01-02", "2020-01-31", "2020-02-29"},
+		},
+		{
+			"FREQ=MONTHLY", dtstart, dtstart.AddDate(0, 2, 1),
+			[]string{"2020-01-02", "2020-02-02", "2020-03-02"},
+		},
+		{
+			"FREQ=YEARLY;BYMONTH=3;BYDAY=2SU", dtstart, dtstart.AddDate(2, 0, 0),
+			[]string{"2020-01-02", "2020-03-08", "2021-03-14"},
+		},
+		{
+			"FREQ=YEARLY", dtstart, dtstart.AddDate(2, 0, 1),
+			[]string{"2020-01-02", "2021-01-02", "2022-01-02"},
+		},
+	}
+
+	for _, tc := range testCases {
+		rule, err := ParseRule(tc.rule, la)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.rule, err)
+		}
+
+		var got []string
+		for _, s := range rule.Starts(dtstart, tc.from, tc.to) {
+			if s.Hour() != 9 || s.Location() != la {
+				t.Errorf("%s: Expected occurrences at 9:00 in %s, got %v", tc.rule, la, s)
+			}
+			got = append(got, s.Format("2006-01-02"))
+		}
+
+		if strings.Join(got, " ") != strings.Join(tc.e, " ") {
+			t.Errorf("%s: Expected %v, got %v", tc.rule, tc.e, got)
+		}
+	}
+
+	for _, rule := range []string{"FREQ=HOURLY", "FREQ=DAILY;BYSETPOS=1", "COUNT=2", "FREQ=DAILY;INTERVAL=0", "FREQ=WEEKLY;BYDAY=XX"} {
+		if _, err := ParseRule(rule, la); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: Expected %v, got %v", rule, ErrInvalid, err)
+		}
+	}
+}
+
+func TestBusy(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		// Every weekday at 9:00 for an hour, except Monday the 6th, and moved on the 7th.
+		"BEGIN:VEVENT", "UID:class", "DTSTART;TZID=America/Los_Angeles:20200102T090000", "DURATION:PT1H",
+		"RRULE:FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR", "EXDATE;TZID=America/Los_Angeles:20200106T090000", "END:VEVENT",
+		"BEGIN:VEVENT", "UID:class", "RECURRENCE-ID;TZID=America/Los_Angeles:20200107T090000",
+		"DTSTART:20200107T200000Z", "DTEND:20200107T210000Z", "END:VEVENT",
+		// Whole days.
+		"BEGIN:VEVENT", "UID:trip", "DTSTART;VALUE=DATE:20200109", "DTEND;VALUE=DATE:20200111", "END:VEVENT",
+		// Events that don't take up time.
+		"BEGIN:VEVENT", "UID:free", "DTSTART:20200103T180000Z", "DTEND:20200103T190000Z", "TRANSP:TRANSPARENT", "END:VEVENT",
+		"BEGIN:VEVENT", "UID:cancelled", "DTSTART:20200103T180000Z", "DTEND:20200103T190000Z", "STATUS:CANCELLED", "END:VEVENT",
+		"BEGIN:VEVENT", "UID:reminder", "DTSTART:20200103T180000Z", "END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	cal, err := Decode(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := Events(cal, la)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2020, 1, 3, 9, 30, 0, 0, la)
+	end := time.Date(2020, 1, 10, 0, 0, 0, 0, la)
+	want := []string{
+		// The occurrence in progress at the start overlaps it.
+		"2020-01-03T09:00:00-08:00 2020-01-03T10:00:00-08:00",
+		"2020-01-07T20:00:00Z 2020-01-07T21:00:00Z",
+		"2020-01-08T09:00:00-08:00 2020-01-08T10:00:00-08:00",
+		"2020-01-09T00:00:00-08:00 2020-01-11T00:00:00-08:00",
+		"2020-01-09T09:00:00-08:00 2020-01-09T10:00:00-08:00",
+	}
+
+	var got []string
+	for _, p := range Busy(events, start, end) {
+		got = append(got, p.Start.Format(time.RFC3339)+" "+p.End.Format(time.RFC3339))
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestMergeSubtract(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2020, 1, 2, hour, 0, 0, 0, time.UTC) }
+	format := func(periods []Period) string {
+		var s []string
+		for _, p := range periods {
+			s = append(s, p.Start.Format("15")+"-"+p.End.Format("15"))
+		}
+		return strings.Join(s, " ")
+	}
+
+	busy := Merge([]Period{
+		{Start: at(13), End: at(14)},
+		{Start: at(9), End: at(10)},
+		{Start: at(10), End: at(11)},
+		{Start: at(13), End: at(15)},
+		{Start: at(14), End: at(14)},
+		{Start: at(6), End: at(7)},
+	})
+	if got := format(busy); got != "06-07 09-11 13-15" {
+		t.Errorf("Expected %q, got %q", "06-07 09-11 13-15", got)
+	}
+
+	free := Subtract([]Period{{Start: at(8), End: at(12)}, {Start: at(14), End: at(17)}}, busy)
+	if got := format(free); got != "08-09 11-12 15-17" {
+		t.Errorf("Expected %q, got %q", "08-09 11-12 15-17", got)
+	}
+
+	if got := FormatPeriods(busy[:2]); got != "20200102T060000Z/20200102T070000Z,20200102T090000Z/20200102T110000Z" {
+		t.Errorf("Expected the periods in UTC, got %q", got)
+	}
+}
@@ -0,0 +1,153 @@
+// Package ical encodes and decodes iCalendar (RFC 5545) data, the format of calendar feeds.
+package ical
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxLineOctets is the longest a content line may be before it is folded.
+	maxLineOctets = 75
+
+	dateTimeFormat    = "20060102T150405"
+	utcDateTimeFormat = "20060102T150405Z"
+	dateFormat        = "20060102"
+)
+
+// Component is a calendar object such as a VCALENDAR, VEVENT or VTIMEZONE, made up of
+// properties and nested components.
+type Component struct {
+	Name       string
+	Properties []Property
+	Components []*Component
+}
+
+// Property is a named value with optional parameters, such as DTSTART;TZID=UTC:20200102T090000.
+// Value is as it appears in the content line, so text values must be escaped with EscapeText.
+type Property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// NewCalendar returns an empty VCALENDAR produced by prodID.
+func NewCalendar(prodID string) *Component {
+	c := &Component{Name: "VCALENDAR"}
+	c.Add("VERSION", "2.0")
+	c.Add("PRODID", prodID)
+	c.Add("CALSCALE", "GREGORIAN")
+
+	return c
+}
+
+// Add appends a property with the given value to the component.
+func (c *Component) Add(name, value string) *Property {
+	c.Properties = append(c.Properties, Property{Name: name, Value: value})
+	return &c.Properties[len(c.Properties)-1]
+}
+
+// AddText appends a property with a text value, which is escaped.
+func (c *Component) AddText(name, value string) {
+	c.Add(name, EscapeText(value))
+}
+
+// AddTime appends a date-time property. Times in UTC are written as such; others are written as
+// local times with a TZID parameter naming their location, which needs a VTIMEZONE.
+func (c *Component) AddTime(name string, t time.Time) {
+	if t.Location() == time.UTC {
+		c.Add(name, t.Format(utcDateTimeFormat))
+		return
+	}
+
+	p := c.Add(name, t.Format(dateTimeFormat))
+	p.Params = map[string]string{"TZID": t.Location().String()}
+}
+
+// Get returns the first property with the name, or nil if there is none.
+func (c *Component) Get(name string) *Property {
+	for i := range c.Properties {
+		if strings.EqualFold(c.Properties[i].Name, name) {
+			return &c.Properties[i]
+		}
+	}
+
+	return nil
+}
+
+// Encode writes the component as content lines, each ended by CRLF and folded at 75 octets.
+func (c *Component) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	c.encode(bw)
+	return bw.Flush()
+}
+
+func (c *Component) encode(w *bufio.Writer) {
+	writeLine(w, "BEGIN:"+c.Name)
+	for _, p := range c.Properties {
+		writeLine(w, p.line())
+	}
+	for _, child := range c.Components {
+		child.encode(w)
+	}
+	writeLine(w, "END:"+c.Name)
+}
+
+// line returns the property's unfolded content line.
+func (p Property) line() string {
+	var b strings.Builder
+	b.WriteString(p.Name)
+
+	names := make([]string, 0, len(p.Params))
+	for name := range p.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := p.Params[name]
+		if strings.ContainsAny(value, ":;,") {
+			value = `"` + value + `"`
+		}
+		b.WriteString(";" + name + "=" + value)
+	}
+
+	b.WriteString(":" + p.Value)
+	return b.String()
+}
+
+// writeLine writes a content line, folding it so that no line is longer than 75 octets without
+// splitting a UTF-8 character.
+func writeLine(w *bufio.Writer, line string) {
+	limit := maxLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isRuneStart(line[cut]) {
+			cut--
+		}
+
+		_, _ = w.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// Continuation lines start with a space, which counts towards their length.
+		limit = maxLineOctets - 1
+	}
+
+	_, _ = w.WriteString(line + "\r\n")
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// EscapeText escapes a TEXT value's backslashes, semicolons, commas and newlines.
+func EscapeText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// FormatUTC returns t as a UTC date-time value, as DTSTAMP and LAST-MODIFIED need.
+func FormatUTC(t time.Time) string {
+	return t.UTC().Format(utcDateTimeFormat)
+}
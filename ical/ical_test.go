@@ -0,0 +1,212 @@
+package ical
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncode(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cal := NewCalendar("-//Test//EN")
+	event := &Component{Name: "VEVENT"}
+	event.Add("UID", "1@example.com")
+	event.AddTime("DTSTART", time.Date(2020, 1, 2, 9, 0, 0, 0, la))
+	event.AddTime("DTSTAMP", time.Date(2020, 1, 1, 8, 0, 0, 0, time.UTC))
+	event.AddText("SUMMARY", "Legs, core; and\nstretching")
+	event.AddText("DESCRIPTION", strings.Repeat("é", 40))
+	cal.Components = append(cal.Components, event)
+
+	var b strings.Builder
+	if err := cal.Encode(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"PRODID:-//Test//EN\r\n" +
+		"CALSCALE:GREGORIAN\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:1@example.com\r\n" +
+		"DTSTART;TZID=America/Los_Angeles:20200102T090000\r\n" +
+		"DTSTAMP:20200101T080000Z\r\n" +
+		`SUMMARY:Legs\, core\; and\nstretching` + "\r\n" +
+		// Folded lines don't split a character.
+		"DESCRIPTION:" + strings.Repeat("é", 31) + "\r\n" +
+		" " + strings.Repeat("é", 9) + "\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	if got := b.String(); got != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, got)
+	}
+
+	for _, line := range strings.Split(b.String(), "\r\n") {
+		if len(line) > maxLineOctets {
+			t.Errorf("Expected lines of at most %d octets, got %d: %q", maxLineOctets, len(line), line)
+		}
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name string
+		loc  *time.Location
+		want string
+	}{
+		{
+			"Daylight saving",
+			la,
+			"BEGIN:VTIMEZONE\r\n" +
+				"TZID:America/Los_Angeles\r\n" +
+				"BEGIN:STANDARD\r\n" +
+				"TZOFFSETFROM:-0800\r\nTZOFFSETTO:-0800\r\nTZNAME:PST\r\n" +
+				"DTSTART:19700101T000000\r\n" +
+				"END:STANDARD\r\n" +
+				// The rules before 2007 end with their last transition.
+				"BEGIN:DAYLIGHT\r\n" +
+				"TZOFFSETFROM:-0800\r\nTZOFFSETTO:-0700\r\nTZNAME:PDT\r\n" +
+				"DTSTART:19700426T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=4;BYDAY=-1SU;UNTIL=19730429T100000Z\r\n" +
+				"END:DAYLIGHT\r\n" +
+				"BEGIN:STANDARD\r\n" +
+				"TZOFFSETFROM:-0700\r\nTZOFFSETTO:-0800\r\nTZNAME:PST\r\n" +
+				"DTSTART:19701025T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU;UNTIL=20061029T090000Z\r\n" +
+				"END:STANDARD\r\n" +
+				"BEGIN:DAYLIGHT\r\n" +
+				"TZOFFSETFROM:-0800\r\nTZOFFSETTO:-0700\r\nTZNAME:PDT\r\n" +
+				"DTSTART:19740106T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=1;BYDAY=1SU;UNTIL=19740106T100000Z\r\n" +
+				"END:DAYLIGHT\r\n" +
+				"BEGIN:DAYLIGHT\r\n" +
+				"TZOFFSETFROM:-0800\r\nTZOFFSETTO:-0700\r\nTZNAME:PDT\r\n" +
+				"DTSTART:19750223T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=2;BYDAY=-1SU;UNTIL=19750223T100000Z\r\n" +
+				"END:DAYLIGHT\r\n" +
+				"BEGIN:DAYLIGHT\r\n" +
+				"TZOFFSETFROM:-0800\r\nTZOFFSETTO:-0700\r\nTZNAME:PDT\r\n" +
+				"DTSTART:19760425T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=4;BYDAY=-1SU;UNTIL=19860427T100000Z\r\n" +
+				"END:DAYLIGHT\r\n" +
+				"BEGIN:DAYLIGHT\r\n" +
+				"TZOFFSETFROM:-0800\r\nTZOFFSETTO:-0700\r\nTZNAME:PDT\r\n" +
+				"DTSTART:19870405T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=4;BYDAY=1SU;UNTIL=20060402T100000Z\r\n" +
+				"END:DAYLIGHT\r\n" +
+				"BEGIN:DAYLIGHT\r\n" +
+				"TZOFFSETFROM:-0800\r\nTZOFFSETTO:-0700\r\nTZNAME:PDT\r\n" +
+				"DTSTART:20070311T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=2SU\r\n" +
+				"END:DAYLIGHT\r\n" +
+				"BEGIN:STANDARD\r\n" +
+				"TZOFFSETFROM:-0700\r\nTZOFFSETTO:-0800\r\nTZNAME:PST\r\n" +
+				"DTSTART:20071104T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=1SU\r\n" +
+				"END:STANDARD\r\n" +
+				"END:VTIMEZONE\r\n",
+		},
+		{
+			"Fixed offset",
+			time.UTC,
+			"BEGIN:VTIMEZONE\r\n" +
+				"TZID:UTC\r\n" +
+				"BEGIN:STANDARD\r\n" +
+				"TZOFFSETFROM:+0000\r\nTZOFFSETTO:+0000\r\nTZNAME:UTC\r\n" +
+				"DTSTART:19700101T000000\r\n" +
+				"END:STANDARD\r\n" +
+				"END:VTIMEZONE\r\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		var b strings.Builder
+		if err := Timezone(tc.loc, 2020).Encode(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := b.String(); got != tc.want {
+			t.Errorf("%s: Expected\n%s\ngot\n%s", tc.name, tc.want, got)
+		}
+	}
+}
+
+// TestTimezoneTransitions checks that expanding a VTIMEZONE's observances gives back every
+// transition the location has had.
+func TestTimezoneTransitions(t *testing.T) {
+	for _, name := range []string{"America/Los_Angeles", "America/Phoenix", "Europe/London", "Australia/Sydney"} {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Date(observanceEpoch, time.January, 1, 0, 0, 0, 0, loc)
+		end := time.Date(2021, time.January, 1, 0, 0, 0, 0, loc)
+		var want []time.Time
+		for _, tr := range zoneTransitions(start, end) {
+			want = append(want, tr.UTC())
+		}
+
+		var got []time.Time
+		for _, o := range Timezone(loc, 2020).Components {
+			from, err := strconv.Atoi(strings.TrimPrefix(o.Get("TZOFFSETFROM").Value, "+"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			offset := time.FixedZone("", (from/100*60+from%100)*60)
+			dtstart, _, err := o.Get("DTSTART").Time(offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if o.Get("RRULE") == nil {
+				continue
+			}
+
+			rule, err := ParseRule(o.Get("RRULE").Value, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, s := range rule.Starts(dtstart, start, end) {
+				got = append(got, s.UTC())
+			}
+		}
+
+		sort.Slice(got, func(i, j int) bool { return got[i].Before(got[j]) })
+		if len(got) != len(want) {
+			t.Errorf("%s: Expected %d transitions, got %d", name, len(want), len(got))
+			continue
+		}
+
+		for i := range want {
+			if !got[i].Equal(want[i]) {
+				t.Errorf("%s: Expected %v, got %v", name, want[i], got[i])
+			}
+		}
+	}
+}
+
+func TestNthWeekday(t *testing.T) {
+	testCases := []struct {
+		month   time.Month
+		weekday time.Weekday
+		n       int
+		e       int
+	}{
+		{time.March, time.Sunday, 2, 8},
+		{time.November, time.Sunday, 1, 1},
+		{time.March, time.Sunday, -1, 29},
+		{time.October, time.Sunday, -1, 25},
+		{time.February, time.Saturday, -2, 21},
+	}
+
+	for _, tc := range testCases {
+		if got := nthWeekday(1970, tc.month, tc.weekday, tc.n).Day(); got != tc.e {
+			t.Errorf("%d %s of %s: Expected %d, got %d", tc.n, tc.weekday, tc.month, tc.e, got)
+		}
+	}
+}
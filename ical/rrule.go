@@ -0,0 +1,295 @@
+package ical
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence frequencies
+const (
+	Daily   = "DAILY"
+	Weekly  = "WEEKLY"
+	Monthly = "MONTHLY"
+	Yearly  = "YEARLY"
+)
+
+// Rule is a recurrence rule (RRULE). Rules are expanded a day at a time, so those recurring
+// more often than daily, and the BYSETPOS, BYYEARDAY, BYWEEKNO and BYHOUR-like parts, aren't
+// supported.
+type Rule struct {
+	Freq     string
+	Interval int
+	// Count, if set, limits the occurrences, and Until, if set, is the latest start.
+	Count int
+	Until time.Time
+
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []time.Month
+	// WeekStart is the first day of the week for weekly intervals. Defaults to Monday.
+	WeekStart time.Weekday
+}
+
+// WeekdayNum is a BYDAY entry: a weekday, and for monthly and yearly rules, which one of the
+// month or year it is, counting from the end if negative, or every one if zero.
+type WeekdayNum struct {
+	N       int
+	Weekday time.Weekday
+}
+
+// ParseRule parses an RRULE value. A floating UNTIL is read in loc.
+func ParseRule(value string, loc *time.Location) (*Rule, error) {
+	r := &Rule{Interval: 1, WeekStart: time.Monday}
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%w: RRULE: %q", ErrInvalid, part)
+		}
+
+		name, v := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+		var err error
+		switch name {
+		case "FREQ":
+			r.Freq = v
+			if v != Daily && v != Weekly && v != Monthly && v != Yearly {
+				return nil, fmt.Errorf("%w: RRULE: FREQ=%s isn't supported", ErrInvalid, v)
+			}
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(v)
+			if err == nil && r.Interval < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "COUNT":
+			r.Count, err = strconv.Atoi(v)
+		case "UNTIL":
+			var isDate bool
+			r.Until, isDate, err = parseTime(v, loc)
+			if isDate {
+				// A date includes the whole day.
+				r.Until = r.Until.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+		case "BYDAY":
+			r.ByDay, err = parseByDay(v)
+		case "BYMONTHDAY":
+			r.ByMonthDay, err = parseInts(v, 31)
+		case "BYMONTH":
+			var months []int
+			months, err = parseInts(v, 12)
+			for _, m := range months {
+				if m < 0 {
+					err = fmt.Errorf("months must be positive")
+				}
+				r.ByMonth = append(r.ByMonth, time.Month(m))
+			}
+		case "WKST":
+			r.WeekStart, err = parseWeekday(v)
+		default:
+			return nil, fmt.Errorf("%w: RRULE: %s isn't supported", ErrInvalid, name)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: RRULE: %s: %v", ErrInvalid, name, err)
+		}
+	}
+
+	if r.Freq == "" {
+		return nil, fmt.Errorf("%w: RRULE: FREQ is required", ErrInvalid)
+	}
+
+	return r, nil
+}
+
+func parseByDay(value string) ([]WeekdayNum, error) {
+	var days []WeekdayNum
+	for _, entry := range strings.Split(value, ",") {
+		if len(entry) < 2 {
+			return nil, fmt.Errorf("%q", entry)
+		}
+
+		weekday, err := parseWeekday(entry[len(entry)-2:])
+		if err != nil {
+			return nil, err
+		}
+
+		n := 0
+		if prefix := entry[:len(entry)-2]; prefix != "" {
+			if n, err = strconv.Atoi(prefix); err != nil || n == 0 || n < -53 || n > 53 {
+				return nil, fmt.Errorf("%q", entry)
+			}
+		}
+
+		days = append(days, WeekdayNum{N: n, Weekday: weekday})
+	}
+
+	return days, nil
+}
+
+func parseWeekday(value string) (time.Weekday, error) {
+	for i, abbr := range weekdays {
+		if value == abbr {
+			return time.Weekday(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown weekday %q", value)
+}
+
+func parseInts(value string, max int) ([]int, error) {
+	var ints []int
+	for _, s := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n == 0 || n < -max || n > max {
+			return nil, fmt.Errorf("%q", s)
+		}
+		ints = append(ints, n)
+	}
+
+	return ints, nil
+}
+
+// Starts returns the starts of the occurrences of a rule beginning at dtstart that are in
+// [from, to). Occurrences keep dtstart's wall clock time in its location.
+func (r *Rule) Starts(dtstart, from, to time.Time) []time.Time {
+	loc := dtstart.Location()
+	first := dateOf(dtstart)
+	day := first
+	if r.Count == 0 {
+		// Without a count, the days before from needn't be visited to number the occurrences.
+		if start := dateOf(from.In(loc)).AddDate(0, 0, -1); start.After(day) {
+			day = start
+		}
+	}
+
+	var starts []time.Time
+	count := 0
+	for {
+		t := time.Date(day.Year(), day.Month(), day.Day(), dtstart.Hour(), dtstart.Minute(), dtstart.Second(), 0, loc)
+		if !t.Before(to) || (!r.Until.IsZero() && t.After(r.Until)) {
+			break
+		}
+
+		// DTSTART is always the first occurrence, whether or not it matches the rule.
+		if day.Equal(first) || (!t.Before(dtstart) && r.matches(first, day)) {
+			count++
+			if r.Count > 0 && count > r.Count {
+				break
+			}
+
+			if !t.Before(from) {
+				starts = append(starts, t)
+			}
+		}
+
+		day = day.AddDate(0, 0, 1)
+	}
+
+	return starts
+}
+
+// matches reports whether a rule beginning on the date first has an occurrence on the date day.
+func (r *Rule) matches(first, day time.Time) bool {
+	var period int
+	switch r.Freq {
+	case Daily:
+		period = int(day.Sub(first).Hours() / 24)
+	case Weekly:
+		period = int(r.weekOf(day).Sub(r.weekOf(first)).Hours() / 24 / 7)
+	case Monthly:
+		period = (day.Year()-first.Year())*12 + int(day.Month()) - int(first.Month())
+	case Yearly:
+		period = day.Year() - first.Year()
+	}
+	if period%r.Interval != 0 {
+		return false
+	}
+
+	if len(r.ByMonth) > 0 && !containsMonth(r.ByMonth, day.Month()) {
+		return false
+	}
+
+	if len(r.ByMonthDay) > 0 && !r.matchesMonthDay(day) {
+		return false
+	}
+
+	if len(r.ByDay) > 0 && !r.matchesDay(day) {
+		return false
+	}
+
+	// Parts a rule leaves out are taken from its start.
+	switch r.Freq {
+	case Weekly:
+		if len(r.ByDay) == 0 && day.Weekday() != first.Weekday() {
+			return false
+		}
+	case Monthly, Yearly:
+		if r.Freq == Yearly && len(r.ByMonth) == 0 && len(r.ByDay) == 0 && len(r.ByMonthDay) == 0 &&
+			day.Month() != first.Month() {
+			return false
+		}
+		if len(r.ByDay) == 0 && len(r.ByMonthDay) == 0 && day.Day() != first.Day() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *Rule) matchesMonthDay(day time.Time) bool {
+	days := daysIn(day.Year(), day.Month())
+	for _, d := range r.ByMonthDay {
+		if d == day.Day() || days+d+1 == day.Day() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Rule) matchesDay(day time.Time) bool {
+	for _, wd := range r.ByDay {
+		if wd.Weekday != day.Weekday() {
+			continue
+		}
+
+		if wd.N == 0 || r.Freq == Daily || r.Freq == Weekly {
+			return true
+		}
+
+		// Ordinals count within the month, or within the year for yearly rules without BYMONTH.
+		n, total := (day.Day()-1)/7+1, daysIn(day.Year(), day.Month())
+		last := (total-day.Day())/7 + 1
+		if r.Freq == Yearly && len(r.ByMonth) == 0 {
+			n, total = (day.YearDay()-1)/7+1, time.Date(day.Year(), time.December, 31, 0, 0, 0, 0, time.UTC).YearDay()
+			last = (total-day.YearDay())/7 + 1
+		}
+
+		if wd.N == n || wd.N == -last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// weekOf returns the first day of day's week.
+func (r *Rule) weekOf(day time.Time) time.Time {
+	return day.AddDate(0, 0, -((int(day.Weekday()) - int(r.WeekStart) + 7) % 7))
+}
+
+func containsMonth(months []time.Month, month time.Month) bool {
+	for _, m := range months {
+		if m == month {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dateOf returns t's date at midnight UTC, so that days can be counted without daylight saving
+// time getting in the way.
+func dateOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,191 @@
+package ical
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// observanceEpoch is the year observances start in, so that they cover any time a calendar
+// holds.
+const observanceEpoch = 1970
+
+// Timezone returns a VTIMEZONE for loc, with the daylight saving rules loc has followed from
+// observanceEpoch through year as yearly recurrences. A rule that stopped applying before year,
+// like the US rules before 2007, ends with the last transition it caused, and the rules of year
+// carry on after it.
+func Timezone(loc *time.Location, year int) *Component {
+	tz := &Component{Name: "VTIMEZONE"}
+	tz.Add("TZID", loc.String())
+
+	epoch := time.Date(observanceEpoch, time.January, 1, 0, 0, 0, 0, loc)
+	var runs []*ruleRun
+	current := map[transitionRule]*ruleRun{}
+	for y := observanceEpoch; y <= year; y++ {
+		start := time.Date(y, time.January, 1, 0, 0, 0, 0, loc)
+		for _, t := range zoneTransitions(start, start.AddDate(1, 0, 0)) {
+			rule := ruleOf(t)
+			if run, ok := current[rule]; ok && run.lastYear == y-1 {
+				run.last, run.lastYear = t, y
+				continue
+			}
+
+			run := &ruleRun{rule: rule, first: t, last: t, lastYear: y}
+			current[rule] = run
+			runs = append(runs, run)
+		}
+	}
+
+	// Observances only say which offset applies from their onset, so the offset at the epoch gets
+	// one of its own to cover the time before the first transition.
+	name, offset := epoch.Zone()
+	kind := "STANDARD"
+	if epoch.IsDST() {
+		kind = "DAYLIGHT"
+	}
+
+	o := observance(kind, name, offset, offset)
+	o.Add("DTSTART", time.Date(observanceEpoch, time.January, 1, 0, 0, 0, 0, time.UTC).Format(dateTimeFormat))
+	tz.Components = append(tz.Components, o)
+
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].first.Before(runs[j].first) })
+	for _, run := range runs {
+		r := run.rule
+		o := observance(r.kind, r.name, r.from, r.to)
+		o.Add("DTSTART", r.onset(run.first).Format(dateTimeFormat))
+		rrule := fmt.Sprintf("FREQ=YEARLY;BYMONTH=%d;BYDAY=%d%s", r.month, r.n, weekdays[r.weekday])
+		if run.lastYear < year {
+			rrule += ";UNTIL=" + run.last.UTC().Format(dateTimeFormat) + "Z"
+		}
+
+		o.Add("RRULE", rrule)
+		tz.Components = append(tz.Components, o)
+	}
+
+	return tz
+}
+
+// transitionRule is the yearly rule a zone transition follows: the nth weekday of a month at a
+// wall clock time, counting from the end of the month if n is negative.
+type transitionRule struct {
+	kind     string
+	name     string
+	from, to int
+	month    time.Month
+	weekday  time.Weekday
+	n        int
+	clock    int
+}
+
+// ruleOf returns the rule that the transition at t follows.
+func ruleOf(t time.Time) transitionRule {
+	_, from := t.Add(-time.Second).Zone()
+	name, to := t.Zone()
+	kind := "STANDARD"
+	if t.IsDST() {
+		kind = "DAYLIGHT"
+	}
+
+	// The transition happens at a wall clock time that is read in the offset it changes from.
+	local := t.In(time.FixedZone("", from))
+	n := (local.Day()-1)/7 + 1
+	if local.Day()+7 > daysIn(local.Year(), local.Month()) {
+		n = -1
+	}
+
+	return transitionRule{
+		kind:    kind,
+		name:    name,
+		from:    from,
+		to:      to,
+		month:   local.Month(),
+		weekday: local.Weekday(),
+		n:       n,
+		clock:   local.Hour()*3600 + local.Minute()*60 + local.Second(),
+	}
+}
+
+// onset returns the local time of the transition at t as a floating time, for DTSTART.
+func (r transitionRule) onset(t time.Time) time.Time {
+	local := t.In(time.FixedZone("", r.from))
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, r.clock, 0, time.UTC)
+}
+
+// ruleRun is a run of consecutive years whose transitions followed a rule.
+type ruleRun struct {
+	rule        transitionRule
+	first, last time.Time
+	lastYear    int
+}
+
+func observance(kind, name string, from, to int) *Component {
+	o := &Component{Name: kind}
+	o.Add("TZOFFSETFROM", formatOffset(from))
+	o.Add("TZOFFSETTO", formatOffset(to))
+	o.Add("TZNAME", name)
+
+	return o
+}
+
+// zoneTransitions returns the instants in [start, end) at which the offset from UTC changes. It
+// assumes an offset lasts at least a day.
+func zoneTransitions(start, end time.Time) []time.Time {
+	var transitions []time.Time
+	_, offset := start.Zone()
+	for t := start; t.Before(end); t = t.Add(24 * time.Hour) {
+		if _, o := t.Zone(); o != offset {
+			// Narrow the day down to the second the offset changed.
+			lo, hi := t.Add(-24*time.Hour), t
+			for hi.Sub(lo) > time.Second {
+				mid := lo.Add(hi.Sub(lo) / 2).Truncate(time.Second)
+				if _, o := mid.Zone(); o != offset {
+					hi = mid
+				} else {
+					lo = mid
+				}
+			}
+
+			transitions = append(transitions, hi)
+			offset = o
+		}
+	}
+
+	return transitions
+}
+
+// formatOffset returns an offset from UTC in seconds as a UTC-OFFSET value such as -0800.
+func formatOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+
+	s := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset%3600/60)
+	if offset%60 != 0 {
+		s += fmt.Sprintf("%02d", offset%60)
+	}
+
+	return s
+}
+
+// nthWeekday returns the date of the nth weekday of the month, counting from the end of the
+// month if n is negative.
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) time.Time {
+	if n < 0 {
+		last := time.Date(year, month, daysIn(year, month), 0, 0, 0, 0, time.UTC)
+		back := (int(last.Weekday()) - int(weekday) + 7) % 7
+		return last.AddDate(0, 0, -back+7*(n+1))
+	}
+
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	ahead := (int(weekday) - int(first.Weekday()) + 7) % 7
+	return first.AddDate(0, 0, ahead+7*(n-1))
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// weekdays are the BYDAY abbreviations of the days of the week.
+var weekdays = [...]string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
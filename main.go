@@ -1,43 +1,137 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"time"
 
+	"github.com/marcuscarr/appts/auth"
 	"github.com/marcuscarr/appts/server"
 )
 
 func main() {
-	host := os.Getenv("HOST")
-	port, err := strconv.Atoi(os.Getenv("PORT"))
+	config := configFromEnv()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			migrate(config, os.Args[2:])
+		case "import":
+			importData(config, os.Args[2:])
+		case "export":
+			exportData(config, os.Args[2:])
+		case "apikeys":
+			apiKeys(config, os.Args[2:])
+		default:
+			log.Fatalf("Unknown command %q; expected migrate, import, export or apikeys, or none to run the server", os.Args[1])
+		}
+
+		return
+	}
+
+	if config.Port == 0 {
+		log.Fatal("PORT is required")
+	}
+
+	server, err := server.New(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	dbHost := os.Getenv("DB_HOST")
-	dbPort, err := strconv.Atoi(os.Getenv("DB_PORT"))
-	if err != nil {
+	// Shut down gracefully when interrupted (Ctrl+C).
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := server.Run(ctx); err != nil {
 		log.Fatal(err)
 	}
+}
 
-	dbUser := os.Getenv("DB_USER")
-	dbPass := os.Getenv("DB_PASS")
-	dbName := os.Getenv("DB_NAME")
+// configFromEnv reads the config from environment variables.
+func configFromEnv() *server.Config {
+	storage := os.Getenv("STORAGE")
+
+	// The database server settings are only needed for Postgres.
+	dbPort := 0
+	if storage == "" || storage == server.StoragePostgres {
+		dbPort = envInt("DB_PORT")
+	}
+
+	return &server.Config{
+		Host:            os.Getenv("HOST"),
+		Port:            envInt("PORT"),
+		DBHost:          os.Getenv("DB_HOST"),
+		DBPort:          dbPort,
+		DBUser:          os.Getenv("DB_USER"),
+		DBName:          os.Getenv("DB_NAME"),
+		DBPass:          os.Getenv("DB_PASS"),
+		Timeout:         time.Duration(5) * time.Second,
+		Storage:         storage,
+		DBPath:          os.Getenv("DB_PATH"),
+		Migrate:         os.Getenv("MIGRATE") == "true",
+		JWT:             jwtConfigFromEnv(),
+		BootstrapAPIKey: os.Getenv("BOOTSTRAP_API_KEY"),
+		OIDC: auth.OIDCConfig{
+			Issuer:       os.Getenv("OIDC_ISSUER"),
+			ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			Leeway:       time.Minute,
+		},
+		RateLimit: rateLimitFromEnv(),
+		BusyCalendars: server.BusyCalendarsConfig{
+			Dir: os.Getenv("BUSY_CALENDAR_DIR"),
+		},
+	}
+}
 
-	config := server.Config{
-		Host:    host,
-		Port:    port,
-		DBHost:  dbHost,
-		DBPort:  dbPort,
-		DBUser:  dbUser,
-		DBName:  dbName,
-		DBPass:  dbPass,
-		Timeout: time.Duration(5) * time.Second,
+// rateLimitFromEnv returns the default rate limits, unless RATE_LIMIT is "off".
+func rateLimitFromEnv() server.RateLimitConfig {
+	if os.Getenv("RATE_LIMIT") == "off" {
+		return server.RateLimitConfig{}
 	}
 
-	server := server.New(&config)
+	return server.DefaultRateLimits
+}
+
+// jwtConfigFromEnv reads which JWTs to accept. JWT_RS256_PUBLIC_KEY is the path of a PEM file.
+func jwtConfigFromEnv() auth.JWTConfig {
+	config := auth.JWTConfig{
+		HS256Secret: []byte(os.Getenv("JWT_HS256_SECRET")),
+		Issuer:      os.Getenv("JWT_ISSUER"),
+		Audience:    os.Getenv("JWT_AUDIENCE"),
+		Leeway:      time.Minute,
+	}
+
+	if path := os.Getenv("JWT_RS256_PUBLIC_KEY"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("JWT_RS256_PUBLIC_KEY: %v", err)
+		}
+
+		config.RS256Key, err = auth.ParseRSAPublicKey(data)
+		if err != nil {
+			log.Fatalf("JWT_RS256_PUBLIC_KEY: %v", err)
+		}
+	}
+
+	return config
+}
+
+// envInt returns the integer value of the environment variable, or 0 if it isn't set.
+func envInt(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
 
-	server.Run()
+	return i
 }
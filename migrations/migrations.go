@@ -0,0 +1,303 @@
+// Package migrations versions the database schema. Each migration is a pair of SQL files,
+// NNNN_name.up.sql and NNNN_name.down.sql, in the directory for each database. The versions
+// applied to a database are recorded in its schema_migrations table.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+// Migration is a versioned change to the schema and the SQL to undo it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration and whether it has been applied.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// dialect holds the SQL that differs between databases.
+type dialect struct {
+	// begin starts a transaction that holds the lock on migrating, so that replicas starting
+	// together apply each migration once.
+	begin  []string
+	create string
+	insert string
+	delete string
+}
+
+// lockID identifies the Postgres advisory lock taken while migrating.
+const lockID = 0x61707074 // "appt"
+
+var dialects = map[string]dialect{
+	"postgres": {
+		begin: []string{"BEGIN", fmt.Sprintf("SELECT pg_advisory_xact_lock(%d)", lockID)},
+		create: `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint PRIMARY KEY,
+			name text NOT NULL,
+			applied_at timestamptz NOT NULL
+		)`,
+		insert: "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+		delete: "DELETE FROM schema_migrations WHERE version = $1",
+	},
+	// SQLite has a single writer, which BEGIN IMMEDIATE waits to become.
+	"sqlite": {
+		begin: []string{"BEGIN IMMEDIATE"},
+		create: `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer PRIMARY KEY,
+			name text NOT NULL,
+			applied_at datetime NOT NULL
+		)`,
+		insert: "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		delete: "DELETE FROM schema_migrations WHERE version = ?",
+	},
+}
+
+// Migrator applies and reverts migrations on a database.
+type Migrator struct {
+	db         *sql.DB
+	dialect    dialect
+	migrations []Migration
+}
+
+// New returns a Migrator for db, which is a "postgres" or "sqlite" database.
+func New(db *sql.DB, driver string) (*Migrator, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database %q", driver)
+	}
+
+	migrations, err := load(driver)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, dialect: d, migrations: migrations}, nil
+}
+
+// load reads the migrations for the driver, checking that each has an up and a down file.
+func load(driver string) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, driver)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		base := strings.TrimSuffix(name, ".sql")
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 || (direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("migration %s: name must be NNNN_name.up.sql or NNNN_name.down.sql", name)
+		}
+
+		body, err := fs.ReadFile(files, path.Join(driver, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		} else if m.Name != parts[1] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, m.Name, parts[1])
+		}
+
+		if direction == ".up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both up and down SQL", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Status returns every migration, oldest first, with whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		for _, migration := range m.migrations {
+			appliedAt, ok := applied[migration.Version]
+			statuses = append(statuses, Status{Migration: migration, Applied: ok, AppliedAt: appliedAt})
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// Pending returns the migrations that haven't been applied, oldest first.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, status := range statuses {
+		if !status.Applied {
+			pending = append(pending, status.Migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Up applies every pending migration in order and returns those it applied. Each migration runs
+// in its own transaction, so a failure leaves the earlier ones applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	for _, migration := range m.migrations {
+		migration := migration
+		ran := false
+		err := m.locked(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+			// Another replica may have applied it while we waited for the lock.
+			if _, ok := applied[migration.Version]; ok {
+				return nil
+			}
+
+			if _, err := conn.ExecContext(ctx, migration.Up); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+
+			ran = true
+			_, err := conn.ExecContext(ctx, m.dialect.insert, migration.Version, migration.Name, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return done, err
+		}
+
+		if ran {
+			done = append(done, migration)
+		}
+	}
+
+	return done, nil
+}
+
+// Down reverts the most recently applied migrations, up to steps of them, newest first, and
+// returns those it reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	for len(done) < steps {
+		var reverted *Migration
+		err := m.locked(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+			for i := len(m.migrations) - 1; i >= 0; i-- {
+				migration := m.migrations[i]
+				if _, ok := applied[migration.Version]; !ok {
+					continue
+				}
+
+				if _, err := conn.ExecContext(ctx, migration.Down); err != nil {
+					return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+				}
+
+				reverted = &migration
+				_, err := conn.ExecContext(ctx, m.dialect.delete, migration.Version)
+				return err
+			}
+
+			return nil
+		})
+		if err != nil {
+			return done, err
+		}
+
+		if reverted == nil {
+			break
+		}
+		done = append(done, *reverted)
+	}
+
+	return done, nil
+}
+
+// locked runs fn in a transaction holding the migration lock, with the versions applied so far.
+// The transaction is committed if fn returns nil and rolled back otherwise.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn, applied map[int]time.Time) error) (err error) {
+	// The lock belongs to a connection, so everything runs on the same one.
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, stmt := range m.dialect.begin {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		end := "COMMIT"
+		if err != nil {
+			end = "ROLLBACK"
+		}
+
+		if _, endErr := conn.ExecContext(ctx, end); endErr != nil && err == nil {
+			err = endErr
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, m.dialect.create); err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return err
+		}
+		applied[version] = appliedAt
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	return fn(conn, applied)
+}
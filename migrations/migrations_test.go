@@ -0,0 +1,168 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	_ "github.com/glebarez/go-sqlite"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "appts.db")
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestLoad(t *testing.T) {
+	for driver := range dialects {
+		migrations, err := load(driver)
+		if err != nil {
+			t.Errorf("%s: Expected no error, got %v", driver, err)
+		}
+
+		for i, m := range migrations {
+			if m.Version != i+1 {
+				t.Errorf("%s: Expected version %d, got %d", driver, i+1, m.Version)
+			}
+		}
+	}
+
+	postgres, _ := load("postgres")
+	sqlite, _ := load("sqlite")
+	if len(postgres) != len(sqlite) {
+		t.Errorf("Expected the same number of migrations for each database, got %d and %d", len(postgres), len(sqlite))
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	m, err := New(db, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != len(m.migrations) {
+		t.Errorf("Expected %d migrations applied, got %d", len(m.migrations), len(applied))
+	}
+
+	// Applying again does nothing.
+	if applied, err := m.Up(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("Expected no migrations applied, got %v, %v", applied, err)
+	}
+
+	if _, err := db.Exec(`INSERT INTO trainers (id, name, email) VALUES (1, 'Trainer', 't@example.com')`); err != nil {
+		t.Fatal(err)
+	}
+
+	insert := `INSERT INTO appts (start_time, end_time, user_id, trainer_id)
+		VALUES ('2020-01-02 17:00:00+00:00', '2020-01-02 17:30:00+00:00', NULL, 1)`
+	if _, err := db.Exec(insert); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(insert); err == nil {
+		t.Errorf("Expected a trainer's slot to be unique")
+	}
+
+	if _, err := db.Exec(`DELETE FROM trainers WHERE id = 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	var appts int
+	if err := db.QueryRow(`SELECT count(*) FROM appts`).Scan(&appts); err != nil {
+		t.Fatal(err)
+	}
+
+	if appts != 0 {
+		t.Errorf("Expected deleting a trainer to delete their appts, got %d", appts)
+	}
+
+	if _, err := db.Exec(`INSERT INTO trainers (id, name, email) VALUES (1, 'Trainer', 't@example.com')`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(insert); err != nil {
+		t.Fatal(err)
+	}
+
+	reverted, err := m.Down(ctx, len(m.migrations)-1)
+	if err != nil || len(reverted) != len(m.migrations)-1 || reverted[0].Version != len(m.migrations) {
+		t.Errorf("Expected all but the first migration reverted, newest first, got %v, %v", reverted, err)
+	}
+
+	if _, err := db.Exec(insert); err != nil {
+		t.Errorf("Expected no unique slot after reverting, got %v", err)
+	}
+
+	pending, err := m.Pending(ctx)
+	if err != nil || len(pending) != len(m.migrations)-1 {
+		t.Errorf("Expected %d pending migrations, got %v, %v", len(m.migrations)-1, pending, err)
+	}
+
+	if _, err := m.Down(ctx, len(m.migrations)+1); err != nil {
+		t.Fatal(err)
+	}
+
+	var tables int
+	if err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'appts'`).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+
+	if tables != 0 {
+		t.Errorf("Expected the appts table to be dropped")
+	}
+}
+
+func TestConcurrentUp(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	const migrators = 4
+	counts := make([]int, migrators)
+	errs := make([]error, migrators)
+	var wg sync.WaitGroup
+	for i := 0; i < migrators; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m, err := New(db, "sqlite")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			applied, err := m.Up(ctx)
+			counts[i], errs[i] = len(applied), err
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for i := range counts {
+		if errs[i] != nil {
+			t.Errorf("Expected no error, got %v", errs[i])
+		}
+		total += counts[i]
+	}
+
+	migrations, _ := load("sqlite")
+	if total != len(migrations) {
+		t.Errorf("Expected each migration applied once, got %d applications", total)
+	}
+}
@@ -0,0 +1,4 @@
+DROP TABLE idempotency_keys;
+DROP TABLE appts;
+DROP TABLE trainers;
+DROP TABLE users;
@@ -0,0 +1,50 @@
+-- The schema GORM's AutoMigrate created before migrations were versioned. IF NOT EXISTS lets
+-- databases created that way adopt this migration.
+CREATE TABLE IF NOT EXISTS users (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	name text NOT NULL,
+	email text NOT NULL,
+	username text,
+	version bigint NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+
+CREATE TABLE IF NOT EXISTS trainers (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	name text NOT NULL,
+	email text NOT NULL,
+	username text,
+	version bigint NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS idx_trainers_deleted_at ON trainers (deleted_at);
+
+CREATE TABLE IF NOT EXISTS appts (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	start_time timestamptz NOT NULL,
+	end_time timestamptz NOT NULL,
+	user_id bigint,
+	trainer_id bigint,
+	version bigint NOT NULL DEFAULT 1,
+	CONSTRAINT fk_users_appts FOREIGN KEY (user_id) REFERENCES users (id),
+	CONSTRAINT fk_trainers_appts FOREIGN KEY (trainer_id) REFERENCES trainers (id)
+);
+CREATE INDEX IF NOT EXISTS idx_appts_deleted_at ON appts (deleted_at);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key text PRIMARY KEY,
+	fingerprint text NOT NULL,
+	status_code bigint,
+	header bytea,
+	body bytea,
+	created_at timestamptz NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys (created_at);
@@ -0,0 +1,5 @@
+ALTER TABLE appts
+	DROP CONSTRAINT fk_users_appts,
+	ADD CONSTRAINT fk_users_appts FOREIGN KEY (user_id) REFERENCES users (id),
+	DROP CONSTRAINT fk_trainers_appts,
+	ADD CONSTRAINT fk_trainers_appts FOREIGN KEY (trainer_id) REFERENCES trainers (id);
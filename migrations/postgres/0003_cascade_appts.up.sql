@@ -0,0 +1,6 @@
+-- Purging a user or trainer removes their appointments, as the models' constraints say.
+ALTER TABLE appts
+	DROP CONSTRAINT fk_users_appts,
+	ADD CONSTRAINT fk_users_appts FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+	DROP CONSTRAINT fk_trainers_appts,
+	ADD CONSTRAINT fk_trainers_appts FOREIGN KEY (trainer_id) REFERENCES trainers (id) ON DELETE CASCADE;
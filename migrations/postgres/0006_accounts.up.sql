@@ -0,0 +1,18 @@
+CREATE TABLE credentials (
+	user_id bigint PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	password_hash text NOT NULL,
+	failed_logins integer NOT NULL DEFAULT 0,
+	locked_until timestamptz,
+	created_at timestamptz,
+	updated_at timestamptz
+);
+
+CREATE TABLE user_tokens (
+	hash text PRIMARY KEY,
+	user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	kind text NOT NULL,
+	expires_at timestamptz NOT NULL,
+	used_at timestamptz,
+	created_at timestamptz
+);
+CREATE INDEX idx_user_tokens_user_id ON user_tokens (user_id);
@@ -0,0 +1 @@
+DROP TABLE appt_versions;
@@ -0,0 +1,33 @@
+CREATE TABLE appt_versions (
+	id bigserial PRIMARY KEY,
+	appt_id bigint NOT NULL REFERENCES appts (id) ON DELETE CASCADE,
+	version bigint NOT NULL,
+	start_time timestamptz,
+	end_time timestamptz,
+	user_id bigint,
+	trainer_id bigint,
+	attended boolean,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	recorded_at timestamptz NOT NULL
+);
+CREATE INDEX idx_appt_versions_appt_id ON appt_versions (appt_id);
+CREATE INDEX idx_appt_versions_recorded_at ON appt_versions (recorded_at);
+
+-- Existing appts start their history at their last update, and deleted ones get a second version
+-- for their deletion.
+INSERT INTO appt_versions (
+	appt_id, version, start_time, end_time, user_id, trainer_id, attended,
+	created_at, updated_at, deleted_at, recorded_at
+)
+SELECT id, version, start_time, end_time, user_id, trainer_id, attended,
+	created_at, updated_at, NULL, COALESCE(updated_at, created_at)
+FROM appts;
+INSERT INTO appt_versions (
+	appt_id, version, start_time, end_time, user_id, trainer_id, attended,
+	created_at, updated_at, deleted_at, recorded_at
+)
+SELECT id, version, start_time, end_time, user_id, trainer_id, attended,
+	created_at, updated_at, deleted_at, deleted_at
+FROM appts WHERE deleted_at IS NOT NULL;
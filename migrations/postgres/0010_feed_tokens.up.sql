@@ -0,0 +1,12 @@
+CREATE TABLE feed_tokens (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	owner text NOT NULL,
+	owner_id bigint NOT NULL,
+	hash text NOT NULL
+);
+CREATE UNIQUE INDEX idx_feed_tokens_hash ON feed_tokens (hash);
+CREATE INDEX idx_feed_tokens_owner ON feed_tokens (owner, owner_id);
+CREATE INDEX idx_feed_tokens_deleted_at ON feed_tokens (deleted_at);
@@ -0,0 +1,14 @@
+CREATE TABLE busy_calendars (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	trainer_id bigint NOT NULL,
+	name text NOT NULL,
+	source text NOT NULL,
+	data text NOT NULL,
+	fetched_at timestamptz,
+	error text NOT NULL
+);
+CREATE INDEX idx_busy_calendars_trainer_id ON busy_calendars (trainer_id);
+CREATE INDEX idx_busy_calendars_deleted_at ON busy_calendars (deleted_at);
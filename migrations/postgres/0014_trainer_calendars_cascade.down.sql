@@ -0,0 +1,2 @@
+ALTER TABLE busy_calendars DROP CONSTRAINT fk_trainers_busy_calendars;
+ALTER TABLE time_off DROP CONSTRAINT fk_trainers_time_off;
@@ -0,0 +1,9 @@
+-- Purging a trainer removes their busy calendars and time off, rather than leaving them behind.
+-- Those of trainers already purged are removed first.
+DELETE FROM busy_calendars WHERE trainer_id NOT IN (SELECT id FROM trainers);
+DELETE FROM time_off WHERE trainer_id NOT IN (SELECT id FROM trainers);
+
+ALTER TABLE busy_calendars
+	ADD CONSTRAINT fk_trainers_busy_calendars FOREIGN KEY (trainer_id) REFERENCES trainers (id) ON DELETE CASCADE;
+ALTER TABLE time_off
+	ADD CONSTRAINT fk_trainers_time_off FOREIGN KEY (trainer_id) REFERENCES trainers (id) ON DELETE CASCADE;
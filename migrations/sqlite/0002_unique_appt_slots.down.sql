@@ -0,0 +1 @@
+DROP INDEX idx_appts_trainer_start_time;
@@ -0,0 +1,5 @@
+-- A trainer can't have two appointments starting at the same time. The handlers check this, but
+-- two concurrent requests can both pass the check, so the database enforces it too. Deleted
+-- appointments don't hold their slot.
+CREATE UNIQUE INDEX idx_appts_trainer_start_time ON appts (trainer_id, start_time)
+	WHERE deleted_at IS NULL;
@@ -0,0 +1,21 @@
+CREATE TABLE appts_new (
+	id integer PRIMARY KEY,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	start_time datetime NOT NULL,
+	end_time datetime NOT NULL,
+	user_id integer,
+	trainer_id integer,
+	version integer NOT NULL DEFAULT 1,
+	CONSTRAINT fk_users_appts FOREIGN KEY (user_id) REFERENCES users (id),
+	CONSTRAINT fk_trainers_appts FOREIGN KEY (trainer_id) REFERENCES trainers (id)
+);
+INSERT INTO appts_new SELECT id, created_at, updated_at, deleted_at, start_time, end_time, user_id, trainer_id, version
+	FROM appts;
+DROP TABLE appts;
+ALTER TABLE appts_new RENAME TO appts;
+
+CREATE INDEX idx_appts_deleted_at ON appts (deleted_at);
+CREATE UNIQUE INDEX idx_appts_trainer_start_time ON appts (trainer_id, start_time)
+	WHERE deleted_at IS NULL;
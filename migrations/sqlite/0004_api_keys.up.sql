@@ -0,0 +1,11 @@
+CREATE TABLE api_keys (
+	id integer PRIMARY KEY,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	name text NOT NULL,
+	prefix text NOT NULL,
+	hash text NOT NULL
+);
+CREATE UNIQUE INDEX idx_api_keys_hash ON api_keys (hash);
+CREATE INDEX idx_api_keys_deleted_at ON api_keys (deleted_at);
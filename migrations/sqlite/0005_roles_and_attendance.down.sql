@@ -0,0 +1,2 @@
+ALTER TABLE appts DROP COLUMN attended;
+ALTER TABLE api_keys DROP COLUMN role;
@@ -0,0 +1,2 @@
+ALTER TABLE api_keys ADD COLUMN role text NOT NULL DEFAULT 'admin';
+ALTER TABLE appts ADD COLUMN attended boolean;
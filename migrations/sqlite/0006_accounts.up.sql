@@ -0,0 +1,18 @@
+CREATE TABLE credentials (
+	user_id integer PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+	password_hash text NOT NULL,
+	failed_logins integer NOT NULL DEFAULT 0,
+	locked_until datetime,
+	created_at datetime,
+	updated_at datetime
+);
+
+CREATE TABLE user_tokens (
+	hash text PRIMARY KEY,
+	user_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	kind text NOT NULL,
+	expires_at datetime NOT NULL,
+	used_at datetime,
+	created_at datetime
+);
+CREATE INDEX idx_user_tokens_user_id ON user_tokens (user_id);
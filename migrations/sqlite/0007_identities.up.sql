@@ -0,0 +1,10 @@
+CREATE TABLE identities (
+	issuer text NOT NULL,
+	subject text NOT NULL,
+	user_id integer REFERENCES users (id) ON DELETE CASCADE,
+	trainer_id integer REFERENCES trainers (id) ON DELETE CASCADE,
+	created_at datetime,
+	PRIMARY KEY (issuer, subject)
+);
+CREATE INDEX idx_identities_user_id ON identities (user_id);
+CREATE INDEX idx_identities_trainer_id ON identities (trainer_id);
@@ -0,0 +1,11 @@
+CREATE TABLE audit_entries (
+	id integer PRIMARY KEY,
+	actor text NOT NULL,
+	action text NOT NULL,
+	resource text NOT NULL,
+	resource_id integer NOT NULL,
+	changes text NOT NULL,
+	request_id text NOT NULL,
+	created_at datetime NOT NULL
+);
+CREATE INDEX idx_audit_entries_resource ON audit_entries (resource, resource_id);
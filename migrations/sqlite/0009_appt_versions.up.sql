@@ -0,0 +1,33 @@
+CREATE TABLE appt_versions (
+	id integer PRIMARY KEY,
+	appt_id integer NOT NULL REFERENCES appts (id) ON DELETE CASCADE,
+	version integer NOT NULL,
+	start_time datetime,
+	end_time datetime,
+	user_id integer,
+	trainer_id integer,
+	attended boolean,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	recorded_at datetime NOT NULL
+);
+CREATE INDEX idx_appt_versions_appt_id ON appt_versions (appt_id);
+CREATE INDEX idx_appt_versions_recorded_at ON appt_versions (recorded_at);
+
+-- Existing appts start their history at their last update, and deleted ones get a second version
+-- for their deletion.
+INSERT INTO appt_versions (
+	appt_id, version, start_time, end_time, user_id, trainer_id, attended,
+	created_at, updated_at, deleted_at, recorded_at
+)
+SELECT id, version, start_time, end_time, user_id, trainer_id, attended,
+	created_at, updated_at, NULL, COALESCE(updated_at, created_at)
+FROM appts;
+INSERT INTO appt_versions (
+	appt_id, version, start_time, end_time, user_id, trainer_id, attended,
+	created_at, updated_at, deleted_at, recorded_at
+)
+SELECT id, version, start_time, end_time, user_id, trainer_id, attended,
+	created_at, updated_at, deleted_at, deleted_at
+FROM appts WHERE deleted_at IS NOT NULL;
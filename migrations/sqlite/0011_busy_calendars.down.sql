@@ -0,0 +1 @@
+DROP TABLE busy_calendars;
@@ -0,0 +1,14 @@
+CREATE TABLE busy_calendars (
+	id integer PRIMARY KEY,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	trainer_id integer NOT NULL,
+	name text NOT NULL,
+	source text NOT NULL,
+	data text NOT NULL,
+	fetched_at datetime,
+	error text NOT NULL
+);
+CREATE INDEX idx_busy_calendars_trainer_id ON busy_calendars (trainer_id);
+CREATE INDEX idx_busy_calendars_deleted_at ON busy_calendars (deleted_at);
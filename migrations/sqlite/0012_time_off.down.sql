@@ -0,0 +1 @@
+DROP TABLE time_off;
@@ -0,0 +1,12 @@
+CREATE TABLE time_off (
+	id integer PRIMARY KEY,
+	created_at datetime,
+	updated_at datetime,
+	version integer NOT NULL DEFAULT 1,
+	trainer_id integer NOT NULL,
+	name text NOT NULL,
+	uid text NOT NULL,
+	summary text NOT NULL,
+	data text NOT NULL
+);
+CREATE UNIQUE INDEX idx_time_off_name ON time_off (trainer_id, name);
@@ -0,0 +1,4 @@
+-- Whether staff set the user's email, which lets logins through an identity provider with that
+-- email link to the user. Users who never registered themselves were created by staff.
+ALTER TABLE users ADD COLUMN email_verified boolean NOT NULL DEFAULT false;
+UPDATE users SET email_verified = true WHERE id NOT IN (SELECT user_id FROM credentials);
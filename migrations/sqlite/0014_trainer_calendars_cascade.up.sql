@@ -0,0 +1,43 @@
+-- Purging a trainer removes their busy calendars and time off, rather than leaving them behind.
+-- Those of trainers already purged are removed first. SQLite can't add constraints, so the
+-- tables are rebuilt with them.
+DELETE FROM busy_calendars WHERE trainer_id NOT IN (SELECT id FROM trainers);
+DELETE FROM time_off WHERE trainer_id NOT IN (SELECT id FROM trainers);
+
+CREATE TABLE busy_calendars_new (
+	id integer PRIMARY KEY,
+	created_at datetime,
+	updated_at datetime,
+	deleted_at datetime,
+	trainer_id integer NOT NULL REFERENCES trainers (id) ON DELETE CASCADE,
+	name text NOT NULL,
+	source text NOT NULL,
+	data text NOT NULL,
+	fetched_at datetime,
+	error text NOT NULL
+);
+INSERT INTO busy_calendars_new SELECT id, created_at, updated_at, deleted_at, trainer_id, name, source, data,
+	fetched_at, error FROM busy_calendars;
+DROP TABLE busy_calendars;
+ALTER TABLE busy_calendars_new RENAME TO busy_calendars;
+
+CREATE INDEX idx_busy_calendars_trainer_id ON busy_calendars (trainer_id);
+CREATE INDEX idx_busy_calendars_deleted_at ON busy_calendars (deleted_at);
+
+CREATE TABLE time_off_new (
+	id integer PRIMARY KEY,
+	created_at datetime,
+	updated_at datetime,
+	version integer NOT NULL DEFAULT 1,
+	trainer_id integer NOT NULL REFERENCES trainers (id) ON DELETE CASCADE,
+	name text NOT NULL,
+	uid text NOT NULL,
+	summary text NOT NULL,
+	data text NOT NULL
+);
+INSERT INTO time_off_new SELECT id, created_at, updated_at, version, trainer_id, name, uid, summary, data
+	FROM time_off;
+DROP TABLE time_off;
+ALTER TABLE time_off_new RENAME TO time_off;
+
+CREATE UNIQUE INDEX idx_time_off_name ON time_off (trainer_id, name);
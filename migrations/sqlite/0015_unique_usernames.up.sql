@@ -0,0 +1,15 @@
+-- Users log in with their username, so no two users that aren't deleted may share one. Users
+-- without a username can't log in with a password and don't take part. Logins found the oldest
+-- of users sharing a username, so the others lose theirs.
+UPDATE users SET username = ''
+WHERE deleted_at IS NULL
+	AND username <> ''
+	AND EXISTS (
+		SELECT 1 FROM users AS first
+		WHERE first.username = users.username
+			AND first.deleted_at IS NULL
+			AND first.id < users.id
+	);
+
+CREATE UNIQUE INDEX idx_users_username ON users (username)
+	WHERE deleted_at IS NULL AND username <> '';
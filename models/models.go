@@ -15,6 +15,35 @@ type Appt struct {
 
 	UserID    uint `json:"user_id" validate:"required" gorm:"not null,index"`
 	TrainerID uint `json:"trainer_id" validate:"required" gorm:"not null,index"`
+
+	// Attended records whether the user came, once the trainer has marked it.
+	Attended *bool `json:"attended"`
+
+	// Version is incremented on every update and used for optimistic concurrency.
+	Version uint `json:"version" gorm:"not null;default:1"`
+}
+
+// ApptVersion is an appt as it was after one of its changes, so that its history can be shown
+// and its state at a past time reconstructed. Deleting an appt records a version with DeletedAt
+// set.
+type ApptVersion struct {
+	ID uint `gorm:"primaryKey"`
+
+	ApptID    uint `gorm:"not null;index"`
+	Version   uint `gorm:"not null"`
+	StartTime time.Time
+	EndTime   time.Time
+	UserID    uint
+	TrainerID uint
+	Attended  *bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// DeletedAt isn't a gorm.DeletedAt, which would hide the versions of deleted appts.
+	DeletedAt *time.Time
+
+	// RecordedAt is when the change was made. The version is the appt's state from then until
+	// its next version's RecordedAt.
+	RecordedAt time.Time `gorm:"not null"`
 }
 
 type User struct {
@@ -24,6 +53,12 @@ type User struct {
 	Name     string `gorm:"not null"`
 	Email    string `gorm:"not null"`
 	Username string `gorm:"not null,unique"`
+	// EmailVerified is whether staff set Email. Only then do logins through an identity provider
+	// with the email link to the user, as users can set their own to anything.
+	EmailVerified bool `json:"-" gorm:"not null"`
+
+	// Version is incremented on every update and used for optimistic concurrency.
+	Version uint `json:"version" gorm:"not null;default:1"`
 
 	Appts []Appt `gorm:"constraint:ON DELETE CASCADE;"`
 }
@@ -36,5 +71,164 @@ type Trainer struct {
 	Email    string `gorm:"not null"`
 	Username string `gorm:"not null,unique"`
 
+	// Version is incremented on every update and used for optimistic concurrency.
+	Version uint `json:"version" gorm:"not null;default:1"`
+
 	Appts []Appt `gorm:"constraint:ON DELETE CASCADE;"`
 }
+
+// IdempotencyKey records the response to a request made with an Idempotency-Key header so that
+// retries of the same request can be answered without repeating it.
+type IdempotencyKey struct {
+	Key string `gorm:"primaryKey"`
+
+	// Fingerprint is a hash of the request method, path and body, used to reject reuse of a key
+	// for a different request.
+	Fingerprint string `gorm:"not null"`
+
+	// StatusCode is zero while the original request is still being handled.
+	StatusCode int
+	Header     []byte
+	Body       []byte
+
+	CreatedAt time.Time `gorm:"not null;index"`
+}
+
+// APIKey lets a client call the API. Only a hash of the key is stored; the key itself is shown
+// once, when it is created.
+type APIKey struct {
+	gorm.Model
+
+	Name string `gorm:"not null"`
+	// Role is the role of the key's holder, one of the auth.Role constants.
+	Role string `gorm:"not null;default:admin"`
+	// Prefix is the start of the key, so that keys can be told apart without storing them.
+	Prefix string `gorm:"not null"`
+	// Hash is the hex SHA-256 of the key. Keys are random, so a slow hash isn't needed. It is
+	// left out of the audit log.
+	Hash string `gorm:"not null;uniqueIndex" audit:"-"`
+}
+
+// Credential is a user's password, and the state of their failed attempts to log in.
+type Credential struct {
+	UserID uint `gorm:"primaryKey;autoIncrement:false"`
+
+	// PasswordHash is the bcrypt hash of the password.
+	PasswordHash string `gorm:"not null"`
+	// FailedLogins counts the failed attempts since the last successful one.
+	FailedLogins int `gorm:"not null;default:0"`
+	// LockedUntil, if set, is when the user may next try to log in.
+	LockedUntil *time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// UserToken is an opaque token issued to a user, such as a refresh token. Like API keys, only
+// its hash is stored.
+type UserToken struct {
+	Hash string `gorm:"primaryKey"`
+
+	UserID uint   `gorm:"not null;index"`
+	Kind   string `gorm:"not null"`
+
+	ExpiresAt time.Time `gorm:"not null"`
+	// UsedAt is set when the token is used or revoked. Tokens can only be used once.
+	UsedAt *time.Time
+
+	CreatedAt time.Time
+}
+
+// Identity links an account at an OpenID Connect provider, named by its issuer and subject, to
+// the user or trainer it logs in as. Exactly one of UserID and TrainerID is set.
+type Identity struct {
+	Issuer  string `gorm:"primaryKey"`
+	Subject string `gorm:"primaryKey"`
+
+	UserID    *uint `gorm:"index"`
+	TrainerID *uint `gorm:"index"`
+
+	CreatedAt time.Time
+}
+
+// AuditEntry records a change made to a resource through the API. Entries are only ever
+// appended, so that the log can be trusted to show who changed what.
+type AuditEntry struct {
+	ID uint `gorm:"primaryKey"`
+
+	// Actor is the subject of the principal who made the change, or empty if they hadn't
+	// authenticated, as when registering.
+	Actor string `gorm:"not null"`
+	// Action is create, update, delete, restore or purge.
+	Action string `gorm:"not null"`
+	// Resource is the resource's path, such as appointments, and ResourceID the ID of the model
+	// changed. A purge changes many at once and has no ID.
+	Resource   string `gorm:"not null"`
+	ResourceID uint   `gorm:"not null"`
+	// Changes is a JSON object with the before and after values of each changed field.
+	Changes string `gorm:"not null"`
+	// RequestID is the X-Request-ID of the request that made the change.
+	RequestID string `gorm:"not null"`
+
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// FeedToken lets a calendar app read the calendar feed of a trainer or user. Calendar apps can't
+// send credentials, so the token is part of the feed's URL. Like API keys, only its hash is
+// stored.
+type FeedToken struct {
+	gorm.Model
+
+	// Owner is the resource whose calendar the token reads, trainers or users, and OwnerID the
+	// ID of the trainer or user.
+	Owner   string `gorm:"not null;index:idx_feed_tokens_owner"`
+	OwnerID uint   `gorm:"not null;index:idx_feed_tokens_owner"`
+	// Hash is the hex SHA-256 of the token. It is left out of the audit log.
+	Hash string `gorm:"not null;uniqueIndex" audit:"-"`
+}
+
+// BusyCalendar is a trainer's calendar kept elsewhere, such as at another gym, whose events
+// keep the trainer busy. Its iCalendar data is either uploaded, or fetched from its source and
+// refreshed periodically.
+type BusyCalendar struct {
+	gorm.Model
+
+	TrainerID uint   `gorm:"not null;index"`
+	Name      string `gorm:"not null"`
+	// Source is the http or https URL, or the path of the file, the data is fetched from. It is
+	// empty for uploaded calendars.
+	Source string `gorm:"not null"`
+	// Data is the iCalendar data. It is left out of the audit log.
+	Data string `gorm:"not null" audit:"-"`
+	// FetchedAt is when the data was last fetched from the source, and Error why fetching it
+	// last failed, if it did. The last data fetched is kept until the source can be read again.
+	FetchedAt *time.Time
+	Error     string `gorm:"not null"`
+}
+
+// TimeOff is time a trainer has blocked off from their calendar app, such as a vacation or a
+// dentist's appointment. It is stored as the calendar object the app sent, a VCALENDAR with
+// one event, which may recur, and keeps the trainer busy like the events of a busy calendar.
+// Time off is removed outright rather than soft deleted, so that its name can be reused.
+type TimeOff struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Version increases with each change, and is the object's ETag.
+	Version uint `gorm:"not null;default:1"`
+
+	TrainerID uint `gorm:"not null;uniqueIndex:idx_time_off_name"`
+	// Name is the last segment of the object's path in the trainer's calendar, such as
+	// 0b0a8c2e.ics, chosen by the calendar app.
+	Name string `gorm:"not null;uniqueIndex:idx_time_off_name"`
+	// UID is the event's UID, and Summary its SUMMARY.
+	UID     string `gorm:"not null"`
+	Summary string `gorm:"not null"`
+	// Data is the iCalendar data. It is left out of the audit log.
+	Data string `gorm:"not null" audit:"-"`
+}
+
+// TableName keeps GORM from pluralizing time off.
+func (TimeOff) TableName() string {
+	return "time_off"
+}
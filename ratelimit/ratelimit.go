@@ -0,0 +1,155 @@
+// Package ratelimit limits how often clients may act, with token buckets kept in a Backend.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/marcuscarr/appts/clock"
+)
+
+// sweepEvery is how many takes the memory backend makes between removing full buckets.
+const sweepEvery = 1024
+
+// Limit is a token bucket's budget: Requests every Per on average, in bursts of up to Burst.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+	// Burst is the bucket's capacity. Defaults to Requests.
+	Burst int
+}
+
+// Enabled reports whether the limit allows any requests at all; a zero Limit means unlimited.
+func (l Limit) Enabled() bool {
+	return l.Requests > 0 && l.Per > 0
+}
+
+// Capacity returns the most tokens the bucket holds.
+func (l Limit) Capacity() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+
+	return l.Requests
+}
+
+// rate returns how many tokens are added each second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// Result is the state of a bucket after a take.
+type Result struct {
+	// Allowed reports whether a token was taken.
+	Allowed bool
+	// Remaining is how many whole tokens are left.
+	Remaining int
+	// RetryAfter is how long until a token is available, if none was.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Backend keeps the buckets. The memory backend limits each replica of the server separately; a
+// backend shared between replicas, e.g. kept in Redis, makes the limits hold across them.
+type Backend interface {
+	// Take takes a token from the bucket named key, which is refilled according to limit.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+	// Peek returns the state of the bucket named key without taking a token. Allowed reports
+	// whether there is one to take.
+	Peek(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+	limit  Limit
+}
+
+// refill returns the bucket's tokens at now.
+func (b bucket) refill(now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.at).Seconds()*b.limit.rate()
+	return math.Min(tokens, float64(b.limit.Capacity()))
+}
+
+// result returns the state of the bucket, just after a token was taken if allowed.
+func (b bucket) result(allowed bool) Result {
+	result := Result{Allowed: allowed}
+	if !allowed {
+		result.RetryAfter = seconds((1 - b.tokens) / b.limit.rate())
+	}
+
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((float64(b.limit.Capacity()) - b.tokens) / b.limit.rate())
+	return result
+}
+
+// Memory is a Backend that keeps the buckets in memory.
+type Memory struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+// NewMemory returns an empty memory backend, which refills buckets by the time on c.
+func NewMemory(c clock.Clock) *Memory {
+	return &Memory{clock: c, buckets: map[string]*bucket{}}
+}
+
+func (m *Memory) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	m.takes++
+	if m.takes%sweepEvery == 0 {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.Capacity()), at: now, limit: limit}
+		m.buckets[key] = b
+	}
+
+	b.tokens = b.refill(now)
+	b.at = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	return b.result(allowed), nil
+}
+
+func (m *Memory) Peek(ctx context.Context, key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	b, ok := m.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.Capacity()), at: now, limit: limit}
+	}
+
+	peeked := bucket{tokens: b.refill(now), at: now, limit: limit}
+	return peeked.result(peeked.tokens >= 1), nil
+}
+
+// sweep removes the buckets that have refilled, which are the same as new ones.
+func (m *Memory) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		if b.refill(now) >= float64(b.limit.Capacity()) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
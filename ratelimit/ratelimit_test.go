@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/marcuscarr/appts/clock"
+)
+
+func TestMemoryTake(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewFake(now)
+	m := NewMemory(c)
+	limit := Limit{Requests: 2, Per: time.Second}
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		key     string
+		want    Result
+	}{
+		{"First", 0, "a", Result{Allowed: true, Remaining: 1, Reset: 500 * time.Millisecond}},
+		{"Second", 0, "a", Result{Allowed: true, Remaining: 0, Reset: time.Second}},
+		{"Empty", 0, "a", Result{RetryAfter: 500 * time.Millisecond, Reset: time.Second}},
+		{"Other key", 0, "b", Result{Allowed: true, Remaining: 1, Reset: 500 * time.Millisecond}},
+		{"Refilled one", 500 * time.Millisecond, "a", Result{Allowed: true, Remaining: 0, Reset: time.Second}},
+		{"Refilled to capacity", time.Hour, "a", Result{Allowed: true, Remaining: 1, Reset: 500 * time.Millisecond}},
+	}
+
+	for _, step := range steps {
+		c.Set(c.Now().Add(step.advance))
+		got, err := m.Take(context.Background(), step.key, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != step.want {
+			t.Errorf("%s: Expected %+v, got %+v", step.name, step.want, got)
+		}
+	}
+}
+
+func TestMemoryPeek(t *testing.T) {
+	c := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	m := NewMemory(c)
+	limit := Limit{Requests: 1, Per: time.Second}
+	ctx := context.Background()
+
+	steps := []struct {
+		name string
+		take bool
+		want Result
+	}{
+		{"New bucket", false, Result{Allowed: true, Remaining: 1}},
+		{"Still full", false, Result{Allowed: true, Remaining: 1}},
+		{"Take", true, Result{Allowed: true, Remaining: 0, Reset: time.Second}},
+		{"Empty", false, Result{RetryAfter: time.Second, Reset: time.Second}},
+	}
+
+	for _, step := range steps {
+		var got Result
+		var err error
+		if step.take {
+			got, err = m.Take(ctx, "a", limit)
+		} else {
+			got, err = m.Peek(ctx, "a", limit)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != step.want {
+			t.Errorf("%s: Expected %+v, got %+v", step.name, step.want, got)
+		}
+	}
+}
+
+func TestMemoryBurst(t *testing.T) {
+	c := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	m := NewMemory(c)
+	limit := Limit{Requests: 60, Per: time.Minute, Burst: 3}
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if result, _ := m.Take(context.Background(), "a", limit); result.Allowed {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("Expected %d, got %d", 3, allowed)
+	}
+}
+
+func TestMemorySweep(t *testing.T) {
+	c := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	m := NewMemory(c)
+	limit := Limit{Requests: 1, Per: time.Second}
+
+	for i := 0; i < sweepEvery-1; i++ {
+		_, _ = m.Take(context.Background(), "a", limit)
+	}
+
+	// Once "a" refills it is swept with the next take.
+	c.Set(c.Now().Add(time.Hour))
+	_, _ = m.Take(context.Background(), "b", limit)
+	if _, ok := m.buckets["a"]; ok {
+		t.Errorf("Expected the full bucket to be swept")
+	}
+}
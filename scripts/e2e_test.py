@@ -1,8 +1,11 @@
 from datetime import datetime, timedelta, timezone
 from http import HTTPStatus
+import os
 import requests
 
-from init_db import initialize
+# The server stores BOOTSTRAP_API_KEY as an API key when it starts.
+session = requests.Session()
+session.headers["Authorization"] = f"Bearer {os.environ.get('BOOTSTRAP_API_KEY', 'appts_dev')}"
 
 
 def checkSuccess(r):
@@ -26,11 +29,10 @@ def checkFailure(r):
 
 
 def main():
-    initialize()
-
+    # Expects the data set to have been imported with `make seed`.
     # Create a new appointment
-    r = requests.post(
-        "http://localhost:8080/appointments",
+    r = session.post(
+        "http://localhost:8080/v1/appointments",
         json={
             "start_time": "2020-01-01T10:00:00-08:00",
             "end_time": "2020-01-01T10:30:00-08:00",
@@ -46,8 +48,8 @@ def main():
     # ########################
 
     # Attempt to create an appointment with a user that does not exist
-    r = requests.post(
-        "http://localhost:8080/appointments",
+    r = session.post(
+        "http://localhost:8080/v1/appointments",
         json={
             "start_time": "2020-01-02T10:00:00-08:00",
             "end_time": "2020-01-02T10:30:00-08:00",
@@ -58,8 +60,8 @@ def main():
     checkFailure(r)
 
     # Attempt to create an appointment with a trainer that does not exist
-    r = requests.post(
-        "http://localhost:8080/appointments",
+    r = session.post(
+        "http://localhost:8080/v1/appointments",
         json={
             "start_time": "2020-01-02T10:00:00-08:00",
             "end_time": "2020-01-02T10:30:00-08:00",
@@ -70,8 +72,8 @@ def main():
     checkFailure(r)
 
     # Attempt to create an appointment outside of business hours
-    r = requests.post(
-        "http://localhost:8080/appointments",
+    r = session.post(
+        "http://localhost:8080/v1/appointments",
         json={
             "start_time": "2020-01-01T06:00:00-08:00",
             "end_time": "2020-01-01T06:30:00-08:00",
@@ -83,8 +85,8 @@ def main():
     checkFailure(r)
 
     # Attempt to create an appointment with a start time after the end time
-    r = requests.post(
-        "http://localhost:8080/appointments",
+    r = session.post(
+        "http://localhost:8080/v1/appointments",
         json={
             "start_time": "2020-01-01T11:30:00-08:00",
             "end_time": "2020-01-01T11:00:00-08:00",
@@ -98,17 +100,17 @@ def main():
     ############################
 
     # Get a trainer
-    r = requests.get("http://localhost:8080/trainers/1")
+    r = session.get("http://localhost:8080/v1/trainers/1")
     print(f"Trainer: {r.json()}")
 
     # # Get a trainer's appointments
-    r = requests.get("http://localhost:8080/trainers/1/appointments")
+    r = session.get("http://localhost:8080/v1/trainers/1/appointments")
     appointments = r.json()
     apptSet = {a["start_time"] for a in appointments}
 
     # Get the availability of a trainer
-    r = requests.get(
-        "http://localhost:8080/trainers/1/appointments/available",
+    r = session.get(
+        "http://localhost:8080/v1/trainers/1/appointments/available",
         params={
             "starts_at": "2019-01-24",
             "ends_at": "2019-01-26",
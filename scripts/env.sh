@@ -11,6 +11,9 @@ export DB_NAME=${DB_NAME:-appts}
 export DB_USER=${DB_USER:-postgres}
 export DB_PASS=${DB_PASS:-password}
 
+# Only for development: the server accepts this as an API key.
+export BOOTSTRAP_API_KEY=${BOOTSTRAP_API_KEY:-appts_dev}
+
 export POSTGRES_DATA_DIR=${POSTGRES_DATA_DIR:-~/scr/postgres/data}
 
 exec "$@"
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+const (
+	// Audit actions
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+	auditPurge   = "purge"
+
+	// Audited resources other than those in resourceRoutes
+	apiKeysResource       = "api-keys"
+	feedTokensResource    = "feed-tokens"
+	busyCalendarsResource = "busy-calendars"
+	timeOffResource       = "time-off"
+
+	resourceParam = "resource"
+)
+
+// auditResources are the resources recorded in the audit log.
+var auditResources = map[string]bool{
+	"appointments":        true,
+	"trainers":            true,
+	"users":               true,
+	apiKeysResource:       true,
+	feedTokensResource:    true,
+	busyCalendarsResource: true,
+	timeOffResource:       true,
+}
+
+// auditColumns names the fields in audit entries' changes the same way GORM names columns.
+var auditColumns = schema.NamingStrategy{}
+
+// auditChange is a field's value before and after a change. Before is null for a create.
+type auditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type auditEntryResponse struct {
+	ID         uint            `json:"id"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	Resource   string          `json:"resource"`
+	ResourceID uint            `json:"resource_id,omitempty"`
+	Changes    json.RawMessage `json:"changes"`
+	RequestID  string          `json:"request_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+func newAuditEntryResponse(e *models.AuditEntry) auditEntryResponse {
+	return auditEntryResponse{
+		ID:         e.ID,
+		Actor:      e.Actor,
+		Action:     e.Action,
+		Resource:   e.Resource,
+		ResourceID: e.ResourceID,
+		Changes:    json.RawMessage(e.Changes),
+		RequestID:  e.RequestID,
+		CreatedAt:  e.CreatedAt.In(location),
+	}
+}
+
+// recordAudit appends an entry for a change that r made to the resource with the given ID. before
+// and after are pointers to the model before and after the change, either of which may be nil.
+// s should be the transaction the change was made in, so that neither is kept without the other.
+func recordAudit(s store.Store, r *http.Request, action, resource string, id uint, before, after interface{}) error {
+	changes, err := json.Marshal(auditChanges(auditSnapshot(before), auditSnapshot(after)))
+	if err != nil {
+		return err
+	}
+
+	var actor string
+	if p := auth.FromContext(r.Context()); p != nil {
+		actor = p.Subject
+	}
+
+	return s.Audit().Append(&models.AuditEntry{
+		Actor:      actor,
+		Action:     action,
+		Resource:   resource,
+		ResourceID: id,
+		Changes:    string(changes),
+		RequestID:  requestIDFrom(r.Context()),
+	})
+}
+
+// auditChanges returns the fields whose values differ between two snapshots.
+func auditChanges(before, after map[string]interface{}) map[string]auditChange {
+	changes := map[string]auditChange{}
+	for name, value := range after {
+		if old, ok := before[name]; !ok || !sameJSON(old, value) {
+			changes[name] = auditChange{Before: old, After: value}
+		}
+	}
+
+	for name, old := range before {
+		if _, ok := after[name]; !ok {
+			changes[name] = auditChange{Before: old}
+		}
+	}
+
+	return changes
+}
+
+// sameJSON reports whether two values encode to the same JSON, which is how they are compared in
+// the log.
+func sameJSON(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aJSON, bJSON)
+}
+
+// auditSnapshot returns the columns of a pointer to a model by name, or nil for a nil model.
+// Associations and fields tagged `audit:"-"` are left out.
+func auditSnapshot(model interface{}) map[string]interface{} {
+	value := reflect.ValueOf(model)
+	if model == nil || value.IsNil() {
+		return nil
+	}
+
+	snapshot := map[string]interface{}{}
+	addAuditFields(snapshot, value.Elem())
+	return snapshot
+}
+
+// addAuditFields adds the fields of a struct to a snapshot. Fields of embedded structs such as
+// gorm.Model are shadowed by the model's own, as in the store.
+func addAuditFields(snapshot map[string]interface{}, value reflect.Value) {
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if field.Anonymous || !field.IsExported() || field.Tag.Get("audit") == "-" {
+			continue
+		}
+
+		kind := field.Type.Kind()
+		if kind == reflect.Slice || kind == reflect.Map {
+			continue
+		}
+
+		name := auditColumns.ColumnName("", field.Name)
+		if _, ok := snapshot[name]; !ok {
+			snapshot[name] = auditValue(value.Field(i))
+		}
+	}
+
+	for i := 0; i < valueType.NumField(); i++ {
+		if valueType.Field(i).Anonymous && value.Field(i).Kind() == reflect.Struct {
+			addAuditFields(snapshot, value.Field(i))
+		}
+	}
+}
+
+// auditValue returns a field's value in a form that compares and encodes the same however it
+// was loaded. Times are in UTC, since databases return them that way.
+func auditValue(field reflect.Value) interface{} {
+	switch v := field.Interface().(type) {
+	case time.Time:
+		return v.UTC()
+	case *time.Time:
+		if v == nil {
+			return nil
+		}
+		return v.UTC()
+	case gorm.DeletedAt:
+		if !v.Valid {
+			return nil
+		}
+		return v.Time.UTC()
+	}
+
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return nil
+		}
+		return field.Elem().Interface()
+	}
+
+	return field.Interface()
+}
+
+// copyModel returns a pointer to a copy of the model, to keep its state from before a change.
+func copyModel(model interface{}) interface{} {
+	value := reflect.ValueOf(model).Elem()
+	copied := reflect.New(value.Type())
+	copied.Elem().Set(value)
+	return copied.Interface()
+}
+
+// auditHandler serves the audit log.
+type auditHandler struct {
+	store  store.Store
+	logger *log.Logger
+}
+
+func newAuditHandler(s store.Store, logger *log.Logger) *auditHandler {
+	return &auditHandler{store: s, logger: logger}
+}
+
+// list returns the audit log, oldest first, optionally limited to a resource and to one of its
+// models with ?resource= and ?id=.
+func (ah *auditHandler) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var filter store.Filter
+	if resource := query.Get(resourceParam); resource != "" {
+		if !auditResources[resource] {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("unknown resource " + strconv.Quote(resource)))
+			return
+		}
+
+		filter = append(filter, store.Condition{Column: "resource", Op: "=", Value: resource})
+	}
+
+	if idValue := query.Get(idParam); idValue != "" {
+		id, err := strconv.ParseUint(idValue, 10, 0)
+		if err != nil || len(filter) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("id must be a number, and needs a resource"))
+			return
+		}
+
+		filter = append(filter, store.Condition{Column: "resource_id", Op: "=", Value: uint(id)})
+	}
+
+	var entries []models.AuditEntry
+	if err := ah.store.Audit().List(filter, &entries); err != nil {
+		ah.logger.Printf("Error listing audit entries: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]auditEntryResponse, len(entries))
+	for i := range entries {
+		resp[i] = newAuditEntryResponse(&entries[i])
+	}
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		ah.logger.Printf("Error encoding response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
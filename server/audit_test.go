@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/marcuscarr/appts/auth"
+)
+
+func TestAudit(t *testing.T) {
+	forEachStorage(t, testAudit)
+}
+
+func testAudit(t *testing.T, s *Server) {
+	seed(t, s)
+
+	steps := []struct {
+		method, path, body string
+		header             []string
+		e                  int
+	}{
+		{"POST", "/v1/appointments", apptBody("1"), []string{requestIDHeader, "create-appt"}, http.StatusOK},
+		{
+			"PATCH", "/v1/appointments/1",
+			`{"start_time":"2020-01-02T10:00:00-08:00","end_time":"2020-01-02T10:30:00-08:00"}`,
+			[]string{ifMatchHeader, `"1"`}, http.StatusOK,
+		},
+		// Failed changes aren't recorded.
+		{"DELETE", "/v1/appointments/1", "", []string{ifMatchHeader, `"1"`}, http.StatusPreconditionFailed},
+		{"DELETE", "/v1/appointments/1", "", []string{ifMatchHeader, `"2"`}, http.StatusNoContent},
+		{"POST", "/v1/appointments/1/restore", "", []string{ifMatchHeader, `"2"`}, http.StatusOK},
+		{
+			"POST", "/v1/batch",
+			`{"operations":[{"method":"update","resource":"users","id":1,"version":1,"body":{"name":"Renamed","email":"user@example.com","username":"user"}}]}`,
+			nil, http.StatusOK,
+		},
+	}
+
+	for _, step := range steps {
+		if w := do(s, step.method, step.path, step.body, step.header...); w.Code != step.e {
+			t.Fatalf("%s %s: Expected %d, got %d: %s", step.method, step.path, step.e, w.Code, w.Body)
+		}
+	}
+
+	entries := listAudit(t, s, "/v1/audit?resource=appointments&id=1")
+	actions := make([]string, len(entries))
+	for i, e := range entries {
+		actions[i] = e.Action
+		if e.Actor != "test" || e.Resource != "appointments" || e.ResourceID != 1 || e.RequestID == "" {
+			t.Errorf("Expected an entry for appointment 1 by test with a request ID, got %+v", e)
+		}
+	}
+	if want := []string{auditCreate, auditUpdate, auditDelete, auditRestore}; !equalStrings(actions, want) {
+		t.Fatalf("Expected %v, got %v", want, actions)
+	}
+	if entries[0].RequestID != "create-appt" {
+		t.Errorf("Expected request ID %q, got %q", "create-appt", entries[0].RequestID)
+	}
+
+	testCases := []struct {
+		entry  auditEntryResponse
+		fields []string
+		field  string
+		before interface{}
+		after  interface{}
+	}{
+		{entries[0], nil, "trainer_id", nil, float64(1)},
+		{
+			entries[1], []string{"end_time", "start_time", "version"},
+			"start_time", "2020-01-02T17:00:00Z", "2020-01-02T18:00:00Z",
+		},
+		{entries[2], []string{"deleted_at"}, "deleted_at", nil, "2020-01-01T08:00:00Z"},
+		{entries[3], []string{"deleted_at", "version"}, "version", float64(2), float64(3)},
+	}
+
+	for _, tc := range testCases {
+		var changes map[string]auditChange
+		if err := json.Unmarshal(tc.entry.Changes, &changes); err != nil {
+			t.Fatal(err)
+		}
+
+		if tc.fields != nil {
+			var fields []string
+			for field := range changes {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			if !equalStrings(fields, tc.fields) {
+				t.Errorf("%s: Expected changes to %v, got %v", tc.entry.Action, tc.fields, fields)
+			}
+		}
+
+		if got := changes[tc.field]; got.Before != tc.before || got.After != tc.after {
+			t.Errorf("%s: Expected %s to change from %v to %v, got %+v", tc.entry.Action, tc.field, tc.before, tc.after, got)
+		}
+	}
+
+	// Batches are recorded too, and entries can be listed by resource.
+	users := listAudit(t, s, "/v1/audit?resource=users")
+	if len(users) != 2 || users[1].Action != auditUpdate || users[1].ResourceID != 1 {
+		t.Errorf("Expected the user's creation and update, got %+v", users)
+	}
+	if all := listAudit(t, s, "/v1/audit"); len(all) != len(users)+2+len(entries) {
+		t.Errorf("Expected %d entries, got %d", len(users)+2+len(entries), len(all))
+	}
+
+	// API keys' hashes are left out.
+	if w := do(s, "POST", "/v1/admin/api-keys", `{"name":"Kiosk"}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d", http.StatusCreated, w.Code)
+	}
+	keys := listAudit(t, s, "/v1/audit?resource=api-keys")
+	if len(keys) != 1 || !strings.Contains(string(keys[0].Changes), `"prefix"`) || strings.Contains(string(keys[0].Changes), `"hash"`) {
+		t.Errorf("Expected the key's creation without its hash, got %+v", keys)
+	}
+
+	client := "Bearer " + testToken(s, auth.Claims{"sub": "client", "role": auth.RoleClient, "user_id": float64(1)})
+	badRequests := []struct {
+		path    string
+		headers []string
+		e       int
+	}{
+		{"/v1/audit?resource=appointments", []string{authorizationHeader, client}, http.StatusForbidden},
+		{"/v1/audit?resource=unknown", nil, http.StatusBadRequest},
+		{"/v1/audit?id=1", nil, http.StatusBadRequest},
+		{"/v1/audit?resource=users&id=one", nil, http.StatusBadRequest},
+	}
+	for _, tc := range badRequests {
+		if w := do(s, "GET", tc.path, "", tc.headers...); w.Code != tc.e {
+			t.Errorf("%s: Expected %d, got %d", tc.path, tc.e, w.Code)
+		}
+	}
+}
+
+func listAudit(t *testing.T, s *Server, path string) []auditEntryResponse {
+	t.Helper()
+
+	w := do(s, "GET", path, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: Expected %d, got %d: %s", path, http.StatusOK, w.Code, w.Body)
+	}
+
+	var entries []auditEntryResponse
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+
+	return entries
+}
+
+func TestRequestID(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s *Server) {
+		testCases := []struct {
+			sent string
+			same bool
+		}{
+			{"abc-123", true},
+			{"", false},
+			{"has spaces", false},
+		}
+
+		for _, tc := range testCases {
+			w := do(s, "GET", "/healthz", "", requestIDHeader, tc.sent)
+			got := w.Header().Get(requestIDHeader)
+			if got == "" || (got == tc.sent) != tc.same {
+				t.Errorf("%q: Expected the same ID %v, got %q", tc.sent, tc.same, got)
+			}
+		}
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+const (
+	authorizationHeader   = "Authorization"
+	wwwAuthenticateHeader = "WWW-Authenticate"
+	bearerScheme          = "Bearer"
+	basicScheme           = "Basic"
+)
+
+// publicPaths are served without authentication.
+var publicPaths = map[string]bool{
+	"/healthz":      true,
+	"/openapi.json": true,
+	"/docs":         true,
+}
+
+// publicPrefix is the prefix of the account routes, which are how clients get credentials.
+const publicPrefix = "/v1/auth/"
+
+// docsPrefix is the prefix of the files the docs page loads.
+const docsPrefix = "/docs/"
+
+// isPublic reports whether path is served without authentication. Calendar feeds check their
+// own tokens.
+func isPublic(path string) bool {
+	return publicPaths[path] || strings.HasPrefix(path, publicPrefix) || strings.HasPrefix(path, docsPrefix) ||
+		isCalendarFeed(path)
+}
+
+// authenticator identifies the client making each request, from an API key or a JWT given as a
+// bearer token. Calendar apps can only send a username and password, so CalDAV requests may
+// give the key or JWT as the password of Basic credentials instead.
+type authenticator struct {
+	store  store.Store
+	logger *log.Logger
+	// jwt is nil if no JWT keys are configured.
+	jwt *auth.JWTVerifier
+}
+
+func newAuthenticator(s store.Store, logger *log.Logger, c clock.Clock, config auth.JWTConfig) *authenticator {
+	a := &authenticator{store: s, logger: logger}
+	if config.Enabled() {
+		a.jwt = auth.NewJWTVerifier(config, c)
+	}
+
+	return a
+}
+
+// middleware rejects requests without valid credentials, and attaches the principal to the
+// context of the others.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		caldav := strings.HasPrefix(r.URL.Path, caldavPrefix)
+		reject := func(reason string) {
+			if caldav {
+				// Calendar apps only send credentials when challenged for Basic ones.
+				w.Header().Add(wwwAuthenticateHeader, basicScheme+` realm="appts"`)
+			}
+			unauthorized(w, reason)
+		}
+
+		token, ok := bearerToken(r)
+		if !ok && caldav {
+			token, ok = basicPassword(r)
+		}
+
+		if !ok {
+			reject("bearer token required")
+			return
+		}
+
+		principal, err := a.authenticate(token)
+		if err != nil {
+			if errors.Is(err, auth.ErrInvalidToken) {
+				reject(err.Error())
+				return
+			}
+
+			a.logger.Printf("Error authenticating: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), principal)))
+	})
+}
+
+func (a *authenticator) authenticate(token string) (*auth.Principal, error) {
+	if auth.IsJWT(token) {
+		if a.jwt == nil {
+			return nil, fmt.Errorf("%w: JWTs aren't accepted", auth.ErrInvalidToken)
+		}
+
+		claims, err := a.jwt.Verify(token)
+		if err != nil {
+			return nil, err
+		}
+
+		return auth.PrincipalFromClaims(claims)
+	}
+
+	key, err := a.store.APIKeys().GetByHash(auth.HashToken(token))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, auth.ErrInvalidToken
+		}
+
+		return nil, err
+	}
+
+	return &auth.Principal{Subject: apiKeySubject(key), Method: auth.MethodAPIKey, Role: key.Role}, nil
+}
+
+// bearerToken returns the token from the request's Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	parts := strings.SplitN(r.Header.Get(authorizationHeader), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], bearerScheme) {
+		return "", false
+	}
+
+	token := strings.TrimSpace(parts[1])
+	return token, token != ""
+}
+
+// basicPassword returns the password of Basic credentials in the request's Authorization header.
+func basicPassword(r *http.Request) (string, bool) {
+	_, password, ok := r.BasicAuth()
+	return password, ok && password != ""
+}
+
+func unauthorized(w http.ResponseWriter, reason string) {
+	w.Header().Add(wwwAuthenticateHeader, bearerScheme+` realm="appts"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = w.Write([]byte(reason))
+}
+
+func apiKeySubject(key *models.APIKey) string {
+	return "api-key:" + strconv.FormatUint(uint64(key.ID), 10)
+}
+
+// CreateAPIKey stores a new API key named name for a holder with role, and returns the key,
+// which can't be recovered later. Keys are for staff, so role is auth.RoleAdmin or
+// auth.RoleFrontDesk.
+func CreateAPIKey(s store.Store, name, role string) (*models.APIKey, string, error) {
+	if role != auth.RoleAdmin && role != auth.RoleFrontDesk {
+		return nil, "", fmt.Errorf("API keys can't have role %q", role)
+	}
+
+	key, err := auth.NewAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	stored, err := storeAPIKey(s, name, role, key)
+	return stored, key, err
+}
+
+// storeAPIKey stores the hash of key under name.
+func storeAPIKey(s store.Store, name, role, key string) (*models.APIKey, error) {
+	stored := &models.APIKey{
+		Name:   name,
+		Role:   role,
+		Prefix: auth.APIKeyDisplayPrefix(key),
+		Hash:   auth.HashToken(key),
+	}
+	if err := s.APIKeys().Create(stored); err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
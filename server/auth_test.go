@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+func TestAuthentication(t *testing.T) {
+	forEachStorage(t, testAuthentication)
+}
+
+func testAuthentication(t *testing.T, s *Server) {
+	w := do(s, "POST", "/v1/admin/api-keys", `{"name":"ci"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+
+	var created apiKeyResponse
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, created.Prefix) {
+		t.Errorf("Expected key starting with %v, got %v", created.Prefix, created.Key)
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		code          int
+	}{
+		{"No credentials", "/v1/users", "", http.StatusUnauthorized},
+		{"Other scheme", "/v1/users", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		{"Public path", "/healthz", "", http.StatusOK},
+		{"Not a calendar feed", "/v1/caldav/trainers/1/calendar.ics", "", http.StatusUnauthorized},
+		{"API key", "/v1/users", "Bearer " + created.Key, http.StatusOK},
+		{"Legacy route", "/users", "Bearer " + created.Key, http.StatusOK},
+		{"Unknown API key", "/v1/users", "Bearer appts_unknown", http.StatusUnauthorized},
+		{"JWT", "/v1/users", "Bearer " + testToken(s, auth.Claims{"sub": "42", "role": auth.RoleAdmin}), http.StatusOK},
+		{"JWT without role", "/v1/users", "Bearer " + testToken(s, auth.Claims{"sub": "42"}), http.StatusUnauthorized},
+		{
+			"Client JWT without user_id", "/v1/users",
+			"Bearer " + testToken(s, auth.Claims{"sub": "42", "role": auth.RoleClient}),
+			http.StatusUnauthorized,
+		},
+		{
+			"Expired JWT", "/v1/users",
+			"Bearer " + testToken(s, auth.Claims{"sub": "42", "role": auth.RoleAdmin, "exp": float64(testNow.Add(-time.Hour).Unix())}),
+			http.StatusUnauthorized,
+		},
+		{"JWT without sub", "/v1/users", "Bearer " + testToken(s, auth.Claims{"role": auth.RoleAdmin}), http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := do(s, "GET", test.path, "", authorizationHeader, test.authorization)
+			if w.Code != test.code {
+				t.Errorf("Expected %d, got %d: %s", test.code, w.Code, w.Body)
+			}
+
+			if test.code == http.StatusUnauthorized && w.Header().Get(wwwAuthenticateHeader) == "" {
+				t.Errorf("Expected a %s header", wwwAuthenticateHeader)
+			}
+		})
+	}
+
+	w = do(s, "GET", "/v1/admin/api-keys", "")
+	var listed []apiKeyResponse
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != created.ID || listed[0].Key != "" {
+		t.Errorf("Expected key %d without its secret, got %+v", created.ID, listed)
+	}
+
+	if w := do(s, "DELETE", "/v1/admin/api-keys/"+fmt.Sprint(created.ID), ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	w = do(s, "GET", "/v1/users", "", authorizationHeader, "Bearer "+created.Key)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d after revoking, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if w := do(s, "DELETE", "/v1/admin/api-keys/"+fmt.Sprint(created.ID), ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected %d revoking twice, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	testCases := []struct {
+		path string
+		e    bool
+	}{
+		{"/healthz", true},
+		{"/docs/swagger-ui.css", true},
+		{"/v1/auth/login", true},
+		{"/v1/trainers/1/calendar.ics", true},
+		{"/v1/users/1/calendar.ics", true},
+		{"/trainers/1/calendar.ics", true},
+		{"/v1/users", false},
+		{"/v1/caldav/trainers/1/calendar.ics", false},
+		{"/v1/trainers/calendar.ics", false},
+		{"/v1/trainers/1/busy-calendars/calendar.ics", false},
+		{"/v1/appointments/calendar.ics", false},
+	}
+
+	for _, tc := range testCases {
+		if got := isPublic(tc.path); got != tc.e {
+			t.Errorf("%s: Expected %v, got %v", tc.path, tc.e, got)
+		}
+	}
+}
+
+func TestAuthenticatorPrincipal(t *testing.T) {
+	st := store.NewMemory(clock.Real)
+	stored, key, err := CreateAPIKey(st, "test", auth.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *auth.Principal
+	a := newAuthenticator(st, log.Default(), clock.Real, auth.JWTConfig{})
+	handler := a.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = auth.FromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+	r.Header.Set(authorizationHeader, "bearer "+key)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got == nil || got.Subject != apiKeySubject(stored) || got.Method != auth.MethodAPIKey {
+		t.Errorf("Expected principal %v, got %+v", apiKeySubject(stored), got)
+	}
+
+	// Without keys configured, JWTs are rejected.
+	r = httptest.NewRequest(http.MethodGet, "/v1/users", nil)
+	r.Header.Set(authorizationHeader, "Bearer a.b.c")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestBootstrapAPIKey(t *testing.T) {
+	st := store.NewMemory(clock.Real)
+	config := &Config{BootstrapAPIKey: "appts_bootstrap"}
+
+	// Starting twice with the same key stores it once.
+	for i := 0; i < 2; i++ {
+		s, err := New(config, WithStore(st))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := do(s, "GET", "/v1/users", "", authorizationHeader, "Bearer appts_bootstrap")
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	var keys []models.APIKey
+	if err := st.APIKeys().List(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("Expected %d key, got %d", 1, len(keys))
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+// action is something a principal may be allowed to do to a resource.
+type action int
+
+const (
+	actionCreate action = iota
+	actionRead
+	actionUpdate
+	actionDelete
+	actionRestore
+	actionAttend
+)
+
+var staffRoles = []string{auth.RoleAdmin, auth.RoleFrontDesk}
+
+// policy decides which principals may act on a resource's models.
+type policy struct {
+	// any lists the roles that may take each action on every model.
+	any map[action][]string
+	// own lists the roles that may take each action on the models they own.
+	own map[action][]string
+	// owns reports whether the principal owns the model, a pointer to a model.
+	owns func(p *auth.Principal, model interface{}) bool
+	// scope limits a list to the models the principal owns.
+	scope func(p *auth.Principal) store.Filter
+}
+
+// allows reports whether p may take the action on model.
+func (pol *policy) allows(p *auth.Principal, a action, model interface{}) bool {
+	if p.HasRole(pol.any[a]...) {
+		return true
+	}
+
+	return p.HasRole(pol.own[a]...) && pol.owns(p, model)
+}
+
+// readScope returns the filter that limits a list to what p may read. It reports false if p may
+// read none of the models.
+func (pol *policy) readScope(p *auth.Principal) (store.Filter, bool) {
+	if p.HasRole(pol.any[actionRead]...) {
+		return nil, true
+	}
+
+	if p.HasRole(pol.own[actionRead]...) {
+		return pol.scope(p), true
+	}
+
+	return nil, false
+}
+
+// apptPolicy lets clients book, see and cancel their own appointments, and trainers see their
+// schedule and mark attendance. Staff may do anything.
+var apptPolicy = &policy{
+	any: map[action][]string{
+		actionCreate:  staffRoles,
+		actionRead:    staffRoles,
+		actionUpdate:  staffRoles,
+		actionDelete:  staffRoles,
+		actionRestore: staffRoles,
+		actionAttend:  staffRoles,
+	},
+	own: map[action][]string{
+		actionCreate: {auth.RoleClient},
+		actionRead:   {auth.RoleClient, auth.RoleTrainer},
+		actionUpdate: {auth.RoleClient},
+		actionDelete: {auth.RoleClient},
+		actionAttend: {auth.RoleTrainer},
+	},
+	owns: func(p *auth.Principal, model interface{}) bool {
+		appt := model.(*models.Appt)
+		if p.Role == auth.RoleTrainer {
+			return appt.TrainerID == p.TrainerID
+		}
+
+		return appt.UserID == p.UserID
+	},
+	scope: func(p *auth.Principal) store.Filter {
+		if p.Role == auth.RoleTrainer {
+			return store.Filter{{Column: trainerIDParam, Op: "=", Value: idString(p.TrainerID)}}
+		}
+
+		return store.Filter{{Column: userIDParam, Op: "=", Value: idString(p.UserID)}}
+	},
+}
+
+// userPolicy lets staff manage users, and clients see and update themselves.
+var userPolicy = &policy{
+	any: map[action][]string{
+		actionCreate:  staffRoles,
+		actionRead:    staffRoles,
+		actionUpdate:  staffRoles,
+		actionDelete:  staffRoles,
+		actionRestore: staffRoles,
+	},
+	own: map[action][]string{
+		actionRead:   {auth.RoleClient},
+		actionUpdate: {auth.RoleClient},
+	},
+	owns: func(p *auth.Principal, model interface{}) bool {
+		return model.(*models.User).ID == p.UserID
+	},
+	scope: func(p *auth.Principal) store.Filter {
+		return store.Filter{{Column: "id", Op: "=", Value: idString(p.UserID)}}
+	},
+}
+
+// trainerPolicy lets everyone see trainers, but only admins manage them.
+var trainerPolicy = &policy{
+	any: map[action][]string{
+		actionCreate:  {auth.RoleAdmin},
+		actionRead:    {auth.RoleAdmin, auth.RoleFrontDesk, auth.RoleTrainer, auth.RoleClient},
+		actionUpdate:  {auth.RoleAdmin},
+		actionDelete:  {auth.RoleAdmin},
+		actionRestore: {auth.RoleAdmin},
+	},
+}
+
+// feedTokenPolicy lets trainers and clients manage the tokens of their own calendar feeds. Staff
+// may manage anyone's.
+var feedTokenPolicy = &policy{
+	any: map[action][]string{
+		actionCreate: staffRoles,
+		actionDelete: staffRoles,
+	},
+	own: map[action][]string{
+		actionCreate: {auth.RoleTrainer, auth.RoleClient},
+		actionDelete: {auth.RoleTrainer, auth.RoleClient},
+	},
+	owns: func(p *auth.Principal, model interface{}) bool {
+		token := model.(*models.FeedToken)
+		if p.Role == auth.RoleTrainer {
+			return token.Owner == trainerCalendar.resource && token.OwnerID == p.TrainerID
+		}
+
+		return token.Owner == userCalendar.resource && token.OwnerID == p.UserID
+	},
+}
+
+// busyCalendarPolicy lets trainers manage their own busy calendars. Staff may manage anyone's.
+var busyCalendarPolicy = &policy{
+	any: map[action][]string{
+		actionCreate: staffRoles,
+		actionRead:   staffRoles,
+		actionUpdate: staffRoles,
+		actionDelete: staffRoles,
+	},
+	own: map[action][]string{
+		actionCreate: {auth.RoleTrainer},
+		actionRead:   {auth.RoleTrainer},
+		actionUpdate: {auth.RoleTrainer},
+		actionDelete: {auth.RoleTrainer},
+	},
+	owns: func(p *auth.Principal, model interface{}) bool {
+		return model.(*models.BusyCalendar).TrainerID == p.TrainerID
+	},
+}
+
+// timeOffPolicy lets trainers block off their own time. Staff may manage anyone's.
+var timeOffPolicy = &policy{
+	any: map[action][]string{
+		actionCreate: staffRoles,
+		actionRead:   staffRoles,
+		actionUpdate: staffRoles,
+		actionDelete: staffRoles,
+	},
+	own: map[action][]string{
+		actionCreate: {auth.RoleTrainer},
+		actionRead:   {auth.RoleTrainer},
+		actionUpdate: {auth.RoleTrainer},
+		actionDelete: {auth.RoleTrainer},
+	},
+	owns: func(p *auth.Principal, model interface{}) bool {
+		return model.(*models.TimeOff).TrainerID == p.TrainerID
+	},
+}
+
+// requireRole rejects requests from principals without one of roles.
+func requireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !auth.FromContext(r.Context()).HasRole(roles...) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func idString(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+)
+
+func TestAuthorization(t *testing.T) {
+	forEachStorage(t, testAuthorization)
+}
+
+func testAuthorization(t *testing.T, s *Server) {
+	seed(t, s)
+
+	body := func(userID, trainerID, hour int) string {
+		return fmt.Sprintf(
+			`{"start_time":"2020-01-02T%02d:00:00-08:00","end_time":"2020-01-02T%02d:30:00-08:00","user_id":%d,"trainer_id":%d}`,
+			hour, hour, userID, trainerID,
+		)
+	}
+
+	bearer := func(claims auth.Claims) string {
+		return "Bearer " + testToken(s, claims)
+	}
+	client := bearer(auth.Claims{"sub": "client", "role": auth.RoleClient, "user_id": 1})
+	trainer := bearer(auth.Claims{"sub": "trainer", "role": auth.RoleTrainer, "trainer_id": 1})
+	frontDesk := bearer(auth.Claims{"sub": "front-desk", "role": auth.RoleFrontDesk})
+
+	// Appointment 1 is the client's with trainer 1, and 2 another user's with trainer 2.
+	setup := []struct{ path, body string }{
+		{"/v1/users", `{"name":"User 2","email":"user2@example.com","username":"user2"}`},
+		{"/v1/appointments", body(1, 1, 9)},
+		{"/v1/appointments", body(2, 2, 9)},
+	}
+	for _, req := range setup {
+		if w := do(s, "POST", req.path, req.body); w.Code != http.StatusOK {
+			t.Fatalf("Expected %d creating %s, got %d", http.StatusOK, req.path, w.Code)
+		}
+	}
+
+	batch := `{"operations":[{"method":"create","resource":"appointments","body":` + body(2, 1, 11) + `}]}`
+	steps := []struct {
+		name          string
+		authorization string
+		method, path  string
+		body          string
+		code          int
+	}{
+		{"Client books for themself", client, "POST", "/v1/appointments", body(1, 1, 10), http.StatusOK},
+		{"Client books for another user", client, "POST", "/v1/appointments", body(2, 1, 11), http.StatusForbidden},
+		{"Client books for another user in a batch", client, "POST", "/v1/batch", batch, http.StatusForbidden},
+		{"Client sees their appointment", client, "GET", "/v1/appointments/1", "", http.StatusOK},
+		{"Client sees another's appointment", client, "GET", "/v1/appointments/2", "", http.StatusForbidden},
+		{"Client moves their appointment to another user", client, "PATCH", "/v1/appointments/1", `{"user_id":2}`, http.StatusForbidden},
+		{"Client sees themself", client, "GET", "/v1/users/1", "", http.StatusOK},
+		{"Client sees another user", client, "GET", "/v1/users/2", "", http.StatusForbidden},
+		{"Client sees trainers", client, "GET", "/v1/trainers", "", http.StatusOK},
+		{"Client creates a trainer", client, "POST", "/v1/trainers", `{"name":"T","email":"t@example.com","username":"t"}`, http.StatusForbidden},
+		{"Trainer books", trainer, "POST", "/v1/appointments", body(1, 1, 12), http.StatusForbidden},
+		{"Trainer sees another trainer's appointment", trainer, "GET", "/v1/appointments/2", "", http.StatusForbidden},
+		{"Trainer lists users", trainer, "GET", "/v1/users", "", http.StatusForbidden},
+		{"Trainer marks attendance early", trainer, "POST", "/v1/appointments/3/attendance", `{"attended":true}`, http.StatusConflict},
+		{"Front desk creates a user", frontDesk, "POST", "/v1/users", `{"name":"U","email":"u@example.com","username":"u"}`, http.StatusOK},
+		{"Front desk creates a trainer", frontDesk, "POST", "/v1/trainers", `{"name":"T","email":"t@example.com","username":"t"}`, http.StatusForbidden},
+		{"Front desk deletes a trainer", frontDesk, "DELETE", "/v1/trainers/2", "", http.StatusForbidden},
+		{"Front desk manages API keys", frontDesk, "GET", "/v1/admin/api-keys", "", http.StatusForbidden},
+		{"Client cancels their appointment", client, "DELETE", "/v1/appointments/1", "", http.StatusNoContent},
+	}
+
+	for _, step := range steps {
+		w := do(s, step.method, step.path, step.body, authorizationHeader, step.authorization, ifMatchHeader, etag(1))
+		if w.Code != step.code {
+			t.Errorf("%s: Expected %d, got %d: %s", step.name, step.code, w.Code, w.Body)
+		}
+	}
+
+	lists := []struct {
+		authorization string
+		path          string
+		ids           []uint
+	}{
+		{client, "/v1/appointments", []uint{3}},
+		{client, "/v1/trainers/2/appointments", nil},
+		{trainer, "/v1/appointments", []uint{3}},
+		{client, "/v1/users", []uint{1}},
+	}
+	for _, list := range lists {
+		w := do(s, "GET", list.path, "", authorizationHeader, list.authorization)
+		var items []struct {
+			ID uint `json:"id"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&items); err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []uint
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(list.ids) {
+			t.Errorf("%s: Expected %v, got %v", list.path, list.ids, ids)
+		}
+	}
+
+	// Once the appointments have started, the trainer can mark attendance at their own. The
+	// token is renewed since the clock has moved past its expiry.
+	s.clock.(*clock.Fake).Set(time.Date(2020, 1, 2, 11, 0, 0, 0, location))
+	trainer = bearer(auth.Claims{"sub": "trainer", "role": auth.RoleTrainer, "trainer_id": 1})
+	w := do(s, "POST", "/v1/appointments/3/attendance", `{"attended":true}`,
+		authorizationHeader, trainer, ifMatchHeader, etag(1))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var appt apptResponse
+	if err := json.NewDecoder(w.Body).Decode(&appt); err != nil {
+		t.Fatal(err)
+	}
+	if appt.Attended == nil || !*appt.Attended {
+		t.Errorf("Expected attended, got %v", appt.Attended)
+	}
+
+	w = do(s, "POST", "/v1/appointments/2/attendance", `{"attended":true}`,
+		authorizationHeader, trainer, ifMatchHeader, etag(1))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected %d, got %d", http.StatusForbidden, w.Code)
+	}
+}
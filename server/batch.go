@@ -0,0 +1,377 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+
+	"github.com/go-playground/validator"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+const (
+	maxBatchOperations = 1000
+
+	// Batch modes
+	batchAtomic      = "atomic"
+	batchIndependent = "independent"
+
+	// Batch methods
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+)
+
+type batchRequest struct {
+	// Mode is "atomic" (the default) to roll back every operation if any fails, or
+	// "independent" to apply each operation that succeeds.
+	Mode       string    `json:"mode"`
+	Operations []batchOp `json:"operations"`
+}
+
+type batchOp struct {
+	Method   string `json:"method"`
+	Resource string `json:"resource"`
+	ID       uint   `json:"id"`
+	// Version is required for an update or delete, and must match the stored version for it to
+	// apply, like the If-Match header of single requests.
+	Version uint            `json:"version"`
+	Body    json.RawMessage `json:"body"`
+}
+
+type batchResult struct {
+	Status int         `json:"status"`
+	Body   interface{} `json:"body,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// batchError is returned by an operation to give the status code it failed with.
+type batchError struct {
+	status int
+	err    error
+}
+
+var errBatchForbidden = &batchError{http.StatusForbidden, errors.New("forbidden")}
+
+func (e *batchError) Error() string {
+	return e.err.Error()
+}
+
+// batchHandler applies a list of create, update and delete operations across resources in a
+// single transaction.
+type batchHandler struct {
+	store     store.Store
+	logger    *log.Logger
+	validator *validator.Validate
+	resources map[string]*modelHandler
+}
+
+func newBatchHandler(s store.Store, logger *log.Logger, resources map[string]*modelHandler) *batchHandler {
+	return &batchHandler{
+		store:     s,
+		logger:    logger,
+		validator: validator.New(),
+		resources: resources,
+	}
+}
+
+func (bh *batchHandler) handle(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		bh.logger.Printf("Error decoding body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = batchAtomic
+	}
+
+	if req.Mode != batchAtomic && req.Mode != batchIndependent {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("mode must be %q or %q", batchAtomic, batchIndependent)))
+		return
+	}
+
+	if len(req.Operations) > maxBatchOperations {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = w.Write([]byte(fmt.Sprintf("a batch may have at most %d operations", maxBatchOperations)))
+		return
+	}
+
+	// The query applies to every operation's response, so a query that can't be served fails the
+	// batch before anything is applied.
+	for _, mh := range bh.resources {
+		if err := mh.rep.checkQuery(r); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	results := make([]batchResult, len(req.Operations))
+	status := http.StatusOK
+
+	txErr := bh.store.Transaction(func(tx store.Store) error {
+		for i, op := range req.Operations {
+			var body interface{}
+			var opErr error
+			if req.Mode == batchAtomic {
+				body, opErr = bh.apply(tx, r, op)
+			} else {
+				// Each operation gets a savepoint so that a failure only undoes itself.
+				opErr = tx.Transaction(func(tx store.Store) error {
+					var err error
+					body, err = bh.apply(tx, r, op)
+					return err
+				})
+			}
+
+			results[i] = bh.resultFor(op, body, opErr)
+			if opErr != nil && req.Mode == batchIndependent {
+				// Some operations may have been applied, so the client must check each result.
+				status = http.StatusMultiStatus
+			}
+
+			if opErr != nil && req.Mode == batchAtomic {
+				status = results[i].Status
+				for j := i + 1; j < len(results); j++ {
+					results[j] = batchResult{Status: http.StatusFailedDependency, Error: "not attempted"}
+				}
+				return opErr
+			}
+		}
+
+		return nil
+	})
+
+	var opErr *batchError
+	if txErr != nil && !errors.As(txErr, &opErr) {
+		bh.logger.Printf("Error applying batch: %v", txErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(batchResponse{Results: results})
+	if err != nil {
+		bh.logger.Printf("Error encoding batch response: %v", err)
+	}
+}
+
+func (bh *batchHandler) resultFor(op batchOp, body interface{}, err error) batchResult {
+	if err == nil {
+		status := http.StatusOK
+		if op.Method == batchCreate {
+			status = http.StatusCreated
+		} else if op.Method == batchDelete {
+			status = http.StatusNoContent
+		}
+
+		return batchResult{Status: status, Body: body}
+	}
+
+	var opErr *batchError
+	if errors.As(err, &opErr) {
+		return batchResult{Status: opErr.status, Error: opErr.Error()}
+	}
+
+	bh.logger.Printf("Error applying batch operation: %v", err)
+	return batchResult{Status: http.StatusInternalServerError, Error: err.Error()}
+}
+
+// apply runs a single operation in tx, returning the representation of the resulting model.
+func (bh *batchHandler) apply(tx store.Store, r *http.Request, op batchOp) (interface{}, error) {
+	mh, ok := bh.resources[op.Resource]
+	if !ok {
+		return nil, &batchError{http.StatusBadRequest, fmt.Errorf("unknown resource %q", op.Resource)}
+	}
+
+	var model interface{}
+	var err error
+	switch op.Method {
+	case batchCreate:
+		model, err = bh.create(tx, mh, r, op)
+	case batchUpdate:
+		model, err = bh.update(tx, mh, r, op)
+	case batchDelete:
+		return nil, bh.delete(tx, mh, r, op)
+	default:
+		return nil, &batchError{http.StatusBadRequest, fmt.Errorf("unknown method %q", op.Method)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := encodeOne(mh.rep, tx, r, model)
+	if errors.Is(err, errInvalidInclude) {
+		return nil, &batchError{http.StatusBadRequest, err}
+	}
+
+	return body, err
+}
+
+func (bh *batchHandler) create(tx store.Store, mh *modelHandler, r *http.Request, op batchOp) (interface{}, error) {
+	p := auth.FromContext(r.Context())
+	model := reflect.New(mh.model).Interface()
+	if err := mh.rep.decode(bytes.NewReader(op.Body), model); err != nil {
+		return nil, &batchError{http.StatusBadRequest, err}
+	}
+
+	if op.ID != 0 {
+		reflect.ValueOf(model).Elem().FieldByName("ID").SetUint(uint64(op.ID))
+	}
+	setModelVersion(model, 1)
+	setEmailVerified(p, model, nil)
+	if appt, ok := model.(*models.Appt); ok {
+		newAppt(appt)
+	}
+
+	if !mh.policy.allows(p, actionCreate, model) {
+		return nil, errBatchForbidden
+	}
+
+	if err := bh.check(tx, model); err != nil {
+		return nil, err
+	}
+
+	err := mh.models(tx).Create(model)
+	if errors.Is(err, store.ErrDuplicate) {
+		return nil, &batchError{http.StatusConflict, err}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return model, recordAudit(tx, r, auditCreate, mh.resource, modelID(model), nil, model)
+}
+
+func (bh *batchHandler) update(tx store.Store, mh *modelHandler, r *http.Request, op batchOp) (interface{}, error) {
+	p := auth.FromContext(r.Context())
+	existing, err := bh.find(tx, mh, op)
+	if err != nil {
+		return nil, err
+	}
+
+	model := reflect.New(mh.model).Interface()
+	if err := mh.rep.decode(bytes.NewReader(op.Body), model); err != nil {
+		return nil, &batchError{http.StatusBadRequest, err}
+	}
+	copyModelFields(model, existing, "ID", "CreatedAt")
+	if _, ok := model.(*models.Appt); ok {
+		// Attendance is only changed by marking it.
+		copyModelFields(model, existing, "Attended")
+	}
+	setEmailVerified(p, model, existing)
+
+	if !mh.policy.allows(p, actionUpdate, existing) || !mh.policy.allows(p, actionUpdate, model) {
+		return nil, errBatchForbidden
+	}
+
+	if err := bh.check(tx, model); err != nil {
+		return nil, err
+	}
+
+	err = mh.models(tx).Update(model, modelVersion(existing))
+	if errors.Is(err, store.ErrConflict) {
+		return nil, &batchError{http.StatusPreconditionFailed, errors.New("version does not match")}
+	}
+
+	if errors.Is(err, store.ErrDuplicate) {
+		return nil, &batchError{http.StatusConflict, err}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return model, recordAudit(tx, r, auditUpdate, mh.resource, modelID(model), existing, model)
+}
+
+func (bh *batchHandler) delete(tx store.Store, mh *modelHandler, r *http.Request, op batchOp) error {
+	p := auth.FromContext(r.Context())
+	existing, err := bh.find(tx, mh, op)
+	if err != nil {
+		return err
+	}
+
+	if !mh.policy.allows(p, actionDelete, existing) {
+		return errBatchForbidden
+	}
+
+	err = mh.deleteModel(tx, r, existing)
+	if errors.Is(err, store.ErrConflict) {
+		return &batchError{http.StatusPreconditionFailed, errors.New("version does not match")}
+	}
+
+	return err
+}
+
+// find loads the model an update or delete operation applies to and checks its version.
+func (bh *batchHandler) find(tx store.Store, mh *modelHandler, op batchOp) (interface{}, error) {
+	if op.ID == 0 {
+		return nil, &batchError{http.StatusBadRequest, errors.New("id is required")}
+	}
+
+	existing, err := mh.find(mh.models(tx), int(op.ID))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, &batchError{http.StatusNotFound, fmt.Errorf("%s %d not found", op.Resource, op.ID)}
+		}
+
+		return nil, err
+	}
+
+	if op.Version == 0 {
+		return nil, &batchError{http.StatusPreconditionRequired, errors.New("version is required")}
+	}
+
+	if op.Version != modelVersion(existing) {
+		return nil, &batchError{http.StatusPreconditionFailed, errors.New("version does not match")}
+	}
+
+	return existing, nil
+}
+
+// check applies the same rules as the appointment handlers to appointments in a batch.
+func (bh *batchHandler) check(tx store.Store, model interface{}) error {
+	appt, ok := model.(*models.Appt)
+	if !ok {
+		return nil
+	}
+
+	if err := validAppt(bh.validator, *appt); err != nil {
+		return &batchError{http.StatusBadRequest, err}
+	}
+
+	if err := apptParties(tx, *appt); err != nil {
+		if errors.Is(err, errNotExist) {
+			return &batchError{http.StatusBadRequest, err}
+		}
+
+		return err
+	}
+
+	isAvailable, err := availableAppt(tx, *appt)
+	if err != nil {
+		return err
+	}
+
+	if !isAvailable {
+		return &batchError{http.StatusConflict, errors.New("appt is not available")}
+	}
+
+	return nil
+}
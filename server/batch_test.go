@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// batch posts the operations in the mode and returns the response's status and result statuses.
+func batch(t *testing.T, s *Server, mode string, ops ...string) (int, []int) {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"mode":%q,"operations":[%s]}`, mode, strings.Join(ops, ","))
+	w := do(s, "POST", "/v1/batch", body)
+
+	var resp batchResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Expected results, got %d: %v", w.Code, err)
+	}
+
+	statuses := make([]int, len(resp.Results))
+	for i, result := range resp.Results {
+		statuses[i] = result.Status
+	}
+
+	return w.Code, statuses
+}
+
+// count returns how many of the resource there are.
+func count(t *testing.T, s *Server, path string) int {
+	t.Helper()
+
+	w := do(s, "GET", path, "")
+	var list []json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("%s: Expected a list, got %d: %v", path, w.Code, err)
+	}
+
+	return len(list)
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+const (
+	batchCreateUser = `{"method":"create","resource":"users","body":{"name":"User %d","email":"u%d@example.com","username":"u%d"}}`
+	batchCreateAppt = `{"method":"create","resource":"appointments","body":` +
+		`{"start_time":"2020-01-02T%s:00-08:00","end_time":"2020-01-02T%s:00-08:00","user_id":1,"trainer_id":1}}`
+)
+
+func createUserOp(n int) string {
+	return fmt.Sprintf(batchCreateUser, n, n, n)
+}
+
+func TestBatch(t *testing.T) {
+	forEachStorage(t, testBatch)
+}
+
+func testBatch(t *testing.T, s *Server) {
+	seed(t, s)
+
+	testCases := []struct {
+		name     string
+		mode     string
+		ops      []string
+		e        int
+		statuses []int
+		users    int
+		appts    int
+	}{
+		{
+			// A failure rolls back the operations before it and skips those after it.
+			"atomic", batchAtomic,
+			[]string{
+				createUserOp(2),
+				fmt.Sprintf(batchCreateAppt, "09:00", "09:30"),
+				`{"method":"delete","resource":"trainers","id":9}`,
+				createUserOp(3),
+			},
+			http.StatusNotFound,
+			[]int{http.StatusCreated, http.StatusCreated, http.StatusNotFound, http.StatusFailedDependency},
+			1, 0,
+		},
+		{
+			"atomic conflict", batchAtomic,
+			[]string{
+				fmt.Sprintf(batchCreateAppt, "09:00", "09:30"),
+				fmt.Sprintf(batchCreateAppt, "09:00", "09:30"),
+			},
+			http.StatusConflict,
+			[]int{http.StatusCreated, http.StatusConflict},
+			1, 0,
+		},
+		{
+			// Each operation is undone on its own, and the response says some failed.
+			"independent", batchIndependent,
+			[]string{
+				createUserOp(2),
+				fmt.Sprintf(batchCreateAppt, "09:00", "09:30"),
+				fmt.Sprintf(batchCreateAppt, "09:00", "09:30"),
+				`{"method":"delete","resource":"trainers","id":9}`,
+				createUserOp(3),
+			},
+			http.StatusMultiStatus,
+			[]int{http.StatusCreated, http.StatusCreated, http.StatusConflict, http.StatusNotFound, http.StatusCreated},
+			3, 1,
+		},
+		{
+			"independent success", batchIndependent,
+			[]string{createUserOp(4)},
+			http.StatusOK,
+			[]int{http.StatusCreated},
+			4, 1,
+		},
+		{
+			// The appointment is at version 1.
+			"versions", batchIndependent,
+			[]string{
+				`{"method":"update","resource":"appointments","id":1,"body":` +
+					`{"start_time":"2020-01-02T10:00:00-08:00","end_time":"2020-01-02T10:30:00-08:00","user_id":1,"trainer_id":1}}`,
+				`{"method":"delete","resource":"appointments","id":1}`,
+				`{"method":"update","resource":"appointments","id":1,"version":2,"body":` +
+					`{"start_time":"2020-01-02T10:00:00-08:00","end_time":"2020-01-02T10:30:00-08:00","user_id":1,"trainer_id":1}}`,
+				`{"method":"update","resource":"appointments","id":1,"version":1,"body":` +
+					`{"start_time":"2020-01-02T10:00:00-08:00","end_time":"2020-01-02T10:30:00-08:00","user_id":1,"trainer_id":1}}`,
+				`{"method":"delete","resource":"appointments","id":1,"version":1}`,
+				`{"method":"delete","resource":"appointments","id":1,"version":2}`,
+			},
+			http.StatusMultiStatus,
+			[]int{
+				http.StatusPreconditionRequired, http.StatusPreconditionRequired,
+				http.StatusPreconditionFailed, http.StatusOK, http.StatusPreconditionFailed, http.StatusNoContent,
+			},
+			4, 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		code, statuses := batch(t, s, tc.mode, tc.ops...)
+		if code != tc.e || !equalInts(statuses, tc.statuses) {
+			t.Errorf("%s: Expected %d %v, got %d %v", tc.name, tc.e, tc.statuses, code, statuses)
+		}
+
+		if users := count(t, s, "/v1/users"); users != tc.users {
+			t.Errorf("%s: Expected %d users, got %d", tc.name, tc.users, users)
+		}
+		if appts := count(t, s, "/v1/appointments"); appts != tc.appts {
+			t.Errorf("%s: Expected %d appointments, got %d", tc.name, tc.appts, appts)
+		}
+	}
+
+	ops := make([]string, maxBatchOperations+1)
+	for i := range ops {
+		ops[i] = createUserOp(10 + i)
+	}
+	body := fmt.Sprintf(`{"operations":[%s]}`, strings.Join(ops, ","))
+	if w := do(s, "POST", "/v1/batch", body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+	if users := count(t, s, "/v1/users"); users != 4 {
+		t.Errorf("Expected no users to be created, got %d", users)
+	}
+}
@@ -0,0 +1,616 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/ical"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+const (
+	busyCalendarsPath = "/busy-calendars"
+	// busyCalendarNameParam names a calendar uploaded as a text/calendar body.
+	busyCalendarNameParam = "name"
+
+	defaultBusyCalendarRefresh = time.Hour
+	// busyCalendarFetchTimeout limits each fetch of a calendar's source.
+	busyCalendarFetchTimeout = 10 * time.Second
+	// maxBusyCalendarSize limits the iCalendar data of a calendar, uploaded or fetched.
+	maxBusyCalendarSize = 4 << 20
+)
+
+// BusyCalendarsConfig configures fetching trainers' busy calendars from their sources.
+type BusyCalendarsConfig struct {
+	// Dir is the directory calendars may be read from, by paths relative to it. Without it,
+	// calendars can only be uploaded or fetched from URLs.
+	Dir string
+	// Refresh is how often calendars are fetched again from their sources. Defaults to an hour.
+	Refresh time.Duration
+	// AllowPrivateSources lets URL sources be fetched from loopback, private and link-local
+	// addresses, such as a calendar server on the studio's network. Without it, sources can't
+	// reach the services next to the server, like a cloud metadata endpoint.
+	AllowPrivateSources bool
+}
+
+// withDefaults returns the config with defaults for the unset fields.
+func (c BusyCalendarsConfig) withDefaults() BusyCalendarsConfig {
+	if c.Refresh == 0 {
+		c.Refresh = defaultBusyCalendarRefresh
+	}
+
+	return c
+}
+
+// busyCalendarRequest creates a busy calendar from either a source or uploaded data.
+type busyCalendarRequest struct {
+	Name string `json:"name" validate:"required"`
+	// Source is an http or https URL, or a path relative to the configured directory.
+	Source string `json:"source"`
+	// ICS is the iCalendar data of an uploaded calendar.
+	ICS string `json:"ics"`
+}
+
+type busyCalendarResponse struct {
+	ID        uint       `json:"id"`
+	TrainerID uint       `json:"trainer_id"`
+	Name      string     `json:"name"`
+	Source    string     `json:"source,omitempty"`
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+func newBusyCalendarResponse(cal *models.BusyCalendar) busyCalendarResponse {
+	resp := busyCalendarResponse{
+		ID:        cal.ID,
+		TrainerID: cal.TrainerID,
+		Name:      cal.Name,
+		Source:    cal.Source,
+		Error:     cal.Error,
+		CreatedAt: cal.CreatedAt.In(location),
+		UpdatedAt: cal.UpdatedAt.In(location),
+	}
+	if cal.FetchedAt != nil {
+		fetchedAt := cal.FetchedAt.In(location)
+		resp.FetchedAt = &fetchedAt
+	}
+
+	return resp
+}
+
+// trainerBusy returns the periods between start and end in which the trainer's busy calendars
+// and time off have them busy, ordered by start.
+func trainerBusy(s store.Store, trainerID uint, start, end time.Time) ([]ical.Period, error) {
+	filter := store.Filter{{Column: trainerIDParam, Op: "=", Value: idString(trainerID)}}
+
+	var cals []models.BusyCalendar
+	if err := s.BusyCalendars().List(filter, &cals); err != nil {
+		return nil, err
+	}
+
+	var timeOff []models.TimeOff
+	if err := s.TimeOff().List(filter, &timeOff); err != nil {
+		return nil, err
+	}
+
+	var events []ical.Event
+	for _, cal := range cals {
+		calEvents, err := busyEvents.events(busyCalendarsResource, cal.ID, cal.Data)
+		if err != nil {
+			return nil, fmt.Errorf("busy calendar %d: %w", cal.ID, err)
+		}
+
+		events = append(events, calEvents...)
+	}
+
+	for _, t := range timeOff {
+		timeOffEvents, err := busyEvents.events(timeOffResource, t.ID, t.Data)
+		if err != nil {
+			return nil, fmt.Errorf("time off %d: %w", t.ID, err)
+		}
+
+		events = append(events, timeOffEvents...)
+	}
+
+	return ical.Busy(events, start, end), nil
+}
+
+// parseBusyCalendar returns the events of a calendar's iCalendar data. Floating times are read
+// in the business's location.
+func parseBusyCalendar(data string) ([]ical.Event, error) {
+	cal, err := ical.Decode(strings.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if cal.Name != "VCALENDAR" {
+		return nil, fmt.Errorf("%w: expected a VCALENDAR, got %s", ical.ErrInvalid, cal.Name)
+	}
+
+	return ical.Events(cal, location)
+}
+
+// busyEvents holds the parsed events of busy calendars and time off. Every availability check
+// reads them, and parsing calendars of up to maxBusyCalendarSize each time would dominate it, so
+// they are parsed when saved, or when first read after the server starts.
+var busyEvents = &eventCache{entries: map[eventCacheKey]cachedEvents{}}
+
+// eventCache caches the events of the iCalendar data of busy calendars and time off, by their
+// resource and ID. Entries are checked against the data read, so that one saved by another
+// server, or left by a write that rolled back, is parsed again rather than used.
+type eventCache struct {
+	mu      sync.Mutex
+	entries map[eventCacheKey]cachedEvents
+}
+
+type eventCacheKey struct {
+	resource string
+	id       uint
+}
+
+type cachedEvents struct {
+	data   string
+	events []ical.Event
+}
+
+// events returns the events of data, that of the resource's row with the ID, parsing it unless
+// it is cached.
+func (c *eventCache) events(resource string, id uint, data string) ([]ical.Event, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[eventCacheKey{resource, id}]
+	c.mu.Unlock()
+	if ok && entry.data == data {
+		return entry.events, nil
+	}
+
+	events, err := parseBusyCalendar(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c.put(resource, id, data, events)
+	return events, nil
+}
+
+// put caches the events of a row's data.
+func (c *eventCache) put(resource string, id uint, data string, events []ical.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[eventCacheKey{resource, id}] = cachedEvents{data: data, events: events}
+}
+
+// forget drops a removed row's events.
+func (c *eventCache) forget(resource string, id uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, eventCacheKey{resource, id})
+}
+
+// busyCalendarHandler manages trainers' busy calendars, and fetches those with a source.
+type busyCalendarHandler struct {
+	store  store.Store
+	logger *log.Logger
+	clock  clock.Clock
+	config BusyCalendarsConfig
+	client *http.Client
+}
+
+func newBusyCalendarHandler(s store.Store, logger *log.Logger, clock clock.Clock, config BusyCalendarsConfig) *busyCalendarHandler {
+	bh := &busyCalendarHandler{
+		store:  s,
+		logger: logger,
+		clock:  clock,
+		config: config.withDefaults(),
+	}
+
+	// Destinations are checked as they are dialed, so that redirects and DNS answers can't lead
+	// elsewhere. Proxies are left out, as their address would be checked instead.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: busyCalendarFetchTimeout, Control: bh.checkDestination}).DialContext
+	bh.client = &http.Client{Timeout: busyCalendarFetchTimeout, Transport: transport}
+
+	return bh
+}
+
+// errPrivateSource is the error dialing a source at an address that isn't allowed.
+var errPrivateSource = errors.New("source address isn't allowed")
+
+// checkDestination rejects connections to loopback, private, link-local and unspecified
+// addresses, unless the config allows private sources.
+func (bh *busyCalendarHandler) checkDestination(network, address string, _ syscall.RawConn) error {
+	if bh.config.AllowPrivateSources {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return errPrivateSource
+	}
+
+	return nil
+}
+
+// list returns the trainer's busy calendars, without their data.
+func (bh *busyCalendarHandler) list(w http.ResponseWriter, r *http.Request) {
+	trainerID, ok := bh.trainer(w, r, actionRead)
+	if !ok {
+		return
+	}
+
+	var cals []models.BusyCalendar
+	filter := store.Filter{{Column: trainerIDParam, Op: "=", Value: idString(trainerID)}}
+	if err := bh.store.BusyCalendars().List(filter, &cals); err != nil {
+		bh.logger.Printf("Error listing busy calendars: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]busyCalendarResponse, len(cals))
+	for i := range cals {
+		resp[i] = newBusyCalendarResponse(&cals[i])
+	}
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		bh.logger.Printf("Error encoding response: %v", err)
+	}
+}
+
+// create adds a busy calendar to the trainer. The body is either JSON naming the calendar and
+// giving its source or data, or the iCalendar data itself, named by the name query parameter.
+// Calendars with a source are fetched right away, and must be readable to be added.
+func (bh *busyCalendarHandler) create(w http.ResponseWriter, r *http.Request) {
+	trainerID, ok := bh.trainer(w, r, actionCreate)
+	if !ok {
+		return
+	}
+
+	req, err := bh.decodeRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	cal := &models.BusyCalendar{TrainerID: trainerID, Name: req.Name, Source: req.Source, Data: req.ICS}
+	if cal.Source != "" {
+		if cal.Data, err = bh.fetch(r.Context(), cal.Source); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		now := bh.clock.Now()
+		cal.FetchedAt = &now
+	}
+
+	events, err := parseBusyCalendar(cal.Data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = bh.store.Transaction(func(tx store.Store) error {
+		if err := tx.BusyCalendars().Create(cal); err != nil {
+			return err
+		}
+
+		return recordAudit(tx, r, auditCreate, busyCalendarsResource, cal.ID, nil, cal)
+	})
+	if err != nil {
+		bh.logger.Printf("Error creating busy calendar: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	busyEvents.put(busyCalendarsResource, cal.ID, cal.Data, events)
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(newBusyCalendarResponse(cal)); err != nil {
+		bh.logger.Printf("Error encoding response: %v", err)
+	}
+}
+
+// decodeRequest reads a create request, checking that it has exactly one of a source or data.
+func (bh *busyCalendarHandler) decodeRequest(r *http.Request) (*busyCalendarRequest, error) {
+	body := io.LimitReader(r.Body, maxBusyCalendarSize+1)
+
+	var req busyCalendarRequest
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/calendar" {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+
+		req = busyCalendarRequest{Name: r.URL.Query().Get(busyCalendarNameParam), ICS: string(data)}
+	} else if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	if err := validator.New().Struct(req); err != nil {
+		return nil, err
+	}
+
+	if (req.Source == "") == (req.ICS == "") {
+		return nil, errors.New("exactly one of source and ics is required")
+	}
+
+	if len(req.ICS) > maxBusyCalendarSize {
+		return nil, fmt.Errorf("calendar is larger than %d bytes", maxBusyCalendarSize)
+	}
+
+	return &req, nil
+}
+
+// refresh fetches a calendar from its source again.
+func (bh *busyCalendarHandler) refresh(w http.ResponseWriter, r *http.Request) {
+	cal, ok := bh.calendar(w, r, actionUpdate)
+	if !ok {
+		return
+	}
+
+	if cal.Source == "" {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("calendar was uploaded and has no source"))
+		return
+	}
+
+	before := *cal
+	bh.fetchInto(r.Context(), cal)
+	err := bh.store.Transaction(func(tx store.Store) error {
+		if err := tx.BusyCalendars().Save(cal); err != nil {
+			return err
+		}
+
+		return recordAudit(tx, r, auditUpdate, busyCalendarsResource, cal.ID, &before, cal)
+	})
+	if err != nil {
+		bh.logger.Printf("Error saving busy calendar: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(newBusyCalendarResponse(cal)); err != nil {
+		bh.logger.Printf("Error encoding response: %v", err)
+	}
+}
+
+// delete removes a busy calendar, so that its events no longer keep the trainer busy.
+func (bh *busyCalendarHandler) delete(w http.ResponseWriter, r *http.Request) {
+	cal, ok := bh.calendar(w, r, actionDelete)
+	if !ok {
+		return
+	}
+
+	err := bh.store.Transaction(func(tx store.Store) error {
+		if err := tx.BusyCalendars().Delete(cal.ID); err != nil {
+			return err
+		}
+
+		deleted := *cal
+		deleted.DeletedAt = gorm.DeletedAt{Time: bh.clock.Now(), Valid: true}
+		return recordAudit(tx, r, auditDelete, busyCalendarsResource, cal.ID, cal, &deleted)
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		bh.logger.Printf("Error deleting busy calendar: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	busyEvents.forget(busyCalendarsResource, cal.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trainer returns the ID of the request's trainer, if they exist and the request's principal
+// may take the action on their busy calendars. Otherwise it writes the error response.
+func (bh *busyCalendarHandler) trainer(w http.ResponseWriter, r *http.Request, a action) (uint, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)[trainerIDParam], 10, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, false
+	}
+
+	if _, err := trainerName(bh.store, uint(id), false); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return 0, false
+		}
+
+		bh.logger.Printf("Error loading trainer: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return 0, false
+	}
+
+	if !busyCalendarPolicy.allows(auth.FromContext(r.Context()), a, &models.BusyCalendar{TrainerID: uint(id)}) {
+		w.WriteHeader(http.StatusForbidden)
+		return 0, false
+	}
+
+	return uint(id), true
+}
+
+// calendar returns the request's busy calendar, if it belongs to the request's trainer and the
+// request's principal may take the action on it. Otherwise it writes the error response.
+func (bh *busyCalendarHandler) calendar(w http.ResponseWriter, r *http.Request, a action) (*models.BusyCalendar, bool) {
+	trainerID, ok := bh.trainer(w, r, a)
+	if !ok {
+		return nil, false
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)[idParam], 10, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	cal, err := bh.store.BusyCalendars().Get(uint(id))
+	if err != nil || cal.TrainerID != trainerID {
+		if err == nil || errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return nil, false
+		}
+
+		bh.logger.Printf("Error loading busy calendar: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return cal, true
+}
+
+// refreshAll fetches the calendars with a source again every period until ctx is done.
+func (bh *busyCalendarHandler) refreshAll(ctx context.Context, period time.Duration) {
+	ticker := bh.clock.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			var cals []models.BusyCalendar
+			if err := bh.store.BusyCalendars().List(nil, &cals); err != nil {
+				bh.logger.Printf("Error listing busy calendars: %v", err)
+				continue
+			}
+
+			for i := range cals {
+				if cals[i].Source == "" {
+					continue
+				}
+
+				bh.fetchInto(ctx, &cals[i])
+				if err := bh.store.BusyCalendars().Save(&cals[i]); err != nil {
+					bh.logger.Printf("Error saving busy calendar %d: %v", cals[i].ID, err)
+				}
+			}
+		}
+	}
+}
+
+// fetchInto fetches cal's data from its source. If that fails, the error is recorded and the
+// data fetched last is kept, so that a source being down doesn't free the trainer.
+func (bh *busyCalendarHandler) fetchInto(ctx context.Context, cal *models.BusyCalendar) {
+	data, err := bh.fetch(ctx, cal.Source)
+	var events []ical.Event
+	if err == nil {
+		events, err = parseBusyCalendar(data)
+	}
+
+	if err != nil {
+		bh.logger.Printf("Error fetching busy calendar %d: %v", cal.ID, err)
+		cal.Error = err.Error()
+		return
+	}
+
+	busyEvents.put(busyCalendarsResource, cal.ID, data, events)
+	now := bh.clock.Now()
+	cal.Data, cal.FetchedAt, cal.Error = data, &now, ""
+}
+
+// fetch returns the iCalendar data at source, an http or https URL, or a path relative to the
+// configured directory. Why a source couldn't be read is logged rather than returned, as it can
+// describe the network or files around the server.
+func (bh *busyCalendarHandler) fetch(ctx context.Context, source string) (string, error) {
+	var body io.ReadCloser
+	if u, err := url.Parse(source); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return "", err
+		}
+
+		resp, err := bh.client.Do(req)
+		if err != nil {
+			bh.logger.Printf("Error fetching calendar %s: %v", source, err)
+			return "", errFetchCalendar
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			bh.logger.Printf("Error fetching calendar %s: %s", source, resp.Status)
+			return "", errFetchCalendar
+		}
+
+		body = resp.Body
+	} else {
+		path, err := bh.localPath(source)
+		if err != nil {
+			return "", err
+		}
+
+		if body, err = os.Open(path); err != nil {
+			bh.logger.Printf("Error reading calendar %s: %v", source, err)
+			return "", errFetchCalendar
+		}
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, maxBusyCalendarSize+1))
+	if err != nil {
+		bh.logger.Printf("Error reading calendar %s: %v", source, err)
+		return "", errFetchCalendar
+	}
+
+	if len(data) > maxBusyCalendarSize {
+		return "", fmt.Errorf("calendar is larger than %d bytes", maxBusyCalendarSize)
+	}
+
+	return string(data), nil
+}
+
+// errFetchCalendar is the error a source that couldn't be read gives.
+var errFetchCalendar = errors.New("calendar couldn't be read from its source")
+
+// localPath returns the path of a file source within the configured directory, rejecting
+// sources that would leave it.
+func (bh *busyCalendarHandler) localPath(source string) (string, error) {
+	if bh.config.Dir == "" {
+		return "", errors.New("source must be an http or https URL")
+	}
+
+	clean := filepath.Clean(filepath.FromSlash(source))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.New("source must be a URL or a path within the calendar directory")
+	}
+
+	return filepath.Join(bh.config.Dir, clean), nil
+}
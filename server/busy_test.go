@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/models"
+)
+
+// busyICS returns a calendar with the given events, each a DTSTART, DTEND and any other lines.
+func busyICS(events ...[]string) string {
+	lines := []string{"BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:-//Other gym//EN"}
+	for i, e := range events {
+		lines = append(lines, "BEGIN:VEVENT", "UID:event-"+string(rune('a'+i)))
+		lines = append(lines, e...)
+		lines = append(lines, "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func TestBusyCalendars(t *testing.T) {
+	forEachStorage(t, testBusyCalendars)
+}
+
+func testBusyCalendars(t *testing.T, s *Server) {
+	seed(t, s)
+
+	// A class at 9:00 every Thursday, from January 2.
+	weekly := busyICS([]string{
+		"DTSTART;TZID=America/Los_Angeles:20200102T090000", "DTEND;TZID=America/Los_Angeles:20200102T100000",
+		"RRULE:FREQ=WEEKLY",
+	})
+	// A session at 11:00 on January 2.
+	once := busyICS([]string{"DTSTART:20200102T190000Z", "DTEND:20200102T200000Z"})
+
+	var failing int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = w.Write([]byte(once))
+	}))
+	defer source.Close()
+
+	dir := t.TempDir()
+	s.busyCalendars.config.Dir = dir
+	// The source is served on loopback.
+	s.busyCalendars.config.AllowPrivateSources = true
+	if err := os.WriteFile(filepath.Join(dir, "gym.ics"), []byte(busyICS()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	trainer1 := "Bearer " + testToken(s, auth.Claims{"sub": "t1", "role": auth.RoleTrainer, "trainer_id": float64(1)})
+	trainer2 := "Bearer " + testToken(s, auth.Claims{"sub": "t2", "role": auth.RoleTrainer, "trainer_id": float64(2)})
+	client := "Bearer " + testToken(s, auth.Claims{"sub": "client", "role": auth.RoleClient, "user_id": float64(1)})
+
+	const path = "/v1/trainers/1/busy-calendars"
+	steps := []struct {
+		method, path, body string
+		header             []string
+		e                  int
+	}{
+		{"POST", path + "?name=Other+gym", weekly, []string{"Content-Type", "text/calendar"}, http.StatusCreated},
+		{"POST", path, `{"name":"Sessions","source":"` + source.URL + `/"}`, []string{authorizationHeader, trainer1}, http.StatusCreated},
+		{"POST", path, `{"name":"File","source":"gym.ics"}`, nil, http.StatusCreated},
+
+		// The trainer is busy then, even with no appointments.
+		{"POST", "/v1/appointments", apptBody("1"), nil, http.StatusConflict},
+		{"POST", "/v1/appointments", apptBody("2"), nil, http.StatusOK},
+
+		{"POST", path, `{"name":"Invalid","ics":"BEGIN:VCALENDAR"}`, nil, http.StatusBadRequest},
+		{"POST", path, `{"name":"Unsupported","ics":"` + strings.ReplaceAll(busyICS([]string{"DTSTART:20200102T190000Z", "RRULE:FREQ=HOURLY"}), "\r\n", `\r\n`) + `"}`, nil, http.StatusBadRequest},
+		{"POST", path, `{"name":"Neither"}`, nil, http.StatusBadRequest},
+		{"POST", path, `{"name":"Both","source":"gym.ics","ics":"BEGIN:VCALENDAR"}`, nil, http.StatusBadRequest},
+		{"POST", path, `{"source":"gym.ics"}`, nil, http.StatusBadRequest},
+		{"POST", path, `{"name":"Outside","source":"../gym.ics"}`, nil, http.StatusBadRequest},
+		{"POST", path, `{"name":"Missing","source":"missing.ics"}`, nil, http.StatusBadRequest},
+		{"POST", path, `{"name":"Down","source":"` + source.URL + `/404"}`, nil, http.StatusBadRequest},
+
+		{"POST", "/v1/trainers/9/busy-calendars", `{"name":"File","source":"gym.ics"}`, nil, http.StatusNotFound},
+		{"POST", path, `{"name":"File","source":"gym.ics"}`, []string{authorizationHeader, trainer2}, http.StatusForbidden},
+		{"GET", path, "", []string{authorizationHeader, trainer2}, http.StatusForbidden},
+		{"GET", path, "", []string{authorizationHeader, client}, http.StatusForbidden},
+		{"DELETE", "/v1/trainers/2/busy-calendars/3", "", nil, http.StatusNotFound},
+		{"POST", path + "/1/refresh", "", nil, http.StatusConflict},
+	}
+
+	for _, step := range steps {
+		if w := do(s, step.method, step.path, step.body, step.header...); w.Code != step.e {
+			t.Fatalf("%s %s %s: Expected %d, got %d: %s", step.method, step.path, step.body, step.e, w.Code, w.Body)
+		}
+	}
+
+	testCases := []struct {
+		date string
+		busy []string
+	}{
+		{"2020-01-02", []string{"09:00", "09:30", "11:00", "11:30"}},
+		{"2020-01-09", []string{"09:00", "09:30"}},
+		{"2020-01-10", nil},
+	}
+
+	for _, tc := range testCases {
+		available := availableTimes(t, s, tc.date)
+		for _, busy := range tc.busy {
+			if available[busy] {
+				t.Errorf("%s: Expected %s to be busy, got %v", tc.date, busy, available)
+			}
+		}
+
+		if len(available) != 18-len(tc.busy) {
+			t.Errorf("%s: Expected %d available slots, got %v", tc.date, 18-len(tc.busy), available)
+		}
+	}
+
+	// A source that can't be fetched keeps the data fetched last.
+	atomic.StoreInt32(&failing, 1)
+	w := do(s, "POST", path+"/2/refresh", "", authorizationHeader, trainer1)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"error":"`+errFetchCalendar.Error()+`"`) {
+		t.Errorf("Expected the fetch error, got %d: %s", w.Code, w.Body)
+	}
+	if availableTimes(t, s, "2020-01-02")["11:00"] {
+		t.Errorf("Expected 11:00 to stay busy")
+	}
+
+	w = do(s, "GET", path, "", authorizationHeader, trainer1)
+	var cals []busyCalendarResponse
+	if err := json.NewDecoder(w.Body).Decode(&cals); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, len(cals))
+	for i, cal := range cals {
+		names[i] = cal.Name
+	}
+	if !equalStrings(names, []string{"Other gym", "Sessions", "File"}) {
+		t.Errorf("Expected the trainer's calendars, got %v", names)
+	}
+	if cals[0].FetchedAt != nil || cals[1].FetchedAt == nil || cals[1].Error == "" {
+		t.Errorf("Expected only the calendars with a source to be fetched, got %+v", cals)
+	}
+
+	// Removing a calendar frees the trainer.
+	if w := do(s, "DELETE", path+"/1", "", authorizationHeader, trainer1); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if w := do(s, "POST", "/v1/appointments", apptBody("1")); w.Code != http.StatusOK {
+		t.Errorf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	// Calendars are audited without their data.
+	entries := listAudit(t, s, "/v1/audit?resource=busy-calendars")
+	if len(entries) == 0 || strings.Contains(string(entries[0].Changes), `"data"`) {
+		t.Errorf("Expected busy calendar entries without data, got %+v", entries)
+	}
+}
+
+func TestPurgeTrainerCalendars(t *testing.T) {
+	forEachStorage(t, testPurgeTrainerCalendars)
+}
+
+// testPurgeTrainerCalendars purges a trainer with a busy calendar and time off, which go with
+// them.
+func testPurgeTrainerCalendars(t *testing.T, s *Server) {
+	seed(t, s)
+
+	for _, trainerID := range []uint{1, 2} {
+		path := "/v1/trainers/" + idString(trainerID) + "/busy-calendars?name=Other+gym"
+		if w := do(s, "POST", path, busyICS(), "Content-Type", "text/calendar"); w.Code != http.StatusCreated {
+			t.Fatalf("Expected %d, got %d: %s", http.StatusCreated, w.Code, w.Body)
+		}
+
+		timeOff := &models.TimeOff{TrainerID: trainerID, Name: "vacation.ics", UID: "vacation", Data: busyICS()}
+		if err := s.store.TimeOff().Create(timeOff); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		method, path, body string
+		header             []string
+	}{
+		{"DELETE", "/v1/trainers/2", "", []string{"If-Match", `"1"`}},
+		{"POST", "/v1/admin/purge", `{"resource":"trainers","deleted_before":"2020-01-02T00:00:00Z"}`, nil},
+	}
+	for _, step := range steps {
+		if w := do(s, step.method, step.path, step.body, step.header...); w.Code >= 300 {
+			t.Fatalf("%s %s: Expected success, got %d: %s", step.method, step.path, w.Code, w.Body)
+		}
+	}
+
+	var cals []models.BusyCalendar
+	if err := s.store.BusyCalendars().List(nil, &cals); err != nil {
+		t.Fatal(err)
+	}
+	if len(cals) != 1 || cals[0].TrainerID != 1 {
+		t.Errorf("Expected only trainer 1's busy calendar, got %+v", cals)
+	}
+
+	var timeOff []models.TimeOff
+	if err := s.store.TimeOff().List(nil, &timeOff); err != nil {
+		t.Fatal(err)
+	}
+	if len(timeOff) != 1 || timeOff[0].TrainerID != 1 {
+		t.Errorf("Expected only trainer 1's time off, got %+v", timeOff)
+	}
+}
+
+func TestEventCache(t *testing.T) {
+	c := &eventCache{entries: map[eventCacheKey]cachedEvents{}}
+	once := busyICS([]string{"DTSTART:20200102T190000Z", "DTEND:20200102T200000Z"})
+	twice := busyICS([]string{"DTSTART:20200102T190000Z", "DTEND:20200102T200000Z"}, []string{"DTSTART:20200103T190000Z", "DTEND:20200103T200000Z"})
+
+	first, err := c.events(busyCalendarsResource, 1, once)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same data isn't parsed again.
+	if again, err := c.events(busyCalendarsResource, 1, once); err != nil || &again[0] != &first[0] {
+		t.Errorf("Expected the cached events, got %v, %v", again, err)
+	}
+
+	// Changed data is, as is that of another resource with the ID.
+	if changed, err := c.events(busyCalendarsResource, 1, twice); err != nil || len(changed) != 2 {
+		t.Errorf("Expected 2 events, got %v, %v", changed, err)
+	}
+	if other, err := c.events(timeOffResource, 1, once); err != nil || &other[0] == &first[0] {
+		t.Errorf("Expected the time off's own events, got %v, %v", other, err)
+	}
+
+	if _, err := c.events(busyCalendarsResource, 2, "BEGIN:VCALENDAR"); err == nil {
+		t.Errorf("Expected an error for invalid data")
+	}
+
+	c.forget(busyCalendarsResource, 1)
+	if _, ok := c.entries[eventCacheKey{busyCalendarsResource, 1}]; ok {
+		t.Errorf("Expected the calendar's events to be forgotten")
+	}
+}
+
+func TestBusyCalendarSourceAddresses(t *testing.T) {
+	bh := newBusyCalendarHandler(nil, log.New(io.Discard, "", 0), nil, BusyCalendarsConfig{})
+
+	testCases := []struct {
+		address string
+		e       error
+	}{
+		{"93.184.216.34:443", nil},
+		{"[2606:2800:220:1::]:443", nil},
+		{"127.0.0.1:80", errPrivateSource},
+		{"[::1]:80", errPrivateSource},
+		{"10.0.0.1:80", errPrivateSource},
+		{"192.168.1.1:80", errPrivateSource},
+		{"[fd00::1]:80", errPrivateSource},
+		{"169.254.169.254:80", errPrivateSource},
+		{"[fe80::1]:80", errPrivateSource},
+		{"0.0.0.0:80", errPrivateSource},
+		{"[::ffff:127.0.0.1]:80", errPrivateSource},
+	}
+
+	for _, tc := range testCases {
+		if err := bh.checkDestination("tcp", tc.address, nil); err != tc.e {
+			t.Errorf("%s: Expected %v, got %v", tc.address, tc.e, err)
+		}
+	}
+
+	// Private sources aren't fetched, and the error doesn't say why.
+	var fetched int32
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		_, _ = w.Write([]byte(busyICS()))
+	}))
+	defer private.Close()
+
+	if _, err := bh.fetch(context.Background(), private.URL); err != errFetchCalendar {
+		t.Errorf("Expected %v, got %v", errFetchCalendar, err)
+	}
+	if fetched != 0 {
+		t.Errorf("Expected the private source not to be fetched, got %d requests", fetched)
+	}
+
+	bh.config.AllowPrivateSources = true
+	if _, err := bh.fetch(context.Background(), private.URL); err != nil {
+		t.Errorf("Expected private sources to be allowed, got %v", err)
+	}
+}
+
+// availableTimes returns the available slots of trainer 1 on the date, by their time of day.
+func availableTimes(t *testing.T, s *Server, date string) map[string]bool {
+	t.Helper()
+
+	w := do(s, "GET", "/v1/trainers/1/appointments/available?starts_at="+date+"&ends_at="+date, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var resp map[string][]string
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	available := map[string]bool{}
+	for _, slot := range resp["available"] {
+		available[slot[strings.IndexByte(slot, 'T')+1:][:5]] = true
+	}
+
+	return available
+}
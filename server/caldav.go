@@ -0,0 +1,911 @@
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/ical"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+const (
+	// caldavPrefix starts the paths of the CalDAV routes, whose clients authenticate with Basic
+	// credentials.
+	caldavPrefix      = "/v1/caldav/"
+	caldavPath        = "/caldav"
+	caldavObjectParam = "object"
+
+	davNamespace    = "DAV:"
+	caldavNamespace = "urn:ietf:params:xml:ns:caldav"
+
+	// apptObjectPrefix starts the names of the appointments' calendar objects, such as
+	// appointment-1.ics. Other names in a trainer's calendar are their time off.
+	apptObjectPrefix     = "appointment-"
+	calendarObjectSuffix = ".ics"
+
+	depthHeader    = "Depth"
+	xmlContentType = "application/xml; charset=utf-8"
+
+	methodPropfind = "PROPFIND"
+	methodReport   = "REPORT"
+	caldavMethods  = "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT"
+)
+
+// davElement is an element of a WebDAV response. Names in the DAV: and CalDAV namespaces are
+// written with the D: and C: prefixes the multistatus element declares.
+type davElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr   `xml:",any,attr"`
+	Text     string       `xml:",chardata"`
+	Children []davElement `xml:",any"`
+}
+
+func davNode(name string, children ...davElement) davElement {
+	return davElement{XMLName: xml.Name{Local: name}, Children: children}
+}
+
+func davText(name, text string) davElement {
+	return davElement{XMLName: xml.Name{Local: name}, Text: text}
+}
+
+// davProp returns an empty element for a property, prefixed if its namespace is known.
+func davProp(name xml.Name) davElement {
+	switch name.Space {
+	case davNamespace:
+		return davNode("D:" + name.Local)
+	case caldavNamespace:
+		return davNode("C:" + name.Local)
+	}
+
+	return davElement{XMLName: name}
+}
+
+// davProps is the D:prop element of a request, listing the properties it asks for.
+type davProps struct {
+	Props []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+func (p *davProps) names() []xml.Name {
+	names := make([]xml.Name, len(p.Props))
+	for i, prop := range p.Props {
+		names[i] = prop.XMLName
+	}
+
+	return names
+}
+
+type propfindRequest struct {
+	XMLName xml.Name  `xml:"DAV: propfind"`
+	AllProp *struct{} `xml:"DAV: allprop"`
+	Prop    *davProps `xml:"DAV: prop"`
+}
+
+type calendarQuery struct {
+	XMLName xml.Name  `xml:"urn:ietf:params:xml:ns:caldav calendar-query"`
+	AllProp *struct{} `xml:"DAV: allprop"`
+	Prop    *davProps `xml:"DAV: prop"`
+	Filter  struct {
+		CompFilter compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	} `xml:"urn:ietf:params:xml:ns:caldav filter"`
+}
+
+type calendarMultiget struct {
+	XMLName xml.Name  `xml:"urn:ietf:params:xml:ns:caldav calendar-multiget"`
+	AllProp *struct{} `xml:"DAV: allprop"`
+	Prop    *davProps `xml:"DAV: prop"`
+	Hrefs   []string  `xml:"DAV: href"`
+}
+
+// compFilter matches components by name, and nested components or a time range.
+type compFilter struct {
+	Name        string       `xml:"name,attr"`
+	TimeRange   *timeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	CompFilters []compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+// timeRange bounds a query by UTC date-times. Either bound may be left out.
+type timeRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+// period returns the range's bounds, with zero times for those left out.
+func (tr *timeRange) period() (ical.Period, error) {
+	var p ical.Period
+	var err error
+	if tr.Start != "" {
+		if p.Start, err = ical.ParseUTC(tr.Start); err != nil {
+			return p, err
+		}
+	}
+
+	if tr.End != "" {
+		if p.End, err = ical.ParseUTC(tr.End); err != nil {
+			return p, err
+		}
+	}
+
+	return p, nil
+}
+
+// caldavObject is a calendar object in a trainer's calendar: one of their appointments, or
+// time they have blocked off.
+type caldavObject struct {
+	name    string
+	version uint
+	data    string
+	// appt is set for appointments, and timeOff for time off.
+	appt    *models.Appt
+	timeOff *models.TimeOff
+}
+
+// overlaps reports whether the object's event takes up any time in the period, whose zero
+// bounds are open.
+func (o *caldavObject) overlaps(p ical.Period) (bool, error) {
+	if o.appt != nil {
+		return (p.End.IsZero() || o.appt.StartTime.Before(p.End)) &&
+			(p.Start.IsZero() || o.appt.EndTime.After(p.Start)), nil
+	}
+
+	if p.End.IsZero() {
+		// Recurring time off may never end.
+		return true, nil
+	}
+
+	events, err := busyEvents.events(timeOffResource, o.timeOff.ID, o.data)
+	if err != nil {
+		return false, err
+	}
+
+	return len(ical.Busy(events, p.Start, p.End)) > 0, nil
+}
+
+// caldavHandler serves a calendar for each trainer over CalDAV, so that they can see their
+// appointments and block off time from their calendar app. The calendar holds the trainer's
+// appointments, which staff may move or cancel like through the API, and their time off, which
+// the trainer may add, change and remove.
+type caldavHandler struct {
+	store  store.Store
+	logger *log.Logger
+	clock  clock.Clock
+	appts  *apptHandler
+}
+
+func newCaldavHandler(s store.Store, logger *log.Logger, clock clock.Clock) *caldavHandler {
+	return &caldavHandler{
+		store:  s,
+		logger: logger,
+		clock:  clock,
+		appts:  newApptHandler(s, logger, clock, dtoRepresentations.appt),
+	}
+}
+
+// ServeHTTP dispatches on the method, as the WebDAV methods can't be routed by name.
+func (ch *caldavHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	trainerID, trainer, ok := ch.trainer(w, r)
+	if !ok {
+		return
+	}
+
+	name := mux.Vars(r)[caldavObjectParam]
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("DAV", "1, 3, calendar-access")
+		w.Header().Set("Allow", caldavMethods)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == methodPropfind:
+		ch.propfind(w, r, trainerID, trainer, name)
+	case r.Method == methodReport && name == "":
+		ch.report(w, r, trainerID)
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && name != "":
+		ch.get(w, trainerID, name)
+	case r.Method == http.MethodPut && name != "":
+		ch.put(w, r, trainerID, name)
+	case r.Method == http.MethodDelete && name != "":
+		ch.delete(w, r, trainerID, name)
+	default:
+		w.Header().Set("Allow", caldavMethods)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// trainer returns the ID and name of the request's trainer, if they exist and the request's
+// principal may read their calendar. Otherwise it writes the error response.
+func (ch *caldavHandler) trainer(w http.ResponseWriter, r *http.Request) (uint, string, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)[trainerIDParam], 10, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, "", false
+	}
+
+	name, err := trainerName(ch.store, uint(id), false)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return 0, "", false
+		}
+
+		ch.logger.Printf("Error loading trainer: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return 0, "", false
+	}
+
+	if !timeOffPolicy.allows(auth.FromContext(r.Context()), actionRead, &models.TimeOff{TrainerID: uint(id)}) {
+		w.WriteHeader(http.StatusForbidden)
+		return 0, "", false
+	}
+
+	return uint(id), name, true
+}
+
+// propfind describes the trainer's calendar, and with a Depth of 1 the objects in it, or the
+// named object.
+func (ch *caldavHandler) propfind(w http.ResponseWriter, r *http.Request, trainerID uint, trainer, name string) {
+	var req propfindRequest
+	if err := decodeXML(r.Body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	var names []xml.Name
+	if req.Prop != nil && req.AllProp == nil {
+		names = req.Prop.names()
+	}
+
+	if name != "" {
+		obj, err := ch.object(trainerID, name)
+		if err != nil {
+			ch.writeObjectError(w, err)
+			return
+		}
+
+		ch.writeMultistatus(w, ch.objectResponse(trainerID, obj, names))
+		return
+	}
+
+	collection := collectionHref(trainerID)
+	responses := []davElement{propResponse(collection, names, allCollectionProps, func(prop xml.Name) (davElement, bool) {
+		return collectionProp(prop, trainer)
+	})}
+
+	if r.Header.Get(depthHeader) != "0" {
+		objs, err := ch.objects(trainerID)
+		if err != nil {
+			ch.logger.Printf("Error listing calendar objects: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		for i := range objs {
+			responses = append(responses, ch.objectResponse(trainerID, &objs[i], names))
+		}
+	}
+
+	ch.writeMultistatus(w, responses...)
+}
+
+// report answers a calendar-query, for the objects whose events fall in a time range, or a
+// calendar-multiget, for the objects at the given paths.
+func (ch *caldavHandler) report(w http.ResponseWriter, r *http.Request, trainerID uint) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBusyCalendarSize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var root struct{ XMLName xml.Name }
+	if err := xml.Unmarshal(body, &root); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	switch root.XMLName {
+	case xml.Name{Space: caldavNamespace, Local: "calendar-query"}:
+		var query calendarQuery
+		if err := xml.Unmarshal(body, &query); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		ch.query(w, trainerID, &query)
+	case xml.Name{Space: caldavNamespace, Local: "calendar-multiget"}:
+		var multiget calendarMultiget
+		if err := xml.Unmarshal(body, &multiget); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		ch.multiget(w, trainerID, &multiget)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("unsupported report " + root.XMLName.Local))
+	}
+}
+
+// query returns the objects matching a calendar-query's filter. The calendar only holds events,
+// so the filter must be for VCALENDAR components, and can narrow them by a VEVENT's time range.
+func (ch *caldavHandler) query(w http.ResponseWriter, trainerID uint, query *calendarQuery) {
+	filter := query.Filter.CompFilter
+	if filter.Name != "VCALENDAR" || len(filter.CompFilters) > 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("expected a VCALENDAR filter, with at most one nested filter"))
+		return
+	}
+
+	var period ical.Period
+	if len(filter.CompFilters) == 1 {
+		event := filter.CompFilters[0]
+		if event.Name != "VEVENT" {
+			// Nothing but events are stored.
+			ch.writeMultistatus(w)
+			return
+		}
+
+		if event.TimeRange != nil {
+			var err error
+			if period, err = event.TimeRange.period(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+		}
+	}
+
+	objs, err := ch.objects(trainerID)
+	if err != nil {
+		ch.logger.Printf("Error listing calendar objects: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var names []xml.Name
+	if query.Prop != nil && query.AllProp == nil {
+		names = query.Prop.names()
+	}
+
+	var responses []davElement
+	for i := range objs {
+		overlaps, err := objs[i].overlaps(period)
+		if err != nil {
+			ch.logger.Printf("Error reading calendar object %s: %v", objs[i].name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if overlaps {
+			responses = append(responses, ch.objectResponse(trainerID, &objs[i], names))
+		}
+	}
+
+	ch.writeMultistatus(w, responses...)
+}
+
+// multiget returns the objects at the paths of a calendar-multiget, and 404 for those that
+// aren't in the calendar.
+func (ch *caldavHandler) multiget(w http.ResponseWriter, trainerID uint, multiget *calendarMultiget) {
+	var names []xml.Name
+	if multiget.Prop != nil && multiget.AllProp == nil {
+		names = multiget.Prop.names()
+	}
+
+	collection := collectionHref(trainerID)
+	var responses []davElement
+	for _, href := range multiget.Hrefs {
+		href = strings.TrimSpace(href)
+		if u, err := url.Parse(href); err == nil {
+			href = u.Path
+		}
+
+		var obj *caldavObject
+		name := strings.TrimPrefix(href, collection)
+		err := store.ErrNotFound
+		if name != href && !strings.Contains(name, "/") {
+			obj, err = ch.object(trainerID, name)
+		}
+
+		if err != nil {
+			if !errors.Is(err, store.ErrNotFound) {
+				ch.logger.Printf("Error loading calendar object: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			responses = append(responses, davNode("D:response",
+				davText("D:href", href),
+				davText("D:status", davStatus(http.StatusNotFound)),
+			))
+			continue
+		}
+
+		responses = append(responses, ch.objectResponse(trainerID, obj, names))
+	}
+
+	ch.writeMultistatus(w, responses...)
+}
+
+// get returns the iCalendar data of an object.
+func (ch *caldavHandler) get(w http.ResponseWriter, trainerID uint, name string) {
+	obj, err := ch.object(trainerID, name)
+	if err != nil {
+		ch.writeObjectError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", calendarContentType)
+	w.Header().Set(etagHeader, etag(obj.version))
+	_, _ = w.Write([]byte(obj.data))
+}
+
+// put moves an appointment to the time of its event, or adds or changes time off. Appointments
+// are only booked through the API, so an appointment's object must already exist.
+func (ch *caldavHandler) put(w http.ResponseWriter, r *http.Request, trainerID uint, name string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBusyCalendarSize+1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(body) > maxBusyCalendarSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if strings.HasPrefix(name, apptObjectPrefix) {
+		ch.putAppt(w, r, trainerID, name, string(body))
+		return
+	}
+
+	uid, summary, events, err := parseTimeOff(string(body))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	existing, err := ch.store.TimeOff().Get(trainerID, name)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		ch.logger.Printf("Error loading time off: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	a := actionCreate
+	if existing != nil {
+		a = actionUpdate
+	}
+
+	timeOff := &models.TimeOff{TrainerID: trainerID, Name: name, UID: uid, Summary: summary, Data: string(body)}
+	if !timeOffPolicy.allows(auth.FromContext(r.Context()), a, timeOff) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !objectPreconditions(r, existing != nil, func() uint { return existing.Version }) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	err = ch.store.Transaction(func(tx store.Store) error {
+		if existing == nil {
+			if err := tx.TimeOff().Create(timeOff); err != nil {
+				return err
+			}
+
+			return recordAudit(tx, r, auditCreate, timeOffResource, timeOff.ID, nil, timeOff)
+		}
+
+		timeOff.ID = existing.ID
+		if err := tx.TimeOff().Update(timeOff, existing.Version); err != nil {
+			return err
+		}
+
+		return recordAudit(tx, r, auditUpdate, timeOffResource, timeOff.ID, existing, timeOff)
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrDuplicate) || errors.Is(err, store.ErrConflict) {
+			// Another request wrote the object after it was loaded.
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		ch.logger.Printf("Error saving time off: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	busyEvents.put(timeOffResource, timeOff.ID, timeOff.Data, events)
+
+	w.Header().Set(etagHeader, etag(timeOff.Version))
+	if existing == nil {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// putAppt moves an appointment to the time of the event in data, which must be the
+// appointment's and not recur. It is saved like an update through the API.
+func (ch *caldavHandler) putAppt(w http.ResponseWriter, r *http.Request, trainerID uint, name, data string) {
+	obj, err := ch.object(trainerID, name)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte("appointments are booked through the API"))
+			return
+		}
+
+		ch.writeObjectError(w, err)
+		return
+	}
+
+	if !objectPreconditions(r, true, func() uint { return obj.version }) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	events, err := parseBusyCalendar(data)
+	if err == nil && (len(events) != 1 || events[0].UID != apptUID(obj.appt.ID)) {
+		err = errors.New("expected the appointment's event")
+	}
+
+	if err == nil && (events[0].Rule != nil || len(events[0].RDates) > 0 || events[0].AllDay) {
+		err = errors.New("appointments can't recur or last all day")
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	appt := *obj.appt
+	appt.StartTime = events[0].Start.In(location)
+	appt.EndTime = events[0].End.In(location)
+	saved, ok := ch.appts.saveAppt(w, r, appt, *obj.appt)
+	if !ok {
+		return
+	}
+
+	w.Header().Set(etagHeader, etag(saved.Version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// delete cancels an appointment like a delete through the API, or removes time off.
+func (ch *caldavHandler) delete(w http.ResponseWriter, r *http.Request, trainerID uint, name string) {
+	obj, err := ch.object(trainerID, name)
+	if err != nil {
+		ch.writeObjectError(w, err)
+		return
+	}
+
+	p := auth.FromContext(r.Context())
+	if obj.appt != nil && !ch.appts.allows(r, actionDelete, obj.appt) ||
+		obj.timeOff != nil && !timeOffPolicy.allows(p, actionDelete, obj.timeOff) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !objectPreconditions(r, true, func() uint { return obj.version }) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	err = ch.store.Transaction(func(tx store.Store) error {
+		if obj.appt != nil {
+			return ch.appts.deleteModel(tx, r, obj.appt)
+		}
+
+		if err := tx.TimeOff().Delete(obj.timeOff.ID); err != nil {
+			return err
+		}
+
+		return recordAudit(tx, r, auditDelete, timeOffResource, obj.timeOff.ID, obj.timeOff, nil)
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrConflict) || errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		ch.logger.Printf("Error deleting calendar object: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if obj.timeOff != nil {
+		busyEvents.forget(timeOffResource, obj.timeOff.ID)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// objectPreconditions reports whether the request's If-Match and If-None-Match headers hold for
+// an object, which exists at the version if exists. Unlike the API, CalDAV doesn't require
+// If-Match, as calendar apps only send it when they have the object.
+func objectPreconditions(r *http.Request, exists bool, version func() uint) bool {
+	if header := r.Header.Get(ifMatchHeader); header != "" && (!exists || !matchesStrongETag(header, etag(version()))) {
+		return false
+	}
+
+	header := r.Header.Get(ifNoneMatchHeader)
+	return header == "" || !exists || !matchesWeakETag(header, etag(version()))
+}
+
+// parseTimeOff checks that data is a calendar of one event, with any overrides of its
+// occurrences, and returns the event's UID and summary, and the events.
+func parseTimeOff(data string) (string, string, []ical.Event, error) {
+	events, err := parseBusyCalendar(data)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	cal, err := ical.Decode(strings.NewReader(data))
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	var uid, summary string
+	for _, c := range cal.Components {
+		if c.Name != "VEVENT" {
+			continue
+		}
+
+		p := c.Get("UID")
+		if p == nil || p.Value == "" || uid != "" && p.Value != uid {
+			return "", "", nil, fmt.Errorf("%w: expected events with the same UID", ical.ErrInvalid)
+		}
+
+		uid = p.Value
+		if s := c.Get("SUMMARY"); s != nil && c.Get("RECURRENCE-ID") == nil {
+			summary = ical.UnescapeText(s.Value)
+		}
+	}
+
+	if uid == "" {
+		return "", "", nil, fmt.Errorf("%w: expected an event", ical.ErrInvalid)
+	}
+
+	return uid, summary, events, nil
+}
+
+// objects returns the objects in the trainer's calendar: their appointments, then their time off.
+func (ch *caldavHandler) objects(trainerID uint) ([]caldavObject, error) {
+	filter := store.Filter{{Column: trainerIDParam, Op: "=", Value: idString(trainerID)}}
+
+	var appts []models.Appt
+	if err := ch.store.Appts().List(filter, &appts); err != nil {
+		return nil, err
+	}
+
+	var timeOff []models.TimeOff
+	if err := ch.store.TimeOff().List(filter, &timeOff); err != nil {
+		return nil, err
+	}
+
+	objs := make([]caldavObject, 0, len(appts)+len(timeOff))
+	for i := range appts {
+		obj, err := ch.apptObject(&appts[i])
+		if err != nil {
+			return nil, err
+		}
+
+		objs = append(objs, obj)
+	}
+
+	for i := range timeOff {
+		objs = append(objs, timeOffObject(&timeOff[i]))
+	}
+
+	return objs, nil
+}
+
+// object returns the named object in the trainer's calendar, or store.ErrNotFound.
+func (ch *caldavHandler) object(trainerID uint, name string) (*caldavObject, error) {
+	if strings.HasPrefix(name, apptObjectPrefix) {
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, apptObjectPrefix), calendarObjectSuffix), 10, 0)
+		if err != nil || name != apptObjectName(uint(id)) {
+			return nil, store.ErrNotFound
+		}
+
+		var appt models.Appt
+		if err := ch.store.Appts().Get(uint(id), &appt); err != nil {
+			return nil, err
+		}
+
+		if appt.TrainerID != trainerID {
+			return nil, store.ErrNotFound
+		}
+
+		obj, err := ch.apptObject(&appt)
+		return &obj, err
+	}
+
+	timeOff, err := ch.store.TimeOff().Get(trainerID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := timeOffObject(timeOff)
+	return &obj, nil
+}
+
+// apptObject returns an appointment's object, a calendar of its event.
+func (ch *caldavHandler) apptObject(appt *models.Appt) (caldavObject, error) {
+	user, err := userName(ch.store, appt.UserID, true)
+	if err != nil {
+		return caldavObject{}, err
+	}
+
+	cal := ical.NewCalendar(calendarProdID)
+	cal.Components = append(cal.Components,
+		ical.Timezone(location, appt.StartTime.In(location).Year()),
+		apptEvent(*appt, "Appointment with "+user),
+	)
+
+	var data strings.Builder
+	if err := cal.Encode(&data); err != nil {
+		return caldavObject{}, err
+	}
+
+	return caldavObject{name: apptObjectName(appt.ID), version: appt.Version, data: data.String(), appt: appt}, nil
+}
+
+func timeOffObject(t *models.TimeOff) caldavObject {
+	return caldavObject{name: t.Name, version: t.Version, data: t.Data, timeOff: t}
+}
+
+func apptObjectName(id uint) string {
+	return fmt.Sprintf("%s%d%s", apptObjectPrefix, id, calendarObjectSuffix)
+}
+
+// collectionHref returns the path of the trainer's calendar.
+func collectionHref(trainerID uint) string {
+	return fmt.Sprintf("%strainers/%d/", caldavPrefix, trainerID)
+}
+
+var (
+	allCollectionProps = []xml.Name{
+		{Space: davNamespace, Local: "resourcetype"},
+		{Space: davNamespace, Local: "displayname"},
+		{Space: caldavNamespace, Local: "supported-calendar-component-set"},
+	}
+
+	// allObjectProps leaves out calendar-data, which is only returned when asked for.
+	allObjectProps = []xml.Name{
+		{Space: davNamespace, Local: "resourcetype"},
+		{Space: davNamespace, Local: "getetag"},
+		{Space: davNamespace, Local: "getcontenttype"},
+	}
+)
+
+// collectionProp returns the value of a property of a trainer's calendar, and whether it has it.
+func collectionProp(name xml.Name, trainer string) (davElement, bool) {
+	prop := davProp(name)
+	switch name {
+	case xml.Name{Space: davNamespace, Local: "resourcetype"}:
+		prop.Children = []davElement{davNode("D:collection"), davNode("C:calendar")}
+	case xml.Name{Space: davNamespace, Local: "displayname"}:
+		prop.Text = trainer + "'s appointments"
+	case xml.Name{Space: caldavNamespace, Local: "supported-calendar-component-set"}:
+		comp := davNode("C:comp")
+		comp.Attrs = []xml.Attr{{Name: xml.Name{Local: "name"}, Value: "VEVENT"}}
+		prop.Children = []davElement{comp}
+	default:
+		return prop, false
+	}
+
+	return prop, true
+}
+
+// objectProp returns the value of a property of an object, and whether it has it.
+func objectProp(name xml.Name, obj *caldavObject) (davElement, bool) {
+	prop := davProp(name)
+	switch name {
+	case xml.Name{Space: davNamespace, Local: "resourcetype"}:
+	case xml.Name{Space: davNamespace, Local: "getetag"}:
+		prop.Text = etag(obj.version)
+	case xml.Name{Space: davNamespace, Local: "getcontenttype"}:
+		prop.Text = calendarContentType
+	case xml.Name{Space: caldavNamespace, Local: "calendar-data"}:
+		prop.Text = obj.data
+	default:
+		return prop, false
+	}
+
+	return prop, true
+}
+
+func (ch *caldavHandler) objectResponse(trainerID uint, obj *caldavObject, names []xml.Name) davElement {
+	href := collectionHref(trainerID) + url.PathEscape(obj.name)
+	return propResponse(href, names, allObjectProps, func(name xml.Name) (davElement, bool) {
+		return objectProp(name, obj)
+	})
+}
+
+// propResponse returns the response for a resource, with the properties it has and a 404 for
+// those it doesn't. Without names, it has all the resource's properties.
+func propResponse(href string, names, all []xml.Name, prop func(xml.Name) (davElement, bool)) davElement {
+	if names == nil {
+		names = all
+	}
+
+	found, missing := davNode("D:prop"), davNode("D:prop")
+	for _, name := range names {
+		if value, ok := prop(name); ok {
+			found.Children = append(found.Children, value)
+		} else {
+			missing.Children = append(missing.Children, value)
+		}
+	}
+
+	resp := davNode("D:response", davText("D:href", href))
+	if len(found.Children) > 0 {
+		resp.Children = append(resp.Children, davNode("D:propstat", found, davText("D:status", davStatus(http.StatusOK))))
+	}
+
+	if len(missing.Children) > 0 {
+		resp.Children = append(resp.Children, davNode("D:propstat", missing, davText("D:status", davStatus(http.StatusNotFound))))
+	}
+
+	return resp
+}
+
+func davStatus(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+// writeMultistatus writes a 207 response with the responses.
+func (ch *caldavHandler) writeMultistatus(w http.ResponseWriter, responses ...davElement) {
+	multistatus := davNode("D:multistatus", responses...)
+	multistatus.Attrs = []xml.Attr{
+		{Name: xml.Name{Local: "xmlns:D"}, Value: davNamespace},
+		{Name: xml.Name{Local: "xmlns:C"}, Value: caldavNamespace},
+	}
+
+	w.Header().Set("Content-Type", xmlContentType)
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(multistatus); err != nil {
+		ch.logger.Printf("Error encoding multistatus: %v", err)
+	}
+}
+
+// writeObjectError responds to an error loading an object.
+func (ch *caldavHandler) writeObjectError(w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ch.logger.Printf("Error loading calendar object: %v", err)
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+// decodeXML decodes a request body into v. An empty body leaves v as it is.
+func decodeXML(body io.Reader, v interface{}) error {
+	err := xml.NewDecoder(io.LimitReader(body, maxBusyCalendarSize)).Decode(v)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	goical "github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+
+	"github.com/marcuscarr/appts/auth"
+)
+
+// davTransport sends a client's requests with Basic credentials, unless its password is empty,
+// and with any extra headers, such as the preconditions the CalDAV client can't set. It keeps
+// the status and headers of the last response, which the clients' errors don't expose.
+type davTransport struct {
+	client   *http.Client
+	password string
+	header   http.Header
+
+	status         int
+	responseHeader http.Header
+}
+
+func (t *davTransport) Do(r *http.Request) (*http.Response, error) {
+	if t.password != "" {
+		r.SetBasicAuth("trainer", t.password)
+	}
+	for name, values := range t.header {
+		r.Header[name] = values
+	}
+
+	resp, err := t.client.Do(r)
+	if err == nil {
+		t.status, t.responseHeader = resp.StatusCode, resp.Header
+	}
+
+	return resp, err
+}
+
+// caldavClient is a calendar app's CalDAV client, with a plain WebDAV client sharing its
+// transport for bodies the CalDAV client won't encode.
+type caldavClient struct {
+	*caldav.Client
+	dav       *webdav.Client
+	transport *davTransport
+}
+
+func newCaldavClient(t *testing.T, srv *httptest.Server, password string) *caldavClient {
+	t.Helper()
+
+	transport := &davTransport{client: srv.Client(), password: password}
+	c, err := caldav.NewClient(transport, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dav, err := webdav.NewClient(transport, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &caldavClient{Client: c, dav: dav, transport: transport}
+}
+
+// with sets the headers of the client's next requests, given as name and value pairs.
+func (c *caldavClient) with(header ...string) *caldavClient {
+	c.transport.header = http.Header{}
+	for i := 0; i+1 < len(header); i += 2 {
+		c.transport.header.Set(header[i], header[i+1])
+	}
+
+	return c
+}
+
+// putRaw writes body to the object at path as is.
+func (c *caldavClient) putRaw(path, body string) error {
+	w, err := c.dav.Create(context.Background(), path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, body); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+// moveAppt moves appointment 1 to start and end on January 2, like a calendar app: by reading
+// its object, changing the event's times and writing it back.
+func (c *caldavClient) moveAppt(path, start, end string) error {
+	ctx := context.Background()
+	obj, err := c.GetCalendarObject(ctx, path+"appointment-1.ics")
+	if err != nil {
+		return err
+	}
+
+	for name, hhmm := range map[string]string{goical.PropDateTimeStart: start, goical.PropDateTimeEnd: end} {
+		t, err := time.ParseInLocation("2006-01-02 15:04", "2020-01-02 "+hhmm, location)
+		if err != nil {
+			return err
+		}
+
+		obj.Data.Events()[0].Props.SetDateTime(name, t)
+	}
+
+	_, err = c.PutCalendarObject(ctx, path+"appointment-1.ics", obj.Data)
+	return err
+}
+
+// timeOffICS returns a calendar with a weekly event from 10:00 to 11:00, from the given day.
+func timeOffICS(day string) string {
+	return busyICS([]string{
+		"DTSTAMP:20200101T080000Z", "SUMMARY:Physio",
+		"DTSTART;TZID=America/Los_Angeles:" + day + "T100000", "DTEND;TZID=America/Los_Angeles:" + day + "T110000",
+		"RRULE:FREQ=WEEKLY",
+	})
+}
+
+// timeOff returns timeOffICS as the calendar app holds it.
+func timeOff(t *testing.T, day string) *goical.Calendar {
+	t.Helper()
+
+	cal, err := goical.NewDecoder(strings.NewReader(timeOffICS(day))).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cal
+}
+
+// objectPaths returns the paths of the objects, relative to the calendar at path.
+func objectPaths(objs []caldav.CalendarObject, path string) []string {
+	paths := make([]string, len(objs))
+	for i, obj := range objs {
+		paths[i] = strings.TrimPrefix(obj.Path, path)
+	}
+
+	return paths
+}
+
+func TestCaldav(t *testing.T) {
+	forEachStorage(t, testCaldav)
+}
+
+func testCaldav(t *testing.T, s *Server) {
+	seed(t, s)
+	if w := do(s, "POST", "/v1/appointments", apptBody("1")); w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	w := do(s, "POST", "/v1/admin/api-keys", `{"name":"Front desk"}`)
+	var key apiKeyResponse
+	if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	trainer1 := newCaldavClient(t, srv, testToken(s, auth.Claims{"sub": "t1", "role": auth.RoleTrainer, "trainer_id": float64(1)}))
+	trainer2 := newCaldavClient(t, srv, testToken(s, auth.Claims{"sub": "t2", "role": auth.RoleTrainer, "trainer_id": float64(2)}))
+	client := newCaldavClient(t, srv, testToken(s, auth.Claims{"sub": "client", "role": auth.RoleClient, "user_id": float64(1)}))
+	staff := newCaldavClient(t, srv, key.Key)
+	wrong := newCaldavClient(t, srv, "wrong")
+	anonymous := newCaldavClient(t, srv, "")
+
+	ctx := context.Background()
+	const path = "/v1/caldav/trainers/1/"
+	findCalendars := func(path string) func(*caldavClient) error {
+		return func(c *caldavClient) error {
+			_, err := c.FindCalendars(ctx, path)
+			return err
+		}
+	}
+	putTimeOff := func(path, day string) func(*caldavClient) error {
+		return func(c *caldavClient) error {
+			_, err := c.PutCalendarObject(ctx, path, timeOff(t, day))
+			return err
+		}
+	}
+	putRaw := func(path, body string) func(*caldavClient) error {
+		return func(c *caldavClient) error { return c.putRaw(path, body) }
+	}
+	get := func(path string) func(*caldavClient) error {
+		return func(c *caldavClient) error {
+			_, err := c.GetCalendarObject(ctx, path)
+			return err
+		}
+	}
+	moveAppt := func(start, end string) func(*caldavClient) error {
+		return func(c *caldavClient) error { return c.moveAppt(path, start, end) }
+	}
+
+	steps := []struct {
+		name   string
+		client *caldavClient
+		header []string
+		do     func(*caldavClient) error
+		e      int
+	}{
+		{"other trainer", trainer2, nil, findCalendars(path), http.StatusForbidden},
+		{"client", client, nil, findCalendars(path), http.StatusForbidden},
+		{"missing trainer", staff, nil, findCalendars("/v1/caldav/trainers/9/"), http.StatusNotFound},
+		{"wrong password", wrong, nil, findCalendars(path), http.StatusUnauthorized},
+
+		// Time off blocks the trainer's time, and can only be created once.
+		{"add time off", trainer1, []string{ifNoneMatchHeader, "*"}, putTimeOff(path+"physio.ics", "20200103"), http.StatusCreated},
+		{"add time off again", trainer1, []string{ifNoneMatchHeader, "*"}, putTimeOff(path+"physio.ics", "20200103"), http.StatusPreconditionFailed},
+		{"change stale time off", trainer1, []string{ifMatchHeader, `"2"`}, putTimeOff(path+"physio.ics", "20200102"), http.StatusPreconditionFailed},
+		{"change time off", trainer1, []string{ifMatchHeader, `"1"`}, putTimeOff(path+"physio.ics", "20200102"), http.StatusNoContent},
+		{"invalid time off", trainer1, nil, putRaw(path+"invalid.ics", "BEGIN:VCALENDAR"), http.StatusBadRequest},
+		{"empty time off", trainer1, nil, putRaw(path+"empty.ics", busyICS()), http.StatusBadRequest},
+		{"other trainer's time off", trainer1, nil, putTimeOff("/v1/caldav/trainers/2/physio.ics", "20200103"), http.StatusForbidden},
+		{"get time off", trainer1, nil, get(path + "physio.ics"), http.StatusOK},
+		{"get missing", trainer1, nil, get(path + "missing.ics"), http.StatusNotFound},
+
+		// Appointments are booked through the API. Trainers can't move theirs, but staff can.
+		{"book", staff, nil, putRaw(path+"appointment-9.ics", timeOffICS("20200102")), http.StatusConflict},
+		{"other trainer's appointment", staff, nil, get("/v1/caldav/trainers/2/appointment-1.ics"), http.StatusNotFound},
+		{"trainer moves", trainer1, nil, moveAppt("11:30", "12:00"), http.StatusForbidden},
+		{"move into time off", staff, nil, moveAppt("10:00", "10:30"), http.StatusConflict},
+		{"move stale", staff, []string{ifMatchHeader, `"2"`}, moveAppt("11:30", "12:00"), http.StatusPreconditionFailed},
+		{"move too long", staff, nil, moveAppt("11:30", "13:00"), http.StatusBadRequest},
+		{"move", staff, []string{ifMatchHeader, `"1"`}, moveAppt("11:30", "12:00"), http.StatusNoContent},
+	}
+
+	for _, step := range steps {
+		err := step.do(step.client.with(step.header...))
+		if got := step.client.transport.status; got != step.e || (err != nil) != (step.e >= 300) {
+			t.Fatalf("%s: Expected %d, got %d: %v", step.name, step.e, got, err)
+		}
+	}
+
+	if w := do(s, "POST", "/v1/appointments", strings.ReplaceAll(apptBody("1"), "T09", "T10")); w.Code != http.StatusConflict {
+		t.Errorf("Expected the time off to conflict with booking, got %d: %s", w.Code, w.Body)
+	}
+
+	available := availableTimes(t, s, "2020-01-09")
+	if available["10:00"] || available["10:30"] || !available["11:00"] {
+		t.Errorf("Expected the time off to be busy, got %v", available)
+	}
+
+	// Moving an appointment, the last step, responds like writing any other object, without the
+	// API's body.
+	if etag := staff.transport.responseHeader.Get(etagHeader); etag != `"2"` {
+		t.Errorf("Expected the moved appointment's ETag, got %q", etag)
+	}
+
+	// Only credentials challenged for are sent.
+	_, err := anonymous.with().FindCalendars(ctx, path)
+	if anonymous.transport.status != http.StatusUnauthorized || err == nil ||
+		!strings.HasPrefix(anonymous.transport.responseHeader.Get(wwwAuthenticateHeader), "Basic") {
+		t.Errorf("Expected a Basic challenge, got %d %v", anonymous.transport.status, anonymous.transport.responseHeader)
+	}
+
+	if w := do(s, "OPTIONS", path, "", authorizationHeader, "Bearer "+trainer1.transport.password); !strings.Contains(w.Header().Get("DAV"), "calendar-access") {
+		t.Errorf("Expected calendar access, got %v", w.Header())
+	}
+
+	trainer1.with()
+	cals, err := trainer1.FindCalendars(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cals) != 1 || cals[0].Path != path || cals[0].Name != "Trainer 1's appointments" || !equalStrings(cals[0].SupportedComponentSet, []string{"VEVENT"}) {
+		t.Errorf("Expected trainer 1's calendar, got %+v", cals)
+	}
+
+	testCases := []struct {
+		name   string
+		filter caldav.CompFilter
+		paths  []string
+	}{
+		{"all", caldav.CompFilter{Name: "VCALENDAR"}, []string{"appointment-1.ics", "physio.ics"}},
+		{
+			"time range",
+			caldav.CompFilter{Name: "VCALENDAR", Comps: []caldav.CompFilter{{
+				Name:  "VEVENT",
+				Start: time.Date(2020, 1, 9, 0, 0, 0, 0, time.UTC),
+				End:   time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC),
+			}}},
+			[]string{"physio.ics"},
+		},
+		{"todos", caldav.CompFilter{Name: "VCALENDAR", Comps: []caldav.CompFilter{{Name: "VTODO"}}}, []string{}},
+	}
+
+	queried := map[string][]caldav.CalendarObject{}
+	for _, tc := range testCases {
+		objs, err := trainer1.QueryCalendar(ctx, path, &caldav.CalendarQuery{CompFilter: tc.filter})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if paths := objectPaths(objs, path); !equalStrings(paths, tc.paths) {
+			t.Errorf("%s: Expected %v, got %v", tc.name, tc.paths, paths)
+		}
+
+		queried[tc.name] = objs
+	}
+
+	if all := queried["all"]; len(all) == 2 && (all[0].ETag != "2" || all[1].ETag != "2") {
+		t.Errorf("Expected the objects' versions as ETags, got %+v", all)
+	}
+
+	if objs := queried["time range"]; len(objs) == 1 {
+		if summary, _ := objs[0].Data.Events()[0].Props.Text(goical.PropSummary); summary != "Physio" {
+			t.Errorf("Expected the time off's data, got %q", summary)
+		}
+	}
+
+	objs, err := trainer1.MultiGetCalendar(ctx, path, &caldav.CalendarMultiGet{Paths: []string{path + "appointment-1.ics"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, err := objs[0].Data.Events()[0].DateTimeStart(location)
+	if err != nil || !start.Equal(time.Date(2020, 1, 2, 11, 30, 0, 0, location)) {
+		t.Errorf("Expected the moved appointment, got %v, %v", start, err)
+	}
+
+	// The client fails on the missing object's 404.
+	_, err = trainer1.MultiGetCalendar(ctx, path, &caldav.CalendarMultiGet{Paths: []string{path + "missing.ics"}})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected a missing object, got %v", err)
+	}
+
+	// Removing time off frees the trainer, and appointments are cancelled like through the API.
+	deletes := []struct {
+		path   string
+		client *caldavClient
+		e      int
+	}{
+		{"physio.ics", trainer1, http.StatusNoContent},
+		{"physio.ics", trainer1, http.StatusNotFound},
+		{"appointment-1.ics", trainer1, http.StatusForbidden},
+		{"appointment-1.ics", staff, http.StatusNoContent},
+	}
+
+	for _, d := range deletes {
+		err := d.client.with().dav.RemoveAll(ctx, path+d.path)
+		if got := d.client.transport.status; got != d.e || (err != nil) != (d.e >= 300) {
+			t.Errorf("DELETE %s: Expected %d, got %d: %v", d.path, d.e, got, err)
+		}
+	}
+
+	if available := availableTimes(t, s, "2020-01-02"); len(available) != 18 {
+		t.Errorf("Expected every slot to be available, got %v", available)
+	}
+
+	entries := listAudit(t, s, "/v1/audit?resource=time-off")
+	if len(entries) != 3 || strings.Contains(string(entries[0].Changes), `"data"`) {
+		t.Errorf("Expected time off entries without data, got %+v", entries)
+	}
+}
@@ -0,0 +1,389 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/ical"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+const (
+	calendarContentType = "text/calendar; charset=utf-8"
+	calendarProdID      = "-//Appts//Appointments//EN"
+	// calendarFeedSuffix ends the paths of the calendar feeds, which calendar apps fetch without
+	// credentials, so they are public and check a feed token instead; see isCalendarFeed.
+	calendarFeedSuffix = "/calendar.ics"
+	calendarTokenPath  = "/calendar/token"
+
+	feedTokenParam = "token"
+)
+
+type feedTokenResponse struct {
+	// URL is the path of the feed with the token, to subscribe to from a calendar app.
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// calendarOwner describes whose appointments a calendar feed shows.
+type calendarOwner struct {
+	// resource is the owner's resource, trainers or users.
+	resource string
+	// param is the route variable holding the owner's ID, and the appts column referring to them.
+	param string
+	// name returns the name of the trainer or user with the ID, looking among deleted ones too if
+	// withDeleted.
+	name func(s store.Store, id uint, withDeleted bool) (string, error)
+	// of returns the ID of the appt's trainer or user, whichever the owner is.
+	of func(appt models.Appt) uint
+	// other returns the ID of the appt's other party, and otherName their name.
+	other     func(appt models.Appt) uint
+	otherName func(s store.Store, id uint, withDeleted bool) (string, error)
+}
+
+var (
+	trainerCalendar = &calendarOwner{
+		resource:  "trainers",
+		param:     trainerIDParam,
+		name:      trainerName,
+		of:        func(appt models.Appt) uint { return appt.TrainerID },
+		other:     func(appt models.Appt) uint { return appt.UserID },
+		otherName: userName,
+	}
+
+	userCalendar = &calendarOwner{
+		resource:  "users",
+		param:     userIDParam,
+		name:      userName,
+		of:        func(appt models.Appt) uint { return appt.UserID },
+		other:     func(appt models.Appt) uint { return appt.TrainerID },
+		otherName: trainerName,
+	}
+)
+
+func trainerName(s store.Store, id uint, withDeleted bool) (string, error) {
+	var trainers store.ModelStore = s.Trainers()
+	if withDeleted {
+		trainers = trainers.WithDeleted()
+	}
+
+	var trainer models.Trainer
+	err := trainers.Get(id, &trainer)
+	return trainer.Name, err
+}
+
+func userName(s store.Store, id uint, withDeleted bool) (string, error) {
+	var users store.ModelStore = s.Users()
+	if withDeleted {
+		users = users.WithDeleted()
+	}
+
+	var user models.User
+	err := users.Get(id, &user)
+	return user.Name, err
+}
+
+// isCalendarFeed reports whether path is the path of a trainer's or user's calendar feed, in any
+// version of the API.
+func isCalendarFeed(path string) bool {
+	_, path = versionOf(path)
+	for _, owner := range []*calendarOwner{trainerCalendar, userCalendar} {
+		prefix := "/" + owner.resource + "/"
+		if len(path) <= len(prefix)+len(calendarFeedSuffix) ||
+			!strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, calendarFeedSuffix) {
+			continue
+		}
+
+		if id := path[len(prefix) : len(path)-len(calendarFeedSuffix)]; !strings.Contains(id, "/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// calendarHandler serves a trainer's or user's appointments as an iCalendar feed, and manages
+// the tokens that read it.
+type calendarHandler struct {
+	store  store.Store
+	logger *log.Logger
+	clock  clock.Clock
+	owner  *calendarOwner
+}
+
+func newCalendarHandler(s store.Store, logger *log.Logger, clock clock.Clock, owner *calendarOwner) *calendarHandler {
+	return &calendarHandler{store: s, logger: logger, clock: clock, owner: owner}
+}
+
+// feed returns the owner's appointments as an iCalendar feed, if the request's token reads it.
+// Deleted appointments, and those moved to another trainer or user, are kept in the feed as
+// cancelled, so that calendar apps remove them.
+func (ch *calendarHandler) feed(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)[ch.owner.param], 10, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	token, err := ch.store.FeedTokens().GetByHash(auth.HashToken(r.URL.Query().Get(feedTokenParam)))
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		ch.logger.Printf("Error loading feed token: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err != nil || token.Owner != ch.owner.resource || token.OwnerID != uint(id) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("invalid feed token"))
+		return
+	}
+
+	name, err := ch.owner.name(ch.store, uint(id), true)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		ch.logger.Printf("Error loading calendar owner: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var appts []models.Appt
+	filter := store.Filter{{Column: ch.owner.param, Op: "=", Value: idString(uint(id))}}
+	if err := ch.store.Appts().WithDeleted().List(filter, &appts); err != nil {
+		ch.logger.Printf("Error listing appts: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	moved, err := ch.movedAppts(uint(id), appts)
+	if err != nil {
+		ch.logger.Printf("Error finding moved appts: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	appts = append(appts, moved...)
+
+	cal := ical.NewCalendar(calendarProdID)
+	cal.AddText("X-WR-CALNAME", name+"'s appointments")
+	cal.Components = append(cal.Components, ical.Timezone(location, ch.clock.Now().In(location).Year()))
+
+	names := map[uint]string{}
+	for _, appt := range appts {
+		otherID := ch.owner.other(appt)
+		if _, ok := names[otherID]; !ok {
+			if names[otherID], err = ch.owner.otherName(ch.store, otherID, true); err != nil {
+				ch.logger.Printf("Error loading appt's other party: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		cal.Components = append(cal.Components, apptEvent(appt, "Appointment with "+names[otherID]))
+	}
+
+	w.Header().Set("Content-Type", calendarContentType)
+	if err := cal.Encode(w); err != nil {
+		ch.logger.Printf("Error encoding calendar: %v", err)
+	}
+}
+
+// movedAppts returns the appts that were the owner's but have since moved to another trainer or
+// user, given the owner's current appts. Each is as it was when it moved, and deleted then, so
+// that its event is cancelled.
+func (ch *calendarHandler) movedAppts(id uint, current []models.Appt) ([]models.Appt, error) {
+	seen := map[uint]bool{}
+	for _, appt := range current {
+		seen[appt.ID] = true
+	}
+
+	var versions []models.ApptVersion
+	filter := store.Filter{{Column: ch.owner.param, Op: "=", Value: idString(id)}}
+	if err := ch.store.Appts().Versions(filter, &versions); err != nil {
+		return nil, err
+	}
+
+	var moved []models.Appt
+	for _, v := range versions {
+		if seen[v.ApptID] {
+			continue
+		}
+		seen[v.ApptID] = true
+
+		var history []models.ApptVersion
+		if err := ch.store.Appts().History(v.ApptID, &history); err != nil {
+			return nil, err
+		}
+
+		// The version after the last that was the owner's moved the appt away.
+		for i := len(history) - 2; i >= 0; i-- {
+			appt := store.ApptAt(history[i])
+			if ch.owner.of(appt) == id {
+				appt.DeletedAt = gorm.DeletedAt{Time: history[i+1].RecordedAt, Valid: true}
+				moved = append(moved, appt)
+				break
+			}
+		}
+	}
+
+	return moved, nil
+}
+
+// apptEvent returns the VEVENT of an appt. Every change to the appt increments its SEQUENCE, and
+// a deleted appt is cancelled.
+func apptEvent(appt models.Appt, summary string) *ical.Component {
+	stamp, status, sequence := appt.UpdatedAt, "CONFIRMED", appt.Version-1
+	if appt.DeletedAt.Valid {
+		// Deleting doesn't change the appt's version, but is a change to the event.
+		stamp, status, sequence = appt.DeletedAt.Time, "CANCELLED", appt.Version
+	}
+
+	event := &ical.Component{Name: "VEVENT"}
+	event.Add("UID", apptUID(appt.ID))
+	event.Add("DTSTAMP", ical.FormatUTC(stamp))
+	event.Add("CREATED", ical.FormatUTC(appt.CreatedAt))
+	event.Add("LAST-MODIFIED", ical.FormatUTC(stamp))
+	event.Add("SEQUENCE", strconv.FormatUint(uint64(sequence), 10))
+	event.AddTime("DTSTART", appt.StartTime.In(location))
+	event.AddTime("DTEND", appt.EndTime.In(location))
+	event.AddText("SUMMARY", summary)
+	event.Add("STATUS", status)
+
+	return event
+}
+
+// apptUID returns the UID of an appt's event, which stays the same across changes to the appt.
+func apptUID(id uint) string {
+	return fmt.Sprintf("appointment-%d@appts", id)
+}
+
+// createToken issues a new token for the owner's feed, revoking the feed's earlier tokens. The
+// response is the only time the token is shown.
+func (ch *calendarHandler) createToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := ch.tokenOwner(w, r, actionCreate)
+	if !ok {
+		return
+	}
+
+	key, err := auth.NewToken()
+	if err != nil {
+		ch.logger.Printf("Error generating feed token: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	token := &models.FeedToken{Owner: ch.owner.resource, OwnerID: id, Hash: auth.HashToken(key)}
+	err = ch.store.Transaction(func(tx store.Store) error {
+		if err := ch.revoke(tx, r, id); err != nil {
+			return err
+		}
+
+		if err := tx.FeedTokens().Create(token); err != nil {
+			return err
+		}
+
+		return recordAudit(tx, r, auditCreate, feedTokensResource, token.ID, nil, token)
+	})
+	if err != nil {
+		ch.logger.Printf("Error creating feed token: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	feedPath := strings.TrimSuffix(r.URL.Path, calendarTokenPath) + calendarFeedSuffix
+	noStore(w)
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(feedTokenResponse{
+		URL:       feedPath + "?" + feedTokenParam + "=" + key,
+		Token:     key,
+		CreatedAt: token.CreatedAt.In(location),
+	})
+	if err != nil {
+		ch.logger.Printf("Error encoding response: %v", err)
+	}
+}
+
+// revokeTokens revokes every token of the owner's feed.
+func (ch *calendarHandler) revokeTokens(w http.ResponseWriter, r *http.Request) {
+	id, ok := ch.tokenOwner(w, r, actionDelete)
+	if !ok {
+		return
+	}
+
+	err := ch.store.Transaction(func(tx store.Store) error {
+		return ch.revoke(tx, r, id)
+	})
+	if err != nil {
+		ch.logger.Printf("Error revoking feed tokens: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tokenOwner returns the ID of the feed's owner, if they exist and the request's principal may
+// take the action on their feed's tokens. Otherwise it writes the error response.
+func (ch *calendarHandler) tokenOwner(w http.ResponseWriter, r *http.Request, a action) (uint, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)[ch.owner.param], 10, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, false
+	}
+
+	if _, err := ch.owner.name(ch.store, uint(id), false); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return 0, false
+		}
+
+		ch.logger.Printf("Error loading calendar owner: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return 0, false
+	}
+
+	token := &models.FeedToken{Owner: ch.owner.resource, OwnerID: uint(id)}
+	if !feedTokenPolicy.allows(auth.FromContext(r.Context()), a, token) {
+		w.WriteHeader(http.StatusForbidden)
+		return 0, false
+	}
+
+	return uint(id), true
+}
+
+// revoke deletes the tokens of the owner's feed in tx.
+func (ch *calendarHandler) revoke(tx store.Store, r *http.Request, id uint) error {
+	var tokens []models.FeedToken
+	if err := tx.FeedTokens().List(ch.owner.resource, id, &tokens); err != nil {
+		return err
+	}
+
+	for i := range tokens {
+		if err := tx.FeedTokens().Delete(tokens[i].ID); err != nil {
+			return err
+		}
+
+		revoked := tokens[i]
+		revoked.DeletedAt = gorm.DeletedAt{Time: ch.clock.Now(), Valid: true}
+		if err := recordAudit(tx, r, auditDelete, feedTokensResource, revoked.ID, &tokens[i], &revoked); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
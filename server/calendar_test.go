@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/marcuscarr/appts/auth"
+)
+
+func TestCalendarFeed(t *testing.T) {
+	forEachStorage(t, testCalendarFeed)
+}
+
+func testCalendarFeed(t *testing.T, s *Server) {
+	seed(t, s)
+
+	steps := []struct {
+		method, path, body string
+		header             []string
+		e                  int
+	}{
+		{"POST", "/v1/appointments", apptBody("1"), nil, http.StatusOK},
+		{"POST", "/v1/appointments", apptBody("2"), nil, http.StatusOK},
+		{
+			"POST", "/v1/appointments",
+			`{"start_time":"2020-01-02T11:00:00-08:00","end_time":"2020-01-02T11:30:00-08:00","user_id":1,"trainer_id":1}`,
+			nil, http.StatusOK,
+		},
+		{
+			"PATCH", "/v1/appointments/1",
+			`{"start_time":"2020-01-02T10:00:00-08:00","end_time":"2020-01-02T10:30:00-08:00"}`,
+			[]string{ifMatchHeader, `"1"`}, http.StatusOK,
+		},
+		{"DELETE", "/v1/appointments/3", "", []string{ifMatchHeader, `"1"`}, http.StatusNoContent},
+		// Appointment 4 moves to trainer 2.
+		{
+			"POST", "/v1/appointments",
+			`{"start_time":"2020-01-02T12:00:00-08:00","end_time":"2020-01-02T12:30:00-08:00","user_id":1,"trainer_id":1}`,
+			nil, http.StatusOK,
+		},
+		{"PATCH", "/v1/appointments/4", `{"trainer_id":2}`, []string{ifMatchHeader, `"1"`}, http.StatusOK},
+	}
+
+	for _, step := range steps {
+		if w := do(s, step.method, step.path, step.body, step.header...); w.Code != step.e {
+			t.Fatalf("%s %s: Expected %d, got %d: %s", step.method, step.path, step.e, w.Code, w.Body)
+		}
+	}
+
+	token := createFeedToken(t, s, "/v1/trainers/1/calendar/token")
+	if !strings.HasPrefix(token.URL, "/v1/trainers/1/calendar.ics?token=") || !strings.HasSuffix(token.URL, token.Token) {
+		t.Errorf("Expected the feed's URL with the token, got %q", token.URL)
+	}
+
+	w := do(s, "GET", token.URL, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != calendarContentType {
+		t.Errorf("Expected content type %q, got %q", calendarContentType, got)
+	}
+
+	feed := w.Body.String()
+	for _, want := range []string{"BEGIN:VCALENDAR\r\n", "X-WR-CALNAME:Trainer 1's appointments\r\n", "TZID:America/Los_Angeles\r\n"} {
+		if !strings.Contains(feed, want) {
+			t.Errorf("Expected the feed to contain %q, got\n%s", want, feed)
+		}
+	}
+
+	testCases := []struct {
+		uid  string
+		want []string
+	}{
+		{
+			"appointment-1@appts",
+			[]string{
+				"DTSTART;TZID=America/Los_Angeles:20200102T100000", "DTEND;TZID=America/Los_Angeles:20200102T103000",
+				"SEQUENCE:1", "STATUS:CONFIRMED", "SUMMARY:Appointment with User", "DTSTAMP:20200101T080000Z",
+			},
+		},
+		{"appointment-2@appts", nil},
+		{"appointment-3@appts", []string{"SEQUENCE:1", "STATUS:CANCELLED"}},
+		{
+			"appointment-4@appts",
+			[]string{"DTSTART;TZID=America/Los_Angeles:20200102T120000", "SEQUENCE:1", "STATUS:CANCELLED"},
+		},
+	}
+
+	for _, tc := range testCases {
+		event, ok := calendarEvent(feed, tc.uid)
+		if ok != (tc.want != nil) {
+			t.Errorf("%s: Expected it in the feed %v, got\n%s", tc.uid, tc.want != nil, feed)
+			continue
+		}
+
+		for _, want := range tc.want {
+			if !strings.Contains(event, want+"\r\n") {
+				t.Errorf("%s: Expected %q, got\n%s", tc.uid, want, event)
+			}
+		}
+	}
+
+	// A user's feed names their trainers.
+	userToken := createFeedToken(t, s, "/v1/users/1/calendar/token")
+	w = do(s, "GET", userToken.URL, "")
+	if !strings.Contains(w.Body.String(), "SUMMARY:Appointment with Trainer 2\r\n") {
+		t.Errorf("Expected the user's appointment with trainer 2, got %d\n%s", w.Code, w.Body)
+	}
+
+	// The moved appointment is still the user's, so it stays in their feed.
+	if event, _ := calendarEvent(w.Body.String(), "appointment-4@appts"); !strings.Contains(event, "STATUS:CONFIRMED\r\n") {
+		t.Errorf("Expected the moved appointment to be confirmed, got\n%s", event)
+	}
+
+	// Issuing a token revokes the earlier ones.
+	rotated := createFeedToken(t, s, "/v1/trainers/1/calendar/token")
+	trainer2 := "Bearer " + testToken(s, auth.Claims{"sub": "t2", "role": auth.RoleTrainer, "trainer_id": float64(2)})
+	client := "Bearer " + testToken(s, auth.Claims{"sub": "client", "role": auth.RoleClient, "user_id": float64(1)})
+
+	requests := []struct {
+		method, path string
+		headers      []string
+		e            int
+	}{
+		{"GET", "/v1/trainers/1/calendar.ics", nil, http.StatusUnauthorized},
+		{"GET", token.URL, nil, http.StatusUnauthorized},
+		{"GET", rotated.URL, nil, http.StatusOK},
+		// Tokens only read their own feed.
+		{"GET", "/v1/users/1/calendar.ics?token=" + rotated.Token, nil, http.StatusUnauthorized},
+		{"GET", "/v1/trainers/2/calendar.ics?token=" + rotated.Token, nil, http.StatusUnauthorized},
+		{"POST", "/v1/trainers/9/calendar/token", nil, http.StatusNotFound},
+		{"POST", "/v1/trainers/1/calendar/token", []string{authorizationHeader, trainer2}, http.StatusForbidden},
+		{"POST", "/v1/trainers/2/calendar/token", []string{authorizationHeader, trainer2}, http.StatusCreated},
+		{"POST", "/v1/trainers/1/calendar/token", []string{authorizationHeader, client}, http.StatusForbidden},
+		{"DELETE", "/v1/users/1/calendar/token", []string{authorizationHeader, client}, http.StatusNoContent},
+		{"GET", userToken.URL, nil, http.StatusUnauthorized},
+		{"DELETE", "/v1/trainers/1/calendar/token", nil, http.StatusNoContent},
+		{"GET", rotated.URL, nil, http.StatusUnauthorized},
+	}
+
+	// Feeds are public, so the credentials do sends are ignored and only the token counts.
+	for _, tc := range requests {
+		if w := do(s, tc.method, tc.path, "", tc.headers...); w.Code != tc.e {
+			t.Errorf("%s %s: Expected %d, got %d", tc.method, tc.path, tc.e, w.Code)
+		}
+	}
+
+	// Tokens are audited without their hashes.
+	entries := listAudit(t, s, "/v1/audit?resource=feed-tokens")
+	if len(entries) == 0 || strings.Contains(string(entries[0].Changes), `"hash"`) {
+		t.Errorf("Expected feed token entries without hashes, got %+v", entries)
+	}
+}
+
+func createFeedToken(t *testing.T, s *Server, path string) feedTokenResponse {
+	t.Helper()
+
+	w := do(s, "POST", path, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("%s: Expected %d, got %d: %s", path, http.StatusCreated, w.Code, w.Body)
+	}
+
+	var token feedTokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+// calendarEvent returns the lines of the VEVENT with the UID in an iCalendar feed.
+func calendarEvent(feed, uid string) (string, bool) {
+	for _, event := range strings.Split(feed, "BEGIN:VEVENT\r\n")[1:] {
+		event = strings.SplitN(event, "END:VEVENT\r\n", 2)[0]
+		if strings.Contains(event, "UID:"+uid+"\r\n") {
+			return event, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+
+	"github.com/marcuscarr/appts/migrations"
+)
+
+// OpenDB connects to the configured Postgres or SQLite database, creating it if it doesn't exist.
+// It doesn't migrate the schema; see Migrator.
+func OpenDB(config *Config) (*gorm.DB, error) {
+	if config.Storage == StorageSQLite {
+		return openSQLite(config)
+	}
+
+	return openPostgres(config)
+}
+
+// Migrator returns the migrator for db's schema.
+func Migrator(db *gorm.DB) (*migrations.Migrator, error) {
+	dbConn, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	return migrations.New(dbConn, db.Dialector.Name())
+}
+
+// checkSchema applies pending migrations if config.Migrate is set, and otherwise fails if there
+// are any, since the server can't work with an older schema.
+func checkSchema(config *Config, db *gorm.DB, logger *log.Logger) error {
+	migrator, err := Migrator(db)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if config.Migrate {
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			logger.Printf("Applied migration %d_%s", m.Version, m.Name)
+		}
+
+		return err
+	}
+
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		return fmt.Errorf("database has %d pending migrations; run `appts migrate up`", len(pending))
+	}
+
+	return nil
+}
+
+func openPostgres(config *Config) (*gorm.DB, error) {
+	// Connect to the postgres instance
+	dsn := fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s sslmode=disable",
+		config.DBHost, strconv.Itoa(config.DBPort), config.DBUser, config.DBPass,
+	)
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the database if it doesn't exist. CREATE DATABASE takes no parameters, so the name
+	// is quoted as an identifier instead.
+	var exists bool
+	err = db.Raw("SELECT EXISTS (SELECT FROM pg_database WHERE datname = ?)", config.DBName).Scan(&exists).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if err := db.Exec("CREATE DATABASE " + quoteIdentifier(config.DBName)).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	dbConn, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	dbConn.Close()
+
+	// Connect to the database
+	dsn = fmt.Sprintf(
+		"host=%s port=%s user=%s dbname=%s password=%s sslmode=disable TimeZone=UTC",
+		config.DBHost, strconv.Itoa(config.DBPort), config.DBUser, config.DBName, config.DBPass,
+	)
+
+	return gorm.Open(postgres.Open(dsn), &gorm.Config{})
+}
+
+// quoteIdentifier quotes name as a Postgres identifier.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func openSQLite(config *Config) (*gorm.DB, error) {
+	// SQLite creates the file if it doesn't exist. Foreign keys are off by default, and waiting
+	// for locks avoids failing requests that arrive during another's write.
+	dsn := config.DBPath + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	dbConn, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows one writer at a time, so transactions take turns on a single connection
+	// rather than failing with SQLITE_BUSY.
+	dbConn.SetMaxOpenConns(1)
+
+	return db, nil
+}
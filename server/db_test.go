@@ -0,0 +1,19 @@
+package server
+
+import "testing"
+
+func TestQuoteIdentifier(t *testing.T) {
+	testCases := []struct {
+		name, e string
+	}{
+		{"appts", `"appts"`},
+		{"Appts test", `"Appts test"`},
+		{`appts"; DROP DATABASE postgres; --`, `"appts""; DROP DATABASE postgres; --"`},
+	}
+
+	for _, tc := range testCases {
+		if got := quoteIdentifier(tc.name); got != tc.e {
+			t.Errorf("Expected %s, got %s", tc.e, got)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+// Kept out of index.html so that the page works under a Content-Security-Policy without
+// 'unsafe-inline'.
+window.onload = () => {
+  window.ui = SwaggerUIBundle({
+    url: "openapi.json",
+    dom_id: "#swagger-ui",
+  });
+};
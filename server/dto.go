@@ -0,0 +1,361 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+const includeParam = "include"
+
+var errInvalidInclude = errors.New("invalid include")
+
+// representation maps a model to and from the JSON the API receives and sends for it.
+type representation interface {
+	// decode reads a request body onto model, a pointer to a model. Fields missing from the
+	// body are left as they are.
+	decode(r io.Reader, model interface{}) error
+	// encode returns the response bodies for models, which are pointers to models, loading any
+	// related resources the request asks to include.
+	encode(s store.Store, r *http.Request, models []interface{}) ([]interface{}, error)
+	// checkQuery returns the error encode would return for the request's query, so that writes
+	// can be refused before they're applied.
+	checkQuery(r *http.Request) error
+}
+
+// representations are the encodings of each resource in a version of the API.
+type representations struct {
+	appt    representation
+	trainer representation
+	user    representation
+}
+
+var (
+	// dtoRepresentations use the request and response types below.
+	dtoRepresentations = representations{
+		appt:    apptRepresentation{},
+		trainer: trainerRepresentation{},
+		user:    userRepresentation{},
+	}
+
+	// modelRepresentations encode the GORM models directly, as the API did before v1.
+	modelRepresentations = representations{
+		appt:    modelRepresentation{},
+		trainer: modelRepresentation{},
+		user:    modelRepresentation{},
+	}
+)
+
+// encodeOne returns the response body for a single model.
+func encodeOne(rep representation, s store.Store, r *http.Request, model interface{}) (interface{}, error) {
+	bodies, err := rep.encode(s, r, []interface{}{model})
+	if err != nil {
+		return nil, err
+	}
+
+	return bodies[0], nil
+}
+
+type modelRepresentation struct{}
+
+func (modelRepresentation) decode(r io.Reader, model interface{}) error {
+	return json.NewDecoder(r).Decode(model)
+}
+
+func (modelRepresentation) encode(s store.Store, r *http.Request, models []interface{}) ([]interface{}, error) {
+	return models, nil
+}
+
+func (modelRepresentation) checkQuery(r *http.Request) error {
+	return nil
+}
+
+type apptRequest struct {
+	ID        uint      `json:"id"`
+	StartTime time.Time `json:"start_time" validate:"required"`
+	EndTime   time.Time `json:"end_time" validate:"required,gtfield=StartTime"`
+	UserID    uint      `json:"user_id" validate:"required"`
+	TrainerID uint      `json:"trainer_id" validate:"required"`
+}
+
+// attendanceRequest is the body of a request to mark attendance.
+type attendanceRequest struct {
+	Attended *bool `json:"attended" validate:"required"`
+}
+
+type apptResponse struct {
+	ID        uint      `json:"id"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	UserID    uint      `json:"user_id"`
+	TrainerID uint      `json:"trainer_id"`
+	// Attended is null until the trainer marks attendance.
+	Attended  *bool     `json:"attended"`
+	Version   uint      `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is set on deleted resources, which are listed with ?include_deleted=true.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// User and Trainer are set when requested with ?include=user,trainer.
+	User    *userResponse    `json:"user,omitempty"`
+	Trainer *trainerResponse `json:"trainer,omitempty"`
+}
+
+func newApptResponse(appt *models.Appt) *apptResponse {
+	return &apptResponse{
+		ID:        appt.ID,
+		StartTime: appt.StartTime.In(location),
+		EndTime:   appt.EndTime.In(location),
+		UserID:    appt.UserID,
+		TrainerID: appt.TrainerID,
+		Attended:  appt.Attended,
+		Version:   appt.Version,
+		CreatedAt: appt.CreatedAt.In(location),
+		UpdatedAt: appt.UpdatedAt.In(location),
+		DeletedAt: deletedAt(appt.DeletedAt),
+	}
+}
+
+// deletedAt returns the time a model was deleted, or nil if it wasn't.
+func deletedAt(deleted gorm.DeletedAt) *time.Time {
+	if !deleted.Valid {
+		return nil
+	}
+
+	t := deleted.Time.In(location)
+	return &t
+}
+
+type apptRepresentation struct{}
+
+func (apptRepresentation) decode(r io.Reader, model interface{}) error {
+	appt := model.(*models.Appt)
+	req := apptRequest{
+		ID:        appt.ID,
+		StartTime: appt.StartTime,
+		EndTime:   appt.EndTime,
+		UserID:    appt.UserID,
+		TrainerID: appt.TrainerID,
+	}
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return err
+	}
+
+	appt.ID = req.ID
+	appt.StartTime = req.StartTime
+	appt.EndTime = req.EndTime
+	appt.UserID = req.UserID
+	appt.TrainerID = req.TrainerID
+
+	return nil
+}
+
+func (apptRepresentation) checkQuery(r *http.Request) error {
+	_, _, err := parseApptInclude(r)
+	return err
+}
+
+// parseApptInclude returns whether the request asks for appointments' users and trainers to be
+// included.
+func parseApptInclude(r *http.Request) (includeUser, includeTrainer bool, err error) {
+	include := r.URL.Query().Get(includeParam)
+	if include == "" {
+		return false, false, nil
+	}
+
+	for _, name := range strings.Split(include, ",") {
+		switch strings.TrimSpace(name) {
+		case "user":
+			includeUser = true
+		case "trainer":
+			includeTrainer = true
+		default:
+			return false, false, fmt.Errorf("%w: unknown resource %q", errInvalidInclude, name)
+		}
+	}
+
+	return includeUser, includeTrainer, nil
+}
+
+func (apptRepresentation) encode(s store.Store, r *http.Request, ms []interface{}) ([]interface{}, error) {
+	includeUser, includeTrainer, err := parseApptInclude(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var userIDs, trainerIDs []uint
+	for _, m := range ms {
+		appt := m.(*models.Appt)
+		userIDs = append(userIDs, appt.UserID)
+		trainerIDs = append(trainerIDs, appt.TrainerID)
+	}
+
+	users := map[uint]*userResponse{}
+	if includeUser && len(userIDs) > 0 {
+		var found []models.User
+		if err := s.Users().List(store.Filter{{Column: "id", Op: "in", Value: userIDs}}, &found); err != nil {
+			return nil, err
+		}
+		for i := range found {
+			users[found[i].ID] = newUserResponse(&found[i])
+		}
+	}
+
+	trainers := map[uint]*trainerResponse{}
+	if includeTrainer && len(trainerIDs) > 0 {
+		var found []models.Trainer
+		if err := s.Trainers().List(store.Filter{{Column: "id", Op: "in", Value: trainerIDs}}, &found); err != nil {
+			return nil, err
+		}
+		for i := range found {
+			trainers[found[i].ID] = newTrainerResponse(&found[i])
+		}
+	}
+
+	bodies := make([]interface{}, len(ms))
+	for i, m := range ms {
+		appt := m.(*models.Appt)
+		body := newApptResponse(appt)
+		body.User = users[appt.UserID]
+		body.Trainer = trainers[appt.TrainerID]
+		bodies[i] = body
+	}
+
+	return bodies, nil
+}
+
+type userRequest struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
+
+type userResponse struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	// EmailVerified is whether staff set the email, which lets the user log in through an
+	// identity provider with it.
+	EmailVerified bool       `json:"email_verified"`
+	Version       uint       `json:"version"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+}
+
+func newUserResponse(user *models.User) *userResponse {
+	return &userResponse{
+		ID:            user.ID,
+		Name:          user.Name,
+		Email:         user.Email,
+		Username:      user.Username,
+		EmailVerified: user.EmailVerified,
+		Version:       user.Version,
+		CreatedAt:     user.CreatedAt.In(location),
+		UpdatedAt:     user.UpdatedAt.In(location),
+		DeletedAt:     deletedAt(user.DeletedAt),
+	}
+}
+
+type userRepresentation struct{}
+
+func (userRepresentation) decode(r io.Reader, model interface{}) error {
+	user := model.(*models.User)
+	req := userRequest{ID: user.ID, Name: user.Name, Email: user.Email, Username: user.Username}
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return err
+	}
+
+	user.ID = req.ID
+	user.Name = req.Name
+	user.Email = req.Email
+	user.Username = req.Username
+
+	return nil
+}
+
+func (userRepresentation) checkQuery(r *http.Request) error {
+	return nil
+}
+
+func (userRepresentation) encode(s store.Store, r *http.Request, ms []interface{}) ([]interface{}, error) {
+	bodies := make([]interface{}, len(ms))
+	for i, m := range ms {
+		bodies[i] = newUserResponse(m.(*models.User))
+	}
+
+	return bodies, nil
+}
+
+type trainerRequest struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
+
+type trainerResponse struct {
+	ID        uint       `json:"id"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email"`
+	Username  string     `json:"username"`
+	Version   uint       `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+func newTrainerResponse(trainer *models.Trainer) *trainerResponse {
+	return &trainerResponse{
+		ID:        trainer.ID,
+		Name:      trainer.Name,
+		Email:     trainer.Email,
+		Username:  trainer.Username,
+		Version:   trainer.Version,
+		CreatedAt: trainer.CreatedAt.In(location),
+		UpdatedAt: trainer.UpdatedAt.In(location),
+		DeletedAt: deletedAt(trainer.DeletedAt),
+	}
+}
+
+type trainerRepresentation struct{}
+
+func (trainerRepresentation) decode(r io.Reader, model interface{}) error {
+	trainer := model.(*models.Trainer)
+	req := trainerRequest{ID: trainer.ID, Name: trainer.Name, Email: trainer.Email, Username: trainer.Username}
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return err
+	}
+
+	trainer.ID = req.ID
+	trainer.Name = req.Name
+	trainer.Email = req.Email
+	trainer.Username = req.Username
+
+	return nil
+}
+
+func (trainerRepresentation) checkQuery(r *http.Request) error {
+	return nil
+}
+
+func (trainerRepresentation) encode(s store.Store, r *http.Request, ms []interface{}) ([]interface{}, error) {
+	bodies := make([]interface{}, len(ms))
+	for i, m := range ms {
+		bodies[i] = newTrainerResponse(m.(*models.Trainer))
+	}
+
+	return bodies, nil
+}
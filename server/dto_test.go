@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcuscarr/appts/models"
+)
+
+func TestApptRepresentationDecode(t *testing.T) {
+	appt := models.Appt{
+		StartTime: time.Date(2020, 1, 1, 9, 0, 0, 0, location),
+		EndTime:   time.Date(2020, 1, 1, 9, 30, 0, 0, location),
+		UserID:    1,
+		TrainerID: 1,
+	}
+
+	err := apptRepresentation{}.decode(strings.NewReader(`{"trainer_id": 2}`), &appt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if appt.TrainerID != 2 {
+		t.Errorf("Expected trainer_id 2, got %d", appt.TrainerID)
+	}
+
+	if appt.UserID != 1 || !appt.StartTime.Equal(time.Date(2020, 1, 1, 9, 0, 0, 0, location)) {
+		t.Errorf("Expected fields missing from the body to be unchanged, got %+v", appt)
+	}
+}
+
+func TestApptRepresentationEncode(t *testing.T) {
+	appt := &models.Appt{ID: 3, UserID: 1, TrainerID: 2, Version: 4}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/appointments/3", nil)
+	body, err := encodeOne(apptRepresentation{}, nil, r, appt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := body.(*apptResponse)
+	if res.ID != 3 || res.UserID != 1 || res.TrainerID != 2 || res.Version != 4 {
+		t.Errorf("Expected the response to mirror the appt, got %+v", res)
+	}
+
+	if res.User != nil || res.Trainer != nil {
+		t.Errorf("Expected no related resources without include, got %+v", res)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/v1/appointments/3?include=trainer,room", nil)
+	if _, err := encodeOne(apptRepresentation{}, nil, r, appt); !errors.Is(err, errInvalidInclude) {
+		t.Errorf("Expected %v, got %v", errInvalidInclude, err)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const (
+	// Headers
+	etagHeader        = "ETag"
+	ifMatchHeader     = "If-Match"
+	ifNoneMatchHeader = "If-None-Match"
+)
+
+// etag returns the strong entity tag for a resource at the given version.
+func etag(version uint) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// modelVersion returns the Version field of a pointer to a model, or 0 if it has none.
+func modelVersion(model interface{}) uint {
+	version := reflect.ValueOf(model).Elem().FieldByName("Version")
+	if !version.IsValid() {
+		return 0
+	}
+
+	return uint(version.Uint())
+}
+
+// setModelVersion sets the Version field of a pointer to a model, if it has one.
+func setModelVersion(model interface{}, version uint) {
+	field := reflect.ValueOf(model).Elem().FieldByName("Version")
+	if field.IsValid() {
+		field.SetUint(uint64(version))
+	}
+}
+
+// matchesStrongETag reports whether a list of entity tags from an If-Match header contains the
+// given tag by strong comparison: weak tags never match, as a write must not apply to a
+// representation that is only equivalent to the client's.
+func matchesStrongETag(header, tag string) bool {
+	return matchesETag(header, func(candidate string) bool {
+		return !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(tag, "W/") && candidate == tag
+	})
+}
+
+// matchesWeakETag reports whether a list of entity tags from an If-None-Match header contains the
+// given tag by weak comparison, which compares tags by their opaque value only.
+func matchesWeakETag(header, tag string) bool {
+	return matchesETag(header, func(candidate string) bool {
+		return strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(tag, "W/")
+	})
+}
+
+// matchesETag reports whether a list of entity tags is * or contains a tag that matches.
+func matchesETag(header string, matches func(candidate string) bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || matches(candidate) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkIfMatch enforces the If-Match precondition for a write to an existing resource. It writes
+// 428 if the header is missing and 412 if it does not match, and reports whether to continue.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, version uint) bool {
+	header := r.Header.Get(ifMatchHeader)
+	if header == "" {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		_, _ = w.Write([]byte("If-Match header is required"))
+		return false
+	}
+
+	if !matchesStrongETag(header, etag(version)) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+
+	return true
+}
+
+// notModified reports whether an If-None-Match header matches the current version, in which
+// case the caller should respond with 304.
+func notModified(r *http.Request, version uint) bool {
+	header := r.Header.Get(ifNoneMatchHeader)
+	return header != "" && matchesWeakETag(header, etag(version))
+}
@@ -0,0 +1,29 @@
+package server
+
+import "testing"
+
+func TestMatchesETag(t *testing.T) {
+	testCases := []struct {
+		header, tag  string
+		strong, weak bool
+	}{
+		{`"1"`, `"1"`, true, true},
+		{`"2"`, `"1"`, false, false},
+		{`*`, `"1"`, true, true},
+		{`"2", "1"`, `"1"`, true, true},
+		{`W/"1"`, `"1"`, false, true},
+		{`"1"`, `W/"1"`, false, true},
+		{`W/"2", "1"`, `"1"`, true, true},
+		{`W/"1", "2"`, `"1"`, false, true},
+		{`1`, `"1"`, false, false},
+	}
+
+	for _, tc := range testCases {
+		if got := matchesStrongETag(tc.header, tc.tag); got != tc.strong {
+			t.Errorf("Expected strong %v for %s against %s, got %v", tc.strong, tc.header, tc.tag, got)
+		}
+		if got := matchesWeakETag(tc.header, tc.tag); got != tc.weak {
+			t.Errorf("Expected weak %v for %s against %s, got %v", tc.weak, tc.header, tc.tag, got)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/ical"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+const (
+	freeBusyPath = "/freebusy"
+	// freeBusyFormatParam selects the response's format: json, the default, or ics for an
+	// iCalendar VFREEBUSY.
+	freeBusyFormatParam = "format"
+	freeBusyFormatICS   = "ics"
+
+	// maxFreeBusyRange limits how long a range free/busy time is asked for, as recurring events
+	// are expanded across it.
+	maxFreeBusyRange = 366 * 24 * time.Hour
+)
+
+type periodResponse struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type freeBusyResponse struct {
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	// Busy is when the trainer has appointments or is busy in their busy calendars and time off.
+	Busy []periodResponse `json:"busy"`
+	// Free is the rest of business hours. Times in neither are outside business hours.
+	Free []periodResponse `json:"free"`
+}
+
+func newPeriodResponses(periods []ical.Period) []periodResponse {
+	resp := make([]periodResponse, len(periods))
+	for i, p := range periods {
+		resp[i] = periodResponse{Start: p.Start.In(location), End: p.End.In(location)}
+	}
+
+	return resp
+}
+
+// freeBusyHandler serves when trainers are busy and free, for integrations to schedule around.
+type freeBusyHandler struct {
+	store  store.Store
+	logger *log.Logger
+	clock  clock.Clock
+}
+
+func newFreeBusyHandler(s store.Store, logger *log.Logger, clock clock.Clock) *freeBusyHandler {
+	return &freeBusyHandler{store: s, logger: logger, clock: clock}
+}
+
+// get returns the trainer's merged busy and free periods between starts_at and ends_at, as JSON
+// or as an iCalendar VFREEBUSY.
+func (fh *freeBusyHandler) get(w http.ResponseWriter, r *http.Request) {
+	trainerID, err := strconv.ParseUint(mux.Vars(r)[trainerIDParam], 10, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	start, end, err := parseRange(query.Get(startsAtParam), query.Get(endsAtParam))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	format := query.Get(freeBusyFormatParam)
+	if format != "" && format != "json" && format != freeBusyFormatICS {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("format must be json or ics"))
+		return
+	}
+
+	if _, err := trainerName(fh.store, uint(trainerID), false); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		fh.logger.Printf("Error loading trainer: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	busy, err := fh.busy(uint(trainerID), start, end)
+	if err != nil {
+		fh.logger.Printf("Error finding busy times: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	free := ical.Subtract(businessHours(start, end), busy)
+
+	if format == freeBusyFormatICS {
+		cal := ical.NewCalendar(calendarProdID)
+		cal.Add("METHOD", "PUBLISH")
+
+		fb := &ical.Component{Name: "VFREEBUSY"}
+		fb.Add("UID", fmt.Sprintf("freebusy-trainer-%d-%s@appts", trainerID, ical.FormatUTC(start)))
+		fb.Add("DTSTAMP", ical.FormatUTC(fh.clock.Now()))
+		fb.Add("DTSTART", ical.FormatUTC(start))
+		fb.Add("DTEND", ical.FormatUTC(end))
+		for _, periods := range []struct {
+			fbType  string
+			periods []ical.Period
+		}{{"BUSY", busy}, {"FREE", free}} {
+			if len(periods.periods) > 0 {
+				p := fb.Add("FREEBUSY", ical.FormatPeriods(periods.periods))
+				p.Params = map[string]string{"FBTYPE": periods.fbType}
+			}
+		}
+		cal.Components = append(cal.Components, fb)
+
+		w.Header().Set("Content-Type", calendarContentType)
+		if err := cal.Encode(w); err != nil {
+			fh.logger.Printf("Error encoding calendar: %v", err)
+		}
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(freeBusyResponse{
+		StartsAt: start.In(location),
+		EndsAt:   end.In(location),
+		Busy:     newPeriodResponses(busy),
+		Free:     newPeriodResponses(free),
+	})
+	if err != nil {
+		fh.logger.Printf("Error encoding response: %v", err)
+	}
+}
+
+// busy returns the periods between start and end in which the trainer has appointments or is
+// busy in their busy calendars and time off, merged where they overlap or meet.
+func (fh *freeBusyHandler) busy(trainerID uint, start, end time.Time) ([]ical.Period, error) {
+	filter := store.Filter{
+		{Column: trainerIDParam, Op: "=", Value: idString(trainerID)},
+		{Column: startTimeParam, Op: "<", Value: end},
+		{Column: endTimeParam, Op: ">", Value: start},
+	}
+
+	var appts []models.Appt
+	if err := fh.store.Appts().List(filter, &appts); err != nil {
+		return nil, err
+	}
+
+	busy, err := trainerBusy(fh.store, trainerID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, appt := range appts {
+		busy = append(busy, ical.Period{Start: appt.StartTime, End: appt.EndTime})
+	}
+
+	busy = ical.Merge(busy)
+	for i := range busy {
+		if busy[i].Start.Before(start) {
+			busy[i].Start = start
+		}
+		if busy[i].End.After(end) {
+			busy[i].End = end
+		}
+	}
+
+	return busy, nil
+}
+
+// parseRange parses the bounds of a range, each either an RFC 3339 date-time or a date. A date
+// starts the range at the start of the day, or ends it at the end of the day, in the business's
+// location.
+func parseRange(startValue, endValue string) (time.Time, time.Time, error) {
+	start, err := parseRangeBound(startsAtParam, startValue, false)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	end, err := parseRangeBound(endsAtParam, endValue, true)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s must be after %s", endsAtParam, startsAtParam)
+	}
+
+	if end.Sub(start) > maxFreeBusyRange {
+		return time.Time{}, time.Time{}, fmt.Errorf("range must be at most %d days", maxFreeBusyRange/(24*time.Hour))
+	}
+
+	return start, end, nil
+}
+
+func parseRangeBound(name, value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("%s is required", name)
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	date, err := time.ParseInLocation(dateFormat, value, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be a date-time or a date", name)
+	}
+
+	if end {
+		date = date.AddDate(0, 0, 1)
+	}
+
+	return date, nil
+}
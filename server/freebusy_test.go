@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFreeBusy(t *testing.T) {
+	forEachStorage(t, testFreeBusy)
+}
+
+func testFreeBusy(t *testing.T, s *Server) {
+	seed(t, s)
+
+	// Appointments at 9:00 and 9:30, and a busy calendar's event from 11:00 to 12:00.
+	setup := []struct{ path, body string }{
+		{"/v1/appointments", apptBody("1")},
+		{"/v1/appointments", strings.NewReplacer("T09:30", "T10:00", "T09:00", "T09:30").Replace(apptBody("1"))},
+		{"/v1/appointments", apptBody("2")},
+		{"/v1/trainers/1/busy-calendars?name=Other+gym", busyICS([]string{"DTSTART:20200102T190000Z", "DTEND:20200102T200000Z"})},
+	}
+	for _, req := range setup {
+		if w := do(s, "POST", req.path, req.body, "Content-Type", "text/calendar"); w.Code != http.StatusOK && w.Code != http.StatusCreated {
+			t.Fatalf("POST %s: Expected success, got %d: %s", req.path, w.Code, w.Body)
+		}
+	}
+
+	testCases := []struct {
+		query      string
+		busy, free []string
+	}{
+		{
+			"starts_at=2020-01-02&ends_at=2020-01-02",
+			[]string{"09:00-10:00", "11:00-12:00"},
+			[]string{"08:00-09:00", "10:00-11:00", "12:00-17:00"},
+		},
+		{
+			"starts_at=2020-01-02T09:15:00-08:00&ends_at=2020-01-02T19:30:00Z",
+			[]string{"09:15-10:00", "11:00-11:30"},
+			[]string{"10:00-11:00"},
+		},
+		{
+			"starts_at=2020-01-02T16:00:00-08:00&ends_at=2020-01-03T09:00:00-08:00",
+			[]string{},
+			[]string{"16:00-17:00", "08:00-09:00"},
+		},
+	}
+
+	format := func(periods []periodResponse) []string {
+		s := make([]string, len(periods))
+		for i, p := range periods {
+			s[i] = p.Start.In(location).Format("15:04") + "-" + p.End.In(location).Format("15:04")
+		}
+		return s
+	}
+
+	for _, tc := range testCases {
+		w := do(s, "GET", "/v1/trainers/1/freebusy?"+tc.query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: Expected %d, got %d: %s", tc.query, http.StatusOK, w.Code, w.Body)
+		}
+
+		var resp freeBusyResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := format(resp.Busy); !equalStrings(got, tc.busy) {
+			t.Errorf("%s: Expected busy %v, got %v", tc.query, tc.busy, got)
+		}
+		if got := format(resp.Free); !equalStrings(got, tc.free) {
+			t.Errorf("%s: Expected free %v, got %v", tc.query, tc.free, got)
+		}
+	}
+
+	w := do(s, "GET", "/v1/trainers/1/freebusy?starts_at=2020-01-02&ends_at=2020-01-02&format=ics", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != calendarContentType {
+		t.Fatalf("Expected a calendar, got %d %v: %s", w.Code, w.Header(), w.Body)
+	}
+
+	body := strings.ReplaceAll(w.Body.String(), "\r\n ", "")
+	for _, line := range []string{
+		"BEGIN:VFREEBUSY",
+		"DTSTART:20200102T080000Z",
+		"DTEND:20200103T080000Z",
+		"FREEBUSY;FBTYPE=BUSY:20200102T170000Z/20200102T180000Z,20200102T190000Z/20200102T200000Z",
+		"FREEBUSY;FBTYPE=FREE:20200102T160000Z/20200102T170000Z,20200102T180000Z/20200102T190000Z," +
+			"20200102T200000Z/20200103T010000Z",
+	} {
+		if !strings.Contains(body, line+"\r\n") {
+			t.Errorf("Expected %q in\n%s", line, body)
+		}
+	}
+
+	invalid := []struct {
+		path string
+		e    int
+	}{
+		{"/v1/trainers/1/freebusy?starts_at=2020-01-02", http.StatusBadRequest},
+		{"/v1/trainers/1/freebusy?starts_at=2020-01-02&ends_at=2020-01-02T09", http.StatusBadRequest},
+		{"/v1/trainers/1/freebusy?starts_at=2020-01-02T10:00:00Z&ends_at=2020-01-02T09:00:00Z", http.StatusBadRequest},
+		{"/v1/trainers/1/freebusy?starts_at=2020-01-02&ends_at=2021-06-01", http.StatusBadRequest},
+		{"/v1/trainers/1/freebusy?starts_at=2020-01-02&ends_at=2020-01-02&format=xml", http.StatusBadRequest},
+		{"/v1/trainers/9/freebusy?starts_at=2020-01-02&ends_at=2020-01-02", http.StatusNotFound},
+	}
+
+	for _, tc := range invalid {
+		if w := do(s, "GET", tc.path, ""); w.Code != tc.e {
+			t.Errorf("%s: Expected %d, got %d: %s", tc.path, tc.e, w.Code, w.Body)
+		}
+	}
+}
@@ -8,19 +8,34 @@ import (
 	"net/http"
 	"reflect"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/store"
 )
 
 type modelHandler struct {
-	db *gorm.DB
-
-	model reflect.Type
+	store  store.Store
+	logger *log.Logger
+	clock  clock.Clock
+	// resource is the resource's path, such as appointments, under which changes are audited.
+	resource string
+	// models returns the resource's storage within s, which may be a transaction.
+	models func(s store.Store) store.ModelStore
+
+	model  reflect.Type
+	rep    representation
+	policy *policy
 
 	idParam string
 	queries []queries
+
+	// asOf, if set, returns the resource's storage as it was at t, for reads with ?as_of=.
+	asOf func(s store.Store, t time.Time) store.ModelStore
 }
 
 type queries struct {
@@ -28,7 +43,11 @@ type queries struct {
 	op    string
 }
 
-func newModelHandler(db *gorm.DB, model interface{}, idParam string, queries []queries) *modelHandler {
+func newModelHandler(
+	s store.Store, logger *log.Logger, clock clock.Clock, resource string,
+	models func(store.Store) store.ModelStore, model interface{}, rep representation, pol *policy,
+	idParam string, queries []queries,
+) *modelHandler {
 	modelType := reflect.TypeOf(model)
 	if modelType.Kind() != reflect.Ptr {
 		panic("model must be a pointer")
@@ -45,63 +64,104 @@ func newModelHandler(db *gorm.DB, model interface{}, idParam string, queries []q
 	}
 
 	return &modelHandler{
-		db:      db,
-		model:   modelType,
-		idParam: idParam,
-		queries: queries,
+		store:    s,
+		logger:   logger,
+		clock:    clock,
+		resource: resource,
+		models:   models,
+		model:    modelType,
+		rep:      rep,
+		policy:   pol,
+		idParam:  idParam,
+		queries:  queries,
 	}
 }
 
 func (mh *modelHandler) create(w http.ResponseWriter, r *http.Request) {
+	if !mh.checkQuery(w, r) {
+		return
+	}
+
 	model := reflect.New(mh.model).Interface()
 
-	if err := json.NewDecoder(r.Body).Decode(model); err != nil {
-		log.Printf("Error decoding body: %v", err)
+	if err := mh.rep.decode(r.Body, model); err != nil {
+		mh.logger.Printf("Error decoding body: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	// If the passed model has an ID, update the auto-increment sequence.
-	id := reflect.ValueOf(model).Elem().FieldByName("ID")
-	if id.IsValid() && id.Uint() != 0 {
-		err := mh.createWithID(mh.db, model)
-		if err != nil {
-			log.Printf("Error creating model with ID: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	mh.insert(w, r, model)
+}
+
+// insert creates the model and writes the response.
+func (mh *modelHandler) insert(w http.ResponseWriter, r *http.Request, model interface{}) {
+	if !mh.allows(r, actionCreate, model) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	setModelVersion(model, 1)
+	setEmailVerified(auth.FromContext(r.Context()), model, nil)
+
+	err := mh.store.Transaction(func(tx store.Store) error {
+		if err := mh.models(tx).Create(model); err != nil {
+			return err
 		}
-	} else {
-		if result := mh.db.Create(model); result.Error != nil {
-			log.Printf("Error creating model: %v", result.Error)
-			w.WriteHeader(http.StatusInternalServerError)
+
+		return recordAudit(tx, r, auditCreate, mh.resource, modelID(model), nil, model)
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrDuplicate) {
+			w.WriteHeader(http.StatusConflict)
 			return
 		}
+
+		mh.logger.Printf("Error creating model: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	err := json.NewEncoder(w).Encode(model)
+	w.Header().Set(etagHeader, etag(modelVersion(model)))
+	mh.respond(w, r, model)
+}
+
+// respond writes the representation of model as the response.
+func (mh *modelHandler) respond(w http.ResponseWriter, r *http.Request, model interface{}) {
+	body, err := encodeOne(mh.rep, mh.store, r, model)
 	if err != nil {
-		log.Printf("Error encoding model: %v", err)
+		mh.writeEncodeError(w, err)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		mh.logger.Printf("Error encoding model: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
-func (mh *modelHandler) createWithID(db *gorm.DB, model interface{}) error {
-	return db.Transaction(func(tx *gorm.DB) error {
-		if result := tx.Create(model); result.Error != nil {
-			return result.Error
-		}
+// checkQuery responds with an error and returns false if the response couldn't be built for the
+// request's query. Writes check it first, so that they aren't applied for requests that fail.
+func (mh *modelHandler) checkQuery(w http.ResponseWriter, r *http.Request) bool {
+	if err := mh.rep.checkQuery(r); err != nil {
+		mh.writeEncodeError(w, err)
+		return false
+	}
 
-		// Gorm default table name is the model name in lowercase plural.
-		tableName := strings.ToLower(mh.model.Name()) + "s"
-		log.Printf("Setting sequence for table name: %s", tableName)
-		result := tx.Exec("SELECT setval(pg_get_serial_sequence(?, 'id'), max(id)) FROM "+tableName, tableName)
-		if result.Error != nil {
-			return result.Error
-		}
+	return true
+}
 
-		return nil
-	})
+// writeEncodeError responds to an error building a representation.
+func (mh *modelHandler) writeEncodeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInvalidInclude) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	mh.logger.Printf("Error building response: %v", err)
+	w.WriteHeader(http.StatusInternalServerError)
 }
 
 func (mh *modelHandler) get(w http.ResponseWriter, r *http.Request) {
@@ -113,10 +173,15 @@ func (mh *modelHandler) get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	model := reflect.New(mh.model).Interface()
-	result := mh.db.First(model, id)
-	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+	models, err := mh.view(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	model, err := mh.find(models, id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
@@ -125,52 +190,132 @@ func (mh *modelHandler) get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = json.NewEncoder(w).Encode(model)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if !mh.allows(r, actionRead, model) {
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	version := modelVersion(model)
+	w.Header().Set(etagHeader, etag(version))
+	if notModified(r, version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	mh.respond(w, r, model)
 }
 
 func (mh *modelHandler) list(w http.ResponseWriter, r *http.Request) {
-	var wheres []interface{}
-	var args []interface{}
+	// Principals who may only read their own models get a list of those.
+	filter, ok := mh.policy.readScope(auth.FromContext(r.Context()))
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	vars := mux.Vars(r)
 	for _, q := range mh.queries {
-		value := r.URL.Query().Get(q.param)
+		// Nested routes such as /trainers/{trainer_id}/appointments filter by path variable.
+		value, ok := vars[q.param]
+		if !ok {
+			value = r.URL.Query().Get(q.param)
+		}
 		if value == "" {
 			continue
 		}
 
-		wheres = append(wheres, fmt.Sprintf("%s %s ?", q.param, q.op))
-		args = append(args, value)
+		filter = append(filter, store.Condition{Column: q.param, Op: q.op, Value: value})
+	}
+
+	view, err := mh.view(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
 	models := reflect.New(reflect.SliceOf(mh.model)).Interface()
+	if err := view.List(filter, models); err != nil {
+		mh.logger.Printf("Error listing models: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	if len(wheres) > 0 {
-		result := mh.db.Where(wheres, args...).Find(models)
-		if result.Error != nil {
+	modelsValue := reflect.ValueOf(models).Elem()
+	items := make([]interface{}, modelsValue.Len())
+	for i := range items {
+		items[i] = modelsValue.Index(i).Addr().Interface()
+	}
+
+	bodies, err := mh.rep.encode(mh.store, r, items)
+	if err != nil {
+		mh.writeEncodeError(w, err)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(bodies)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (mh *modelHandler) update(w http.ResponseWriter, r *http.Request) {
+	if !mh.checkQuery(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	idParam := vars[mh.idParam]
+	id, err := strconv.Atoi(idParam)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	existing, err := mh.find(mh.models(mh.store), id)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-	} else {
-		result := mh.db.Find(models)
-		if result.Error != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+
+		// A PUT to an ID that doesn't exist yet creates it, unless the client expected a
+		// particular version to be there.
+		if r.Header.Get(ifMatchHeader) != "" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		model := reflect.New(mh.model).Interface()
+		if err := mh.rep.decode(r.Body, model); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		reflect.ValueOf(model).Elem().FieldByName("ID").SetUint(uint64(id))
+
+		mh.insert(w, r, model)
+		return
 	}
 
-	err := json.NewEncoder(w).Encode(models)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if !checkIfMatch(w, r, modelVersion(existing)) {
 		return
 	}
+
+	model := reflect.New(mh.model).Interface()
+	if err := mh.rep.decode(r.Body, model); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	copyModelFields(model, existing, "ID", "CreatedAt")
+
+	mh.save(w, r, model, existing)
 }
 
-func (mh *modelHandler) update(w http.ResponseWriter, r *http.Request) {
+func (mh *modelHandler) patch(w http.ResponseWriter, r *http.Request) {
+	if !mh.checkQuery(w, r) {
+		return
+	}
+
 	vars := mux.Vars(r)
 	idParam := vars[mh.idParam]
 	id, err := strconv.Atoi(idParam)
@@ -179,27 +324,79 @@ func (mh *modelHandler) update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	modelValue := reflect.New(mh.model)
-	modelValue.FieldByName("ID").SetInt(int64(id))
-	model := modelValue.Interface()
+	existing, err := mh.find(mh.models(mh.store), id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(model); err != nil {
+	if !checkIfMatch(w, r, modelVersion(existing)) {
+		return
+	}
+
+	// Decoding on top of a copy of the existing model leaves fields missing from the body as
+	// they were.
+	model := reflect.New(mh.model).Interface()
+	reflect.ValueOf(model).Elem().Set(reflect.ValueOf(existing).Elem())
+	if err := mh.rep.decode(r.Body, model); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	copyModelFields(model, existing, "ID", "CreatedAt")
 
-	if result := mh.db.Save(model); result.Error != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	mh.save(w, r, model, existing)
+}
+
+// find loads the model with the given ID from models.
+func (mh *modelHandler) find(models store.ModelStore, id int) (interface{}, error) {
+	model := reflect.New(mh.model).Interface()
+	if err := models.Get(uint(id), model); err != nil {
+		return nil, err
+	}
+
+	return model, nil
+}
+
+// save writes model over existing, bumping its version, and writes the response. If another
+// request updated it since existing was read, it responds with 412.
+func (mh *modelHandler) save(w http.ResponseWriter, r *http.Request, model, existing interface{}) {
+	// Owners may neither change a model they don't own nor give theirs away.
+	if !mh.allows(r, actionUpdate, existing) || !mh.allows(r, actionUpdate, model) {
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
+	setEmailVerified(auth.FromContext(r.Context()), model, existing)
+
+	err := mh.store.Transaction(func(tx store.Store) error {
+		if err := mh.models(tx).Update(model, modelVersion(existing)); err != nil {
+			return err
+		}
 
-	err = json.NewEncoder(w).Encode(model)
+		return recordAudit(tx, r, auditUpdate, mh.resource, modelID(model), existing, model)
+	})
 	if err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		if errors.Is(err, store.ErrDuplicate) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		mh.logger.Printf("Error updating model: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set(etagHeader, etag(modelVersion(model)))
+	mh.respond(w, r, model)
 }
 
 func (mh *modelHandler) delete(w http.ResponseWriter, r *http.Request) {
@@ -211,14 +408,185 @@ func (mh *modelHandler) delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	modelValue := reflect.New(mh.model)
-	modelValue.FieldByName("ID").SetInt(int64(id))
-	model := modelValue.Interface()
+	model, err := mh.find(mh.models(mh.store), id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !mh.allows(r, actionDelete, model) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	version := modelVersion(model)
+	if !checkIfMatch(w, r, version) {
+		return
+	}
 
-	if result := mh.db.Delete(model); result.Error != nil {
+	err = mh.store.Transaction(func(tx store.Store) error {
+		return mh.deleteModel(tx, r, model)
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		mh.logger.Printf("Error deleting model: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// restore undoes the deletion of a model. Like a delete, it needs the model's version in
+// If-Match.
+func (mh *modelHandler) restore(w http.ResponseWriter, r *http.Request) {
+	if !mh.checkQuery(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	idParam := vars[mh.idParam]
+	id, err := strconv.Atoi(idParam)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	model, err := mh.find(mh.models(mh.store).WithDeleted(), id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !mh.allows(r, actionRestore, model) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !modelDeleted(model) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("not deleted"))
+		return
+	}
+
+	version := modelVersion(model)
+	if !checkIfMatch(w, r, version) {
+		return
+	}
+
+	before := copyModel(model)
+	err = mh.store.Transaction(func(tx store.Store) error {
+		if err := mh.models(tx).Restore(model, version); err != nil {
+			return err
+		}
+
+		return recordAudit(tx, r, auditRestore, mh.resource, modelID(model), before, model)
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		if errors.Is(err, store.ErrDuplicate) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		mh.logger.Printf("Error restoring model: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(etagHeader, etag(modelVersion(model)))
+	mh.respond(w, r, model)
+}
+
+// deleteModel deletes model in tx at its version and records the deletion.
+func (mh *modelHandler) deleteModel(tx store.Store, r *http.Request, model interface{}) error {
+	// The GORM store sets the deletion time on model, so keep a copy from before.
+	before := copyModel(model)
+	if err := mh.models(tx).Delete(model, modelVersion(model)); err != nil {
+		return err
+	}
+
+	id := modelID(model)
+	deleted, err := mh.find(mh.models(tx).WithDeleted(), int(id))
+	if err != nil {
+		return err
+	}
+
+	return recordAudit(tx, r, auditDelete, mh.resource, id, before, deleted)
+}
+
+// allows reports whether the request's principal may take the action on model.
+func (mh *modelHandler) allows(r *http.Request, a action, model interface{}) bool {
+	return mh.policy.allows(auth.FromContext(r.Context()), a, model)
+}
+
+// view returns the resource's storage, which includes deleted models if the request asks for
+// them with ?include_deleted=true, and is as it was at a past time with ?as_of=.
+func (mh *modelHandler) view(r *http.Request) (store.ModelStore, error) {
+	models := mh.models(mh.store)
+	if value := r.URL.Query().Get(asOfParam); value != "" {
+		if mh.asOf == nil {
+			return nil, fmt.Errorf("%s has no history", mh.resource)
+		}
+
+		at, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, err
+		}
+
+		models = mh.asOf(mh.store, at)
+	}
+
+	value := r.URL.Query().Get(includeDeletedParam)
+	if value == "" {
+		return models, nil
+	}
+
+	includeDeleted, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if includeDeleted {
+		models = models.WithDeleted()
+	}
+
+	return models, nil
+}
+
+// modelDeleted reports whether a pointer to a model has been soft deleted.
+func modelDeleted(model interface{}) bool {
+	return reflect.ValueOf(model).Elem().FieldByName("DeletedAt").Interface().(gorm.DeletedAt).Valid
+}
+
+// modelID returns the ID of a pointer to a model.
+func modelID(model interface{}) uint {
+	return uint(reflect.ValueOf(model).Elem().FieldByName("ID").Uint())
+}
+
+// copyModelFields copies the named fields from src to dst, both pointers to the same model.
+func copyModelFields(dst, src interface{}, fields ...string) {
+	dstValue := reflect.ValueOf(dst).Elem()
+	srcValue := reflect.ValueOf(src).Elem()
+	for _, field := range fields {
+		dstValue.FieldByName(field).Set(srcValue.FieldByName(field))
+	}
+}
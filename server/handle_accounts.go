@@ -0,0 +1,615 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+const (
+	// Kinds of user tokens
+	tokenKindRefresh       = "refresh"
+	tokenKindPasswordReset = "password_reset"
+
+	retryAfterHeader = "Retry-After"
+
+	defaultAccessTokenTTL   = 15 * time.Minute
+	defaultRefreshTokenTTL  = 30 * 24 * time.Hour
+	defaultPasswordResetTTL = time.Hour
+	defaultMaxFailedLogins  = 5
+	defaultLockoutDuration  = 15 * time.Minute
+)
+
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// AccountsConfig configures users' password accounts. Access tokens are JWTs signed with the
+// server's JWT HS256 secret, so accounts need one.
+type AccountsConfig struct {
+	// AccessTokenTTL is how long access tokens last. Defaults to 15 minutes.
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL is how long refresh tokens last. Defaults to 30 days.
+	RefreshTokenTTL time.Duration
+	// PasswordResetTTL is how long password reset tokens last. Defaults to an hour.
+	PasswordResetTTL time.Duration
+	// MaxFailedLogins is how many wrong passwords in a row lock an account. Defaults to 5.
+	MaxFailedLogins int
+	// LockoutDuration is how long an account stays locked. Defaults to 15 minutes.
+	LockoutDuration time.Duration
+	// PasswordHashCost is the bcrypt cost. Defaults to bcrypt's default.
+	PasswordHashCost int
+}
+
+// withDefaults returns the config with defaults for the unset fields.
+func (c AccountsConfig) withDefaults() AccountsConfig {
+	if c.AccessTokenTTL == 0 {
+		c.AccessTokenTTL = defaultAccessTokenTTL
+	}
+	if c.RefreshTokenTTL == 0 {
+		c.RefreshTokenTTL = defaultRefreshTokenTTL
+	}
+	if c.PasswordResetTTL == 0 {
+		c.PasswordResetTTL = defaultPasswordResetTTL
+	}
+	if c.MaxFailedLogins == 0 {
+		c.MaxFailedLogins = defaultMaxFailedLogins
+	}
+	if c.LockoutDuration == 0 {
+		c.LockoutDuration = defaultLockoutDuration
+	}
+
+	return c
+}
+
+// PasswordResetSender delivers a password reset token to the user, e.g. by email.
+type PasswordResetSender func(user models.User, token string) error
+
+type registerRequest struct {
+	Name     string `json:"name" validate:"required"`
+	Email    string `json:"email" validate:"required,email"`
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required,min=8"`
+}
+
+type loginRequest struct {
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// refreshRequest is the body of requests to refresh a session or log out of it.
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type passwordResetRequest struct {
+	Username string `json:"username" validate:"required"`
+}
+
+type passwordResetConfirmRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8"`
+}
+
+// tokenResponse is the body returned when logging in. It names the user or trainer logged in as;
+// only users get a refresh token.
+type tokenResponse struct {
+	UserID      uint   `json:"user_id,omitempty"`
+	TrainerID   uint   `json:"trainer_id,omitempty"`
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// ExpiresIn is the number of seconds the access token lasts.
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// accountHandler lets users register and log in with a password. Logged in users get a
+// short-lived JWT access token and a refresh token, which is exchanged for new tokens once.
+type accountHandler struct {
+	store     store.Store
+	logger    *log.Logger
+	clock     clock.Clock
+	config    AccountsConfig
+	jwt       auth.JWTConfig
+	sendReset PasswordResetSender
+	validator *validator.Validate
+}
+
+func newAccountHandler(
+	s store.Store, logger *log.Logger, clock clock.Clock, config AccountsConfig, jwt auth.JWTConfig,
+	sendReset PasswordResetSender,
+) *accountHandler {
+	if sendReset == nil {
+		sendReset = func(user models.User, token string) error {
+			logger.Printf("No password reset sender is configured; the reset for user %d wasn't sent", user.ID)
+			return nil
+		}
+	}
+
+	return &accountHandler{
+		store:     s,
+		logger:    logger,
+		clock:     clock,
+		config:    config.withDefaults(),
+		jwt:       jwt,
+		sendReset: sendReset,
+		validator: validator.New(),
+	}
+}
+
+// ready reports whether access tokens can be signed. If not, it responds with 503.
+func (ah *accountHandler) ready(w http.ResponseWriter) bool {
+	if len(ah.jwt.HS256Secret) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("accounts need a JWT HS256 secret to sign access tokens"))
+		return false
+	}
+
+	return true
+}
+
+// decode reads and validates the request body into req. If that fails, it responds with 400, or
+// 503 if access tokens can't be signed.
+func (ah *accountHandler) decode(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if !ah.ready(w) {
+		return false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		ah.logger.Printf("Error decoding body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+
+	if err := ah.validator.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return false
+	}
+
+	return true
+}
+
+// register creates a user with a password, and logs them in.
+func (ah *accountHandler) register(w http.ResponseWriter, r *http.Request) {
+	var req registerRequest
+	if !ah.decode(w, r, &req) {
+		return
+	}
+
+	hash, err := auth.HashPassword(req.Password, ah.config.PasswordHashCost)
+	if err != nil {
+		ah.logger.Printf("Error hashing password: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var tokens *tokenResponse
+	txErr := ah.store.Transaction(func(tx store.Store) error {
+		if _, err := findUsername(tx, req.Username); !errors.Is(err, store.ErrNotFound) {
+			if err == nil {
+				w.WriteHeader(http.StatusConflict)
+				return errors.New("username is taken")
+			}
+
+			ah.logger.Printf("Error finding user: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+
+		user := models.User{Name: req.Name, Email: req.Email, Username: req.Username, Version: 1}
+		err := tx.Users().Create(&user)
+		if err == nil {
+			err = recordAudit(tx, r, auditCreate, "users", user.ID, nil, &user)
+		}
+
+		if errors.Is(err, store.ErrDuplicate) {
+			// Another request registered the username since we looked.
+			w.WriteHeader(http.StatusConflict)
+			return errors.New("username is taken")
+		}
+
+		if err != nil {
+			ah.logger.Printf("Error creating user: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+
+		if err := tx.Accounts().SaveCredential(&models.Credential{UserID: user.ID, PasswordHash: hash}); err != nil {
+			ah.logger.Printf("Error saving credential: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+
+		tokens, err = ah.issueTokens(tx, user)
+		if err != nil {
+			ah.logger.Printf("Error issuing tokens: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+	})
+	if txErr != nil {
+		_, _ = w.Write([]byte(txErr.Error()))
+		return
+	}
+
+	ah.logger.Printf("Registered user %d", tokens.UserID)
+	ah.respond(w, http.StatusCreated, tokens)
+}
+
+// login exchanges a username and password for tokens. After MaxFailedLogins wrong passwords in a
+// row, the account is locked for LockoutDuration.
+func (ah *accountHandler) login(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if !ah.decode(w, r, &req) {
+		return
+	}
+
+	user, err := findUsername(ah.store, req.Username)
+	var cred *models.Credential
+	if err == nil {
+		cred, err = ah.store.Accounts().GetCredential(user.ID)
+	}
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			unauthorized(w, errInvalidCredentials.Error())
+			return
+		}
+
+		ah.logger.Printf("Error finding credential: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := ah.clock.Now()
+	if cred.LockedUntil != nil && now.Before(*cred.LockedUntil) {
+		retryAfter := math.Ceil(cred.LockedUntil.Sub(now).Seconds())
+		w.Header().Set(retryAfterHeader, strconv.Itoa(int(retryAfter)))
+		w.WriteHeader(http.StatusLocked)
+		_, _ = w.Write([]byte("too many failed logins; try again later"))
+		return
+	}
+
+	err = auth.CheckPassword(cred.PasswordHash, req.Password)
+	if errors.Is(err, auth.ErrWrongPassword) {
+		if err := ah.recordLogin(user.ID, false); err != nil {
+			ah.logger.Printf("Error recording failed login: %v", err)
+		}
+
+		unauthorized(w, errInvalidCredentials.Error())
+		return
+	}
+
+	if err != nil {
+		ah.logger.Printf("Error checking password: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := ah.recordLogin(user.ID, true); err != nil {
+		ah.logger.Printf("Error recording login: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := ah.issueTokens(ah.store, *user)
+	if err != nil {
+		ah.logger.Printf("Error issuing tokens: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ah.respond(w, http.StatusOK, tokens)
+}
+
+// recordLogin counts a failed login, locking the account after too many, or resets the count
+// after a successful one.
+func (ah *accountHandler) recordLogin(userID uint, succeeded bool) error {
+	return ah.store.Transaction(func(tx store.Store) error {
+		cred, err := tx.Accounts().GetCredential(userID)
+		if err != nil {
+			return err
+		}
+
+		if succeeded {
+			cred.FailedLogins = 0
+			cred.LockedUntil = nil
+		} else {
+			cred.FailedLogins++
+			if cred.FailedLogins >= ah.config.MaxFailedLogins {
+				lockedUntil := ah.clock.Now().Add(ah.config.LockoutDuration)
+				cred.LockedUntil = &lockedUntil
+				cred.FailedLogins = 0
+				ah.logger.Printf("Locked user %d until %s", userID, lockedUntil.Format(time.RFC3339))
+			}
+		}
+
+		return tx.Accounts().SaveCredential(cred)
+	})
+}
+
+// refresh exchanges a refresh token for new tokens. Each refresh token can only be used once; if
+// one is used again, it may have been stolen, so every session of the user is ended.
+func (ah *accountHandler) refresh(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if !ah.decode(w, r, &req) {
+		return
+	}
+
+	var tokens *tokenResponse
+	txErr := ah.store.Transaction(func(tx store.Store) error {
+		hash := auth.HashToken(req.RefreshToken)
+		stored, err := tx.Accounts().GetToken(tokenKindRefresh, hash)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				unauthorized(w, "invalid refresh token")
+				return nil
+			}
+
+			return err
+		}
+
+		if stored.UsedAt != nil {
+			ah.logger.Printf("Refresh token reused for user %d; ending their sessions", stored.UserID)
+			if err := tx.Accounts().RevokeTokens(stored.UserID, tokenKindRefresh); err != nil {
+				return err
+			}
+
+			unauthorized(w, "invalid refresh token")
+			return nil
+		}
+
+		if !ah.clock.Now().Before(stored.ExpiresAt) {
+			unauthorized(w, "refresh token expired")
+			return nil
+		}
+
+		var user models.User
+		if err := tx.Users().Get(stored.UserID, &user); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				unauthorized(w, "invalid refresh token")
+				return nil
+			}
+
+			return err
+		}
+
+		if err := tx.Accounts().UseToken(hash); err != nil {
+			if errors.Is(err, store.ErrConflict) {
+				unauthorized(w, "invalid refresh token")
+				return nil
+			}
+
+			return err
+		}
+
+		tokens, err = ah.issueTokens(tx, user)
+		return err
+	})
+	if txErr != nil {
+		ah.logger.Printf("Error refreshing tokens: %v", txErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if tokens != nil {
+		ah.respond(w, http.StatusOK, tokens)
+	}
+}
+
+// logout ends the session of a refresh token. Access tokens already issued last until they
+// expire.
+func (ah *accountHandler) logout(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if !ah.decode(w, r, &req) {
+		return
+	}
+
+	err := ah.store.Accounts().UseToken(auth.HashToken(req.RefreshToken))
+	if err != nil && !errors.Is(err, store.ErrConflict) {
+		ah.logger.Printf("Error revoking refresh token: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestPasswordReset sends the user a token to set a new password with. It responds the same
+// whether or not the user exists, so that it can't be used to find usernames.
+func (ah *accountHandler) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetRequest
+	if !ah.decode(w, r, &req) {
+		return
+	}
+
+	user, err := findUsername(ah.store, req.Username)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		ah.logger.Printf("Error finding user: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if user != nil {
+		token, err := ah.createToken(ah.store, user.ID, tokenKindPasswordReset, ah.config.PasswordResetTTL)
+		if err != nil {
+			ah.logger.Printf("Error creating password reset token: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err := ah.sendReset(*user, token); err != nil {
+			ah.logger.Printf("Error sending password reset: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// confirmPasswordReset sets a new password with a reset token. It unlocks the account and ends
+// the user's sessions.
+func (ah *accountHandler) confirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetConfirmRequest
+	if !ah.decode(w, r, &req) {
+		return
+	}
+
+	passwordHash, err := auth.HashPassword(req.Password, ah.config.PasswordHashCost)
+	if err != nil {
+		ah.logger.Printf("Error hashing password: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	txErr := ah.store.Transaction(func(tx store.Store) error {
+		hash := auth.HashToken(req.Token)
+		stored, err := tx.Accounts().GetToken(tokenKindPasswordReset, hash)
+		if errors.Is(err, store.ErrNotFound) ||
+			(err == nil && (stored.UsedAt != nil || !ah.clock.Now().Before(stored.ExpiresAt))) {
+			w.WriteHeader(http.StatusBadRequest)
+			return errors.New("invalid or expired token")
+		}
+
+		if err == nil {
+			err = tx.Accounts().UseToken(hash)
+		}
+		if err == nil {
+			err = tx.Accounts().SaveCredential(&models.Credential{UserID: stored.UserID, PasswordHash: passwordHash})
+		}
+		if err == nil {
+			err = tx.Accounts().RevokeTokens(stored.UserID, tokenKindRefresh)
+		}
+		if err != nil {
+			ah.logger.Printf("Error resetting password: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+	})
+	if txErr != nil {
+		_, _ = w.Write([]byte(txErr.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// issueTokens returns a new access token and refresh token for the user, who acts as a client.
+func (ah *accountHandler) issueTokens(s store.Store, user models.User) (*tokenResponse, error) {
+	tokens, err := ah.accessToken(auth.Claims{
+		"sub":     fmt.Sprintf("user:%d", user.ID),
+		"role":    auth.RoleClient,
+		"user_id": user.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tokens.UserID = user.ID
+	tokens.RefreshToken, err = ah.createToken(s, user.ID, tokenKindRefresh, ah.config.RefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// issueTrainerToken returns a new access token for the trainer. Refresh tokens are only issued to
+// users, so trainers log in again when it expires.
+func (ah *accountHandler) issueTrainerToken(trainer models.Trainer) (*tokenResponse, error) {
+	tokens, err := ah.accessToken(auth.Claims{
+		"sub":        fmt.Sprintf("trainer:%d", trainer.ID),
+		"role":       auth.RoleTrainer,
+		"trainer_id": trainer.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tokens.TrainerID = trainer.ID
+	return tokens, nil
+}
+
+// accessToken signs an access token with claims, which expires after AccessTokenTTL.
+func (ah *accountHandler) accessToken(claims auth.Claims) (*tokenResponse, error) {
+	now := ah.clock.Now()
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ah.config.AccessTokenTTL).Unix()
+	if ah.jwt.Issuer != "" {
+		claims["iss"] = ah.jwt.Issuer
+	}
+	if ah.jwt.Audience != "" {
+		claims["aud"] = ah.jwt.Audience
+	}
+
+	accessToken, err := auth.SignJWT(claims, ah.jwt.HS256Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   bearerScheme,
+		ExpiresIn:   int(ah.config.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// createToken stores a new token of the kind for the user, which expires after ttl.
+func (ah *accountHandler) createToken(s store.Store, userID uint, kind string, ttl time.Duration) (string, error) {
+	token, err := auth.NewToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = s.Accounts().CreateToken(&models.UserToken{
+		Hash:      auth.HashToken(token),
+		UserID:    userID,
+		Kind:      kind,
+		ExpiresAt: ah.clock.Now().Add(ttl),
+	})
+	return token, err
+}
+
+// respond writes tokens, which are credentials, so the response isn't stored; see noStore.
+func (ah *accountHandler) respond(w http.ResponseWriter, status int, body interface{}) {
+	noStore(w)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		ah.logger.Printf("Error encoding response: %v", err)
+	}
+}
+
+// findUsername returns the user with the username, or ErrNotFound. Usernames are unique, so more
+// than one match is an error rather than a guess.
+func findUsername(s store.Store, username string) (*models.User, error) {
+	var users []models.User
+	filter := store.Filter{{Column: "username", Op: "=", Value: username}}
+	if err := s.Users().List(filter, &users); err != nil {
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return nil, store.ErrNotFound
+	}
+
+	if len(users) > 1 {
+		return nil, fmt.Errorf("%d users have username %q", len(users), username)
+	}
+
+	return &users[0], nil
+}
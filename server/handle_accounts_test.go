@@ -0,0 +1,224 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/models"
+)
+
+func TestAccounts(t *testing.T) {
+	for name, config := range testConfigs(t) {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			resets := map[string]string{}
+			send := func(user models.User, token string) error {
+				resets[user.Username] = token
+				return nil
+			}
+
+			s, err := New(config, WithClock(clock.NewFake(testNow)), WithPasswordResetSender(send))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			testAccounts(t, s, resets)
+		})
+	}
+}
+
+func testAccounts(t *testing.T, s *Server, resets map[string]string) {
+	// post sends a request without credentials, which the account routes don't need.
+	post := func(path, body string) (*tokenResponse, int) {
+		w := do(s, "POST", path, body, authorizationHeader, "")
+		if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+			return nil, w.Code
+		}
+
+		var tokens tokenResponse
+		if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+		return &tokens, w.Code
+	}
+	login := func(password string) (*tokenResponse, int) {
+		return post("/v1/auth/login", fmt.Sprintf(`{"username":"alice","password":%q}`, password))
+	}
+	refresh := func(token string) (*tokenResponse, int) {
+		return post("/v1/auth/refresh", fmt.Sprintf(`{"refresh_token":%q}`, token))
+	}
+
+	register := `{"name":"Alice","email":"alice@example.com","username":"alice","password":"correct horse"}`
+	registered, code := post("/v1/auth/register", register)
+	if code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d", http.StatusCreated, code)
+	}
+	if _, code := post("/v1/auth/register", register); code != http.StatusConflict {
+		t.Errorf("Expected %d registering twice, got %d", http.StatusConflict, code)
+	}
+	short := `{"name":"Bob","email":"bob@example.com","username":"bob","password":"short"}`
+	if _, code := post("/v1/auth/register", short); code != http.StatusBadRequest {
+		t.Errorf("Expected %d for a short password, got %d", http.StatusBadRequest, code)
+	}
+
+	// The access token acts as the user, a client.
+	path := fmt.Sprintf("/v1/users/%d", registered.UserID)
+	if w := do(s, "GET", path, "", authorizationHeader, "Bearer "+registered.AccessToken); w.Code != http.StatusOK {
+		t.Errorf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if w := do(s, "GET", "/v1/trainers", "", authorizationHeader, "Bearer "+registered.AccessToken+"x"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d with a tampered token, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if _, code := login("wrong password"); code != http.StatusUnauthorized {
+		t.Errorf("Expected %d, got %d", http.StatusUnauthorized, code)
+	}
+	if _, code := post("/v1/auth/login", `{"username":"nobody","password":"correct horse"}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected %d for an unknown user, got %d", http.StatusUnauthorized, code)
+	}
+	if _, code := login("correct horse"); code != http.StatusOK {
+		t.Errorf("Expected %d, got %d", http.StatusOK, code)
+	}
+
+	// Refresh tokens rotate, and reusing one ends every session.
+	refreshed, code := refresh(registered.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+	}
+	if refreshed.RefreshToken == registered.RefreshToken {
+		t.Errorf("Expected a new refresh token")
+	}
+	if _, code := refresh(registered.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("Expected %d reusing a refresh token, got %d", http.StatusUnauthorized, code)
+	}
+	if _, code := refresh(refreshed.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("Expected %d after reuse, got %d", http.StatusUnauthorized, code)
+	}
+
+	loggedIn, _ := login("correct horse")
+	logout := fmt.Sprintf(`{"refresh_token":%q}`, loggedIn.RefreshToken)
+	if w := do(s, "POST", "/v1/auth/logout", logout, authorizationHeader, ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if _, code := refresh(loggedIn.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("Expected %d after logging out, got %d", http.StatusUnauthorized, code)
+	}
+
+	// Too many wrong passwords lock the account, even against the right one, until it expires.
+	for i := 0; i < defaultMaxFailedLogins; i++ {
+		if _, code := login("wrong password"); code != http.StatusUnauthorized {
+			t.Errorf("Expected %d, got %d", http.StatusUnauthorized, code)
+		}
+	}
+	w := do(s, "POST", "/v1/auth/login", `{"username":"alice","password":"correct horse"}`, authorizationHeader, "")
+	if w.Code != http.StatusLocked {
+		t.Errorf("Expected %d, got %d", http.StatusLocked, w.Code)
+	}
+	if got, want := w.Header().Get(retryAfterHeader), fmt.Sprint(int(defaultLockoutDuration.Seconds())); got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	fake := s.clock.(*clock.Fake)
+	fake.Set(testNow.Add(defaultLockoutDuration))
+	if _, code := login("correct horse"); code != http.StatusOK {
+		t.Errorf("Expected %d after the lockout, got %d", http.StatusOK, code)
+	}
+
+	// A reset sets a new password and ends every session.
+	loggedIn, _ = login("correct horse")
+	if w := do(s, "POST", "/v1/auth/password-reset", `{"username":"nobody"}`, authorizationHeader, ""); w.Code != http.StatusAccepted {
+		t.Errorf("Expected %d for an unknown user, got %d", http.StatusAccepted, w.Code)
+	}
+	if w := do(s, "POST", "/v1/auth/password-reset", `{"username":"alice"}`, authorizationHeader, ""); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected %d, got %d", http.StatusAccepted, w.Code)
+	}
+
+	confirm := fmt.Sprintf(`{"token":%q,"password":"battery staple"}`, resets["alice"])
+	if w := do(s, "POST", "/v1/auth/password-reset/confirm", confirm, authorizationHeader, ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected %d, got %d: %s", http.StatusNoContent, w.Code, w.Body)
+	}
+	if w := do(s, "POST", "/v1/auth/password-reset/confirm", confirm, authorizationHeader, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d reusing a reset token, got %d", http.StatusBadRequest, w.Code)
+	}
+	if _, code := login("correct horse"); code != http.StatusUnauthorized {
+		t.Errorf("Expected %d with the old password, got %d", http.StatusUnauthorized, code)
+	}
+	if _, code := login("battery staple"); code != http.StatusOK {
+		t.Errorf("Expected %d with the new password, got %d", http.StatusOK, code)
+	}
+	if _, code := refresh(loggedIn.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("Expected %d after a reset, got %d", http.StatusUnauthorized, code)
+	}
+
+	// Reset tokens expire.
+	do(s, "POST", "/v1/auth/password-reset", `{"username":"alice"}`, authorizationHeader, "")
+	fake.Set(fake.Now().Add(defaultPasswordResetTTL))
+	confirm = fmt.Sprintf(`{"token":%q,"password":"battery staple"}`, resets["alice"])
+	if w := do(s, "POST", "/v1/auth/password-reset/confirm", confirm, authorizationHeader, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d for an expired token, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAccountsWithoutSecret(t *testing.T) {
+	s, err := New(&Config{Storage: StorageMemory}, WithClock(clock.NewFake(testNow)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"username":"alice","password":"correct horse"}`
+	if w := do(s, "POST", "/v1/auth/login", body, authorizationHeader, ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestUniqueUsernames(t *testing.T) {
+	forEachStorage(t, testUniqueUsernames)
+}
+
+func testUniqueUsernames(t *testing.T, s *Server) {
+	alice := `{"name":"Alice","email":"alice@example.com","username":"alice"}`
+	bob := `{"name":"Bob","email":"bob@example.com","username":"bob"}`
+	nameless := `{"name":"Carol","email":"carol@example.com","username":""}`
+	// Bob, signed in, taking Alice's username.
+	client := []string{authorizationHeader, "Bearer " + testToken(s, auth.Claims{"sub": "bob", "role": auth.RoleClient, "user_id": 2}), "If-Match", `"1"`}
+
+	steps := []struct {
+		method, path, body string
+		header             []string
+		e                  int
+	}{
+		{"POST", "/v1/auth/register", `{"name":"Alice","email":"alice@example.com","username":"alice","password":"correct horse"}`, []string{authorizationHeader, ""}, http.StatusCreated},
+		{"POST", "/v1/users", bob, nil, http.StatusOK},
+		{"POST", "/v1/users", alice, nil, http.StatusConflict},
+		{"PATCH", "/v1/users/2", `{"username":"alice"}`, client, http.StatusConflict},
+		{"PUT", "/v1/users/2", alice, []string{"If-Match", `"1"`}, http.StatusConflict},
+		{"POST", "/v1/batch", `{"operations":[{"method":"create","resource":"users","body":` + alice + `}]}`, nil, http.StatusConflict},
+		{"POST", "/v1/auth/register", `{"name":"Bob","email":"bob@example.com","username":"bob","password":"correct horse"}`, []string{authorizationHeader, ""}, http.StatusConflict},
+
+		// Users without a username don't take it from each other.
+		{"POST", "/v1/users", nameless, nil, http.StatusOK},
+		{"POST", "/v1/users", nameless, nil, http.StatusOK},
+
+		// Deleted users don't hold their username, but can't be restored while it's taken.
+		{"DELETE", "/v1/users/1", "", []string{"If-Match", `"1"`}, http.StatusNoContent},
+		{"PATCH", "/v1/users/2", `{"username":"alice"}`, client, http.StatusOK},
+		{"POST", "/v1/users/1/restore", "", []string{"If-Match", `"1"`}, http.StatusConflict},
+	}
+
+	for i, step := range steps {
+		w := do(s, step.method, step.path, step.body, step.header...)
+		if w.Code != step.e {
+			t.Errorf("%d: %s %s: Expected %d, got %d: %s", i, step.method, step.path, step.e, w.Code, w.Body)
+		}
+	}
+
+	user, err := findUsername(s.store, "alice")
+	if err != nil || user.ID != 2 {
+		t.Errorf("Expected user 2, got %+v %v", user, err)
+	}
+}
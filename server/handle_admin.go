@@ -0,0 +1,231 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+type purgeRequest struct {
+	// Resource is "appointments", "trainers" or "users".
+	Resource string `json:"resource" validate:"required"`
+	// DeletedBefore limits the purge to resources deleted before it. Defaults to now.
+	DeletedBefore *time.Time `json:"deleted_before"`
+}
+
+type purgeResponse struct {
+	Resource string `json:"resource"`
+	Purged   int64  `json:"purged"`
+}
+
+type apiKeyRequest struct {
+	// Name describes who or what uses the key.
+	Name string `json:"name" validate:"required"`
+	// Role is "admin" (the default) or "front-desk".
+	Role string `json:"role" validate:"omitempty,oneof=admin front-desk"`
+}
+
+type apiKeyResponse struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Prefix    string    `json:"prefix"`
+	CreatedAt time.Time `json:"created_at"`
+	// Key is only returned when the key is created.
+	Key string `json:"key,omitempty"`
+}
+
+func newAPIKeyResponse(key *models.APIKey) apiKeyResponse {
+	return apiKeyResponse{ID: key.ID, Name: key.Name, Role: key.Role, Prefix: key.Prefix, CreatedAt: key.CreatedAt.In(location)}
+}
+
+// adminHandler serves operations on the data as a whole rather than on single resources.
+type adminHandler struct {
+	store     store.Store
+	logger    *log.Logger
+	clock     clock.Clock
+	resources map[string]*modelHandler
+}
+
+func newAdminHandler(
+	s store.Store, logger *log.Logger, clock clock.Clock, resources map[string]*modelHandler,
+) *adminHandler {
+	return &adminHandler{
+		store:     s,
+		logger:    logger,
+		clock:     clock,
+		resources: resources,
+	}
+}
+
+// purge permanently removes deleted resources, which can no longer be restored. Purging users
+// or trainers removes their appointments too.
+func (ah *adminHandler) purge(w http.ResponseWriter, r *http.Request) {
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ah.logger.Printf("Error decoding body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	mh, ok := ah.resources[req.Resource]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("unknown resource %q", req.Resource)))
+		return
+	}
+
+	before := ah.clock.Now()
+	if req.DeletedBefore != nil {
+		before = *req.DeletedBefore
+	}
+
+	// Purged models can't be told apart afterwards, so the purge is recorded once, without an ID.
+	var purged int64
+	err := ah.store.Transaction(func(tx store.Store) error {
+		var err error
+		if purged, err = mh.models(tx).Purge(before); err != nil {
+			return err
+		}
+
+		return recordAudit(tx, r, auditPurge, req.Resource, 0, nil, nil)
+	})
+	if err != nil {
+		ah.logger.Printf("Error purging %s: %v", req.Resource, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ah.logger.Printf("Purged %d %s deleted before %s", purged, req.Resource, before.Format(time.RFC3339))
+
+	err = json.NewEncoder(w).Encode(purgeResponse{Resource: req.Resource, Purged: purged})
+	if err != nil {
+		ah.logger.Printf("Error encoding response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// createAPIKey creates an API key. The response is the only time the key is shown.
+func (ah *adminHandler) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ah.logger.Printf("Error decoding body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := validator.New().Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = auth.RoleAdmin
+	}
+
+	var stored *models.APIKey
+	var key string
+	err := ah.store.Transaction(func(tx store.Store) error {
+		var err error
+		if stored, key, err = CreateAPIKey(tx, req.Name, req.Role); err != nil {
+			return err
+		}
+
+		return recordAudit(tx, r, auditCreate, apiKeysResource, stored.ID, nil, stored)
+	})
+	if err != nil {
+		ah.logger.Printf("Error creating API key: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ah.logger.Printf("Created API key %d (%s)", stored.ID, stored.Name)
+
+	resp := newAPIKeyResponse(stored)
+	resp.Key = key
+	noStore(w)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		ah.logger.Printf("Error encoding response: %v", err)
+	}
+}
+
+func (ah *adminHandler) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	var keys []models.APIKey
+	if err := ah.store.APIKeys().List(&keys); err != nil {
+		ah.logger.Printf("Error listing API keys: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]apiKeyResponse, len(keys))
+	for i := range keys {
+		resp[i] = newAPIKeyResponse(&keys[i])
+	}
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		ah.logger.Printf("Error encoding response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// revokeAPIKey deletes an API key, so that it can no longer be used.
+func (ah *adminHandler) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)[idParam], 10, 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = ah.store.Transaction(func(tx store.Store) error {
+		var keys []models.APIKey
+		if err := tx.APIKeys().List(&keys); err != nil {
+			return err
+		}
+
+		for i := range keys {
+			if keys[i].ID != uint(id) {
+				continue
+			}
+
+			if err := tx.APIKeys().Delete(uint(id)); err != nil {
+				return err
+			}
+
+			revoked := keys[i]
+			revoked.DeletedAt = gorm.DeletedAt{Time: ah.clock.Now(), Valid: true}
+			return recordAudit(tx, r, auditDelete, apiKeysResource, revoked.ID, &keys[i], &revoked)
+		}
+
+		return store.ErrNotFound
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		ah.logger.Printf("Error revoking API key: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ah.logger.Printf("Revoked API key %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
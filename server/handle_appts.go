@@ -3,6 +3,7 @@ package server
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -12,7 +13,9 @@ import (
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
 
+	"github.com/marcuscarr/appts/clock"
 	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
 )
 
 const (
@@ -21,6 +24,8 @@ const (
 )
 
 var (
+	errNotExist = errors.New("does not exist")
+
 	location, _ = time.LoadLocation(locale)
 	startOfDay  = time.Date(0, 0, 0, 8, 0, 0, 0, location)
 	endOfDay    = time.Date(0, 0, 0, 17, 0, 0, 0, location)
@@ -32,11 +37,12 @@ type apptHandler struct {
 	validator *validator.Validate
 }
 
-func newApptHandler(db *gorm.DB) *apptHandler {
+func newApptHandler(s store.Store, logger *log.Logger, clock clock.Clock, rep representation) *apptHandler {
 	validate := validator.New()
-	return &apptHandler{
+	ah := &apptHandler{
 		modelHandler: newModelHandler(
-			db, &models.Appt{}, "id",
+			s, logger, clock, "appointments", func(s store.Store) store.ModelStore { return s.Appts() },
+			&models.Appt{}, rep, apptPolicy, "id",
 			[]queries{
 				{userIDParam, "="},
 				{trainerIDParam, "="},
@@ -46,54 +52,85 @@ func newApptHandler(db *gorm.DB) *apptHandler {
 		),
 		validator: validate,
 	}
+	ah.asOf = func(s store.Store, t time.Time) store.ModelStore { return s.Appts().AsOf(t) }
+
+	return ah
 }
 
 func (ah *apptHandler) create(w http.ResponseWriter, r *http.Request) {
-	// TODO: Validate request.
+	if !ah.checkQuery(w, r) {
+		return
+	}
+
 	var appt models.Appt
 
-	if err := json.NewDecoder(r.Body).Decode(&appt); err != nil {
-		log.Printf("Error decoding body: %v", err)
+	if err := ah.rep.decode(r.Body, &appt); err != nil {
+		ah.logger.Printf("Error decoding body: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	ah.insert(w, r, appt)
+}
+
+// insert creates the appt, checking its availability in the same transaction, and writes the
+// response.
+func (ah *apptHandler) insert(w http.ResponseWriter, r *http.Request, appt models.Appt) {
+	newAppt(&appt)
+
+	if !ah.allows(r, actionCreate, &appt) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	if err := validAppt(ah.validator, appt); err != nil {
-		log.Printf("Invalid appt: %v", err)
+		ah.logger.Printf("Invalid appt: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		_, _ = w.Write([]byte(err.Error()))
 		return
 	}
 
-	txErr := ah.db.Transaction(func(tx *gorm.DB) error {
+	txErr := ah.store.Transaction(func(tx store.Store) error {
+		if err := apptParties(tx, appt); err != nil {
+			if errors.Is(err, errNotExist) {
+				w.WriteHeader(http.StatusBadRequest)
+				return err
+			}
+
+			ah.logger.Printf("Error checking appt's user and trainer: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+
 		isAvailable, err := availableAppt(tx, appt)
 		if err != nil {
-			log.Printf("Error checking if appt is available: %v", err)
+			ah.logger.Printf("Error checking if appt is available: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return err
 		}
 
 		if !isAvailable {
-			log.Printf("Appt is not available")
+			ah.logger.Printf("Appt is not available")
 			w.WriteHeader(http.StatusConflict)
 			return errors.New("appt is not available")
 		}
 
-		if appt.ID != 0 {
-			var apptValue interface{} = &appt
-			result := ah.modelHandler.createWithID(tx, apptValue)
-			if result != nil {
-				log.Printf("Error creating appt: %v", result)
-				w.WriteHeader(http.StatusInternalServerError)
-				return result
-			}
-		} else {
-			result := tx.Create(&appt)
-			if result.Error != nil {
-				log.Printf("Error creating appt: %v", result.Error)
-				w.WriteHeader(http.StatusInternalServerError)
-				return result.Error
-			}
+		appt.Version = 1
+		err = tx.Appts().Create(&appt)
+		if errors.Is(err, store.ErrDuplicate) {
+			// Another request took the slot after the check above.
+			w.WriteHeader(http.StatusConflict)
+			return errors.New("appt is not available")
+		}
+
+		if err == nil {
+			err = recordAudit(tx, r, auditCreate, ah.resource, appt.ID, nil, &appt)
+		}
+
+		if err != nil {
+			ah.logger.Printf("Error creating appt: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
 		}
 
 		return nil
@@ -103,17 +140,68 @@ func (ah *apptHandler) create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := json.NewEncoder(w).Encode(appt)
+	w.Header().Set(etagHeader, etag(appt.Version))
+	ah.respond(w, r, &appt)
+}
+
+func (ah *apptHandler) update(w http.ResponseWriter, r *http.Request) {
+	if !ah.checkQuery(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	idValue := vars[ah.idParam]
+	id, err := strconv.Atoi(idValue)
 	if err != nil {
-		log.Printf("Error encoding appt: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var existingAppt models.Appt
+	if err := ah.store.Appts().Get(uint(id), &existingAppt); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			// Like other resources, a PUT to an ID that doesn't exist yet creates it with that ID,
+			// unless the client expected a particular version to be there.
+			if r.Header.Get(ifMatchHeader) != "" {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+
+			var appt models.Appt
+			if err := ah.rep.decode(r.Body, &appt); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			appt.ID = uint(id)
+
+			ah.insert(w, r, appt)
+			return
+		}
+
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	if !checkIfMatch(w, r, existingAppt.Version) {
+		return
+	}
+
+	var appt models.Appt
+	if err := ah.rep.decode(r.Body, &appt); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ah.save(w, r, appt, existingAppt)
 }
 
-func (ah *apptHandler) update(w http.ResponseWriter, r *http.Request) {
+func (ah *apptHandler) patch(w http.ResponseWriter, r *http.Request) {
+	if !ah.checkQuery(w, r) {
+		return
+	}
+
 	vars := mux.Vars(r)
-	idValue := vars[apptIDParam]
+	idValue := vars[ah.idParam]
 	id, err := strconv.Atoi(idValue)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -121,9 +209,9 @@ func (ah *apptHandler) update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var existingAppt models.Appt
-	if result := ah.db.First(&existingAppt, id); result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			ah.create(w, r)
+	if err := ah.store.Appts().Get(uint(id), &existingAppt); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
@@ -131,38 +219,187 @@ func (ah *apptHandler) update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var appt models.Appt
-	if err := json.NewDecoder(r.Body).Decode(&appt); err != nil {
+	if !checkIfMatch(w, r, existingAppt.Version) {
+		return
+	}
+
+	appt := existingAppt
+	if err := ah.rep.decode(r.Body, &appt); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	appt.ID = uint(id)
+
+	ah.save(w, r, appt, existingAppt)
+}
+
+// newAppt clears what the body of a new appt can't set, which the legacy representation decodes:
+// attendance, which is only changed by marking it, and a deletion.
+func newAppt(appt *models.Appt) {
+	appt.Attended = nil
+	appt.DeletedAt = gorm.DeletedAt{}
+}
+
+// save validates appt and writes it over existingAppt, checking availability and the version in
+// the same transaction, and responds with the saved appt.
+func (ah *apptHandler) save(w http.ResponseWriter, r *http.Request, appt, existingAppt models.Appt) {
+	saved, ok := ah.saveAppt(w, r, appt, existingAppt)
+	if !ok {
+		return
+	}
+
+	w.Header().Set(etagHeader, etag(saved.Version))
+	ah.respond(w, r, saved)
+}
+
+// saveAppt writes appt over existingAppt like save, and returns it as saved. If it can't, it
+// writes the error response.
+func (ah *apptHandler) saveAppt(w http.ResponseWriter, r *http.Request, appt, existingAppt models.Appt) (*models.Appt, bool) {
+	appt.ID = existingAppt.ID
+	appt.CreatedAt = existingAppt.CreatedAt
+	// Attendance is only changed by marking it.
+	appt.Attended = existingAppt.Attended
+
+	if !ah.allows(r, actionUpdate, &existingAppt) || !ah.allows(r, actionUpdate, &appt) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
 
 	if err := validAppt(ah.validator, appt); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		_, _ = w.Write([]byte(err.Error()))
-		return
+		return nil, false
 	}
 
-	txErr := ah.db.Transaction(func(tx *gorm.DB) error {
+	txErr := ah.store.Transaction(func(tx store.Store) error {
+		if err := apptParties(tx, appt); err != nil {
+			if errors.Is(err, errNotExist) {
+				w.WriteHeader(http.StatusBadRequest)
+				return err
+			}
+
+			ah.logger.Printf("Error checking appt's user and trainer: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+
 		isAvailable, err := availableAppt(tx, appt)
 		if err != nil {
-			log.Printf("Error checking if appt is available: %v", err)
+			ah.logger.Printf("Error checking if appt is available: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return err
 		}
 
 		if !isAvailable {
-			log.Printf("Appt is not available")
+			ah.logger.Printf("Appt is not available")
+			w.WriteHeader(http.StatusConflict)
+			return errors.New("appt is not available")
+		}
+
+		err = tx.Appts().Update(&appt, existingAppt.Version)
+		if errors.Is(err, store.ErrConflict) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return errors.New("appt was modified concurrently")
+		}
+
+		if errors.Is(err, store.ErrDuplicate) {
+			w.WriteHeader(http.StatusConflict)
+			return errors.New("appt is not available")
+		}
+
+		if err == nil {
+			err = recordAudit(tx, r, auditUpdate, ah.resource, appt.ID, &existingAppt, &appt)
+		}
+
+		if err != nil {
+			ah.logger.Printf("Error updating appt: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+
+		return nil
+	})
+
+	if txErr != nil {
+		_, _ = w.Write([]byte(txErr.Error()))
+		return nil, false
+	}
+
+	return &appt, true
+}
+
+// restore undoes the deletion of an appt, as long as its slot is still free and its user and
+// trainer haven't been deleted.
+func (ah *apptHandler) restore(w http.ResponseWriter, r *http.Request) {
+	if !ah.checkQuery(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	idValue := vars[ah.idParam]
+	id, err := strconv.Atoi(idValue)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var appt models.Appt
+	if err := ah.store.Appts().WithDeleted().Get(uint(id), &appt); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !ah.allows(r, actionRestore, &appt) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !appt.DeletedAt.Valid {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("not deleted"))
+		return
+	}
+
+	if !checkIfMatch(w, r, appt.Version) {
+		return
+	}
+
+	before := appt
+	txErr := ah.store.Transaction(func(tx store.Store) error {
+		if err := apptParties(tx, appt); err != nil {
+			if errors.Is(err, errNotExist) {
+				w.WriteHeader(http.StatusConflict)
+				return err
+			}
+
+			ah.logger.Printf("Error checking appt's user and trainer: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return err
+		}
+
+		err := tx.Appts().Restore(&appt, appt.Version)
+		if errors.Is(err, store.ErrConflict) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return errors.New("appt was modified concurrently")
+		}
+
+		if errors.Is(err, store.ErrDuplicate) {
 			w.WriteHeader(http.StatusConflict)
 			return errors.New("appt is not available")
 		}
 
-		result := tx.Save(&appt)
-		if result.Error != nil {
-			log.Printf("Error updating appt: %v", result.Error)
+		if err == nil {
+			err = recordAudit(tx, r, auditRestore, ah.resource, appt.ID, &before, &appt)
+		}
+
+		if err != nil {
+			ah.logger.Printf("Error restoring appt: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
-			return result.Error
+			return err
 		}
 
 		return nil
@@ -173,21 +410,115 @@ func (ah *apptHandler) update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = json.NewEncoder(w).Encode(appt)
+	w.Header().Set(etagHeader, etag(appt.Version))
+	ah.respond(w, r, &appt)
+}
+
+// markAttendance records whether the user came to an appt that has started. Like an update, it
+// needs the appt's version in If-Match.
+func (ah *apptHandler) markAttendance(w http.ResponseWriter, r *http.Request) {
+	if !ah.checkQuery(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	idValue := vars[ah.idParam]
+	id, err := strconv.Atoi(idValue)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req attendanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Attended == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("attended is required"))
+		return
+	}
+
+	var appt models.Appt
+	if err := ah.store.Appts().Get(uint(id), &appt); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !ah.allows(r, actionAttend, &appt) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !checkIfMatch(w, r, appt.Version) {
+		return
+	}
+
+	if ah.clock.Now().Before(appt.StartTime) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("appt has not started"))
+		return
+	}
+
+	before := appt
+	appt.Attended = req.Attended
+	err = ah.store.Transaction(func(tx store.Store) error {
+		if err := tx.Appts().Update(&appt, before.Version); err != nil {
+			return err
+		}
+
+		return recordAudit(tx, r, auditUpdate, ah.resource, appt.ID, &before, &appt)
+	})
 	if err != nil {
-		log.Printf("Error encoding appt: %v", err)
+		if errors.Is(err, store.ErrConflict) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		ah.logger.Printf("Error marking attendance: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+
+	w.Header().Set(etagHeader, etag(appt.Version))
+	ah.respond(w, r, &appt)
+}
+
+// apptParties checks that the appt's user and trainer exist and haven't been deleted. If not,
+// the error wraps errNotExist.
+func apptParties(s store.Store, appt models.Appt) error {
+	var user models.User
+	if err := s.Users().Get(appt.UserID, &user); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("user %d %w", appt.UserID, errNotExist)
+		}
+
+		return err
+	}
+
+	var trainer models.Trainer
+	if err := s.Trainers().Get(appt.TrainerID, &trainer); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("trainer %d %w", appt.TrainerID, errNotExist)
+		}
+
+		return err
+	}
+
+	return nil
 }
 
-func availableAppt(db *gorm.DB, appt models.Appt) (bool, error) {
-	var existing []models.Appt
-	result := db.Where("trainer_id = ? AND start_time = ?", appt.TrainerID, appt.StartTime).First(&existing)
-	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return false, result.Error
+// availableAppt reports whether the appt's slot is free, ignoring the appt itself so that an
+// update that keeps its time doesn't conflict with its old row, and whether the trainer's busy
+// calendars leave them free then.
+func availableAppt(s store.Store, appt models.Appt) (bool, error) {
+	available, err := s.Appts().Available(appt)
+	if err != nil || !available {
+		return available, err
 	}
 
-	return len(existing) == 0, nil
+	busy, err := trainerBusy(s, appt.TrainerID, appt.StartTime, appt.EndTime)
+	return len(busy) == 0, err
 }
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+const (
+	// oidcCookie carries the state of a login in progress between the redirect to the provider
+	// and the callback.
+	oidcCookie = "appts_oidc"
+	// oidcCookiePath limits the cookie to the OIDC routes.
+	oidcCookiePath = "/v1/auth/oidc"
+	// oidcLoginTTL is how long a user has to log in at the provider.
+	oidcLoginTTL = 10 * time.Minute
+	// oidcLoginAudience keeps login state tokens from passing as anything else signed with the
+	// same secret.
+	oidcLoginAudience = "appts-oidc-login"
+)
+
+var errNoIdentity = errors.New("no trainer or user has this identity")
+
+// oidcHandler logs trainers and users in with an OpenID Connect provider. The first time an
+// identity logs in, it is linked to the trainer, or failing that the user, with its verified
+// email; after that the link is used even if the email changes.
+type oidcHandler struct {
+	store    store.Store
+	logger   *log.Logger
+	clock    clock.Clock
+	provider *auth.OIDCProvider
+	accounts *accountHandler
+	// state verifies the login state tokens, which are signed with the JWT HS256 secret.
+	state *auth.JWTVerifier
+	// secureCookies is set when the server is reached over HTTPS.
+	secureCookies bool
+}
+
+func newOIDCHandler(
+	s store.Store, logger *log.Logger, c clock.Clock, provider *auth.OIDCProvider, accounts *accountHandler,
+	secureCookies bool,
+) *oidcHandler {
+	return &oidcHandler{
+		store:         s,
+		logger:        logger,
+		clock:         c,
+		provider:      provider,
+		accounts:      accounts,
+		secureCookies: secureCookies,
+		state: auth.NewJWTVerifier(auth.JWTConfig{
+			HS256Secret: accounts.jwt.HS256Secret,
+			Audience:    oidcLoginAudience,
+		}, c),
+	}
+}
+
+// login sends the user to the provider to log in. The state, nonce and PKCE verifier of the login
+// are kept in a signed cookie until the provider sends them back to callback.
+func (oh *oidcHandler) login(w http.ResponseWriter, r *http.Request) {
+	if !oh.accounts.ready(w) {
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		value, err := auth.NewToken()
+		if err != nil {
+			oh.logger.Printf("Error generating login state: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	authURL, err := oh.provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		oh.logger.Printf("Error building authorization URL: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	expires := oh.clock.Now().Add(oidcLoginTTL)
+	cookie, err := auth.SignJWT(auth.Claims{
+		"sub":      "oidc-login",
+		"aud":      oidcLoginAudience,
+		"exp":      expires.Unix(),
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+	}, oh.accounts.jwt.HS256Secret)
+	if err != nil {
+		oh.logger.Printf("Error signing login state: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, oh.cookie(cookie, int(oidcLoginTTL.Seconds())))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// callback finishes a login when the provider sends the user back with a code. It responds with
+// tokens for the trainer or user linked to the identity.
+func (oh *oidcHandler) callback(w http.ResponseWriter, r *http.Request) {
+	if !oh.accounts.ready(w) {
+		return
+	}
+
+	q := r.URL.Query()
+	if providerErr := q.Get("error"); providerErr != "" {
+		unauthorized(w, "provider: "+providerErr)
+		return
+	}
+
+	// The login state can only be used once.
+	http.SetCookie(w, oh.cookie("", -1))
+
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("no login in progress"))
+		return
+	}
+
+	login, err := oh.state.Verify(cookie.Value)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("login expired"))
+		return
+	}
+
+	state, _ := login["state"].(string)
+	if subtle.ConstantTimeCompare([]byte(state), []byte(q.Get("state"))) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("state doesn't match"))
+		return
+	}
+
+	verifier, _ := login["verifier"].(string)
+	idToken, err := oh.provider.Exchange(r.Context(), q.Get("code"), verifier)
+	var claims auth.Claims
+	if err == nil {
+		nonce, _ := login["nonce"].(string)
+		claims, err = oh.provider.VerifyIDToken(r.Context(), idToken, nonce)
+	}
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			unauthorized(w, err.Error())
+			return
+		}
+
+		oh.logger.Printf("Error logging in with provider: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	var tokens *tokenResponse
+	txErr := oh.store.Transaction(func(tx store.Store) error {
+		identity, err := oh.identity(tx, claims)
+		if err != nil {
+			return err
+		}
+
+		if identity.TrainerID != nil {
+			var trainer models.Trainer
+			if err := tx.Trainers().Get(*identity.TrainerID, &trainer); err != nil {
+				return err
+			}
+
+			tokens, err = oh.accounts.issueTrainerToken(trainer)
+			return err
+		}
+
+		var user models.User
+		if err := tx.Users().Get(*identity.UserID, &user); err != nil {
+			return err
+		}
+
+		tokens, err = oh.accounts.issueTokens(tx, user)
+		return err
+	})
+	if txErr != nil {
+		if errors.Is(txErr, errNoIdentity) || errors.Is(txErr, store.ErrNotFound) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(errNoIdentity.Error()))
+			return
+		}
+
+		oh.logger.Printf("Error logging in: %v", txErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	oh.accounts.respond(w, http.StatusOK, tokens)
+}
+
+// identity returns the identity with the ID token's claims, linking it to the trainer or user
+// with its email if it is new. Only emails the provider has verified, and users' emails that staff
+// set, are trusted. An email shared by several trainers or users links none of them.
+func (oh *oidcHandler) identity(tx store.Store, claims auth.Claims) (*models.Identity, error) {
+	issuer := oh.provider.Issuer()
+	identity, err := tx.Accounts().GetIdentity(issuer, claims.Subject())
+	if !errors.Is(err, store.ErrNotFound) {
+		return identity, err
+	}
+
+	email, _ := claims["email"].(string)
+	if verified, _ := claims["email_verified"].(bool); !verified || email == "" {
+		return nil, errNoIdentity
+	}
+
+	identity = &models.Identity{Issuer: issuer, Subject: claims.Subject()}
+	filter := store.Filter{{Column: "email", Op: "=", Value: strings.TrimSpace(email)}}
+
+	var trainers []models.Trainer
+	if err := tx.Trainers().List(filter, &trainers); err != nil {
+		return nil, err
+	}
+
+	// Users may set their own emails, so only those set by staff are trusted to be theirs.
+	var users []models.User
+	if len(trainers) == 0 {
+		var found []models.User
+		if err := tx.Users().List(filter, &found); err != nil {
+			return nil, err
+		}
+
+		for _, user := range found {
+			if user.EmailVerified {
+				users = append(users, user)
+			}
+		}
+	}
+
+	switch {
+	case len(trainers) == 1:
+		identity.TrainerID = &trainers[0].ID
+	case len(trainers) == 0 && len(users) == 1:
+		identity.UserID = &users[0].ID
+	default:
+		return nil, errNoIdentity
+	}
+
+	if err := tx.Accounts().CreateIdentity(identity); err != nil {
+		return nil, err
+	}
+
+	oh.logger.Printf("Linked identity %s at %s", identity.Subject, issuer)
+	return identity, nil
+}
+
+func (oh *oidcHandler) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value,
+		Path:     oidcCookiePath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   oh.secureCookies,
+		// Lax, since the provider sends the user back with a cross-site redirect.
+		SameSite: http.SameSiteLaxMode,
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/auth/oidctest"
+	"github.com/marcuscarr/appts/clock"
+)
+
+const testRedirectURL = "http://appts.test/v1/auth/oidc/callback"
+
+func TestOIDCLogin(t *testing.T) {
+	for name, config := range testConfigs(t) {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			c := clock.NewFake(testNow)
+			idp := oidctest.NewProvider(c, "appts", "secret")
+			defer idp.Close()
+
+			config.OIDC = auth.OIDCConfig{
+				Issuer:       idp.Issuer(),
+				ClientID:     "appts",
+				ClientSecret: "secret",
+				RedirectURL:  testRedirectURL,
+			}
+			s, err := New(config, WithClock(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			testOIDCLogin(t, s, idp)
+		})
+	}
+}
+
+// oidcLogin starts a login at the server, logs in at the provider, and returns the callback's
+// query and the cookie carrying the login's state.
+func oidcLogin(t *testing.T, s *Server) (url.Values, string) {
+	t.Helper()
+
+	w := do(s, "GET", "/v1/auth/oidc/login", "", authorizationHeader, "")
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusFound, w.Code, w.Body)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("Expected an HttpOnly cookie, got %v", cookies)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return callback.Query(), cookies[0].Name + "=" + cookies[0].Value
+}
+
+func oidcCallback(s *Server, query url.Values, cookie string) *httptest.ResponseRecorder {
+	return do(s, "GET", "/v1/auth/oidc/callback?"+query.Encode(), "", authorizationHeader, "", "Cookie", cookie)
+}
+
+func testOIDCLogin(t *testing.T, s *Server, idp *oidctest.Provider) {
+	seed(t, s)
+
+	// Users registered with someone else's email, or who change theirs, must not take over the
+	// identity of whoever logs in with it. Users 2 and 4 register themselves, and staff create
+	// users 3 and 5.
+	mover := testToken(s, auth.Claims{"sub": "mover", "role": auth.RoleClient, "user_id": float64(5)})
+	setup := []struct {
+		method, path, body string
+		header             []string
+		e                  int
+	}{
+		{"POST", "/v1/auth/register", `{"name":"Victim?","email":"victim@example.com","username":"attacker","password":"correct horse"}`, nil, http.StatusCreated},
+		{"POST", "/v1/users", `{"name":"Shared","email":"shared@example.com","username":"shared"}`, nil, http.StatusOK},
+		{"POST", "/v1/auth/register", `{"name":"Shared?","email":"shared@example.com","username":"attacker2","password":"correct horse"}`, nil, http.StatusCreated},
+		{"POST", "/v1/users", `{"name":"Mover","email":"mover@example.com","username":"mover"}`, nil, http.StatusOK},
+		{"PATCH", "/v1/users/5", `{"email":"moved@example.com"}`, []string{authorizationHeader, "Bearer " + mover, ifMatchHeader, `"1"`}, http.StatusOK},
+	}
+	for _, step := range setup {
+		if w := do(s, step.method, step.path, step.body, step.header...); w.Code != step.e {
+			t.Fatalf("%s %s: Expected %d, got %d: %s", step.method, step.path, step.e, w.Code, w.Body)
+		}
+	}
+
+	steps := []struct {
+		name      string
+		identity  auth.Claims
+		code      int
+		userID    uint
+		trainerID uint
+	}{
+		{
+			"Trainer with a verified email",
+			auth.Claims{"sub": "t1-sso", "email": "t1@example.com", "email_verified": true},
+			http.StatusOK, 0, 1,
+		},
+		{
+			"Linked trainer whose email changed",
+			auth.Claims{"sub": "t1-sso", "email": "t1@new.example.com", "email_verified": true},
+			http.StatusOK, 0, 1,
+		},
+		{
+			"User with a verified email",
+			auth.Claims{"sub": "user-sso", "email": "user@example.com", "email_verified": true},
+			http.StatusOK, 1, 0,
+		},
+		{
+			"Unverified email",
+			auth.Claims{"sub": "t2-sso", "email": "t2@example.com"},
+			http.StatusForbidden, 0, 0,
+		},
+		{
+			"Email a user registered with",
+			auth.Claims{"sub": "victim-sso", "email": "victim@example.com", "email_verified": true},
+			http.StatusForbidden, 0, 0,
+		},
+		{
+			"Email staff set, also registered by another user",
+			auth.Claims{"sub": "shared-sso", "email": "shared@example.com", "email_verified": true},
+			http.StatusOK, 3, 0,
+		},
+		{
+			"Email a user changed to",
+			auth.Claims{"sub": "moved-sso", "email": "moved@example.com", "email_verified": true},
+			http.StatusForbidden, 0, 0,
+		},
+		{
+			"Unknown email",
+			auth.Claims{"sub": "stranger", "email": "stranger@example.com", "email_verified": true},
+			http.StatusForbidden, 0, 0,
+		},
+	}
+
+	for _, step := range steps {
+		idp.SetIdentity(step.identity)
+		query, cookie := oidcLogin(t, s)
+		w := oidcCallback(s, query, cookie)
+		if w.Code != step.code {
+			t.Errorf("%s: Expected %d, got %d: %s", step.name, step.code, w.Code, w.Body)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		var tokens tokenResponse
+		if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+		if tokens.UserID != step.userID || tokens.TrainerID != step.trainerID {
+			t.Errorf("%s: Expected user %d and trainer %d, got %+v", step.name, step.userID, step.trainerID, tokens)
+		}
+		if (tokens.RefreshToken != "") != (step.userID != 0) {
+			t.Errorf("%s: Expected a refresh token only for users, got %q", step.name, tokens.RefreshToken)
+		}
+
+		// The access token acts as whoever logged in.
+		if w := do(s, "GET", "/v1/appointments", "", authorizationHeader, "Bearer "+tokens.AccessToken); w.Code != http.StatusOK {
+			t.Errorf("%s: Expected %d, got %d: %s", step.name, http.StatusOK, w.Code, w.Body)
+		}
+	}
+
+	idp.SetIdentity(auth.Claims{"sub": "t1-sso"})
+	query, cookie := oidcLogin(t, s)
+
+	wrongState := url.Values{"code": {query.Get("code")}, "state": {"forged"}}
+	if w := oidcCallback(s, wrongState, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d for the wrong state, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := oidcCallback(s, query, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d without the cookie, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := oidcCallback(s, query, cookie); w.Code != http.StatusOK {
+		t.Errorf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if w := oidcCallback(s, query, cookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d reusing the code, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// The login state expires.
+	query, cookie = oidcLogin(t, s)
+	s.clock.(*clock.Fake).Set(testNow.Add(oidcLoginTTL))
+	if w := oidcCallback(s, query, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d after the login expired, got %d", http.StatusBadRequest, w.Code)
+	}
+}
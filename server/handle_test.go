@@ -0,0 +1,733 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+// testConfigs returns a config for each storage to run the handler tests against. Postgres is
+// included when TEST_DB_HOST is set, using a new database named after the test.
+func testConfigs(t *testing.T) map[string]*Config {
+	configs := map[string]*Config{
+		StorageMemory: {Storage: StorageMemory},
+		StorageSQLite: {Storage: StorageSQLite, DBPath: filepath.Join(t.TempDir(), "appts.db"), Migrate: true},
+	}
+
+	if host := os.Getenv("TEST_DB_HOST"); host != "" {
+		port, err := strconv.Atoi(os.Getenv("TEST_DB_PORT"))
+		if err != nil {
+			port = 5432
+		}
+
+		configs[StoragePostgres] = &Config{
+			Storage: StoragePostgres,
+			DBHost:  host,
+			DBPort:  port,
+			DBUser:  os.Getenv("TEST_DB_USER"),
+			DBPass:  os.Getenv("TEST_DB_PASS"),
+			DBName:  fmt.Sprintf("appts_%s_%d", strings.ToLower(t.Name()), time.Now().Unix()),
+			Migrate: true,
+		}
+	}
+
+	for _, config := range configs {
+		config.JWT = auth.JWTConfig{HS256Secret: testJWTSecret}
+		// The cheapest cost keeps hashing passwords fast.
+		config.Accounts = AccountsConfig{PasswordHashCost: bcrypt.MinCost}
+	}
+
+	return configs
+}
+
+// testJWTSecret signs the tokens do sends.
+var testJWTSecret = []byte("test secret")
+
+// testNow is the time on the test servers' clock, midnight before the appointments the tests
+// make.
+var testNow = time.Date(2020, 1, 1, 0, 0, 0, 0, location)
+
+// forEachStorage runs the test with a new server for each storage. The servers' clock is a
+// clock.Fake set to testNow.
+func forEachStorage(t *testing.T, test func(t *testing.T, s *Server)) {
+	for name, config := range testConfigs(t) {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			s, err := New(config, WithClock(clock.NewFake(testNow)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			test(t, s)
+		})
+	}
+}
+
+// do sends a request to the server and returns the response. Headers are given as name, value
+// pairs. Unless an Authorization header is given, the request carries an admin's JWT.
+func do(s *Server, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set(authorizationHeader, "Bearer "+testToken(s, auth.Claims{"sub": "test", "role": auth.RoleAdmin}))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	return w
+}
+
+// testToken returns a JWT signed with testJWTSecret with the given claims, which expires an hour
+// from now on the server's clock unless claims has an exp.
+func testToken(s *Server, claims auth.Claims) string {
+	signed := auth.Claims{"exp": float64(s.clock.Now().Add(time.Hour).Unix())}
+	for k, v := range claims {
+		signed[k] = v
+	}
+
+	token, err := auth.SignJWT(signed, testJWTSecret)
+	if err != nil {
+		panic(err)
+	}
+
+	return token
+}
+
+// seed creates a user and two trainers.
+func seed(t *testing.T, s *Server) {
+	t.Helper()
+
+	requests := []struct{ path, body string }{
+		{"/v1/users", `{"name":"User","email":"user@example.com","username":"user"}`},
+		{"/v1/trainers", `{"name":"Trainer 1","email":"t1@example.com","username":"t1"}`},
+		{"/v1/trainers", `{"name":"Trainer 2","email":"t2@example.com","username":"t2"}`},
+	}
+	for _, req := range requests {
+		if w := do(s, "POST", req.path, req.body); w.Code != http.StatusOK {
+			t.Fatalf("Expected %d creating %s, got %d", http.StatusOK, req.path, w.Code)
+		}
+	}
+}
+
+// apptBody returns a request body for an appointment at 9:00 with the given trainer.
+func apptBody(trainerID string) string {
+	return fmt.Sprintf(
+		`{"start_time":"2020-01-02T09:00:00-08:00","end_time":"2020-01-02T09:30:00-08:00","user_id":1,"trainer_id":%s}`,
+		trainerID,
+	)
+}
+
+func TestApptHandlerCreate(t *testing.T) {
+	forEachStorage(t, testApptHandlerCreate)
+}
+
+func testApptHandlerCreate(t *testing.T, s *Server) {
+	seed(t, s)
+
+	testCases := []struct {
+		body string
+		e    int
+	}{
+		{apptBody("1"), http.StatusOK},
+		{apptBody("1"), http.StatusConflict},
+		{apptBody("2"), http.StatusOK},
+		{`{"start_time":"2020-01-02T05:00:00-08:00","end_time":"2020-01-02T05:30:00-08:00","user_id":1,"trainer_id":1}`, http.StatusBadRequest},
+		{`{"start_time":`, http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		if w := do(s, "POST", "/v1/appointments", tc.body); w.Code != tc.e {
+			t.Errorf("Expected %v, got %v", tc.e, w.Code)
+		}
+	}
+
+	w := do(s, "GET", "/v1/trainers/1/appointments", "")
+	var appts []apptResponse
+	if err := json.NewDecoder(w.Body).Decode(&appts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(appts) != 1 || appts[0].TrainerID != 1 {
+		t.Errorf("Expected 1 appointment for trainer 1, got %v", appts)
+	}
+}
+
+func TestApptSlotUnique(t *testing.T) {
+	forEachStorage(t, testApptSlotUnique)
+}
+
+// testApptSlotUnique checks that every store refuses a second appt in a trainer's slot, like
+// idx_appts_trainer_start_time, without the handlers' availability checks.
+func testApptSlotUnique(t *testing.T, s *Server) {
+	seed(t, s)
+
+	start := time.Date(2020, 1, 2, 9, 0, 0, 0, location)
+	appt := func(trainerID uint, start time.Time) *models.Appt {
+		return &models.Appt{StartTime: start, EndTime: start.Add(apptDuration), UserID: 1, TrainerID: trainerID}
+	}
+
+	appts := s.store.Appts()
+	first := appt(1, start)
+	if err := appts.Create(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := appts.Create(appt(1, start)); !errors.Is(err, store.ErrDuplicate) {
+		t.Errorf("Expected %v creating an appt in a taken slot, got %v", store.ErrDuplicate, err)
+	}
+
+	second := appt(2, start)
+	if err := appts.Create(second); err != nil {
+		t.Fatalf("Expected another trainer's slot to be free, got %v", err)
+	}
+	second.TrainerID = 1
+	if err := appts.Update(second, second.Version); !errors.Is(err, store.ErrDuplicate) {
+		t.Errorf("Expected %v moving an appt into a taken slot, got %v", store.ErrDuplicate, err)
+	}
+
+	// Updating an appt in place doesn't collide with itself, and deleted appts don't hold
+	// their slot.
+	first.EndTime = first.EndTime.Add(apptDuration)
+	if err := appts.Update(first, first.Version); err != nil {
+		t.Errorf("Expected the appt to be updated in its own slot, got %v", err)
+	}
+	if err := appts.Delete(first, first.Version); err != nil {
+		t.Fatal(err)
+	}
+	if err := appts.Update(second, second.Version); err != nil {
+		t.Errorf("Expected the deleted appt's slot to be free, got %v", err)
+	}
+}
+
+func TestApptHandlerCreateFields(t *testing.T) {
+	forEachStorage(t, testApptHandlerCreateFields)
+}
+
+func testApptHandlerCreateFields(t *testing.T, s *Server) {
+	seed(t, s)
+
+	// The legacy representation decodes the stored model, but a new appt can't be created attended
+	// or deleted.
+	fields := `"attended":true,"DeletedAt":"2020-01-01T00:00:00Z",`
+	legacy := func(hour string) string {
+		return strings.Replace(strings.ReplaceAll(apptBody("1"), "T09", "T"+hour), "{", "{"+fields, 1)
+	}
+	steps := []struct {
+		path, body string
+	}{
+		{"/appointments", legacy("09")},
+		{"/batch", `{"operations":[{"method":"create","resource":"appointments","body":` + legacy("10") + `}]}`},
+	}
+
+	for _, step := range steps {
+		if w := do(s, "POST", step.path, step.body); w.Code != http.StatusOK {
+			t.Fatalf("%s: Expected %d, got %d: %s", step.path, http.StatusOK, w.Code, w.Body)
+		}
+	}
+
+	for _, id := range []uint{1, 2} {
+		var appt models.Appt
+		if err := s.store.Appts().Get(id, &appt); err != nil {
+			t.Fatalf("Expected appt %d not to be deleted, got %v", id, err)
+		}
+		if appt.Attended != nil {
+			t.Errorf("Expected appt %d's attendance to be unmarked, got %v", id, *appt.Attended)
+		}
+	}
+}
+
+func TestApptHandlerPutCreate(t *testing.T) {
+	forEachStorage(t, testApptHandlerPutCreate)
+}
+
+func testApptHandlerPutCreate(t *testing.T, s *Server) {
+	seed(t, s)
+
+	// A PUT to an appointment that doesn't exist creates it at the path's ID, whatever the body's.
+	body := strings.Replace(apptBody("1"), "{", `{"id":7,`, 1)
+	w := do(s, "PUT", "/v1/appointments/5", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var created apptResponse
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != 5 {
+		t.Errorf("Expected appointment 5, got %d", created.ID)
+	}
+
+	steps := []struct {
+		path string
+		e    int
+	}{
+		{"/v1/appointments/5", http.StatusOK},
+		{"/v1/appointments/7", http.StatusNotFound},
+	}
+
+	for _, step := range steps {
+		if w := do(s, "GET", step.path, ""); w.Code != step.e {
+			t.Errorf("%s: Expected %d, got %d", step.path, step.e, w.Code)
+		}
+	}
+}
+
+func TestApptHandlerConcurrentCreate(t *testing.T) {
+	forEachStorage(t, testApptHandlerConcurrentCreate)
+}
+
+func testApptHandlerConcurrentCreate(t *testing.T, s *Server) {
+	seed(t, s)
+
+	const requests = 20
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = do(s, "POST", "/v1/appointments", apptBody("1")).Code
+		}(i)
+	}
+	wg.Wait()
+
+	counts := map[int]int{}
+	for _, code := range codes {
+		counts[code]++
+	}
+
+	if counts[http.StatusOK] != 1 || counts[http.StatusConflict] != requests-1 {
+		t.Errorf("Expected 1 created and %d conflicts, got %v", requests-1, counts)
+	}
+}
+
+func TestModelHandlerVersions(t *testing.T) {
+	forEachStorage(t, testModelHandlerVersions)
+}
+
+func testModelHandlerVersions(t *testing.T, s *Server) {
+	seed(t, s)
+
+	body := `{"name":"Renamed","email":"user@example.com","username":"user"}`
+	testCases := []struct {
+		method, path, body string
+		header             []string
+		e                  int
+	}{
+		{"PUT", "/v1/users/1", body, nil, http.StatusPreconditionRequired},
+		{"PUT", "/v1/users/1", body, []string{"If-Match", `"2"`}, http.StatusPreconditionFailed},
+		{"PUT", "/v1/users/1", body, []string{"If-Match", `"1"`}, http.StatusOK},
+		{"GET", "/v1/users/1", "", []string{"If-None-Match", `"2"`}, http.StatusNotModified},
+		{"PATCH", "/v1/users/1", `{"email":"new@example.com"}`, []string{"If-Match", `"2"`}, http.StatusOK},
+		{"DELETE", "/v1/users/1", "", []string{"If-Match", `"2"`}, http.StatusPreconditionFailed},
+		{"DELETE", "/v1/users/1", "", []string{"If-Match", `"3"`}, http.StatusNoContent},
+		{"GET", "/v1/users/1", "", nil, http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		if w := do(s, tc.method, tc.path, tc.body, tc.header...); w.Code != tc.e {
+			t.Errorf("%s %s: Expected %v, got %v", tc.method, tc.path, tc.e, w.Code)
+		}
+	}
+}
+
+func TestApptHandlerListTimes(t *testing.T) {
+	forEachStorage(t, testApptHandlerListTimes)
+}
+
+// testApptHandlerListTimes checks that times in other zones are compared as instants.
+func testApptHandlerListTimes(t *testing.T, s *Server) {
+	seed(t, s)
+
+	bodies := []string{
+		apptBody("1"),
+		`{"start_time":"2020-01-02T10:00:00-08:00","end_time":"2020-01-02T10:30:00-08:00","user_id":1,"trainer_id":1}`,
+	}
+	for _, body := range bodies {
+		if w := do(s, "POST", "/v1/appointments", body); w.Code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	// 17:30 UTC is 9:30 in Los Angeles, after the first appointment starts.
+	w := do(s, "GET", "/v1/appointments?start_time=2020-01-02T17:30:00Z", "")
+	var appts []apptResponse
+	if err := json.NewDecoder(w.Body).Decode(&appts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(appts) != 1 || appts[0].ID != 2 {
+		t.Errorf("Expected appointment 2, got %v", appts)
+	}
+
+	w = do(s, "GET", "/v1/trainers/1/appointments/available?starts_at=2020-01-02&ends_at=2020-01-02", "")
+	var res availableResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, available := range res.Available {
+		if available.Equal(time.Date(2020, 1, 2, 9, 0, 0, 0, location)) ||
+			available.Equal(time.Date(2020, 1, 2, 10, 0, 0, 0, location)) {
+			t.Errorf("Expected %v to be unavailable", available)
+		}
+	}
+
+	if len(res.Available) != 16 {
+		t.Errorf("Expected %d available times, got %d", 16, len(res.Available))
+	}
+}
+
+func TestSoftDeleteCascade(t *testing.T) {
+	forEachStorage(t, testSoftDeleteCascade)
+}
+
+// testSoftDeleteCascade deletes a user with two appointments, takes one of their slots, and
+// restores and purges them.
+func testSoftDeleteCascade(t *testing.T, s *Server) {
+	seed(t, s)
+
+	user2 := `{"name":"User 2","email":"user2@example.com","username":"user2"}`
+	user2Appt := `{"start_time":"2020-01-02T09:00:00-08:00","end_time":"2020-01-02T09:30:00-08:00","user_id":2,"trainer_id":1}`
+	testCases := []struct {
+		method, path, body string
+		header             []string
+		e                  int
+	}{
+		{"POST", "/v1/appointments", apptBody("1"), nil, http.StatusOK},
+		{"POST", "/v1/appointments", apptBody("2"), nil, http.StatusOK},
+		{"POST", "/v1/appointments/1/restore", "", []string{"If-Match", `"1"`}, http.StatusConflict},
+		{"DELETE", "/v1/users/1", "", []string{"If-Match", `"1"`}, http.StatusNoContent},
+		{"GET", "/v1/users/1", "", nil, http.StatusNotFound},
+		{"GET", "/v1/users/1?include_deleted=true", "", nil, http.StatusOK},
+		{"GET", "/v1/users/1?include_deleted=maybe", "", nil, http.StatusBadRequest},
+		{"GET", "/v1/appointments/2", "", nil, http.StatusNotFound},
+		{"POST", "/v1/appointments", apptBody("1"), nil, http.StatusBadRequest},
+		{"POST", "/v1/appointments/1/restore", "", []string{"If-Match", `"1"`}, http.StatusConflict},
+		// Another user takes appointment 1's slot.
+		{"POST", "/v1/users", user2, nil, http.StatusOK},
+		{"POST", "/v1/appointments", user2Appt, nil, http.StatusOK},
+		{"POST", "/v1/users/1/restore", "", []string{"If-Match", `"2"`}, http.StatusPreconditionFailed},
+		{"POST", "/v1/users/1/restore", "", []string{"If-Match", `"1"`}, http.StatusOK},
+		{"POST", "/v1/users/1/restore", "", []string{"If-Match", `"2"`}, http.StatusConflict},
+		{"GET", "/v1/appointments/1", "", nil, http.StatusNotFound},
+		{"GET", "/v1/appointments/2", "", []string{"If-None-Match", `"2"`}, http.StatusNotModified},
+		{"POST", "/v1/appointments/1/restore", "", []string{"If-Match", `"1"`}, http.StatusConflict},
+		{"POST", "/v1/admin/purge", `{"resource":"appointments","deleted_before":"2020-01-02T00:00:00Z"}`, nil, http.StatusOK},
+		{"GET", "/v1/appointments/1?include_deleted=true", "", nil, http.StatusNotFound},
+		{"DELETE", "/v1/trainers/2", "", []string{"If-Match", `"1"`}, http.StatusNoContent},
+		{"POST", "/v1/admin/purge", `{"resource":"trainers","deleted_before":"2020-01-02T00:00:00Z"}`, nil, http.StatusOK},
+		{"GET", "/v1/appointments/2?include_deleted=true", "", nil, http.StatusNotFound},
+		{"POST", "/v1/admin/purge", `{"resource":"nothing"}`, nil, http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		if w := do(s, tc.method, tc.path, tc.body, tc.header...); w.Code != tc.e {
+			t.Errorf("%s %s: Expected %v, got %v: %s", tc.method, tc.path, tc.e, w.Code, w.Body)
+		}
+	}
+
+	w := do(s, "GET", "/v1/appointments?include_deleted=true", "")
+	var appts []apptResponse
+	if err := json.NewDecoder(w.Body).Decode(&appts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(appts) != 1 || appts[0].ID != 3 || appts[0].DeletedAt != nil {
+		t.Errorf("Expected only appointment 3, got %v", appts)
+	}
+}
+
+func TestAvailableApptsDST(t *testing.T) {
+	forEachStorage(t, testAvailableApptsDST)
+}
+
+// testAvailableApptsDST lists a trainer's available times late in the morning that clocks in
+// Los Angeles go forward.
+func testAvailableApptsDST(t *testing.T, s *Server) {
+	seed(t, s)
+	s.clock.(*clock.Fake).Set(time.Date(2020, 3, 8, 11, 10, 0, 0, location))
+
+	body := `{"start_time":"2020-03-08T12:00:00-07:00","end_time":"2020-03-08T12:30:00-07:00","user_id":1,"trainer_id":1}`
+	if w := do(s, "POST", "/v1/appointments", body); w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	w := do(s, "GET", "/v1/trainers/1/appointments/available?starts_at=2020-03-08&ends_at=2020-03-08", "")
+	var res struct {
+		Available []string `json:"available"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	// From 11:30, the first slot not yet started, to 16:30, except 12:00.
+	expected := []string{
+		"2020-03-08T11:30:00-07:00",
+		"2020-03-08T12:30:00-07:00",
+		"2020-03-08T13:00:00-07:00",
+		"2020-03-08T13:30:00-07:00",
+		"2020-03-08T14:00:00-07:00",
+		"2020-03-08T14:30:00-07:00",
+		"2020-03-08T15:00:00-07:00",
+		"2020-03-08T15:30:00-07:00",
+		"2020-03-08T16:00:00-07:00",
+		"2020-03-08T16:30:00-07:00",
+	}
+	if strings.Join(res.Available, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, res.Available)
+	}
+}
+
+func TestIdempotencyKeyScope(t *testing.T) {
+	forEachStorage(t, testIdempotencyKeyScope)
+}
+
+func testIdempotencyKeyScope(t *testing.T, s *Server) {
+	first := `{"name":"User","email":"user@example.com","username":"user"}`
+	second := `{"name":"Other","email":"other@example.com","username":"other"}`
+	other := "Bearer " + testToken(s, auth.Claims{"sub": "other", "role": auth.RoleAdmin})
+
+	// Another client picking the same key neither blocks nor replays the first's requests.
+	steps := []struct {
+		body   string
+		header []string
+		e      int
+		replay bool
+	}{
+		{first, []string{"Idempotency-Key", "key"}, http.StatusOK, false},
+		{second, []string{"Idempotency-Key", "key", authorizationHeader, other}, http.StatusOK, false},
+		{first, []string{"Idempotency-Key", "key"}, http.StatusOK, true},
+		{second, []string{"Idempotency-Key", "key", authorizationHeader, other}, http.StatusOK, true},
+		{second, []string{"Idempotency-Key", "key"}, http.StatusUnprocessableEntity, false},
+	}
+
+	for i, step := range steps {
+		w := do(s, "POST", "/v1/users", step.body, step.header...)
+		if w.Code != step.e || (w.Header().Get(idempotentReplayedHeader) == "true") != step.replay {
+			t.Errorf("%d: Expected %d, replayed %v, got %d %v: %s", i, step.e, step.replay, w.Code, w.Header(), w.Body)
+		}
+	}
+}
+
+func TestIdempotencyKeyExpiry(t *testing.T) {
+	forEachStorage(t, testIdempotencyKeyExpiry)
+}
+
+func testIdempotencyKeyExpiry(t *testing.T, s *Server) {
+	first := `{"name":"User","email":"user@example.com","username":"user"}`
+	second := `{"name":"Other","email":"other@example.com","username":"other"}`
+	key := []string{"Idempotency-Key", "key"}
+
+	if w := do(s, "POST", "/v1/users", first, key...); w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, w.Code)
+	}
+
+	s.clock.(*clock.Fake).Advance(defaultIdempotencyKeyTTL - time.Minute)
+	if w := do(s, "POST", "/v1/users", second, key...); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected the key to still be in use, got %d", w.Code)
+	}
+
+	s.clock.(*clock.Fake).Advance(2 * time.Minute)
+	w := do(s, "POST", "/v1/users", second, key...)
+	if w.Code != http.StatusOK || w.Header().Get(idempotentReplayedHeader) != "" {
+		t.Errorf("Expected the expired key to be reused, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestIdempotencyCredentials(t *testing.T) {
+	forEachStorage(t, testIdempotencyCredentials)
+}
+
+func testIdempotencyCredentials(t *testing.T, s *Server) {
+	register := `{"name":"Alice","email":"alice@example.com","username":"alice","password":"correct horse"}`
+	if w := do(s, "POST", "/v1/auth/register", register, authorizationHeader, ""); w.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+
+	// Retries of requests whose responses carry credentials are handled again, and the
+	// credentials are never written to the store.
+	steps := []struct {
+		path, body, secret string
+		header             []string
+	}{
+		{"/v1/admin/api-keys", `{"name":"Kiosk"}`, "key", nil},
+		{"/v1/auth/login", `{"username":"alice","password":"correct horse"}`, "refresh_token", []string{authorizationHeader, ""}},
+		{"/v1/users/1/calendar/token", "", "token", nil},
+	}
+
+	for i, step := range steps {
+		header := append([]string{"Idempotency-Key", strconv.Itoa(i)}, step.header...)
+		seen := map[string]bool{}
+		for attempt := 0; attempt < 2; attempt++ {
+			w := do(s, "POST", step.path, step.body, header...)
+			if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+				t.Fatalf("%s: Expected success, got %d: %s", step.path, w.Code, w.Body)
+			}
+			if w.Header().Get(cacheControlHeader) != "no-store" || w.Header().Get(idempotentReplayedHeader) != "" {
+				t.Errorf("%s: Expected an unstored, unreplayed response, got %v", step.path, w.Header())
+			}
+
+			var body map[string]interface{}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			secret, _ := body[step.secret].(string)
+			if secret == "" || seen[secret] {
+				t.Errorf("%s: Expected a new %s, got %q", step.path, step.secret, secret)
+			}
+			seen[secret] = true
+		}
+
+		var subject string
+		if len(step.header) == 0 {
+			subject = "test"
+		}
+		r := httptest.NewRequest("POST", step.path, nil)
+		r = r.WithContext(auth.NewContext(r.Context(), &auth.Principal{Subject: subject}))
+		if stored, err := s.store.IdempotencyKeys().Get(scopedKey(r, strconv.Itoa(i))); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("%s: Expected no stored response, got %+v %v", step.path, stored, err)
+		}
+	}
+}
+
+func TestIdempotencyClaimLease(t *testing.T) {
+	forEachStorage(t, testIdempotencyClaimLease)
+}
+
+func testIdempotencyClaimLease(t *testing.T, s *Server) {
+	body := `{"name":"User","email":"user@example.com","username":"user"}`
+	key := []string{"Idempotency-Key", "key"}
+
+	// A claim left behind by a request that never stored its response.
+	r := httptest.NewRequest("POST", "/v1/users", nil)
+	r = r.WithContext(auth.NewContext(r.Context(), &auth.Principal{Subject: "test"}))
+	claim := &models.IdempotencyKey{
+		Key:         scopedKey(r, "key"),
+		Fingerprint: requestFingerprint(r, []byte(body)),
+		CreatedAt:   testNow,
+	}
+	if err := s.store.IdempotencyKeys().Create(claim); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := do(s, "POST", "/v1/users", body, key...); w.Code != http.StatusConflict {
+		t.Errorf("Expected %d, got %d", http.StatusConflict, w.Code)
+	}
+
+	s.clock.(*clock.Fake).Advance(idempotencyClaimLease)
+	w := do(s, "POST", "/v1/users", body, key...)
+	if w.Code != http.StatusOK || w.Header().Get(idempotentReplayedHeader) != "" {
+		t.Errorf("Expected the stale claim to be taken over, got %d %v", w.Code, w.Header())
+	}
+
+	w = do(s, "POST", "/v1/users", body, key...)
+	if w.Code != http.StatusOK || w.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("Expected the response to be replayed, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestInvalidIncludeWrites(t *testing.T) {
+	forEachStorage(t, testInvalidIncludeWrites)
+}
+
+func testInvalidIncludeWrites(t *testing.T, s *Server) {
+	seed(t, s)
+
+	moved := strings.ReplaceAll(apptBody("1"), "T09", "T10")
+	steps := []struct {
+		method, path, body string
+		e                  int
+	}{
+		{"POST", "/v1/appointments?include=bogus", apptBody("1"), http.StatusBadRequest},
+		{"POST", "/v1/batch?include=user,bogus", `{"operations":[{"method":"create","resource":"appointments","body":` + apptBody("1") + `}]}`, http.StatusBadRequest},
+		{"PUT", "/v1/appointments/1?include=bogus", apptBody("1"), http.StatusBadRequest},
+		{"POST", "/v1/appointments?include=user", apptBody("1"), http.StatusOK},
+		{"PUT", "/v1/appointments/1?include=bogus", moved, http.StatusBadRequest},
+		{"PATCH", "/v1/appointments/1?include=bogus", moved, http.StatusBadRequest},
+	}
+
+	for i, step := range steps {
+		w := do(s, step.method, step.path, step.body, "Idempotency-Key", strconv.Itoa(i))
+		if w.Code != step.e {
+			t.Errorf("%s %s: Expected %d, got %d: %s", step.method, step.path, step.e, w.Code, w.Body)
+		}
+	}
+
+	w := do(s, "GET", "/v1/appointments", "")
+	var appts []apptResponse
+	if err := json.NewDecoder(w.Body).Decode(&appts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(appts) != 1 || appts[0].Version != 1 || appts[0].StartTime.In(location).Hour() != 9 {
+		t.Errorf("Expected only the valid request to be applied, got %+v", appts)
+	}
+}
+
+func TestIdempotencyKeyCleanup(t *testing.T) {
+	forEachStorage(t, testIdempotencyKeyCleanup)
+}
+
+func testIdempotencyKeyCleanup(t *testing.T, s *Server) {
+	keys := s.store.IdempotencyKeys()
+	for i, createdAt := range []time.Time{testNow, testNow.Add(2 * time.Hour)} {
+		key := &models.IdempotencyKey{Key: strconv.Itoa(i), Fingerprint: "fingerprint", CreatedAt: createdAt}
+		if err := keys.Create(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := keys.DeleteBefore(testNow.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := keys.Get("0"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("Expected the older key to be deleted, got %v", err)
+	}
+	if _, err := keys.Get("1"); err != nil {
+		t.Errorf("Expected the newer key to be kept, got %v", err)
+	}
+}
+
+func TestResponseTimes(t *testing.T) {
+	forEachStorage(t, testResponseTimes)
+}
+
+func testResponseTimes(t *testing.T, s *Server) {
+	seed(t, s)
+
+	body := `{"start_time":"2020-01-02T12:00:00-05:00","end_time":"2020-01-02T12:30:00-05:00","user_id":1,"trainer_id":1}`
+	if w := do(s, "POST", "/v1/appointments", body); w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	w := do(s, "GET", "/v1/appointments/1", "")
+	for _, field := range []string{
+		`"start_time":"2020-01-02T09:00:00-08:00"`,
+		`"end_time":"2020-01-02T09:30:00-08:00"`,
+		`"created_at":"2020-01-01T00:00:00-08:00"`,
+	} {
+		if !strings.Contains(w.Body.String(), field) {
+			t.Errorf("Expected %s in the business's time zone, got %s", field, w.Body)
+		}
+	}
+}
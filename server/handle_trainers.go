@@ -5,13 +5,12 @@ import (
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
-	"gorm.io/gorm"
-
 	"github.com/gorilla/mux"
+	"github.com/marcuscarr/appts/clock"
 	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
 )
 
 const dateFormat = "2006-01-02"
@@ -20,19 +19,21 @@ type trainerHandler struct {
 	*modelHandler
 }
 
-func newTrainerHandler(db *gorm.DB) *trainerHandler {
+func newTrainerHandler(s store.Store, logger *log.Logger, clock clock.Clock, rep representation) *trainerHandler {
 	return &trainerHandler{
-		modelHandler: newModelHandler(db, &models.Trainer{}, "id", nil),
+		modelHandler: newModelHandler(
+			s, logger, clock, "trainers", func(s store.Store) store.ModelStore { return s.Trainers() },
+			&models.Trainer{}, rep, trainerPolicy, "id", nil,
+		),
 	}
 }
 
 func (th *trainerHandler) getAvailableAppts(w http.ResponseWriter, r *http.Request) {
-	var wheres []string
-	var args []interface{}
+	var filter store.Filter
 
 	err := r.ParseForm()
 	if err != nil {
-		log.Printf("Error parsing form: %v", err)
+		th.logger.Printf("Error parsing form: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -41,7 +42,7 @@ func (th *trainerHandler) getAvailableAppts(w http.ResponseWriter, r *http.Reque
 	vars := mux.Vars(r)
 	trainerID, err := strconv.Atoi(vars[trainerIDParam])
 	if err != nil {
-		log.Printf("Error parsing trainer_id: %v", err)
+		th.logger.Printf("Error parsing trainer_id: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -58,7 +59,7 @@ func (th *trainerHandler) getAvailableAppts(w http.ResponseWriter, r *http.Reque
 	starteDateVal := query[startsAtParam][0]
 	startDatetime, err := time.Parse(dateFormat, starteDateVal)
 	if err != nil {
-		log.Printf("Error parsing starts_at: %v", err)
+		th.logger.Printf("Error parsing starts_at: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -72,41 +73,43 @@ func (th *trainerHandler) getAvailableAppts(w http.ResponseWriter, r *http.Reque
 	endDateVal := query[endsAtParam][0]
 	endDatetime, err := time.Parse(dateFormat, endDateVal)
 	if err != nil {
-		log.Printf("Error parsing ends_at: %v", err)
+		th.logger.Printf("Error parsing ends_at: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	wheres = append(wheres, "trainer_id = ?")
-	args = append(args, trainerID)
+	filter = append(filter, store.Condition{Column: "trainer_id", Op: "=", Value: trainerID})
 
 	// We want to find all appts that start before the end date and end after the start date, so
 	// set the start date to the start of the day and the end date to the end of the day.
 	startDate := time.Date(startDatetime.Year(), startDatetime.Month(), startDatetime.Day(), 0, 0, 0, 0, location)
-	wheres = append(wheres, "start_time >= ?")
-	args = append(args, startDate)
+	filter = append(filter, store.Condition{Column: "start_time", Op: ">=", Value: startDate})
 
 	endDate := time.Date(endDatetime.Year(), endDatetime.Month(), endDatetime.Day(), 23, 59, 59, 0, location)
-	wheres = append(wheres, "end_time <= ?")
-	args = append(args, endDate)
+	filter = append(filter, store.Condition{Column: "end_time", Op: "<=", Value: endDate})
 
 	var appts []models.Appt
-	where := strings.Join(wheres, " AND ")
-	dbErr := th.db.Where(where, args...).Find(&appts)
-	if dbErr.Error != nil {
-		log.Printf("Error finding appts: %v", dbErr.Error)
+	if err := th.store.Appts().List(filter, &appts); err != nil {
+		th.logger.Printf("Error finding appts: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	busy, err := trainerBusy(th.store, uint(trainerID), startDate, endDate)
+	if err != nil {
+		th.logger.Printf("Error finding busy times: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	var res []string
-	for _, a := range buildAvailable(startDate, endDate, appts) {
+	for _, a := range buildAvailable(th.clock.Now(), startDate, endDate, appts, busy) {
 		res = append(res, a.Format(time.RFC3339))
 	}
 
 	err = json.NewEncoder(w).Encode(map[string][]string{"available": res})
 	if err != nil {
-		log.Printf("Error encoding response: %v", err)
+		th.logger.Printf("Error encoding response: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -1,17 +1,40 @@
 package server
 
 import (
-	"gorm.io/gorm"
+	"log"
 
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
 	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
 )
 
 type userHandler struct {
 	*modelHandler
 }
 
-func newUserHandler(db *gorm.DB) *userHandler {
+func newUserHandler(s store.Store, logger *log.Logger, clock clock.Clock, rep representation) *userHandler {
 	return &userHandler{
-		modelHandler: newModelHandler(db, &models.User{}, "id", nil),
+		modelHandler: newModelHandler(
+			s, logger, clock, "users", func(s store.Store) store.ModelStore { return s.Users() },
+			&models.User{}, rep, userPolicy, "id", nil,
+		),
 	}
 }
+
+// setEmailVerified marks a user's email as verified if staff set it, and not if the user did.
+// An email that isn't changed keeps whether it was verified. existing is nil for new models, and
+// models other than users are left alone.
+func setEmailVerified(p *auth.Principal, model, existing interface{}) {
+	user, ok := model.(*models.User)
+	if !ok {
+		return
+	}
+
+	if existing, ok := existing.(*models.User); ok && existing.Email == user.Email {
+		user.EmailVerified = existing.EmailVerified
+		return
+	}
+
+	user.EmailVerified = p.HasRole(staffRoles...)
+}
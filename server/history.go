@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+// historyEntry is an appointment as it was after one of its changes.
+type historyEntry struct {
+	RecordedAt time.Time `json:"recorded_at"`
+	// Changes names the fields that differ from the previous version, and is empty for the
+	// first.
+	Changes     []string    `json:"changes"`
+	Appointment interface{} `json:"appointment"`
+}
+
+// history lists an appt's versions, oldest first, including those of deleted appts.
+func (ah *apptHandler) history(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idValue := vars[ah.idParam]
+	id, err := strconv.Atoi(idValue)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var appt models.Appt
+	if err := ah.store.Appts().WithDeleted().Get(uint(id), &appt); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !ah.allows(r, actionRead, &appt) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var versions []models.ApptVersion
+	if err := ah.store.Appts().History(uint(id), &versions); err != nil {
+		ah.logger.Printf("Error loading appt history: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	appts := make([]models.Appt, len(versions))
+	items := make([]interface{}, len(versions))
+	for i, v := range versions {
+		appts[i] = store.ApptAt(v)
+		items[i] = &appts[i]
+	}
+
+	bodies, err := ah.rep.encode(ah.store, r, items)
+	if err != nil {
+		ah.writeEncodeError(w, err)
+		return
+	}
+
+	entries := make([]historyEntry, len(versions))
+	for i, v := range versions {
+		entries[i] = historyEntry{RecordedAt: v.RecordedAt.In(location), Changes: []string{}, Appointment: bodies[i]}
+		if i > 0 {
+			entries[i].Changes = changedFields(&appts[i-1], &appts[i])
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		ah.logger.Printf("Error encoding response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// changedFields returns the sorted names of the columns that differ between two pointers to
+// models, leaving out the bookkeeping that changes with every version.
+func changedFields(before, after interface{}) []string {
+	fields := []string{}
+	for name := range auditChanges(auditSnapshot(before), auditSnapshot(after)) {
+		if name != "version" && name != "updated_at" {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+
+	return fields
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+)
+
+func TestApptHistory(t *testing.T) {
+	forEachStorage(t, testApptHistory)
+}
+
+func testApptHistory(t *testing.T, s *Server) {
+	seed(t, s)
+	fake := s.clock.(*clock.Fake)
+
+	// Each change is made an hour after the last.
+	steps := []struct {
+		method, path, body string
+		header             []string
+		e                  int
+	}{
+		{"POST", "/v1/appointments", apptBody("1"), nil, http.StatusOK},
+		{
+			"PATCH", "/v1/appointments/1",
+			`{"start_time":"2020-01-02T10:00:00-08:00","end_time":"2020-01-02T10:30:00-08:00"}`,
+			[]string{ifMatchHeader, `"1"`}, http.StatusOK,
+		},
+		{
+			"PATCH", "/v1/appointments/1",
+			`{"start_time":"2020-01-02T11:00:00-08:00","end_time":"2020-01-02T11:30:00-08:00"}`,
+			[]string{ifMatchHeader, `"2"`}, http.StatusOK,
+		},
+		{
+			"PATCH", "/v1/appointments/1",
+			`{"start_time":"2020-01-02T11:00:00-08:00","end_time":"2020-01-02T11:30:00-08:00","trainer_id":2}`,
+			[]string{ifMatchHeader, `"3"`}, http.StatusOK,
+		},
+		{"DELETE", "/v1/appointments/1", "", []string{ifMatchHeader, `"4"`}, http.StatusNoContent},
+	}
+
+	for i, step := range steps {
+		fake.Set(testNow.Add(time.Duration(i) * time.Hour))
+		if w := do(s, step.method, step.path, step.body, step.header...); w.Code != step.e {
+			t.Fatalf("%s %s: Expected %d, got %d: %s", step.method, step.path, step.e, w.Code, w.Body)
+		}
+	}
+
+	w := do(s, "GET", "/v1/appointments/1/history", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var entries []struct {
+		RecordedAt  time.Time    `json:"recorded_at"`
+		Changes     []string     `json:"changes"`
+		Appointment apptResponse `json:"appointment"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting doesn't change the appointment's version.
+	versions := []struct {
+		version uint
+		changes []string
+	}{
+		{1, []string{}},
+		{2, []string{"end_time", "start_time"}},
+		{3, []string{"end_time", "start_time"}},
+		{4, []string{"trainer_id"}},
+		{4, []string{"deleted_at"}},
+	}
+	if len(entries) != len(versions) {
+		t.Fatalf("Expected %d versions, got %d", len(versions), len(entries))
+	}
+
+	for i, e := range entries {
+		v := versions[i]
+		if !equalStrings(e.Changes, v.changes) {
+			t.Errorf("Entry %d: Expected changes to %v, got %v", i, v.changes, e.Changes)
+		}
+		if want := testNow.Add(time.Duration(i) * time.Hour); !e.RecordedAt.Equal(want) {
+			t.Errorf("Entry %d: Expected it recorded at %v, got %v", i, want, e.RecordedAt)
+		}
+		if e.Appointment.ID != 1 || e.Appointment.Version != v.version {
+			t.Errorf("Entry %d: Expected appointment 1 at version %d, got %+v", i, v.version, e.Appointment)
+		}
+	}
+
+	asOf := func(d time.Duration) string {
+		return url.QueryEscape(testNow.Add(d).Format(time.RFC3339))
+	}
+
+	testCases := []struct {
+		path      string
+		e         int
+		startTime string
+		trainerID uint
+	}{
+		{fmt.Sprintf("/v1/appointments/1?as_of=%s", asOf(-time.Minute)), http.StatusNotFound, "", 0},
+		{fmt.Sprintf("/v1/appointments/1?as_of=%s", asOf(30*time.Minute)), http.StatusOK, "2020-01-02T17:00:00Z", 1},
+		{fmt.Sprintf("/v1/appointments/1?as_of=%s", asOf(time.Hour)), http.StatusOK, "2020-01-02T18:00:00Z", 1},
+		{fmt.Sprintf("/v1/appointments/1?as_of=%s", asOf(150*time.Minute)), http.StatusOK, "2020-01-02T19:00:00Z", 1},
+		{fmt.Sprintf("/v1/appointments/1?as_of=%s", asOf(210*time.Minute)), http.StatusOK, "2020-01-02T19:00:00Z", 2},
+		{fmt.Sprintf("/v1/appointments/1?as_of=%s", asOf(5*time.Hour)), http.StatusNotFound, "", 0},
+		{
+			fmt.Sprintf("/v1/appointments/1?as_of=%s&include_deleted=true", asOf(5*time.Hour)),
+			http.StatusOK, "2020-01-02T19:00:00Z", 2,
+		},
+		{"/v1/appointments/1?as_of=yesterday", http.StatusBadRequest, "", 0},
+	}
+
+	for _, tc := range testCases {
+		w := do(s, "GET", tc.path, "")
+		if w.Code != tc.e {
+			t.Errorf("%s: Expected %d, got %d", tc.path, tc.e, w.Code)
+			continue
+		}
+		if tc.e != http.StatusOK {
+			continue
+		}
+
+		var appt apptResponse
+		if err := json.NewDecoder(w.Body).Decode(&appt); err != nil {
+			t.Fatal(err)
+		}
+		if appt.StartTime.UTC().Format(time.RFC3339) != tc.startTime || appt.TrainerID != tc.trainerID {
+			t.Errorf("%s: Expected %s with trainer %d, got %+v", tc.path, tc.startTime, tc.trainerID, appt)
+		}
+	}
+
+	// Lists are filtered on the appointments as they were.
+	listCases := []struct {
+		path string
+		e    int
+	}{
+		{fmt.Sprintf("/v1/trainers/2/appointments?as_of=%s", asOf(150*time.Minute)), 0},
+		{fmt.Sprintf("/v1/trainers/2/appointments?as_of=%s", asOf(210*time.Minute)), 1},
+		{fmt.Sprintf("/v1/appointments?trainer_id=1&as_of=%s", asOf(150*time.Minute)), 1},
+		{"/v1/appointments", 0},
+	}
+
+	for _, tc := range listCases {
+		w := do(s, "GET", tc.path, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: Expected %d, got %d", tc.path, http.StatusOK, w.Code)
+		}
+
+		var appts []apptResponse
+		if err := json.NewDecoder(w.Body).Decode(&appts); err != nil {
+			t.Fatal(err)
+		}
+		if len(appts) != tc.e {
+			t.Errorf("%s: Expected %d appointments, got %d", tc.path, tc.e, len(appts))
+		}
+	}
+
+	other := "Bearer " + testToken(s, auth.Claims{"sub": "client", "role": auth.RoleClient, "user_id": float64(2)})
+	badRequests := []struct {
+		path    string
+		headers []string
+		e       int
+	}{
+		{"/v1/appointments/2/history", nil, http.StatusNotFound},
+		{"/v1/appointments/1/history", []string{authorizationHeader, other}, http.StatusForbidden},
+		// Only appointments keep their history.
+		{fmt.Sprintf("/v1/users?as_of=%s", asOf(time.Hour)), nil, http.StatusBadRequest},
+	}
+	for _, tc := range badRequests {
+		if w := do(s, "GET", tc.path, "", tc.headers...); w.Code != tc.e {
+			t.Errorf("%s: Expected %d, got %d", tc.path, tc.e, w.Code)
+		}
+	}
+}
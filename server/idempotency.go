@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+const (
+	// Headers
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	cacheControlHeader       = "Cache-Control"
+
+	defaultIdempotencyKeyTTL = 24 * time.Hour
+	idempotencyClaimLease    = 5 * time.Minute
+	idempotencyCleanupPeriod = time.Hour
+	maxIdempotencyKeyLength  = 255
+)
+
+// idempotency is middleware that lets clients safely retry POST, PUT and PATCH requests. The
+// first request with a given Idempotency-Key is handled normally and its response stored; later
+// requests from the same client with the same key and body get the stored response replayed.
+// Responses marked with noStore, which carry credentials, are never stored.
+type idempotency struct {
+	store  store.Store
+	logger *log.Logger
+	clock  clock.Clock
+	ttl    time.Duration
+}
+
+func newIdempotency(s store.Store, logger *log.Logger, clock clock.Clock, ttl time.Duration) *idempotency {
+	if ttl == 0 {
+		ttl = defaultIdempotencyKeyTTL
+	}
+
+	return &idempotency{store: s, logger: logger, clock: clock, ttl: ttl}
+}
+
+func (i *idempotency) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || !isIdempotentMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("Idempotency-Key is too long"))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			i.logger.Printf("Error reading body: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := requestFingerprint(r, body)
+		key = scopedKey(r, key)
+
+		stored, claimed, err := i.claim(key, fingerprint)
+		if err != nil {
+			i.logger.Printf("Error claiming idempotency key: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !claimed {
+			i.replay(w, stored, fingerprint)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// Server errors aren't the client's fault, so let them retry with the same key. Responses
+		// that carry credentials aren't kept, so a retry is handled afresh.
+		if rec.status() >= http.StatusInternalServerError || isNoStore(rec.Header()) {
+			if err := i.store.IdempotencyKeys().Delete(key); err != nil {
+				i.logger.Printf("Error releasing idempotency key: %v", err)
+			}
+			return
+		}
+
+		header, err := json.Marshal(rec.Header())
+		if err != nil {
+			i.logger.Printf("Error encoding headers: %v", err)
+			return
+		}
+
+		stored.StatusCode = rec.status()
+		stored.Header = header
+		stored.Body = rec.body.Bytes()
+		if err := i.store.IdempotencyKeys().Save(stored); err != nil {
+			i.logger.Printf("Error storing idempotent response: %v", err)
+		}
+	})
+}
+
+// claim reserves the key for this request and reports whether it did. If the key was already
+// used it returns the stored record instead; expired records are discarded and the key claimed
+// afresh. So is a claim with no response after idempotencyClaimLease, whose request must have
+// died before storing one.
+func (i *idempotency) claim(key, fingerprint string) (*models.IdempotencyKey, bool, error) {
+	var stored *models.IdempotencyKey
+	claimed := false
+	err := i.store.Transaction(func(tx store.Store) error {
+		existing, err := tx.IdempotencyKeys().Get(key)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+
+		if err == nil {
+			age := i.clock.Now().Sub(existing.CreatedAt)
+			if age < i.ttl && (existing.StatusCode != 0 || age < idempotencyClaimLease) {
+				stored = existing
+				return nil
+			}
+
+			if err := tx.IdempotencyKeys().Delete(key); err != nil {
+				return err
+			}
+		}
+
+		stored = &models.IdempotencyKey{Key: key, Fingerprint: fingerprint, CreatedAt: i.clock.Now()}
+		claimed = true
+		return tx.IdempotencyKeys().Create(stored)
+	})
+	if err != nil {
+		// A concurrent request may have claimed the key between our read and insert.
+		if existing, getErr := i.store.IdempotencyKeys().Get(key); getErr == nil {
+			return existing, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	return stored, claimed, nil
+}
+
+func (i *idempotency) replay(w http.ResponseWriter, stored *models.IdempotencyKey, fingerprint string) {
+	if stored.Fingerprint != fingerprint {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte("Idempotency-Key was already used for a different request"))
+		return
+	}
+
+	if stored.StatusCode == 0 {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte("a request with this Idempotency-Key is still in progress"))
+		return
+	}
+
+	var header http.Header
+	if err := json.Unmarshal(stored.Header, &header); err != nil {
+		i.logger.Printf("Error decoding stored headers: %v", err)
+	}
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+
+	w.WriteHeader(stored.StatusCode)
+	_, _ = w.Write(stored.Body)
+}
+
+// cleanup deletes expired keys every period until ctx is done.
+func (i *idempotency) cleanup(ctx context.Context, period time.Duration) {
+	ticker := i.clock.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			if err := i.store.IdempotencyKeys().DeleteBefore(i.clock.Now().Add(-i.ttl)); err != nil {
+				i.logger.Printf("Error deleting expired idempotency keys: %v", err)
+			}
+		}
+	}
+}
+
+// noStore marks the response as carrying credentials, such as tokens or keys, that mustn't be
+// cached by clients or kept for idempotent replay. Call it before writing the status.
+func noStore(w http.ResponseWriter) {
+	w.Header().Set(cacheControlHeader, "no-store")
+}
+
+func isNoStore(header http.Header) bool {
+	for _, directive := range strings.Split(header.Get(cacheControlHeader), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isIdempotentMethod(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch
+}
+
+// scopedKey returns the key as stored: the Idempotency-Key prefixed with the client's subject, so
+// that clients who pick the same key neither replay nor block each other's requests. The
+// subject's length keeps a subject and key apart when either contains the separator.
+func scopedKey(r *http.Request, key string) string {
+	var subject string
+	if principal := auth.FromContext(r.Context()); principal != nil {
+		subject = principal.Subject
+	}
+
+	return fmt.Sprintf("%d:%s:%s", len(subject), subject, key)
+}
+
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	_, _ = io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	_, _ = h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes a response through to the client while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	if rr.code == 0 {
+		rr.code = code
+	}
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.code == 0 {
+		rr.code = http.StatusOK
+	}
+	rr.body.Write(b)
+
+	return rr.ResponseWriter.Write(b)
+}
+
+func (rr *responseRecorder) status() int {
+	if rr.code == 0 {
+		return http.StatusOK
+	}
+
+	return rr.code
+}
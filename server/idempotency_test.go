@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestFingerprint(t *testing.T) {
+	post := httptest.NewRequest(http.MethodPost, "/appointments", nil)
+	put := httptest.NewRequest(http.MethodPut, "/appointments", nil)
+
+	a := requestFingerprint(post, []byte(`{"user_id":1}`))
+	if a != requestFingerprint(post, []byte(`{"user_id":1}`)) {
+		t.Errorf("Expected identical requests to have the same fingerprint")
+	}
+
+	if a == requestFingerprint(post, []byte(`{"user_id":2}`)) {
+		t.Errorf("Expected different bodies to have different fingerprints")
+	}
+
+	if a == requestFingerprint(put, []byte(`{"user_id":1}`)) {
+		t.Errorf("Expected different methods to have different fingerprints")
+	}
+}
+
+func TestResponseRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := &responseRecorder{ResponseWriter: w}
+
+	rec.WriteHeader(http.StatusConflict)
+	rec.WriteHeader(http.StatusOK)
+	_, _ = rec.Write([]byte("appt is not available"))
+
+	if rec.status() != http.StatusConflict {
+		t.Errorf("Expected %d, got %d", http.StatusConflict, rec.status())
+	}
+
+	if rec.body.String() != w.Body.String() {
+		t.Errorf("Expected %q, got %q", w.Body.String(), rec.body.String())
+	}
+}
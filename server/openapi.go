@@ -0,0 +1,707 @@
+package server
+
+import (
+	"compress/gzip"
+	"embed"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const openAPIVersion = "3.0.3"
+
+// docsFiles are the docs page and the Swagger UI it's built on, which is vendored so that the
+// page works without access to a CDN. The Swagger UI assets are stored gzipped.
+//
+//go:embed docs
+var docsFiles embed.FS
+
+// apiOperation describes a route for the OpenAPI document. The router supplies the paths and
+// methods; this supplies what the router doesn't know.
+type apiOperation struct {
+	summary string
+	// request and response are zero values of the body types, or nil for no body.
+	request  interface{}
+	response interface{}
+	// status is the success status code. Defaults to 200.
+	status int
+	query  []apiParam
+	// conditional marks writes that take If-Match and reads that take If-None-Match.
+	conditional bool
+	// contentType is the media type of a response that isn't JSON, which is described as text.
+	contentType string
+}
+
+type apiParam struct {
+	name        string
+	schema      map[string]interface{}
+	required    bool
+	description string
+}
+
+var (
+	idSchema       = map[string]interface{}{"type": "integer", "minimum": 0}
+	dateSchema     = map[string]interface{}{"type": "string", "format": "date"}
+	dateTimeSchema = map[string]interface{}{"type": "string", "format": "date-time"}
+	// rangeBoundSchema is a date-time or a date.
+	rangeBoundSchema = map[string]interface{}{"oneOf": []interface{}{dateTimeSchema, dateSchema}}
+
+	includeQuery = apiParam{
+		name:        includeParam,
+		schema:      map[string]interface{}{"type": "string"},
+		description: "Comma-separated related resources to embed: user, trainer",
+	}
+
+	includeDeletedQuery = apiParam{
+		name:        includeDeletedParam,
+		schema:      map[string]interface{}{"type": "boolean"},
+		description: "Include deleted resources, which have a deleted_at time",
+	}
+
+	asOfQuery = apiParam{
+		name:        asOfParam,
+		schema:      dateTimeSchema,
+		description: "Appointments as they were at this time",
+	}
+
+	feedTokenQuery = apiParam{
+		name:        feedTokenParam,
+		schema:      map[string]interface{}{"type": "string"},
+		required:    true,
+		description: "A token issued for the feed, which calendar apps send instead of credentials",
+	}
+
+	apptQueries = []apiParam{
+		{name: userIDParam, schema: idSchema},
+		{name: trainerIDParam, schema: idSchema},
+		{name: startTimeParam, schema: dateTimeSchema, description: "Appointments starting at or after"},
+		{name: endTimeParam, schema: dateTimeSchema, description: "Appointments ending before"},
+		includeQuery,
+		includeDeletedQuery,
+		asOfQuery,
+	}
+)
+
+// apiOperations is keyed by method and mux path template, without the version prefix. Every
+// registered route needs an entry; TestOpenAPICoversRoutes enforces this.
+var apiOperations = map[string]apiOperation{
+	"GET /healthz": {summary: "Health check"},
+
+	"GET /openapi.json": {summary: "This document"},
+	"GET /docs":         {summary: "Interactive API documentation"},
+	"GET /docs/{file}":  {summary: "A file the documentation page loads"},
+
+	"POST /appointments": {
+		summary: "Create an appointment", request: apptRequest{}, response: apptResponse{},
+	},
+	"GET /appointments": {
+		summary: "List appointments", response: []apptResponse{}, query: apptQueries,
+	},
+	"GET /appointments/{id}": {
+		summary: "Get an appointment", response: apptResponse{}, conditional: true,
+		query: []apiParam{includeQuery, includeDeletedQuery, asOfQuery},
+	},
+	"PUT /appointments/{id}": {
+		summary: "Replace an appointment", request: apptRequest{}, response: apptResponse{}, conditional: true,
+	},
+	"PATCH /appointments/{id}": {
+		summary: "Update fields of an appointment", request: apptRequest{}, response: apptResponse{},
+		conditional: true,
+	},
+	"DELETE /appointments/{id}": {
+		summary: "Delete an appointment", status: http.StatusNoContent, conditional: true,
+	},
+	"POST /appointments/{id}/restore": {
+		summary: "Restore a deleted appointment", response: apptResponse{}, conditional: true,
+	},
+	"POST /appointments/{id}/attendance": {
+		summary: "Mark whether the user attended an appointment that has started", request: attendanceRequest{},
+		response: apptResponse{}, conditional: true,
+	},
+	"GET /appointments/{id}/history": {
+		summary: "List an appointment's versions, oldest first", response: []historyEntry{},
+		query: []apiParam{includeQuery},
+	},
+
+	"POST /trainers": {
+		summary: "Create a trainer", request: trainerRequest{}, response: trainerResponse{},
+	},
+	"GET /trainers": {
+		summary: "List trainers", response: []trainerResponse{}, query: []apiParam{includeDeletedQuery},
+	},
+	"GET /trainers/{id}": {
+		summary: "Get a trainer", response: trainerResponse{}, conditional: true, query: []apiParam{includeDeletedQuery},
+	},
+	"PUT /trainers/{id}": {
+		summary: "Replace a trainer", request: trainerRequest{}, response: trainerResponse{}, conditional: true,
+	},
+	"PATCH /trainers/{id}": {
+		summary: "Update fields of a trainer", request: trainerRequest{}, response: trainerResponse{},
+		conditional: true,
+	},
+	"DELETE /trainers/{id}": {
+		summary: "Delete a trainer", status: http.StatusNoContent, conditional: true,
+	},
+	"POST /trainers/{id}/restore": {
+		summary: "Restore a deleted trainer", response: trainerResponse{}, conditional: true,
+	},
+	"GET /trainers/{trainer_id}/appointments": {
+		summary: "List a trainer's appointments", response: []apptResponse{}, query: apptQueries,
+	},
+	"GET /trainers/{trainer_id}/appointments/available": {
+		summary:  "List a trainer's available appointment start times",
+		response: availableResponse{},
+		query: []apiParam{
+			{name: startsAtParam, schema: dateSchema, required: true},
+			{name: endsAtParam, schema: dateSchema, required: true},
+		},
+	},
+
+	"POST /users": {
+		summary: "Create a user", request: userRequest{}, response: userResponse{},
+	},
+	"GET /users": {
+		summary: "List users", response: []userResponse{}, query: []apiParam{includeDeletedQuery},
+	},
+	"GET /users/{id}": {
+		summary: "Get a user", response: userResponse{}, conditional: true, query: []apiParam{includeDeletedQuery},
+	},
+	"PUT /users/{id}": {
+		summary: "Replace a user", request: userRequest{}, response: userResponse{}, conditional: true,
+	},
+	"PATCH /users/{id}": {
+		summary: "Update fields of a user", request: userRequest{}, response: userResponse{}, conditional: true,
+	},
+	"DELETE /users/{id}": {
+		summary: "Delete a user", status: http.StatusNoContent, conditional: true,
+	},
+	"POST /users/{id}/restore": {
+		summary: "Restore a deleted user", response: userResponse{}, conditional: true,
+	},
+	"GET /users/{user_id}/appointments": {
+		summary: "List a user's appointments", response: []apptResponse{}, query: apptQueries,
+	},
+
+	"GET /trainers/{trainer_id}/calendar.ics": {
+		summary: "Get a trainer's appointments as an iCalendar feed", contentType: calendarContentType,
+		query: []apiParam{feedTokenQuery},
+	},
+	"POST /trainers/{trainer_id}/calendar/token": {
+		summary:  "Issue a token for a trainer's calendar feed, revoking earlier ones",
+		response: feedTokenResponse{}, status: http.StatusCreated,
+	},
+	"DELETE /trainers/{trainer_id}/calendar/token": {
+		summary: "Revoke the tokens of a trainer's calendar feed", status: http.StatusNoContent,
+	},
+	"GET /users/{user_id}/calendar.ics": {
+		summary: "Get a user's appointments as an iCalendar feed", contentType: calendarContentType,
+		query: []apiParam{feedTokenQuery},
+	},
+	"POST /users/{user_id}/calendar/token": {
+		summary:  "Issue a token for a user's calendar feed, revoking earlier ones",
+		response: feedTokenResponse{}, status: http.StatusCreated,
+	},
+	"DELETE /users/{user_id}/calendar/token": {
+		summary: "Revoke the tokens of a user's calendar feed", status: http.StatusNoContent,
+	},
+
+	"GET /trainers/{trainer_id}/freebusy": {
+		summary:  "Get a trainer's busy and free periods",
+		response: freeBusyResponse{},
+		query: []apiParam{
+			{name: startsAtParam, schema: rangeBoundSchema, required: true, description: "A date-time, or a date for the start of that day"},
+			{name: endsAtParam, schema: rangeBoundSchema, required: true, description: "A date-time, or a date for the end of that day"},
+			{
+				name: freeBusyFormatParam, schema: map[string]interface{}{"type": "string", "enum": []string{"json", "ics"}},
+				description: "ics returns an iCalendar VFREEBUSY instead of JSON",
+			},
+		},
+	},
+	"GET /trainers/{trainer_id}/busy-calendars": {
+		summary: "List the calendars whose events keep a trainer busy", response: []busyCalendarResponse{},
+	},
+	"POST /trainers/{trainer_id}/busy-calendars": {
+		summary: "Add a calendar whose events keep a trainer busy, from a source or uploaded data",
+		request: busyCalendarRequest{}, response: busyCalendarResponse{}, status: http.StatusCreated,
+		query: []apiParam{{
+			name: busyCalendarNameParam, schema: map[string]interface{}{"type": "string"},
+			description: "The calendar's name, when the body is text/calendar data rather than JSON",
+		}},
+	},
+	"DELETE /trainers/{trainer_id}/busy-calendars/{id}": {
+		summary: "Remove a trainer's busy calendar", status: http.StatusNoContent,
+	},
+	"POST /trainers/{trainer_id}/busy-calendars/{id}/refresh": {
+		summary: "Fetch a trainer's busy calendar from its source again", response: busyCalendarResponse{},
+	},
+
+	"POST /batch": {
+		summary: "Apply many operations in one transaction", request: batchRequest{}, response: batchResponse{},
+	},
+
+	"GET /audit": {
+		summary: "List recorded changes, oldest first", response: []auditEntryResponse{},
+		query: []apiParam{
+			{
+				name: resourceParam, schema: map[string]interface{}{"type": "string"},
+				description: "Changes to this resource: appointments, trainers, users, api-keys, feed-tokens, busy-calendars or time-off",
+			},
+			{name: idParam, schema: idSchema, description: "Changes to the resource with this ID"},
+		},
+	},
+
+	"POST /admin/purge": {
+		summary: "Permanently remove deleted resources", request: purgeRequest{}, response: purgeResponse{},
+	},
+	"POST /admin/api-keys": {
+		summary: "Create an API key, which is only shown in this response", request: apiKeyRequest{},
+		response: apiKeyResponse{}, status: http.StatusCreated,
+	},
+	"GET /admin/api-keys": {
+		summary: "List API keys", response: []apiKeyResponse{},
+	},
+	"DELETE /admin/api-keys/{id}": {
+		summary: "Revoke an API key", status: http.StatusNoContent,
+	},
+
+	"POST /auth/register": {
+		summary: "Register a user with a password and log them in", request: registerRequest{},
+		response: tokenResponse{}, status: http.StatusCreated,
+	},
+	"POST /auth/login": {
+		summary: "Log in with a username and password", request: loginRequest{}, response: tokenResponse{},
+	},
+	"POST /auth/refresh": {
+		summary: "Exchange a refresh token, which can only be used once, for new tokens",
+		request: refreshRequest{}, response: tokenResponse{},
+	},
+	"POST /auth/logout": {
+		summary: "End the session of a refresh token", request: refreshRequest{}, status: http.StatusNoContent,
+	},
+	"POST /auth/password-reset": {
+		summary: "Send a password reset token to the user", request: passwordResetRequest{},
+		status: http.StatusAccepted,
+	},
+	"POST /auth/password-reset/confirm": {
+		summary: "Set a new password with a reset token", request: passwordResetConfirmRequest{},
+		status: http.StatusNoContent,
+	},
+	"GET /auth/oidc/login": {
+		summary: "Redirect to the OpenID Connect provider to log in", status: http.StatusFound,
+	},
+	"GET /auth/oidc/callback": {
+		summary:  "Finish logging in when the OpenID Connect provider redirects back",
+		response: tokenResponse{},
+		query: []apiParam{
+			{name: "code", schema: map[string]interface{}{"type": "string"}, required: true},
+			{name: "state", schema: map[string]interface{}{"type": "string"}, required: true},
+		},
+	},
+}
+
+// availableResponse is the body returned by getAvailableAppts.
+type availableResponse struct {
+	Available []time.Time `json:"available"`
+}
+
+var pathParamRegexp = regexp.MustCompile(`{([^}:]+)(:[^}]+)?}`)
+
+// openAPISpec builds an OpenAPI document for the routes registered on the router. Routes
+// missing from apiOperations are logged and left out.
+func openAPISpec(router *mux.Router, logger *log.Logger) (map[string]interface{}, error) {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		// Routes nested under a router but outside any version are the legacy aliases. They
+		// encode the models rather than the types described here, so leave them out.
+		version, opPath := versionOf(path)
+		if version == nil && len(ancestors) > 0 {
+			return nil
+		}
+		deprecated := version != nil && !version.deprecated.IsZero()
+
+		for _, method := range methods {
+			op, ok := apiOperations[method+" "+opPath]
+			if !ok {
+				logger.Printf("No OpenAPI entry for %s %s", method, path)
+				continue
+			}
+
+			// OpenAPI path parameters can't carry mux's regexp patterns.
+			specPath := pathParamRegexp.ReplaceAllString(path, "{$1}")
+			if paths[specPath] == nil {
+				paths[specPath] = map[string]interface{}{}
+			}
+
+			spec := op.spec(method, path, schemas)
+			if isPublic(path) {
+				spec["security"] = []interface{}{}
+			}
+			if deprecated {
+				spec["deprecated"] = true
+			}
+			paths[specPath][strings.ToLower(method)] = spec
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "Appts",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		// Every operation needs a bearer token, either an API key or a JWT, unless it overrides
+		// this with no requirements.
+		"security": []interface{}{map[string]interface{}{"bearerAuth": []string{}}},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}, nil
+}
+
+func (op apiOperation) spec(method, path string, schemas map[string]interface{}) map[string]interface{} {
+	var params []map[string]interface{}
+	for _, match := range pathParamRegexp.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]interface{}{
+			"name": match[1], "in": "path", "required": true, "schema": idSchema,
+		})
+	}
+
+	for _, q := range op.query {
+		param := map[string]interface{}{
+			"name": q.name, "in": "query", "required": q.required, "schema": q.schema,
+		}
+		if q.description != "" {
+			param["description"] = q.description
+		}
+		params = append(params, param)
+	}
+
+	responses := map[string]interface{}{}
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if op.response != nil {
+		success["content"] = jsonContent(schemaFor(reflect.TypeOf(op.response), schemas))
+	} else if op.contentType != "" {
+		success["content"] = map[string]interface{}{
+			op.contentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		}
+	}
+	responses[strconv.Itoa(status)] = success
+	if !isPublic(path) {
+		responses[strconv.Itoa(http.StatusUnauthorized)] = map[string]interface{}{
+			"description": "Missing or invalid credentials",
+		}
+		responses[strconv.Itoa(http.StatusForbidden)] = map[string]interface{}{
+			"description": "The principal's role doesn't allow this",
+		}
+	}
+
+	if !publicPaths[path] {
+		responses[strconv.Itoa(http.StatusTooManyRequests)] = map[string]interface{}{
+			"description": "The client's rate limit for the route is used up",
+		}
+	}
+
+	if op.request != nil {
+		responses[strconv.Itoa(http.StatusBadRequest)] = map[string]interface{}{"description": "Invalid request"}
+	}
+
+	if op.conditional {
+		header := ifMatchHeader
+		if method == http.MethodGet {
+			header = ifNoneMatchHeader
+			responses[strconv.Itoa(http.StatusNotModified)] = map[string]interface{}{"description": "Not modified"}
+		} else {
+			responses[strconv.Itoa(http.StatusPreconditionFailed)] = map[string]interface{}{
+				"description": "The resource has changed since it was read",
+			}
+			responses[strconv.Itoa(http.StatusPreconditionRequired)] = map[string]interface{}{
+				"description": "If-Match is required",
+			}
+		}
+		params = append(params, map[string]interface{}{
+			"name": header, "in": "header", "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+
+	if isIdempotentMethod(method) {
+		params = append(params, map[string]interface{}{
+			"name": idempotencyKeyHeader, "in": "header", "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+
+	spec := map[string]interface{}{
+		"summary":   op.summary,
+		"responses": responses,
+	}
+	if len(params) > 0 {
+		spec["parameters"] = params
+	}
+	if op.request != nil {
+		spec["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  jsonContent(schemaFor(reflect.TypeOf(op.request), schemas)),
+		}
+	}
+
+	return spec
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	deletedAtType  = reflect.TypeOf(gorm.DeletedAt{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	interfaceType  = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// schemaFor returns a JSON schema for t, adding named structs to schemas and referring to them.
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t {
+	case timeType:
+		return dateTimeSchema
+	case deletedAtType:
+		return map[string]interface{}{"type": "string", "format": "date-time", "nullable": true}
+	case rawMessageType:
+		return map[string]interface{}{"type": "object"}
+	case interfaceType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := schemaFor(t.Elem(), schemas)
+		return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := schemas[name]; !ok {
+			// Reserve the name first so recursive types terminate.
+			schemas[name] = map[string]interface{}{}
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+
+	return map[string]interface{}{}
+}
+
+func schemaName(t reflect.Type) string {
+	return strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+}
+
+// structSchema describes the JSON encoding of a struct, with required fields and constraints
+// taken from its validate tags.
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			name, omit := jsonFieldName(field)
+			if omit {
+				continue
+			}
+
+			// encoding/json flattens untagged embedded structs; fields declared on the outer
+			// struct win, so don't overwrite them.
+			if field.Anonymous && field.Type.Kind() == reflect.Struct && name == "" {
+				addFields(field.Type)
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			schema := schemaFor(field.Type, schemas)
+			for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+				if rule == "required" {
+					required = append(required, name)
+				} else if strings.HasPrefix(rule, "gtfield=") {
+					schema = withDescription(schema, "Must be after "+jsonName(t, strings.TrimPrefix(rule, "gtfield=")))
+				}
+			}
+			properties[name] = schema
+		}
+	}
+	addFields(t)
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+// jsonFieldName returns the name a field is encoded under, "" for the Go field name, and
+// whether it is omitted from the encoding.
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", true
+	}
+
+	return strings.Split(tag, ",")[0], false
+}
+
+// jsonName returns the JSON name of the named field of t.
+func jsonName(t reflect.Type, fieldName string) string {
+	field, ok := t.FieldByName(fieldName)
+	if !ok {
+		return fieldName
+	}
+
+	if name, _ := jsonFieldName(field); name != "" {
+		return name
+	}
+
+	return fieldName
+}
+
+func withDescription(schema map[string]interface{}, description string) map[string]interface{} {
+	described := map[string]interface{}{"description": description}
+	for k, v := range schema {
+		described[k] = v
+	}
+
+	return described
+}
+
+func (s *Server) openAPI(w http.ResponseWriter, r *http.Request) {
+	spec, err := openAPISpec(s.router, s.logger)
+	if err != nil {
+		s.logger.Printf("Error building OpenAPI document: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(spec)
+	if err != nil {
+		s.logger.Printf("Error encoding OpenAPI document: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) docs(w http.ResponseWriter, r *http.Request) {
+	page, err := docsFiles.ReadFile("docs/index.html")
+	if err != nil {
+		s.logger.Printf("Error reading docs page: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(page)
+}
+
+// docsAsset serves a file the docs page loads, decompressing it for clients that don't accept
+// gzip.
+func (s *Server) docsAsset(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(mux.Vars(r)["file"])
+	if name == "index.html" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(name)))
+	w.Header().Set(cacheControlHeader, "public, max-age=86400")
+
+	if data, err := docsFiles.ReadFile("docs/" + name); err == nil {
+		_, _ = w.Write(data)
+		return
+	}
+
+	data, err := docsFiles.Open("docs/" + name + ".gz")
+	if err != nil {
+		w.Header().Del("Content-Type")
+		w.Header().Del(cacheControlHeader)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer data.Close()
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = io.Copy(w, data)
+		return
+	}
+
+	zr, err := gzip.NewReader(data)
+	if err != nil {
+		s.logger.Printf("Error reading docs asset %s: %v", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.Copy(w, zr); err != nil {
+		s.logger.Printf("Error decompressing docs asset %s: %v", name, err)
+	}
+}
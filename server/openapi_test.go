@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/store"
+)
+
+func newTestRouter(t *testing.T) *mux.Router {
+	s, err := New(nil, WithStore(store.NewMemory(clock.Real)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s.router
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	router := newTestRouter(t)
+
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		_, opPath := versionOf(path)
+		for _, method := range methods {
+			if _, ok := apiOperations[method+" "+opPath]; !ok {
+				t.Errorf("Route %s %s has no entry in apiOperations", method, path)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenAPIApptSchema(t *testing.T) {
+	spec, err := openAPISpec(newTestRouter(t), log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	appt, ok := schemas["ApptRequest"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected an ApptRequest schema, got %v", schemas)
+	}
+
+	required := appt["required"].([]string)
+	expected := []string{"end_time", "start_time", "trainer_id", "user_id"}
+	if len(required) != len(expected) {
+		t.Fatalf("Expected required %v, got %v", expected, required)
+	}
+
+	for i := range expected {
+		if required[i] != expected[i] {
+			t.Errorf("Expected required %v, got %v", expected, required)
+		}
+	}
+
+	properties := appt["properties"].(map[string]interface{})
+	endTime := properties["end_time"].(map[string]interface{})
+	if endTime["description"] != "Must be after start_time" {
+		t.Errorf("Expected end_time to be described as after start_time, got %v", endTime)
+	}
+}
+
+func TestDocs(t *testing.T) {
+	s, err := New(nil, WithStore(store.NewMemory(clock.Real)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := do(s, "GET", "/docs", "", authorizationHeader, "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "https://") {
+		t.Fatalf("Expected a page without external assets, got %d: %s", w.Code, w.Body)
+	}
+
+	testCases := []struct {
+		path, acceptEncoding string
+		e                    int
+		contentType          string
+		contentEncoding      string
+	}{
+		{"/docs/swagger-ui-bundle.js", "gzip, deflate", http.StatusOK, "text/javascript; charset=utf-8", "gzip"},
+		{"/docs/swagger-ui.css", "", http.StatusOK, "text/css; charset=utf-8", ""},
+		{"/docs/init.js", "gzip", http.StatusOK, "text/javascript; charset=utf-8", ""},
+		{"/docs/index.html", "", http.StatusNotFound, "", ""},
+		{"/docs/missing.js", "", http.StatusNotFound, "", ""},
+	}
+
+	for _, tc := range testCases {
+		w := do(s, "GET", tc.path, "", authorizationHeader, "", "Accept-Encoding", tc.acceptEncoding)
+		if w.Code != tc.e {
+			t.Errorf("%s: Expected %d, got %d", tc.path, tc.e, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		header := w.Header()
+		if header.Get("Content-Type") != tc.contentType || header.Get("Content-Encoding") != tc.contentEncoding {
+			t.Errorf("%s: Expected %s %q, got %v", tc.path, tc.contentType, tc.contentEncoding, header)
+		}
+
+		body := w.Body.Bytes()
+		if tc.contentEncoding == "gzip" {
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.path, err)
+			}
+			if body, err = io.ReadAll(zr); err != nil {
+				t.Fatalf("%s: %v", tc.path, err)
+			}
+		}
+		if len(body) == 0 || bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+			t.Errorf("%s: Expected the asset's contents, got %d bytes", tc.path, len(body))
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/ratelimit"
+)
+
+const (
+	// Headers
+	rateLimitLimitHeader     = "RateLimit-Limit"
+	rateLimitRemainingHeader = "RateLimit-Remaining"
+	rateLimitResetHeader     = "RateLimit-Reset"
+	rateLimitPolicyHeader    = "RateLimit-Policy"
+
+	// defaultBudget names the budget shared by the routes without their own.
+	defaultBudget = "default"
+	// failedAuthBudget names the budget of requests whose credentials fail authentication.
+	failedAuthBudget = "failed-auth"
+)
+
+// RateLimitConfig sets how many requests each client may make. Clients are told apart by their
+// API key or JWT subject, or by IP address on the routes that don't need credentials.
+type RateLimitConfig struct {
+	// Default is the budget shared by the routes without their own. A zero Limit leaves them
+	// unlimited.
+	Default ratelimit.Limit
+	// Routes gives routes their own budgets. They are keyed by method and path within the API
+	// version, as in apiOperations, so each version and the legacy routes share a budget.
+	Routes map[string]ratelimit.Limit
+	// FailedAuth is the budget of each IP address's requests with credentials that fail
+	// authentication, to slow down guessing API keys and tokens. Once it's used up, the
+	// address's requests with credentials are refused before they're checked.
+	FailedAuth ratelimit.Limit
+}
+
+// DefaultRateLimits are the limits the appts command serves with. Listing available
+// appointments is expensive, so it has a smaller budget of its own.
+var DefaultRateLimits = RateLimitConfig{
+	Default: ratelimit.Limit{Requests: 600, Per: time.Minute, Burst: 100},
+	Routes: map[string]ratelimit.Limit{
+		"GET /trainers/{trainer_id}/appointments/available": {Requests: 30, Per: time.Minute, Burst: 10},
+		"POST /auth/login":          {Requests: 10, Per: time.Minute},
+		"POST /auth/register":       {Requests: 10, Per: time.Minute},
+		"POST /auth/password-reset": {Requests: 5, Per: time.Minute},
+	},
+	FailedAuth: ratelimit.Limit{Requests: 10, Per: time.Minute, Burst: 20},
+}
+
+// rateLimiter is middleware that rejects requests from clients that have used up their budget
+// for the route with 429 Too Many Requests. Every limited response says how much is left in
+// RateLimit-* headers.
+type rateLimiter struct {
+	backend ratelimit.Backend
+	logger  *log.Logger
+	config  RateLimitConfig
+}
+
+func newRateLimiter(backend ratelimit.Backend, logger *log.Logger, config RateLimitConfig) *rateLimiter {
+	return &rateLimiter{backend: backend, logger: logger, config: config}
+}
+
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget, limit := rl.budget(r)
+		// Health checks and docs are cheap, and health checks may come often.
+		if !limit.Enabled() || publicPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, docsPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		result, err := rl.backend.Take(r.Context(), budget+" "+clientKey(r), limit)
+		if err != nil {
+			// A backend outage shouldn't take the API down with it, so requests are let through.
+			rl.logger.Printf("Error taking from rate limit: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !writeRateLimit(w, limit, result) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// guardCredentials limits how often each IP address may send credentials that fail
+// authentication. It runs before the authenticator, since the budgets after it are kept by
+// principal, which requests with the wrong credentials don't have.
+func (rl *rateLimiter) guardCredentials(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := rl.config.FailedAuth
+		if !limit.Enabled() || r.Header.Get(authorizationHeader) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := failedAuthBudget + " " + ipKey(r)
+		result, err := rl.backend.Peek(r.Context(), key, limit)
+		if err != nil {
+			rl.logger.Printf("Error checking rate limit: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Only failures take from the budget, so the headers are left to the other budgets
+		// unless this one is used up.
+		if !result.Allowed {
+			writeRateLimit(w, limit, result)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		if sw.code == http.StatusUnauthorized {
+			if _, err := rl.backend.Take(r.Context(), key, limit); err != nil {
+				rl.logger.Printf("Error taking from rate limit: %v", err)
+			}
+		}
+	})
+}
+
+// writeRateLimit sets the RateLimit-* headers for the budget's state and, if the request wasn't
+// allowed, responds with 429 Too Many Requests. It reports whether the request was allowed.
+func writeRateLimit(w http.ResponseWriter, limit ratelimit.Limit, result ratelimit.Result) bool {
+	header := w.Header()
+	header.Set(rateLimitLimitHeader, strconv.Itoa(limit.Capacity()))
+	header.Set(rateLimitRemainingHeader, strconv.Itoa(result.Remaining))
+	header.Set(rateLimitResetHeader, ceilSeconds(result.Reset))
+	header.Set(rateLimitPolicyHeader, fmt.Sprintf("%d;w=%s;burst=%d", limit.Requests, ceilSeconds(limit.Per), limit.Capacity()))
+
+	if !result.Allowed {
+		header.Set(retryAfterHeader, ceilSeconds(result.RetryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte("rate limit exceeded"))
+		return false
+	}
+
+	return true
+}
+
+// statusWriter remembers the status of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.code == 0 {
+		sw.code = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.code == 0 {
+		sw.code = http.StatusOK
+	}
+
+	return sw.ResponseWriter.Write(b)
+}
+
+// budget returns the name and limit of the budget the request takes from.
+func (rl *rateLimiter) budget(r *http.Request) (string, ratelimit.Limit) {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			_, path := versionOf(template)
+			name := r.Method + " " + path
+			if limit, ok := rl.config.Routes[name]; ok {
+				return name, limit
+			}
+		}
+	}
+
+	return defaultBudget, rl.config.Default
+}
+
+// clientKey identifies the client making the request: its principal if it authenticated, or its
+// IP address.
+func clientKey(r *http.Request) string {
+	if p := auth.FromContext(r.Context()); p != nil {
+		return p.Method + ":" + p.Subject
+	}
+
+	return ipKey(r)
+}
+
+// ipKey identifies the client making the request by its IP address.
+func ipKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/ratelimit"
+)
+
+func TestRateLimit(t *testing.T) {
+	config := &Config{
+		Storage: StorageMemory,
+		JWT:     auth.JWTConfig{HS256Secret: testJWTSecret},
+		RateLimit: RateLimitConfig{
+			Default: ratelimit.Limit{Requests: 3, Per: time.Minute},
+			Routes: map[string]ratelimit.Limit{
+				"GET /trainers/{trainer_id}/appointments/available": {Requests: 1, Per: time.Minute},
+			},
+		},
+	}
+	s, err := New(config, WithClock(clock.NewFake(testNow)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bearer := func(sub string) string {
+		return "Bearer " + testToken(s, auth.Claims{"sub": sub, "role": auth.RoleAdmin})
+	}
+	alice, bob := bearer("alice"), bearer("bob")
+	available := "/trainers/1/appointments/available?starts_at=2020-01-02&ends_at=2020-01-03"
+
+	steps := []struct {
+		name          string
+		advance       time.Duration
+		authorization string
+		path          string
+		code          int
+		remaining     string
+		retryAfter    string
+	}{
+		{"First", 0, alice, "/v1/trainers", http.StatusOK, "2", ""},
+		{"Second", 0, alice, "/v1/users", http.StatusOK, "1", ""},
+		{"Third", 0, alice, "/v1/trainers", http.StatusOK, "0", ""},
+		{"Used up", 0, alice, "/v1/trainers", http.StatusTooManyRequests, "0", "20"},
+		{"Another client", 0, bob, "/v1/trainers", http.StatusOK, "2", ""},
+		{"Route with its own budget", 0, alice, "/v1" + available, http.StatusOK, "0", ""},
+		{"Its budget used up", 0, alice, "/v1" + available, http.StatusTooManyRequests, "0", "60"},
+		{"Shared with the legacy route", 0, alice, available, http.StatusTooManyRequests, "0", "60"},
+		{"Not limited", 0, alice, "/healthz", http.StatusOK, "", ""},
+		{"Refilled", 20 * time.Second, alice, "/v1/trainers", http.StatusOK, "0", ""},
+	}
+
+	for _, step := range steps {
+		fake := s.clock.(*clock.Fake)
+		fake.Set(fake.Now().Add(step.advance))
+		if step.advance > 0 {
+			alice = bearer("alice")
+		}
+
+		w := do(s, "GET", step.path, "", authorizationHeader, step.authorization)
+		if w.Code != step.code {
+			t.Errorf("%s: Expected %d, got %d: %s", step.name, step.code, w.Code, w.Body)
+		}
+		if got := w.Header().Get(rateLimitRemainingHeader); got != step.remaining {
+			t.Errorf("%s: Expected %s %q, got %q", step.name, rateLimitRemainingHeader, step.remaining, got)
+		}
+		if got := w.Header().Get(retryAfterHeader); got != step.retryAfter {
+			t.Errorf("%s: Expected %s %q, got %q", step.name, retryAfterHeader, step.retryAfter, got)
+		}
+	}
+
+	// Requests without credentials are limited by IP address.
+	for i, code := range []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusTooManyRequests} {
+		if w := do(s, "POST", "/v1/auth/login", "{}", authorizationHeader, ""); w.Code != code {
+			t.Errorf("Login %d: Expected %d, got %d", i+1, code, w.Code)
+		}
+	}
+}
+
+type failingBackend struct{}
+
+func (failingBackend) Take(context.Context, string, ratelimit.Limit) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("unavailable")
+}
+
+func (failingBackend) Peek(context.Context, string, ratelimit.Limit) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("unavailable")
+}
+
+func TestRateLimitFailedAuth(t *testing.T) {
+	config := &Config{
+		Storage:   StorageMemory,
+		JWT:       auth.JWTConfig{HS256Secret: testJWTSecret},
+		RateLimit: RateLimitConfig{FailedAuth: ratelimit.Limit{Requests: 2, Per: time.Minute}},
+	}
+	s, err := New(config, WithClock(clock.NewFake(testNow)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := "Bearer " + testToken(s, auth.Claims{"sub": "alice", "role": auth.RoleAdmin})
+	steps := []struct {
+		name          string
+		advance       time.Duration
+		authorization string
+		code          int
+	}{
+		{"Valid", 0, valid, http.StatusOK},
+		{"Valid again", 0, valid, http.StatusOK},
+		{"Wrong key", 0, "Bearer appts_wrong", http.StatusUnauthorized},
+		{"Wrong token", 0, "Bearer not.a.jwt", http.StatusUnauthorized},
+		{"Guessing", 0, "Bearer appts_guess", http.StatusTooManyRequests},
+		{"Refused before checking", 0, valid, http.StatusTooManyRequests},
+		{"Without credentials", 0, "", http.StatusUnauthorized},
+		{"Refilled one", 30 * time.Second, "Bearer appts_guess", http.StatusUnauthorized},
+		{"Used up again", 0, valid, http.StatusTooManyRequests},
+	}
+
+	for _, step := range steps {
+		fake := s.clock.(*clock.Fake)
+		fake.Set(fake.Now().Add(step.advance))
+
+		w := do(s, "GET", "/v1/trainers", "", authorizationHeader, step.authorization)
+		if w.Code != step.code {
+			t.Errorf("%s: Expected %d, got %d: %s", step.name, step.code, w.Code, w.Body)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get(retryAfterHeader) == "" {
+			t.Errorf("%s: Expected %s, got %v", step.name, retryAfterHeader, w.Header())
+		}
+	}
+}
+
+func TestRateLimitBackendError(t *testing.T) {
+	config := &Config{
+		Storage:   StorageMemory,
+		JWT:       auth.JWTConfig{HS256Secret: testJWTSecret},
+		RateLimit: RateLimitConfig{Default: ratelimit.Limit{Requests: 1, Per: time.Minute}},
+	}
+	s, err := New(config, WithClock(clock.NewFake(testNow)), WithRateLimitBackend(failingBackend{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the backend, requests are let through.
+	for i := 0; i < 2; i++ {
+		if w := do(s, "GET", "/v1/trainers", ""); w.Code != http.StatusOK {
+			t.Errorf("Expected %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+}
@@ -2,21 +2,22 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"os"
-	"os/signal"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
 
-	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/auth"
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/ratelimit"
+	"github.com/marcuscarr/appts/store"
 )
 
 const (
@@ -29,32 +30,230 @@ const (
 	endsAtParam    = "ends_at"
 	startTimeParam = "start_time"
 	endTimeParam   = "end_time"
+
+	includeDeletedParam = "include_deleted"
+	asOfParam           = "as_of"
+
+	defaultShutdownTimeout = 5 * time.Second
+	// oidcTimeout limits each request to the OIDC provider.
+	oidcTimeout = 10 * time.Second
+
+	// Storage backends
+	StoragePostgres = "postgres"
+	StorageSQLite   = "sqlite"
+	StorageMemory   = "memory"
 )
 
+// Server serves the API. Create one with New; it can be used as an http.Handler directly, or
+// started with Run.
 type Server struct {
-	http.Server
-	db      *gorm.DB
-	router  *mux.Router
-	closers []io.Closer
-	config  *Config
+	httpServer    *http.Server
+	listener      net.Listener
+	store         store.Store
+	logger        *log.Logger
+	clock         clock.Clock
+	router        *mux.Router
+	closers       []io.Closer
+	config        *Config
+	idempotency   *idempotency
+	authenticator *authenticator
+	sendReset     PasswordResetSender
+	// oidc is nil unless an OpenID Connect provider is configured.
+	oidc             *auth.OIDCProvider
+	rateLimitBackend ratelimit.Backend
+	rateLimiter      *rateLimiter
+	busyCalendars    *busyCalendarHandler
+}
+
+// Option customizes a Server created by New.
+type Option func(s *Server) error
+
+// WithStore makes the server use st instead of opening the store selected by the config. The
+// caller keeps ownership of st, and closes it after the server.
+func WithStore(st store.Store) Option {
+	return func(s *Server) error {
+		s.store = st
+		return nil
+	}
+}
+
+// WithLogger makes the server log to logger instead of the standard logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) error {
+		s.logger = logger
+		return nil
+	}
+}
+
+// WithClock makes the server tell the time with c instead of the system clock.
+func WithClock(c clock.Clock) Option {
+	return func(s *Server) error {
+		s.clock = c
+		return nil
+	}
+}
+
+// WithListener makes Run serve on l instead of listening on the configured host and port. The
+// server closes l when it shuts down.
+func WithListener(l net.Listener) Option {
+	return func(s *Server) error {
+		s.listener = l
+		return nil
+	}
+}
+
+// WithPasswordResetSender makes the server deliver password reset tokens with send. Without it,
+// resets are requested but never delivered.
+func WithPasswordResetSender(send PasswordResetSender) Option {
+	return func(s *Server) error {
+		s.sendReset = send
+		return nil
+	}
+}
+
+// WithRateLimitBackend makes the server keep rate limit buckets in backend instead of in memory,
+// e.g. to share them between replicas.
+func WithRateLimitBackend(backend ratelimit.Backend) Option {
+	return func(s *Server) error {
+		s.rateLimitBackend = backend
+		return nil
+	}
 }
 
 type Config struct {
-	Host    string
-	Port    int
-	DBHost  string
-	DBPort  int
-	DBUser  string
-	DBPass  string
-	DBName  string
+	Host   string
+	Port   int
+	DBHost string
+	DBPort int
+	DBUser string
+	DBPass string
+	DBName string
+	// Timeout is how long Run waits for requests to finish when shutting down. Defaults to 5
+	// seconds.
 	Timeout time.Duration
+
+	// Storage selects where data is kept: StoragePostgres (the default), StorageSQLite, or
+	// StorageMemory, which needs no database and loses everything when the server stops. The
+	// DB settings other than DBPath are only used for Postgres.
+	Storage string
+	// DBPath is the SQLite database file.
+	DBPath string
+	// Migrate applies pending schema migrations when the server starts. Otherwise the server
+	// refuses to start until they are applied with `appts migrate up`.
+	Migrate bool
+
+	// IdempotencyKeyTTL is how long responses to requests with an Idempotency-Key are kept for
+	// replay. Defaults to 24 hours.
+	IdempotencyKeyTTL time.Duration
+
+	// JWT selects which JWT bearer tokens are accepted. API keys are always accepted.
+	JWT auth.JWTConfig
+	// BootstrapAPIKey, if set, is stored as an API key when the server starts, so that a new
+	// deployment can be called before any keys are created.
+	BootstrapAPIKey string
+	// Accounts configures users' password logins.
+	Accounts AccountsConfig
+	// OIDC configures logging in with an OpenID Connect provider, such as a company's SSO.
+	OIDC auth.OIDCConfig
+	// RateLimit sets how many requests each client may make. The zero value doesn't limit them.
+	RateLimit RateLimitConfig
+	// BusyCalendars configures fetching trainers' busy calendars.
+	BusyCalendars BusyCalendarsConfig
 }
 
 func (s *Server) routes() {
 	s.router.HandleFunc("/healthz", s.healthz).Methods("GET")
+	s.router.HandleFunc("/openapi.json", s.openAPI).Methods("GET")
+	s.router.HandleFunc("/docs", s.docs).Methods("GET")
+	s.router.HandleFunc(docsPrefix+"{file}", s.docsAsset).Methods("GET")
+	s.router.Use(requestID)
+	s.router.Use(s.rateLimiter.guardCredentials)
+	s.router.Use(s.authenticator.middleware)
+	s.router.Use(s.rateLimiter.middleware)
+	s.router.Use(s.idempotency.middleware)
+
+	for _, v := range apiVersions {
+		versionRouter := s.router.PathPrefix("/" + v.name).Subrouter()
+		versionRouter.Use(v.middleware)
+		v.routes(s, versionRouter)
+	}
+
+	// Routes at the root predate versioning and are kept as deprecated aliases of v1.
+	legacyRouter := s.router.NewRoute().Subrouter()
+	legacyRouter.Use(legacyVersion.middleware)
+	legacyVersion.routes(s, legacyRouter)
+}
+
+// routesV1 registers the v1 API on the router.
+func (s *Server) routesV1(router *mux.Router) {
+	resources := s.resourceRoutes(router, dtoRepresentations)
+
+	accountHandler := newAccountHandler(s.store, s.logger, s.clock, s.config.Accounts, s.config.JWT, s.sendReset)
+	authRouter := router.PathPrefix("/auth").Subrouter()
+	authRouter.HandleFunc("/register", accountHandler.register).Methods("POST")
+	authRouter.HandleFunc("/login", accountHandler.login).Methods("POST")
+	authRouter.HandleFunc("/refresh", accountHandler.refresh).Methods("POST")
+	authRouter.HandleFunc("/logout", accountHandler.logout).Methods("POST")
+	authRouter.HandleFunc("/password-reset", accountHandler.requestPasswordReset).Methods("POST")
+	authRouter.HandleFunc("/password-reset/confirm", accountHandler.confirmPasswordReset).Methods("POST")
+
+	if s.oidc != nil {
+		secureCookies := strings.HasPrefix(s.config.OIDC.RedirectURL, "https://")
+		oidcHandler := newOIDCHandler(s.store, s.logger, s.clock, s.oidc, accountHandler, secureCookies)
+		authRouter.HandleFunc("/oidc/login", oidcHandler.login).Methods("GET")
+		authRouter.HandleFunc("/oidc/callback", oidcHandler.callback).Methods("GET")
+	}
+
+	for _, owner := range []*calendarOwner{trainerCalendar, userCalendar} {
+		calendarHandler := newCalendarHandler(s.store, s.logger, s.clock, owner)
+		ownerRoute := fmt.Sprintf("/%s/{%s}", owner.resource, owner.param)
+		router.HandleFunc(ownerRoute+calendarFeedSuffix, calendarHandler.feed).Methods("GET")
+		router.HandleFunc(ownerRoute+calendarTokenPath, calendarHandler.createToken).Methods("POST")
+		router.HandleFunc(ownerRoute+calendarTokenPath, calendarHandler.revokeTokens).Methods("DELETE")
+	}
+
+	freeBusyHandler := newFreeBusyHandler(s.store, s.logger, s.clock)
+	router.HandleFunc(fmt.Sprintf("/trainers/{%s}", trainerIDParam)+freeBusyPath, freeBusyHandler.get).Methods("GET")
+
+	busyRoute := fmt.Sprintf("/trainers/{%s}", trainerIDParam) + busyCalendarsPath
+	router.HandleFunc(busyRoute, s.busyCalendars.list).Methods("GET")
+	router.HandleFunc(busyRoute, s.busyCalendars.create).Methods("POST")
+	busyIDRoute := fmt.Sprintf("%s/{%s}", busyRoute, idParam)
+	router.HandleFunc(busyIDRoute, s.busyCalendars.delete).Methods("DELETE")
+	router.HandleFunc(busyIDRoute+"/refresh", s.busyCalendars.refresh).Methods("POST")
+
+	// The CalDAV routes take the WebDAV methods, so they aren't limited to methods here and are
+	// left out of the OpenAPI document.
+	caldavHandler := newCaldavHandler(s.store, s.logger, s.clock)
+	caldavRoute := fmt.Sprintf("%s/trainers/{%s}", caldavPath, trainerIDParam)
+	router.Handle(caldavRoute, caldavHandler)
+	router.Handle(caldavRoute+"/", caldavHandler)
+	router.Handle(fmt.Sprintf("%s/{%s}", caldavRoute, caldavObjectParam), caldavHandler)
+
+	auditHandler := newAuditHandler(s.store, s.logger)
+	auditRouter := router.PathPrefix("/audit").Subrouter()
+	auditRouter.Use(requireRole(auth.RoleAdmin))
+	auditRouter.HandleFunc("", auditHandler.list).Methods("GET")
+
+	adminHandler := newAdminHandler(s.store, s.logger, s.clock, resources)
+	adminRouter := router.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(requireRole(auth.RoleAdmin))
+	adminRouter.HandleFunc("/purge", adminHandler.purge).Methods("POST")
+	adminRouter.HandleFunc("/api-keys", adminHandler.createAPIKey).Methods("POST")
+	adminRouter.HandleFunc("/api-keys", adminHandler.listAPIKeys).Methods("GET")
+	adminRouter.HandleFunc(fmt.Sprintf("/api-keys/{%s}", idParam), adminHandler.revokeAPIKey).Methods("DELETE")
+}
+
+// routesLegacy registers the unversioned API, which encodes the models directly.
+func (s *Server) routesLegacy(router *mux.Router) {
+	s.resourceRoutes(router, modelRepresentations)
+}
 
-	apptHandler := newApptHandler(s.db)
-	apptsRouter := s.router.PathPrefix("/appointments").Subrouter()
+// resourceRoutes registers the appointment, trainer and user routes using the given encodings,
+// and returns their handlers by resource name.
+func (s *Server) resourceRoutes(router *mux.Router, reps representations) map[string]*modelHandler {
+	apptHandler := newApptHandler(s.store, s.logger, s.clock, reps.appt)
+	apptsRouter := router.PathPrefix("/appointments").Subrouter()
 
 	apptsRouter.HandleFunc("", apptHandler.create).Methods("POST")
 	apptsRouter.HandleFunc("", apptHandler.list).Methods("GET")
@@ -62,18 +261,24 @@ func (s *Server) routes() {
 	apptIDRoute := fmt.Sprintf("/{%s}", idParam)
 	apptsRouter.HandleFunc(apptIDRoute, apptHandler.get).Methods("GET")
 	apptsRouter.HandleFunc(apptIDRoute, apptHandler.update).Methods("PUT")
+	apptsRouter.HandleFunc(apptIDRoute, apptHandler.patch).Methods("PATCH")
 	apptsRouter.HandleFunc(apptIDRoute, apptHandler.delete).Methods("DELETE")
+	apptsRouter.HandleFunc(apptIDRoute+"/restore", apptHandler.restore).Methods("POST")
+	apptsRouter.HandleFunc(apptIDRoute+"/attendance", apptHandler.markAttendance).Methods("POST")
+	apptsRouter.HandleFunc(apptIDRoute+"/history", apptHandler.history).Methods("GET")
 
-	trainerHandler := newTrainerHandler(s.db)
-	trainersRouter := s.router.PathPrefix("/trainers").Subrouter()
+	trainerHandler := newTrainerHandler(s.store, s.logger, s.clock, reps.trainer)
+	trainersRouter := router.PathPrefix("/trainers").Subrouter()
 
 	trainersRouter.HandleFunc("", trainerHandler.create).Methods("POST")
-	trainersRouter.HandleFunc("", trainerHandler.get).Methods("GET")
+	trainersRouter.HandleFunc("", trainerHandler.list).Methods("GET")
 
 	trainerIDRoute := fmt.Sprintf("/{%s}", idParam)
-	trainersRouter.HandleFunc(trainerIDRoute, trainerHandler.list).Methods("GET")
+	trainersRouter.HandleFunc(trainerIDRoute, trainerHandler.get).Methods("GET")
 	trainersRouter.HandleFunc(trainerIDRoute, trainerHandler.update).Methods("PUT")
+	trainersRouter.HandleFunc(trainerIDRoute, trainerHandler.patch).Methods("PATCH")
 	trainersRouter.HandleFunc(trainerIDRoute, trainerHandler.delete).Methods("DELETE")
+	trainersRouter.HandleFunc(trainerIDRoute+"/restore", trainerHandler.restore).Methods("POST")
 
 	trainerApptsRoute := fmt.Sprintf("/{%s}/appointments", trainerIDParam)
 	trainersRouter.HandleFunc(trainerApptsRoute, apptHandler.list).Methods("GET")
@@ -84,8 +289,8 @@ func (s *Server) routes() {
 			endsAtParam, fmt.Sprintf("{%s}", endsAtParam),
 		)
 
-	userHandler := newUserHandler(s.db)
-	usersRouter := s.router.PathPrefix("/users").Subrouter()
+	userHandler := newUserHandler(s.store, s.logger, s.clock, reps.user)
+	usersRouter := router.PathPrefix("/users").Subrouter()
 
 	usersRouter.HandleFunc("", userHandler.create).Methods("POST")
 	usersRouter.HandleFunc("", userHandler.list).Methods("GET")
@@ -93,110 +298,188 @@ func (s *Server) routes() {
 	userIDRoute := fmt.Sprintf("/{%s}", idParam)
 	usersRouter.HandleFunc(userIDRoute, userHandler.get).Methods("GET")
 	usersRouter.HandleFunc(userIDRoute, userHandler.update).Methods("PUT")
+	usersRouter.HandleFunc(userIDRoute, userHandler.patch).Methods("PATCH")
 	usersRouter.HandleFunc(userIDRoute, userHandler.delete).Methods("DELETE")
+	usersRouter.HandleFunc(userIDRoute+"/restore", userHandler.restore).Methods("POST")
+
+	userApptsRoute := fmt.Sprintf("/{%s}/appointments", userIDParam)
+	usersRouter.HandleFunc(userApptsRoute, apptHandler.list).Methods("GET")
+
+	resources := map[string]*modelHandler{
+		"appointments": apptHandler.modelHandler,
+		"trainers":     trainerHandler.modelHandler,
+		"users":        userHandler.modelHandler,
+	}
+
+	batchHandler := newBatchHandler(s.store, s.logger, resources)
+	router.HandleFunc("/batch", batchHandler.handle).Methods("POST")
 
-	usersRouter.HandleFunc(userIDRoute+"/appointments", apptHandler.list).Methods("GET")
+	return resources
 }
 
-func New(config *Config) *Server {
-	// Connect to the postgres instance
-	dsn := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s sslmode=disable",
-		config.DBHost, strconv.Itoa(config.DBPort), config.DBUser, config.DBPass,
-	)
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	if err != nil {
-		log.Fatal(err)
+// OpenStore returns the store selected by config. For a database, it fails if the schema has
+// pending migrations, unless config.Migrate is set to apply them.
+func OpenStore(config *Config) (store.Store, error) {
+	return openStore(config, log.Default(), clock.Real)
+}
+
+func openStore(config *Config, logger *log.Logger, c clock.Clock) (store.Store, error) {
+	switch config.Storage {
+	case "", StoragePostgres, StorageSQLite:
+		db, err := OpenDB(config)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkSchema(config, db, logger); err != nil {
+			return nil, err
+		}
+
+		return store.NewGorm(db, c)
+	case StorageMemory:
+		return store.NewMemory(c), nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q", config.Storage)
 	}
+}
 
-	// Create the database if it doesn't exist
-	db = db.Exec(fmt.Sprintf(`
-		SELECT 'CREATE DATABASE %s'
-		WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = '%s');
-	`, config.DBName, config.DBName))
-	if db.Error != nil {
-		log.Fatal(db.Error)
+// New creates a server for config. Unless a store is given with WithStore, it opens the one
+// selected by config, which Close or Run closes.
+func New(config *Config, opts ...Option) (*Server, error) {
+	if config == nil {
+		config = &Config{}
 	}
 
-	dbConn, err := db.DB()
-	if err != nil {
-		log.Fatal(err)
+	r := mux.NewRouter()
+	s := &Server{
+		router: r,
+		config: config,
+		logger: log.Default(),
+		clock:  clock.Real,
 	}
-	dbConn.Close()
 
-	// Connect to the database
-	dsn = fmt.Sprintf(
-		"host=%s port=%s user=%s dbname=%s password=%s sslmode=disable TimeZone=UTC",
-		config.DBHost, strconv.Itoa(config.DBPort), config.DBUser, config.DBName, config.DBPass,
-	)
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	if err != nil {
-		panic(err)
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
 	}
 
-	// Migrate the schema
-	err = db.AutoMigrate(&models.User{}, &models.Trainer{}, &models.Appt{})
-	if err != nil {
-		panic(err)
+	if s.store == nil {
+		st, err := openStore(config, s.logger, s.clock)
+		if err != nil {
+			return nil, err
+		}
+
+		s.store = st
+		s.closers = append(s.closers, st)
 	}
 
-	// Get the database connection for closing
-	dbConn, err = db.DB()
-	if err != nil {
-		panic(err)
+	s.httpServer = &http.Server{
+		Addr:         fmt.Sprintf("%s:%d", config.Host, config.Port),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+		Handler:      r,
+		ErrorLog:     s.logger,
+	}
+	if config.BootstrapAPIKey != "" {
+		if err := s.bootstrapAPIKey(config.BootstrapAPIKey); err != nil {
+			_ = s.Close()
+			return nil, err
+		}
 	}
 
-	// Create the server
-	r := mux.NewRouter()
-	s := &Server{
-		Server: http.Server{
-			Addr:         fmt.Sprintf("%s:%d", config.Host, config.Port),
-			WriteTimeout: 15 * time.Second,
-			ReadTimeout:  15 * time.Second,
-			IdleTimeout:  60 * time.Second,
-			Handler:      r,
-		},
-		db:      db,
-		closers: []io.Closer{dbConn},
-		router:  r,
+	if config.OIDC.Enabled() {
+		s.oidc = auth.NewOIDCProvider(config.OIDC, &http.Client{Timeout: oidcTimeout}, s.clock)
+	}
+
+	s.authenticator = newAuthenticator(s.store, s.logger, s.clock, config.JWT)
+	if s.rateLimitBackend == nil {
+		s.rateLimitBackend = ratelimit.NewMemory(s.clock)
 	}
+	s.rateLimiter = newRateLimiter(s.rateLimitBackend, s.logger, config.RateLimit)
+	s.idempotency = newIdempotency(s.store, s.logger, s.clock, config.IdempotencyKeyTTL)
+	s.busyCalendars = newBusyCalendarHandler(s.store, s.logger, s.clock, config.BusyCalendars)
 	s.routes()
 
-	return s
+	return s, nil
 }
 
-func (s *Server) Run() {
-	defer close(s.closers...)
+// ServeHTTP handles a request with the server's routes, so that the server can be tested
+// without listening on a port.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
 
-	// Run our server in a goroutine so that it doesn't block.
-	go func() {
-		log.Printf("Starting server on %s\n", s.Addr)
-		if err := s.ListenAndServe(); err != nil {
-			log.Println(err)
+// Run serves requests until ctx is done, then waits up to the config's Timeout for requests in
+// progress to finish, and closes the server.
+func (s *Server) Run(ctx context.Context) error {
+	defer s.Close()
+
+	listener := s.listener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", s.httpServer.Addr)
+		if err != nil {
+			return err
 		}
+	}
+
+	// Background jobs run until the server shuts down.
+	jobsCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go s.idempotency.cleanup(jobsCtx, idempotencyCleanupPeriod)
+	go s.busyCalendars.refreshAll(jobsCtx, s.busyCalendars.config.Refresh)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		s.logger.Printf("Starting server on %s", listener.Addr())
+		serveErr <- s.httpServer.Serve(listener)
 	}()
 
-	c := make(chan os.Signal, 1)
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C).
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
 
-	// Block until we receive our signal.
-	<-c
+	timeout := s.config.Timeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
 
 	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	// Doesn't block if no connections, but will otherwise wait until the timeout deadline.
-	err := s.Shutdown(ctx)
+	if err := s.httpServer.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	s.logger.Println("shutting down")
+	return nil
+}
+
+// Close closes the store if the server opened it. It doesn't stop Run; cancel its context
+// instead.
+func (s *Server) Close() error {
+	return closeAll(s.logger, s.closers...)
+}
+
+// bootstrapAPIKey stores key unless it already is.
+func (s *Server) bootstrapAPIKey(key string) error {
+	if _, err := s.store.APIKeys().GetByHash(auth.HashToken(key)); !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+
+	stored, err := storeAPIKey(s.store, "bootstrap", auth.RoleAdmin, key)
 	if err != nil {
-		log.Println(err)
-		os.Exit(1)
+		return fmt.Errorf("storing bootstrap API key: %w", err)
 	}
 
-	log.Println("shutting down")
-	os.Exit(0)
+	s.logger.Printf("Stored bootstrap API key %d", stored.ID)
+	return nil
 }
 
 func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
@@ -204,17 +487,28 @@ func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("OK"))
 }
 
-func close(closers ...io.Closer) {
+// closeAll closes each closer, logging errors, and returns the first one.
+func closeAll(logger *log.Logger, closers ...io.Closer) error {
+	errs := make([]error, len(closers))
 	var wg sync.WaitGroup
 	wg.Add(len(closers))
-	for _, c := range closers {
-		go func(c io.Closer) {
+	for i, c := range closers {
+		go func(i int, c io.Closer) {
 			defer wg.Done()
 			if err := c.Close(); err != nil {
-				log.Println(err)
+				logger.Println(err)
+				errs[i] = err
 			}
-		}(c)
+		}(i, c)
 	}
 
 	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
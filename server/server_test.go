@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/store"
+)
+
+func TestNewUnknownStorage(t *testing.T) {
+	if _, err := New(&Config{Storage: "cassandra"}); err == nil {
+		t.Errorf("Expected an error for an unknown storage")
+	}
+}
+
+func TestRun(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	s, err := New(&Config{}, WithStore(store.NewMemory(clock.Real)), WithListener(listener), WithLogger(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Errorf("Expected %d OK, got %d %s", http.StatusOK, resp.StatusCode, body)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if !strings.Contains(logs.String(), "Starting server on "+listener.Addr().String()) {
+		t.Errorf("Expected the injected logger to be used, got %q", logs.String())
+	}
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator"
+
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+// Formats for importing and exporting
+const (
+	FormatJSON  = "json"
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// TransferOptions say what to import or export and how it is laid out.
+type TransferOptions struct {
+	// Resource is "users", "trainers" or "appointments".
+	Resource string
+	// Format is FormatJSON (an array of objects), FormatJSONL (an object per line) or FormatCSV
+	// (a header row naming the fields).
+	Format string
+	// Fields renames fields as they pass through, from the name they are read by to the name
+	// they are written as. Fields are named as in the v1 API, so importing a file with a
+	// started_at field maps started_at to start_time, and exporting it back maps start_time to
+	// started_at.
+	Fields map[string]string
+}
+
+// RowError is the reason a row wasn't imported. Row is the line for JSONL and CSV, and the
+// position in the array for JSON, counting from 1.
+type RowError struct {
+	Row int
+	Err error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// ImportResult counts the rows imported and has an error for each row that wasn't.
+type ImportResult struct {
+	Imported int
+	Errors   []*RowError
+}
+
+// transferResource is a resource that can be imported and exported through its v1 encoding.
+type transferResource struct {
+	model    reflect.Type
+	request  reflect.Type
+	response func(model interface{}) interface{}
+	rep      representation
+	models   func(store.Store) store.ModelStore
+}
+
+var transferResources = map[string]transferResource{
+	"appointments": {
+		model:    reflect.TypeOf(models.Appt{}),
+		request:  reflect.TypeOf(apptRequest{}),
+		response: func(model interface{}) interface{} { return newApptResponse(model.(*models.Appt)) },
+		rep:      dtoRepresentations.appt,
+		models:   func(s store.Store) store.ModelStore { return s.Appts() },
+	},
+	"trainers": {
+		model:    reflect.TypeOf(models.Trainer{}),
+		request:  reflect.TypeOf(trainerRequest{}),
+		response: func(model interface{}) interface{} { return newTrainerResponse(model.(*models.Trainer)) },
+		rep:      dtoRepresentations.trainer,
+		models:   func(s store.Store) store.ModelStore { return s.Trainers() },
+	},
+	"users": {
+		model:    reflect.TypeOf(models.User{}),
+		request:  reflect.TypeOf(userRequest{}),
+		response: func(model interface{}) interface{} { return newUserResponse(model.(*models.User)) },
+		rep:      dtoRepresentations.user,
+		models:   func(s store.Store) store.ModelStore { return s.Users() },
+	},
+}
+
+func transferResourceFor(opts TransferOptions) (transferResource, error) {
+	res, ok := transferResources[opts.Resource]
+	if !ok {
+		return transferResource{}, fmt.Errorf("unknown resource %q", opts.Resource)
+	}
+
+	switch opts.Format {
+	case FormatJSON, FormatJSONL, FormatCSV:
+		return res, nil
+	default:
+		return transferResource{}, fmt.Errorf("unknown format %q", opts.Format)
+	}
+}
+
+// Import creates a model for each row read from r. Rows get the same checks as requests to the
+// API, including validAppt, availability and the existence of the user and trainer for
+// appointments, and a row that fails them is reported in the result without stopping the rest.
+// IDs in the rows are kept. An error is returned only if r can't be read at all.
+func Import(s store.Store, r io.Reader, opts TransferOptions) (*ImportResult, error) {
+	res, err := transferResourceFor(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{}
+	validate := validator.New()
+	err = readRows(r, opts.Format, func(row int, fields map[string]interface{}, err error) {
+		if err == nil {
+			err = importRow(s, validate, res, rename(fields, opts.Fields))
+		}
+
+		if err != nil {
+			result.Errors = append(result.Errors, &RowError{Row: row, Err: err})
+			return
+		}
+
+		result.Imported++
+	})
+
+	return result, err
+}
+
+func importRow(s store.Store, validate *validator.Validate, res transferResource, fields map[string]interface{}) error {
+	fields, err := coerce(fields, res.request)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	model := reflect.New(res.model).Interface()
+	if err := res.rep.decode(bytes.NewReader(body), model); err != nil {
+		return err
+	}
+
+	appt, isAppt := model.(*models.Appt)
+	if isAppt {
+		if err := validAppt(validate, *appt); err != nil {
+			return err
+		}
+	}
+
+	return s.Transaction(func(tx store.Store) error {
+		if isAppt {
+			if err := apptParties(tx, *appt); err != nil {
+				return err
+			}
+
+			isAvailable, err := availableAppt(tx, *appt)
+			if err != nil {
+				return err
+			}
+
+			if !isAvailable {
+				return errors.New("appt is not available")
+			}
+		}
+
+		// Imports are run by operators, who vouch for users' emails like staff.
+		if user, ok := model.(*models.User); ok {
+			user.EmailVerified = true
+		}
+
+		setModelVersion(model, 1)
+		return res.models(tx).Create(model)
+	})
+}
+
+// readRows calls fn with the fields of each row in r. A row that can't be parsed is passed with
+// an error, unless the format makes it impossible to find the rows after it.
+func readRows(r io.Reader, format string, fn func(row int, fields map[string]interface{}, err error)) error {
+	switch format {
+	case FormatJSON:
+		dec := json.NewDecoder(r)
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("expected a JSON array: %w", err)
+		}
+
+		for row := 1; dec.More(); row++ {
+			var fields map[string]interface{}
+			if err := dec.Decode(&fields); err != nil {
+				return fmt.Errorf("row %d: %w", row, err)
+			}
+
+			fn(row, fields, nil)
+		}
+
+		return nil
+	case FormatJSONL:
+		lines := bufio.NewScanner(r)
+		for row := 1; lines.Scan(); row++ {
+			line := strings.TrimSpace(lines.Text())
+			if line == "" {
+				continue
+			}
+
+			var fields map[string]interface{}
+			err := json.Unmarshal([]byte(line), &fields)
+			fn(row, fields, err)
+		}
+
+		return lines.Err()
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		header, err := reader.Read()
+		if err != nil {
+			return fmt.Errorf("expected a header row: %w", err)
+		}
+
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+
+			line, _ := reader.FieldPos(0)
+			if err != nil {
+				var parseErr *csv.ParseError
+				if !errors.As(err, &parseErr) {
+					return err
+				}
+
+				fn(parseErr.Line, nil, parseErr.Err)
+				continue
+			}
+
+			fields := make(map[string]interface{}, len(header))
+			for i, name := range header {
+				fields[name] = record[i]
+			}
+
+			fn(line, fields, nil)
+		}
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// rename returns fields with the keys in names renamed.
+func rename(fields map[string]interface{}, names map[string]string) map[string]interface{} {
+	renamed := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		if to, ok := names[name]; ok {
+			name = to
+		}
+		renamed[name] = value
+	}
+
+	return renamed
+}
+
+// coerce converts the strings CSV gives for numeric fields of the request type to numbers. Empty
+// values are dropped, so that an empty id column leaves the ID to be allocated.
+func coerce(fields map[string]interface{}, request reflect.Type) (map[string]interface{}, error) {
+	kinds := map[string]reflect.Kind{}
+	for i := 0; i < request.NumField(); i++ {
+		field := request.Field(i)
+		kinds[strings.Split(field.Tag.Get("json"), ",")[0]] = field.Type.Kind()
+	}
+
+	coerced := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		s, ok := value.(string)
+		if !ok {
+			coerced[name] = value
+			continue
+		}
+
+		if s == "" {
+			continue
+		}
+
+		switch kinds[name] {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			coerced[name] = n
+		default:
+			coerced[name] = s
+		}
+	}
+
+	return coerced, nil
+}
+
+// Export writes every model of the resource to w, ordered by ID, and returns how many it wrote.
+// Rows have the fields of the v1 API's responses.
+func Export(s store.Store, w io.Writer, opts TransferOptions) (int, error) {
+	res, err := transferResourceFor(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	models := reflect.New(reflect.SliceOf(res.model))
+	if err := res.models(s).List(nil, models.Interface()); err != nil {
+		return 0, err
+	}
+
+	rows := make([]map[string]interface{}, models.Elem().Len())
+	for i := range rows {
+		body, err := json.Marshal(res.response(models.Elem().Index(i).Addr().Interface()))
+		if err != nil {
+			return 0, err
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return 0, err
+		}
+
+		rows[i] = rename(fields, opts.Fields)
+	}
+
+	switch opts.Format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		err = enc.Encode(rows)
+	case FormatJSONL:
+		enc := json.NewEncoder(w)
+		for _, row := range rows {
+			if err = enc.Encode(row); err != nil {
+				break
+			}
+		}
+	case FormatCSV:
+		err = writeCSV(w, columns(res, opts.Fields), rows)
+	}
+
+	return len(rows), err
+}
+
+// columns returns the names of the CSV columns for the resource, in the order of its response
+// fields. Nested resources aren't exported.
+func columns(res transferResource, names map[string]string) []string {
+	responseType := reflect.TypeOf(res.response(reflect.New(res.model).Interface())).Elem()
+
+	var columns []string
+	for i := 0; i < responseType.NumField(); i++ {
+		field := responseType.Field(i)
+		if field.Type.Kind() == reflect.Ptr {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if to, ok := names[name]; ok {
+			name = to
+		}
+		columns = append(columns, name)
+	}
+
+	return columns
+}
+
+func writeCSV(w io.Writer, columns []string, rows []map[string]interface{}) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(columns); err != nil {
+		return err
+	}
+
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, column := range columns {
+			switch value := row[column].(type) {
+			case nil:
+				record[i] = ""
+			case float64:
+				record[i] = strconv.FormatFloat(value, 'f', -1, 64)
+			default:
+				record[i] = fmt.Sprint(value)
+			}
+		}
+
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// TransferFormat returns the format for a file name's extension, or "" if it has none.
+func TransferFormat(name string) string {
+	for _, format := range []string{FormatJSON, FormatJSONL, FormatCSV} {
+		if strings.HasSuffix(strings.ToLower(name), "."+format) {
+			return format
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/models"
+	"github.com/marcuscarr/appts/store"
+)
+
+var seedAliases = map[string]string{"started_at": "start_time", "ended_at": "end_time"}
+
+// importSeed imports the data set in data/ into s. It has one invalid appointment, in row 9.
+func importSeed(t *testing.T, s store.Store) {
+	t.Helper()
+
+	invalid := map[string][]int{"appointments": {9}}
+
+	for _, resource := range []string{"users", "trainers", "appointments"} {
+		f, err := os.Open(filepath.Join("..", "data", resource+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		result, err := Import(s, f, TransferOptions{Resource: resource, Format: FormatJSON, Fields: seedAliases})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rows []int
+		for _, rowErr := range result.Errors {
+			rows = append(rows, rowErr.Row)
+		}
+
+		if !reflect.DeepEqual(rows, invalid[resource]) {
+			t.Errorf("Expected errors importing %s for rows %v, got %v", resource, invalid[resource], result.Errors)
+		}
+	}
+}
+
+func TestImportSeed(t *testing.T) {
+	s := store.NewMemory(clock.Real)
+	importSeed(t, s)
+
+	var appt models.Appt
+	if err := s.Appts().Get(4, &appt); err != nil {
+		t.Fatal(err)
+	}
+
+	if appt.TrainerID != 1 || appt.StartTime.Format("2006-01-02T15:04:05Z07:00") != "2019-01-25T10:30:00-08:00" {
+		t.Errorf("Expected appointment 4 from the data set, got %v", appt)
+	}
+}
+
+func TestImportRowErrors(t *testing.T) {
+	s := store.NewMemory(clock.Real)
+	importSeed(t, s)
+
+	csv := strings.Join([]string{
+		"id,started_at,ended_at,user_id,trainer_id",
+		"100,2019-01-28T09:00:00-08:00,2019-01-28T09:30:00-08:00,1,2",
+		"101,2019-01-28T05:00:00-08:00,2019-01-28T05:30:00-08:00,1,2",
+		"102,2019-01-28T09:00:00-08:00,2019-01-28T09:30:00-08:00,2,2",
+		"one,2019-01-28T10:00:00-08:00,2019-01-28T10:30:00-08:00,1,2",
+		"104,2019-01-28T10:00:00-08:00",
+		",2019-01-28T11:00:00-08:00,2019-01-28T11:30:00-08:00,1,2",
+	}, "\n")
+
+	opts := TransferOptions{Resource: "appointments", Format: FormatCSV, Fields: seedAliases}
+	result, err := Import(s, strings.NewReader(csv), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Imported != 2 {
+		t.Errorf("Expected %d imported, got %d", 2, result.Imported)
+	}
+
+	expected := []int{3, 4, 5, 6}
+	if len(result.Errors) != len(expected) {
+		t.Fatalf("Expected errors for rows %v, got %v", expected, result.Errors)
+	}
+
+	for i, row := range expected {
+		if result.Errors[i].Row != row {
+			t.Errorf("Expected %v, got %v", row, result.Errors[i].Row)
+		}
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	s := store.NewMemory(clock.Real)
+	importSeed(t, s)
+
+	exportAliases := map[string]string{"start_time": "started_at", "end_time": "ended_at"}
+	for _, format := range []string{FormatJSON, FormatJSONL, FormatCSV} {
+		copied := store.NewMemory(clock.Real)
+		for _, resource := range []string{"users", "trainers", "appointments"} {
+			var buf bytes.Buffer
+			n, err := Export(s, &buf, TransferOptions{Resource: resource, Format: format, Fields: exportAliases})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resource == "appointments" && !strings.Contains(buf.String(), "started_at") {
+				t.Errorf("%s: Expected exported fields to be renamed", format)
+			}
+
+			result, err := Import(copied, &buf, TransferOptions{Resource: resource, Format: format, Fields: seedAliases})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Imported != n || len(result.Errors) > 0 {
+				t.Errorf("%s: Expected %d %s imported, got %d and %v", format, n, resource, result.Imported, result.Errors)
+			}
+		}
+
+		var original, roundTripped []models.Appt
+		_ = s.Appts().List(nil, &original)
+		_ = copied.Appts().List(nil, &roundTripped)
+		for i := range original {
+			if i >= len(roundTripped) ||
+				original[i].ID != roundTripped[i].ID ||
+				!original[i].StartTime.Equal(roundTripped[i].StartTime) {
+				t.Errorf("%s: Expected %v, got %v", format, original[i], roundTripped)
+				break
+			}
+		}
+	}
+}
+
+func TestTransferFormat(t *testing.T) {
+	testCases := []struct {
+		name string
+		e    string
+	}{
+		{"appointments.json", FormatJSON},
+		{"appointments.JSONL", FormatJSONL},
+		{"appointments.csv", FormatCSV},
+		{"appointments", ""},
+	}
+
+	for _, tc := range testCases {
+		if format := TransferFormat(tc.name); format != tc.e {
+			t.Errorf("Expected %v, got %v", tc.e, format)
+		}
+	}
+}
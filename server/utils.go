@@ -6,13 +6,18 @@ import (
 	"time"
 
 	"github.com/go-playground/validator"
+	"github.com/marcuscarr/appts/ical"
 	"github.com/marcuscarr/appts/models"
 )
 
-func buildAvailable(start, end time.Time, appts []models.Appt) []time.Time {
+// buildAvailable returns the start times of the slots between start and end that are within
+// business hours, not taken by appts, not overlapping busy periods and not already started at
+// now. Busy periods are ordered by start, as ical.Busy returns them.
+func buildAvailable(now, start, end time.Time, appts []models.Appt, busy []ical.Period) []time.Time {
 	unavailable := make(map[time.Time]struct{})
 	for _, appt := range appts {
-		unavailable[appt.StartTime] = struct{}{}
+		// Databases return times in UTC, so convert them to match the candidate times below.
+		unavailable[appt.StartTime.In(location)] = struct{}{}
 	}
 
 	var available []time.Time
@@ -21,7 +26,10 @@ func buildAvailable(start, end time.Time, appts []models.Appt) []time.Time {
 		start.Hour(), start.Minute(), start.Second(), 0, location,
 	)
 	for nextAppt.Before(end) {
-		if !isUnavailable(nextAppt, unavailable) && hourMinuteBetween(startOfDay, endOfDay, nextAppt) {
+		if !isUnavailable(nextAppt, unavailable) &&
+			!isBusy(nextAppt, nextAppt.Add(apptDuration), busy) &&
+			hourMinuteBetween(startOfDay, endOfDay, nextAppt) &&
+			!nextAppt.Before(now) {
 			available = append(available, nextAppt)
 		}
 		nextAppt = nextAppt.Add(apptDuration)
@@ -30,11 +38,49 @@ func buildAvailable(start, end time.Time, appts []models.Appt) []time.Time {
 	return available
 }
 
+// businessHours returns the parts of business hours between start and end, a period a day.
+func businessHours(start, end time.Time) []ical.Period {
+	var hours []ical.Period
+	start, end = start.In(location), end.In(location)
+	for day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, location); day.Before(end); day = day.AddDate(0, 0, 1) {
+		open := time.Date(day.Year(), day.Month(), day.Day(), startOfDay.Hour(), startOfDay.Minute(), 0, 0, location)
+		closed := time.Date(day.Year(), day.Month(), day.Day(), endOfDay.Hour(), endOfDay.Minute(), 0, 0, location)
+		if open.Before(start) {
+			open = start
+		}
+		if closed.After(end) {
+			closed = end
+		}
+
+		if open.Before(closed) {
+			hours = append(hours, ical.Period{Start: open, End: closed})
+		}
+	}
+
+	return hours
+}
+
 func isUnavailable(t time.Time, unavailable map[time.Time]struct{}) bool {
 	_, ok := unavailable[t]
 	return ok
 }
 
+// isBusy reports whether [start, end) overlaps any of the busy periods.
+func isBusy(start, end time.Time, busy []ical.Period) bool {
+	for _, p := range busy {
+		if !p.Start.Before(end) {
+			// The rest start later still.
+			return false
+		}
+
+		if p.End.After(start) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func hourMinuteBetween(start, end, check time.Time) bool {
 	if start.Hour() < check.Hour() && end.Hour() > check.Hour() {
 		return true
@@ -56,9 +102,11 @@ func validAppt(validator *validator.Validate, appt models.Appt) error {
 		return err
 	}
 
+	// Business hours are in the studio's time zone, whatever the times' offsets.
+	start, end := appt.StartTime.In(location), appt.EndTime.In(location)
 	startTime := time.Date(
 		startOfDay.Year(), startOfDay.Month(), startOfDay.Day(),
-		appt.StartTime.Hour(), appt.StartTime.Minute(), 0, 0, location,
+		start.Hour(), start.Minute(), 0, 0, location,
 	)
 	if startTime.Before(startOfDay) || startTime == endOfDay || startTime.After(endOfDay) {
 		return errors.New("start time is outside of business hours")
@@ -66,7 +114,7 @@ func validAppt(validator *validator.Validate, appt models.Appt) error {
 
 	endTime := time.Date(
 		endOfDay.Year(), endOfDay.Month(), endOfDay.Day(),
-		appt.EndTime.Hour(), appt.EndTime.Minute(), 0, 0, location,
+		end.Hour(), end.Minute(), 0, 0, location,
 	)
 	if endTime.Before(startOfDay) || endTime.After(endOfDay) {
 		return errors.New("end time is outside of business hours")
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/go-playground/validator"
+	"github.com/marcuscarr/appts/ical"
 	"github.com/marcuscarr/appts/models"
 )
 
@@ -37,9 +38,11 @@ func TestBuildAvailable(t *testing.T) {
 	}
 
 	available := buildAvailable(
+		time.Time{},
 		time.Date(2020, 1, 1, 9, 0, 0, 0, location),
 		time.Date(2020, 1, 1, 13, 0, 0, 0, location),
 		appts,
+		nil,
 	)
 
 	if len(available) != len(expected) {
@@ -80,6 +83,46 @@ func TestIsUnavailable(t *testing.T) {
 	}
 }
 
+func TestIsBusy(t *testing.T) {
+	busy := []ical.Period{
+		{Start: time.Date(2020, 1, 1, 9, 15, 0, 0, location), End: time.Date(2020, 1, 1, 9, 45, 0, 0, location)},
+		{Start: time.Date(2020, 1, 1, 11, 0, 0, 0, location), End: time.Date(2020, 1, 1, 13, 0, 0, 0, location)},
+	}
+
+	testCases := []struct {
+		start time.Time
+		e     bool
+	}{
+		{time.Date(2020, 1, 1, 8, 30, 0, 0, location), false},
+		{time.Date(2020, 1, 1, 9, 0, 0, 0, location), true},
+		{time.Date(2020, 1, 1, 9, 30, 0, 0, location), true},
+		{time.Date(2020, 1, 1, 10, 0, 0, 0, location), false},
+		{time.Date(2020, 1, 1, 10, 30, 0, 0, location), false},
+		{time.Date(2020, 1, 1, 12, 0, 0, 0, location), true},
+		{time.Date(2020, 1, 1, 13, 0, 0, 0, location), false},
+	}
+
+	for _, tc := range testCases {
+		if got := isBusy(tc.start, tc.start.Add(apptDuration), busy); got != tc.e {
+			t.Errorf("%v: Expected %v, got %v", tc.start, tc.e, got)
+		}
+	}
+}
+
+func TestBusinessHours(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, location)
+	end := time.Date(2020, 1, 3, 9, 0, 0, 0, location)
+
+	var got []string
+	for _, p := range businessHours(start, end) {
+		got = append(got, p.Start.Format("02 15:04")+"-"+p.End.Format("15:04"))
+	}
+
+	if e := []string{"01 12:00-17:00", "02 08:00-17:00", "03 08:00-09:00"}; !equalStrings(got, e) {
+		t.Errorf("Expected %v, got %v", e, got)
+	}
+}
+
 func TestHourMinuteBetween(t *testing.T) {
 	testCases := []struct {
 		start, end, check time.Time
@@ -184,6 +227,16 @@ func TestValidAppt(t *testing.T) {
 			},
 			errors.New("appt time must be on the hour a multiple of 30 minutes past the hour"),
 		},
+		{
+			// 9:00 in the studio's time zone, as stored by SQLite.
+			models.Appt{
+				UserID:    1,
+				TrainerID: 1,
+				StartTime: time.Date(2020, 1, 1, 17, 0, 0, 0, time.UTC),
+				EndTime:   time.Date(2020, 1, 1, 17, 30, 0, 0, time.UTC),
+			},
+			nil,
+		},
 	}
 
 	validator := validator.New()
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Headers
+	deprecationHeader = "Deprecation"
+	sunsetHeader      = "Sunset"
+	linkHeader        = "Link"
+)
+
+// apiVersion is a version of the API mounted under /{name}. Versions are served side by side;
+// a new version registers its own routes, reusing or replacing the previous version's handlers.
+type apiVersion struct {
+	name string
+	// successor is the name of the version clients should move to, if any.
+	successor string
+	// deprecated is when the version was deprecated, or zero if it isn't.
+	deprecated time.Time
+	// sunset is when the version will stop being served, or zero if that isn't scheduled.
+	sunset time.Time
+	routes func(s *Server, router *mux.Router)
+}
+
+// apiVersions are the versions served, oldest first. To add v2, append
+// {name: "v2", routes: (*Server).routesV2} and set successor and deprecated on v1.
+var apiVersions = []apiVersion{
+	{name: "v1", routes: (*Server).routesV1},
+}
+
+// legacyVersion serves the API at the root, where routes lived before versioning, encoding the
+// models as they were then.
+var legacyVersion = apiVersion{
+	successor:  "v1",
+	deprecated: time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+	// Clients get six months to move to /v1.
+	sunset: time.Date(2027, 4, 19, 0, 0, 0, 0, time.UTC),
+	routes: (*Server).routesLegacy,
+}
+
+// middleware adds the Deprecation, Sunset and successor Link headers to deprecated versions.
+func (v apiVersion) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !v.deprecated.IsZero() {
+			w.Header().Set(deprecationHeader, fmt.Sprintf("@%d", v.deprecated.Unix()))
+		}
+
+		if !v.sunset.IsZero() {
+			w.Header().Set(sunsetHeader, v.sunset.UTC().Format(http.TimeFormat))
+		}
+
+		if v.successor != "" && !v.deprecated.IsZero() {
+			path := strings.TrimPrefix(r.URL.Path, "/"+v.name)
+			if v.name == "" {
+				path = r.URL.Path
+			}
+			w.Header().Add(linkHeader, fmt.Sprintf(`</%s%s>; rel="successor-version"`, v.successor, path))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// versionOf splits a route path template into the API version it belongs to and the path
+// within that version. Paths outside any version, such as /healthz, return a nil version.
+func versionOf(path string) (*apiVersion, string) {
+	for i := range apiVersions {
+		prefix := "/" + apiVersions[i].name
+		if strings.HasPrefix(path, prefix+"/") {
+			return &apiVersions[i], strings.TrimPrefix(path, prefix)
+		}
+	}
+
+	return nil, path
+}
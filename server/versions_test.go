@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVersionMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	v1 := apiVersion{name: "v1"}
+	w := httptest.NewRecorder()
+	v1.middleware(next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/users", nil))
+	if w.Header().Get(deprecationHeader) != "" || w.Header().Get(sunsetHeader) != "" {
+		t.Errorf("Expected no deprecation headers on a current version, got %v", w.Header())
+	}
+
+	v1.successor = "v2"
+	v1.deprecated = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	v1.sunset = time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+	w = httptest.NewRecorder()
+	v1.middleware(next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/users/1", nil))
+
+	testCases := []struct {
+		header, e string
+	}{
+		{deprecationHeader, "@1767225600"},
+		{sunsetHeader, "Wed, 01 Jul 2026 00:00:00 GMT"},
+		{linkHeader, `</v2/users/1>; rel="successor-version"`},
+	}
+
+	for _, tc := range testCases {
+		if w.Header().Get(tc.header) != tc.e {
+			t.Errorf("Expected %s %q, got %q", tc.header, tc.e, w.Header().Get(tc.header))
+		}
+	}
+}
+
+func TestVersionOf(t *testing.T) {
+	testCases := []struct {
+		path, version, rest string
+	}{
+		{"/v1/appointments/{id}", "v1", "/appointments/{id}"},
+		{"/appointments/{id}", "", "/appointments/{id}"},
+		{"/healthz", "", "/healthz"},
+		{"/v1beta/users", "", "/v1beta/users"},
+	}
+
+	for _, tc := range testCases {
+		version, rest := versionOf(tc.path)
+		name := ""
+		if version != nil {
+			name = version.name
+		}
+
+		if name != tc.version || rest != tc.rest {
+			t.Errorf("Expected %q, %q for %s, got %q, %q", tc.version, tc.rest, tc.path, name, rest)
+		}
+	}
+}
+
+func TestLegacyVersion(t *testing.T) {
+	forEachStorage(t, testLegacyVersion)
+}
+
+func testLegacyVersion(t *testing.T, s *Server) {
+	seed(t, s)
+
+	w := do(s, "GET", "/users/1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	testCases := []struct {
+		header, e string
+	}{
+		{deprecationHeader, "@1792368000"},
+		{sunsetHeader, "Mon, 19 Apr 2027 00:00:00 GMT"},
+		{linkHeader, `</v1/users/1>; rel="successor-version"`},
+	}
+
+	for _, tc := range testCases {
+		if w.Header().Get(tc.header) != tc.e {
+			t.Errorf("Expected %s %q, got %q", tc.header, tc.e, w.Header().Get(tc.header))
+		}
+	}
+
+	w = do(s, "GET", "/v1/users/1", "")
+	if w.Header().Get(deprecationHeader) != "" || w.Header().Get(sunsetHeader) != "" {
+		t.Errorf("Expected no deprecation headers on /v1, got %v", w.Header())
+	}
+}
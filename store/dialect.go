@@ -0,0 +1,140 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/glebarez/go-sqlite"
+	"github.com/jackc/pgconn"
+	"gorm.io/gorm"
+)
+
+// dialect holds what differs between the databases the GORM store supports.
+type dialect struct {
+	// resetSequence moves the table's ID sequence past its largest ID after a row is inserted
+	// with an explicit ID.
+	resetSequence func(tx *gorm.DB, table string) error
+
+	// value converts a filter value to one the database compares correctly with the column.
+	value func(v interface{}) interface{}
+
+	// register installs any callbacks the database needs on db.
+	register func(db *gorm.DB) error
+
+	// duplicate reports whether err is a unique constraint violation.
+	duplicate func(err error) bool
+}
+
+// SQLite's extended result codes for constraint violations.
+const (
+	sqliteConstraintPrimaryKey = 1555
+	sqliteConstraintUnique     = 2067
+)
+
+var dialects = map[string]dialect{
+	"postgres": {
+		resetSequence: func(tx *gorm.DB, table string) error {
+			return tx.Exec("SELECT setval(pg_get_serial_sequence(?, 'id'), max(id)) FROM "+table, table).Error
+		},
+		value:    func(v interface{}) interface{} { return v },
+		register: func(db *gorm.DB) error { return nil },
+		duplicate: func(err error) bool {
+			var pgErr *pgconn.PgError
+			return errors.As(err, &pgErr) && pgErr.Code == "23505"
+		},
+	},
+
+	// SQLite stores times as text, so they are all kept in UTC for comparisons to work. Its
+	// integer primary keys already continue from the largest ID.
+	"sqlite": {
+		resetSequence: func(tx *gorm.DB, table string) error { return nil },
+		value:         utcValue,
+		register: func(db *gorm.DB) error {
+			if err := db.Callback().Create().Before("gorm:create").Register("appts:utc", utcTimes); err != nil {
+				return err
+			}
+
+			return db.Callback().Update().Before("gorm:update").Register("appts:utc", utcTimes)
+		},
+		duplicate: func(err error) bool {
+			var sqliteErr *sqlite.Error
+			return errors.As(err, &sqliteErr) &&
+				(sqliteErr.Code() == sqliteConstraintUnique || sqliteErr.Code() == sqliteConstraintPrimaryKey)
+		},
+	},
+}
+
+// translate maps GORM and database errors to the store's.
+func (d dialect) translate(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+
+	if err != nil && d.duplicate(err) {
+		return fmt.Errorf("%w: %v", ErrDuplicate, err)
+	}
+
+	return err
+}
+
+// values converts each element of a slice for the dialect.
+func (d dialect) values(slice interface{}) []interface{} {
+	sliceValue := reflect.ValueOf(slice)
+	values := make([]interface{}, sliceValue.Len())
+	for i := range values {
+		values[i] = d.value(sliceValue.Index(i).Interface())
+	}
+
+	return values
+}
+
+// dialectOf returns the dialect of the database db is connected to.
+func dialectOf(db *gorm.DB) (dialect, error) {
+	d, ok := dialects[db.Dialector.Name()]
+	if !ok {
+		return dialect{}, fmt.Errorf("unsupported database %q", db.Dialector.Name())
+	}
+
+	return d, nil
+}
+
+// utcValue converts times, including those in RFC 3339 strings from query parameters, to UTC.
+func utcValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case time.Time:
+		return value.UTC()
+	case string:
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t.UTC()
+		}
+	}
+
+	return v
+}
+
+// utcTimes converts the time fields of the model being written to UTC.
+func utcTimes(db *gorm.DB) {
+	if db.Statement.Schema == nil {
+		return
+	}
+
+	set := func(model reflect.Value) {
+		for _, field := range db.Statement.Schema.Fields {
+			value := field.ReflectValueOf(db.Statement.Context, model)
+			if t, ok := value.Interface().(time.Time); ok && value.CanSet() {
+				value.Set(reflect.ValueOf(t.UTC()))
+			}
+		}
+	}
+
+	switch model := reflect.Indirect(db.Statement.ReflectValue); model.Kind() {
+	case reflect.Struct:
+		set(model)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < model.Len(); i++ {
+			set(reflect.Indirect(model.Index(i)))
+		}
+	}
+}
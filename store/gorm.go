@@ -0,0 +1,747 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/models"
+)
+
+// gormStore stores models in a database through GORM.
+type gormStore struct {
+	db      *gorm.DB
+	dialect dialect
+}
+
+// NewGorm returns a Store backed by the given Postgres or SQLite database. Models' timestamps
+// are taken from c. Closing the Store closes the database.
+func NewGorm(db *gorm.DB, c clock.Clock) (Store, error) {
+	d, err := dialectOf(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.register(db); err != nil {
+		return nil, err
+	}
+
+	db.Config.NowFunc = c.Now
+
+	return &gormStore{db: db, dialect: d}, nil
+}
+
+func (s *gormStore) Appts() ApptStore {
+	return &gormApptStore{gormModelStore{db: s.db, dialect: s.dialect, model: &models.Appt{}}}
+}
+
+func (s *gormStore) Users() UserStore {
+	return &gormModelStore{db: s.db, dialect: s.dialect, model: &models.User{}, cascade: userCascade}
+}
+
+func (s *gormStore) Trainers() TrainerStore {
+	return &gormModelStore{db: s.db, dialect: s.dialect, model: &models.Trainer{}, cascade: trainerCascade}
+}
+
+func (s *gormStore) IdempotencyKeys() IdempotencyKeyStore {
+	return &gormIdempotencyKeyStore{s.db, s.dialect}
+}
+
+func (s *gormStore) APIKeys() APIKeyStore {
+	return &gormAPIKeyStore{s.db, s.dialect}
+}
+
+func (s *gormStore) FeedTokens() FeedTokenStore {
+	return &gormFeedTokenStore{s.db, s.dialect}
+}
+
+func (s *gormStore) BusyCalendars() BusyCalendarStore {
+	return &gormBusyCalendarStore{gormModelStore{db: s.db, dialect: s.dialect, model: &models.BusyCalendar{}}}
+}
+
+func (s *gormStore) TimeOff() TimeOffStore {
+	return &gormTimeOffStore{gormModelStore{db: s.db, dialect: s.dialect, model: &models.TimeOff{}}}
+}
+
+func (s *gormStore) Accounts() AccountStore {
+	return &gormAccountStore{s.db, s.dialect}
+}
+
+func (s *gormStore) Audit() AuditStore {
+	return &gormAuditStore{gormModelStore{db: s.db, dialect: s.dialect, model: &models.AuditEntry{}}}
+}
+
+func (s *gormStore) Transaction(fn func(tx Store) error) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&gormStore{db: tx, dialect: s.dialect})
+	})
+}
+
+func (s *gormStore) Close() error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+
+	return db.Close()
+}
+
+type gormModelStore struct {
+	db      *gorm.DB
+	dialect dialect
+
+	// model is a pointer to the stored model type, for operations that don't take one.
+	model   interface{}
+	cascade *cascade
+	// withDeleted includes deleted models in Get and List.
+	withDeleted bool
+}
+
+// query returns the database for reads, which see deleted models if withDeleted is set.
+func (s *gormModelStore) query() *gorm.DB {
+	if s.withDeleted {
+		return s.db.Unscoped()
+	}
+
+	return s.db
+}
+
+func (s *gormModelStore) Get(id uint, model interface{}) error {
+	return s.dialect.translate(s.query().First(model, id).Error)
+}
+
+func (s *gormModelStore) List(filter Filter, models interface{}) error {
+	db := s.query()
+	for _, c := range filter {
+		if c.Op == "in" {
+			db = db.Where(fmt.Sprintf("%s IN ?", c.Column), s.dialect.values(c.Value))
+		} else {
+			db = db.Where(fmt.Sprintf("%s %s ?", c.Column, c.Op), s.dialect.value(c.Value))
+		}
+	}
+
+	return s.dialect.translate(db.Order("id").Find(models).Error)
+}
+
+func (s *gormModelStore) Create(model interface{}) error {
+	id := reflect.ValueOf(model).Elem().FieldByName("ID")
+	if !id.IsValid() || id.Uint() == 0 {
+		return s.dialect.translate(s.db.Create(model).Error)
+	}
+
+	// The passed model has an ID, so move the auto-increment sequence past it.
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Create(model); result.Error != nil {
+			return result.Error
+		}
+
+		tableName, err := tableOf(tx, model)
+		if err != nil {
+			return err
+		}
+
+		return s.dialect.resetSequence(tx, tableName)
+	})
+
+	return s.dialect.translate(err)
+}
+
+func (s *gormModelStore) Update(model interface{}, version uint) error {
+	versionField := reflect.ValueOf(model).Elem().FieldByName("Version")
+	versionField.SetUint(uint64(version + 1))
+
+	result := s.db.Model(model).
+		Where("version = ?", version).
+		Select("*").
+		Omit("ID", "CreatedAt", "DeletedAt").
+		Updates(model)
+	if result.Error != nil {
+		versionField.SetUint(uint64(version))
+		return s.dialect.translate(result.Error)
+	}
+
+	if result.RowsAffected == 0 {
+		versionField.SetUint(uint64(version))
+		return ErrConflict
+	}
+
+	return nil
+}
+
+func (s *gormModelStore) Delete(model interface{}, version uint) error {
+	// The deletion time is set here rather than by GORM so that the cascade can use the same
+	// one, which is how Restore finds the appts deleted along with the model.
+	now := s.dialect.value(s.db.NowFunc())
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(model).Where("version = ?", version).Update("deleted_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrConflict
+		}
+
+		if _, isAppt := model.(*models.Appt); isAppt {
+			return recordApptVersions(tx, now, "id = ?", modelID(model))
+		}
+
+		if s.cascade == nil {
+			return nil
+		}
+
+		err := tx.Model(&models.Appt{}).
+			Where(s.cascade.column+" = ?", modelID(model)).
+			Update("deleted_at", now).Error
+		if err != nil {
+			return err
+		}
+
+		return recordApptVersions(tx, now, s.cascade.column+" = ? AND deleted_at = ?", modelID(model), now)
+	})
+
+	return s.dialect.translate(err)
+}
+
+func (s *gormModelStore) Restore(model interface{}, version uint) error {
+	id := modelID(model)
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if s.cascade != nil {
+			if err := s.restoreAppts(tx, id); err != nil {
+				return err
+			}
+		}
+
+		result := tx.Unscoped().Model(model).
+			Where("version = ? AND deleted_at IS NOT NULL", version).
+			Updates(map[string]interface{}{"deleted_at": nil, "version": version + 1})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrConflict
+		}
+
+		if _, isAppt := model.(*models.Appt); isAppt {
+			if err := recordApptVersions(tx, s.dialect.value(tx.NowFunc()), "id = ?", id); err != nil {
+				return err
+			}
+		}
+
+		return tx.First(model, id).Error
+	})
+
+	return s.dialect.translate(err)
+}
+
+// restoreAppts restores the appts deleted along with the user or trainer with the given ID,
+// leaving those whose slot has been taken since or whose other party is deleted.
+func (s *gormModelStore) restoreAppts(tx *gorm.DB, id uint) error {
+	table, err := tableOf(tx, s.model)
+	if err != nil {
+		return err
+	}
+
+	otherTable, err := tableOf(tx, s.cascade.other)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint
+	err = tx.Raw(fmt.Sprintf(`
+		SELECT id FROM appts
+		WHERE %[1]s = ?
+			AND deleted_at = (SELECT deleted_at FROM %[2]s WHERE id = ?)
+			AND %[3]s IN (SELECT id FROM %[4]s WHERE deleted_at IS NULL)
+			AND NOT EXISTS (
+				SELECT 1 FROM appts AS taken
+				WHERE taken.trainer_id = appts.trainer_id
+					AND taken.start_time = appts.start_time
+					AND taken.deleted_at IS NULL
+			)`,
+		s.cascade.column, table, s.cascade.otherColumn, otherTable,
+	), id, id).Scan(&ids).Error
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	now := s.dialect.value(s.db.NowFunc())
+	err = tx.Exec(
+		"UPDATE appts SET deleted_at = NULL, updated_at = ?, version = version + 1 WHERE id IN ?", now, ids,
+	).Error
+	if err != nil {
+		return err
+	}
+
+	return recordApptVersions(tx, now, "id IN ?", ids)
+}
+
+// recordApptVersions records the state of the appts matching the condition as their versions
+// from now.
+func recordApptVersions(tx *gorm.DB, now interface{}, condition string, args ...interface{}) error {
+	return tx.Exec(`
+		INSERT INTO appt_versions (
+			appt_id, version, start_time, end_time, user_id, trainer_id, attended,
+			created_at, updated_at, deleted_at, recorded_at
+		)
+		SELECT id, version, start_time, end_time, user_id, trainer_id, attended,
+			created_at, updated_at, deleted_at, ?
+		FROM appts WHERE `+condition,
+		append([]interface{}{now}, args...)...,
+	).Error
+}
+
+func (s *gormModelStore) Purge(before time.Time) (int64, error) {
+	var purged int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		deleted := tx.Unscoped().Model(s.model).Select("id").Where("deleted_at < ?", s.dialect.value(before))
+
+		// The foreign keys cascade too, but removing the appts' versions and then the appts first
+		// doesn't depend on them.
+		var appts *gorm.DB
+		if s.cascade != nil {
+			appts = tx.Unscoped().Model(&models.Appt{}).Select("id").Where(s.cascade.column+" IN (?)", deleted)
+		} else if _, isAppt := s.model.(*models.Appt); isAppt {
+			appts = deleted
+		}
+		if appts != nil {
+			if err := tx.Where("appt_id IN (?)", appts).Delete(&models.ApptVersion{}).Error; err != nil {
+				return err
+			}
+		}
+
+		if s.cascade != nil {
+			err := tx.Unscoped().Where(s.cascade.column+" IN (?)", deleted).Delete(&models.Appt{}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		result := tx.Unscoped().Where("deleted_at < ?", s.dialect.value(before)).Delete(s.model)
+		purged = result.RowsAffected
+		return result.Error
+	})
+
+	return purged, s.dialect.translate(err)
+}
+
+func (s *gormModelStore) WithDeleted() ModelStore {
+	withDeleted := *s
+	withDeleted.withDeleted = true
+	return &withDeleted
+}
+
+// tableOf returns the name of model's table.
+func tableOf(db *gorm.DB, model interface{}) (string, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return "", err
+	}
+
+	return stmt.Schema.Table, nil
+}
+
+// modelID returns the ID of model, a pointer to a model.
+func modelID(model interface{}) uint {
+	return uint(reflect.ValueOf(model).Elem().FieldByName("ID").Uint())
+}
+
+type gormApptStore struct {
+	gormModelStore
+}
+
+func (s *gormApptStore) Create(model interface{}) error {
+	return s.versioned(model, func(appts *gormModelStore) error { return appts.Create(model) })
+}
+
+func (s *gormApptStore) Update(model interface{}, version uint) error {
+	return s.versioned(model, func(appts *gormModelStore) error { return appts.Update(model, version) })
+}
+
+// versioned runs write in a transaction, and records the resulting version of the appt.
+func (s *gormApptStore) versioned(model interface{}, write func(appts *gormModelStore) error) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		appts := s.gormModelStore
+		appts.db = tx
+		if err := write(&appts); err != nil {
+			return err
+		}
+
+		return recordApptVersions(tx, s.dialect.value(tx.NowFunc()), "id = ?", modelID(model))
+	})
+
+	return s.dialect.translate(err)
+}
+
+func (s *gormApptStore) History(id uint, versions *[]models.ApptVersion) error {
+	if err := s.db.Where("appt_id = ?", id).Order("id").Find(versions).Error; err != nil {
+		return err
+	}
+
+	if len(*versions) == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *gormApptStore) Versions(filter Filter, versions *[]models.ApptVersion) error {
+	db := s.db
+	for _, c := range filter {
+		if c.Op == "in" {
+			db = db.Where(fmt.Sprintf("%s IN ?", c.Column), s.dialect.values(c.Value))
+		} else {
+			db = db.Where(fmt.Sprintf("%s %s ?", c.Column, c.Op), s.dialect.value(c.Value))
+		}
+	}
+
+	return s.dialect.translate(db.Order("appt_id, id").Find(versions).Error)
+}
+
+func (s *gormApptStore) AsOf(t time.Time) ModelStore {
+	return &gormApptsAsOf{db: s.db, dialect: s.dialect, at: t}
+}
+
+func (s *gormApptStore) Available(appt models.Appt) (bool, error) {
+	var existing []models.Appt
+	result := s.db.Where(
+		"trainer_id = ? AND start_time = ? AND id <> ?", appt.TrainerID, s.dialect.value(appt.StartTime), appt.ID,
+	).Limit(1).Find(&existing)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return len(existing) == 0, nil
+}
+
+// gormApptsAsOf reconstructs appts from their latest versions recorded at or before at.
+type gormApptsAsOf struct {
+	db      *gorm.DB
+	dialect dialect
+	at      time.Time
+	// withDeleted includes appts that were deleted at the time.
+	withDeleted bool
+}
+
+func (s *gormApptsAsOf) Get(id uint, model interface{}) error {
+	var v models.ApptVersion
+	err := s.db.Where("appt_id = ? AND recorded_at <= ?", id, s.dialect.value(s.at)).Order("id DESC").First(&v).Error
+	if err != nil {
+		return s.dialect.translate(err)
+	}
+
+	if v.DeletedAt != nil && !s.withDeleted {
+		return ErrNotFound
+	}
+
+	*model.(*models.Appt) = ApptAt(v)
+	return nil
+}
+
+func (s *gormApptsAsOf) List(filter Filter, appts interface{}) error {
+	latest := s.db.Model(&models.ApptVersion{}).
+		Select("MAX(id)").
+		Where("recorded_at <= ?", s.dialect.value(s.at)).
+		Group("appt_id")
+
+	db := s.db.Where("id IN (?)", latest)
+	if !s.withDeleted {
+		db = db.Where("deleted_at IS NULL")
+	}
+
+	for _, c := range filter {
+		// The versions have the appts' columns, except for their IDs.
+		if c.Column == "id" {
+			c.Column = "appt_id"
+		}
+
+		if c.Op == "in" {
+			db = db.Where(fmt.Sprintf("%s IN ?", c.Column), s.dialect.values(c.Value))
+		} else {
+			db = db.Where(fmt.Sprintf("%s %s ?", c.Column, c.Op), s.dialect.value(c.Value))
+		}
+	}
+
+	var versions []models.ApptVersion
+	if err := db.Order("appt_id").Find(&versions).Error; err != nil {
+		return s.dialect.translate(err)
+	}
+
+	found := make([]models.Appt, len(versions))
+	for i, v := range versions {
+		found[i] = ApptAt(v)
+	}
+
+	*appts.(*[]models.Appt) = found
+	return nil
+}
+
+func (s *gormApptsAsOf) Create(interface{}) error        { return ErrReadOnly }
+func (s *gormApptsAsOf) Update(interface{}, uint) error  { return ErrReadOnly }
+func (s *gormApptsAsOf) Delete(interface{}, uint) error  { return ErrReadOnly }
+func (s *gormApptsAsOf) Restore(interface{}, uint) error { return ErrReadOnly }
+func (s *gormApptsAsOf) Purge(time.Time) (int64, error)  { return 0, ErrReadOnly }
+
+func (s *gormApptsAsOf) WithDeleted() ModelStore {
+	withDeleted := *s
+	withDeleted.withDeleted = true
+	return &withDeleted
+}
+
+type gormIdempotencyKeyStore struct {
+	db      *gorm.DB
+	dialect dialect
+}
+
+func (s *gormIdempotencyKeyStore) Get(key string) (*models.IdempotencyKey, error) {
+	var stored models.IdempotencyKey
+	if result := s.db.First(&stored, "key = ?", key); result.Error != nil {
+		return nil, s.dialect.translate(result.Error)
+	}
+
+	return &stored, nil
+}
+
+func (s *gormIdempotencyKeyStore) Create(key *models.IdempotencyKey) error {
+	return s.dialect.translate(s.db.Create(key).Error)
+}
+
+func (s *gormIdempotencyKeyStore) Save(key *models.IdempotencyKey) error {
+	return s.db.Save(key).Error
+}
+
+func (s *gormIdempotencyKeyStore) Delete(key string) error {
+	return s.db.Delete(&models.IdempotencyKey{}, "key = ?", key).Error
+}
+
+func (s *gormIdempotencyKeyStore) DeleteBefore(t time.Time) error {
+	return s.db.Where("created_at < ?", s.dialect.value(t)).Delete(&models.IdempotencyKey{}).Error
+}
+
+type gormAPIKeyStore struct {
+	db      *gorm.DB
+	dialect dialect
+}
+
+func (s *gormAPIKeyStore) Create(key *models.APIKey) error {
+	return s.dialect.translate(s.db.Create(key).Error)
+}
+
+func (s *gormAPIKeyStore) List(keys *[]models.APIKey) error {
+	return s.db.Order("id").Find(keys).Error
+}
+
+func (s *gormAPIKeyStore) GetByHash(hash string) (*models.APIKey, error) {
+	var key models.APIKey
+	if result := s.db.First(&key, "hash = ?", hash); result.Error != nil {
+		return nil, s.dialect.translate(result.Error)
+	}
+
+	return &key, nil
+}
+
+func (s *gormAPIKeyStore) Delete(id uint) error {
+	result := s.db.Delete(&models.APIKey{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+type gormFeedTokenStore struct {
+	db      *gorm.DB
+	dialect dialect
+}
+
+func (s *gormFeedTokenStore) Create(token *models.FeedToken) error {
+	return s.dialect.translate(s.db.Create(token).Error)
+}
+
+func (s *gormFeedTokenStore) List(owner string, ownerID uint, tokens *[]models.FeedToken) error {
+	return s.db.Where("owner = ? AND owner_id = ?", owner, ownerID).Order("id").Find(tokens).Error
+}
+
+func (s *gormFeedTokenStore) GetByHash(hash string) (*models.FeedToken, error) {
+	var token models.FeedToken
+	if result := s.db.First(&token, "hash = ?", hash); result.Error != nil {
+		return nil, s.dialect.translate(result.Error)
+	}
+
+	return &token, nil
+}
+
+func (s *gormFeedTokenStore) Delete(id uint) error {
+	result := s.db.Delete(&models.FeedToken{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+type gormBusyCalendarStore struct {
+	gormModelStore
+}
+
+func (s *gormBusyCalendarStore) Create(cal *models.BusyCalendar) error {
+	return s.dialect.translate(s.db.Create(cal).Error)
+}
+
+func (s *gormBusyCalendarStore) Get(id uint) (*models.BusyCalendar, error) {
+	var cal models.BusyCalendar
+	if err := s.gormModelStore.Get(id, &cal); err != nil {
+		return nil, err
+	}
+
+	return &cal, nil
+}
+
+func (s *gormBusyCalendarStore) List(filter Filter, cals *[]models.BusyCalendar) error {
+	return s.gormModelStore.List(filter, cals)
+}
+
+func (s *gormBusyCalendarStore) Save(cal *models.BusyCalendar) error {
+	return s.dialect.translate(s.db.Save(cal).Error)
+}
+
+func (s *gormBusyCalendarStore) Delete(id uint) error {
+	result := s.db.Delete(&models.BusyCalendar{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+type gormTimeOffStore struct {
+	gormModelStore
+}
+
+func (s *gormTimeOffStore) Get(trainerID uint, name string) (*models.TimeOff, error) {
+	var t models.TimeOff
+	if result := s.db.First(&t, "trainer_id = ? AND name = ?", trainerID, name); result.Error != nil {
+		return nil, s.dialect.translate(result.Error)
+	}
+
+	return &t, nil
+}
+
+func (s *gormTimeOffStore) List(filter Filter, timeOff *[]models.TimeOff) error {
+	return s.gormModelStore.List(filter, timeOff)
+}
+
+func (s *gormTimeOffStore) Create(t *models.TimeOff) error {
+	t.Version = 1
+	return s.dialect.translate(s.db.Create(t).Error)
+}
+
+func (s *gormTimeOffStore) Update(t *models.TimeOff, version uint) error {
+	return s.gormModelStore.Update(t, version)
+}
+
+func (s *gormTimeOffStore) Delete(id uint) error {
+	result := s.db.Delete(&models.TimeOff{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+type gormAccountStore struct {
+	db      *gorm.DB
+	dialect dialect
+}
+
+func (s *gormAccountStore) GetCredential(userID uint) (*models.Credential, error) {
+	var c models.Credential
+	if result := s.db.First(&c, "user_id = ?", userID); result.Error != nil {
+		return nil, s.dialect.translate(result.Error)
+	}
+
+	return &c, nil
+}
+
+func (s *gormAccountStore) SaveCredential(c *models.Credential) error {
+	return s.dialect.translate(s.db.Save(c).Error)
+}
+
+func (s *gormAccountStore) CreateToken(t *models.UserToken) error {
+	return s.dialect.translate(s.db.Create(t).Error)
+}
+
+func (s *gormAccountStore) GetToken(kind, hash string) (*models.UserToken, error) {
+	var t models.UserToken
+	if result := s.db.First(&t, "hash = ? AND kind = ?", hash, kind); result.Error != nil {
+		return nil, s.dialect.translate(result.Error)
+	}
+
+	return &t, nil
+}
+
+func (s *gormAccountStore) UseToken(hash string) error {
+	result := s.db.Model(&models.UserToken{}).
+		Where("hash = ? AND used_at IS NULL", hash).
+		Update("used_at", s.db.NowFunc())
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrConflict
+	}
+
+	return nil
+}
+
+func (s *gormAccountStore) RevokeTokens(userID uint, kind string) error {
+	return s.db.Model(&models.UserToken{}).
+		Where("user_id = ? AND kind = ? AND used_at IS NULL", userID, kind).
+		Update("used_at", s.db.NowFunc()).Error
+}
+
+func (s *gormAccountStore) GetIdentity(issuer, subject string) (*models.Identity, error) {
+	var i models.Identity
+	if result := s.db.First(&i, "issuer = ? AND subject = ?", issuer, subject); result.Error != nil {
+		return nil, s.dialect.translate(result.Error)
+	}
+
+	return &i, nil
+}
+
+func (s *gormAccountStore) CreateIdentity(i *models.Identity) error {
+	return s.dialect.translate(s.db.Create(i).Error)
+}
+
+type gormAuditStore struct {
+	gormModelStore
+}
+
+func (s *gormAuditStore) Append(e *models.AuditEntry) error {
+	return s.dialect.translate(s.db.Create(e).Error)
+}
+
+func (s *gormAuditStore) List(filter Filter, entries *[]models.AuditEntry) error {
+	return s.gormModelStore.List(filter, entries)
+}
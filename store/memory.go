@@ -0,0 +1,1341 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/marcuscarr/appts/clock"
+	"github.com/marcuscarr/appts/models"
+)
+
+// memoryStore keeps models in memory, for tests and local development. Every operation holds a
+// single lock, and a transaction holds it from start to commit, so checks such as Available
+// followed by Create can't race with another request.
+type memoryStore struct {
+	// mu is nil within a transaction, since the outermost Store already holds it.
+	mu    *sync.Mutex
+	data  *memoryData
+	clock clock.Clock
+}
+
+type memoryData struct {
+	tables map[reflect.Type]*memoryTable
+	keys   map[string]models.IdempotencyKey
+	// credentials are keyed by user ID, tokens by hash, and identities by issuer and subject.
+	credentials map[uint]models.Credential
+	tokens      map[string]models.UserToken
+	identities  map[identityKey]models.Identity
+	// audit is the audit log, in the order the entries were appended.
+	audit []models.AuditEntry
+	// apptVersions are the appts' versions, in the order they were recorded.
+	apptVersions []models.ApptVersion
+}
+
+type memoryTable struct {
+	// rows are model struct values keyed by ID.
+	rows   map[uint]interface{}
+	nextID uint
+}
+
+// NewMemory returns an empty Store that keeps its data in memory. Models' timestamps are taken
+// from c.
+func NewMemory(c clock.Clock) Store {
+	return &memoryStore{
+		mu:    &sync.Mutex{},
+		clock: c,
+		data: &memoryData{
+			tables: map[reflect.Type]*memoryTable{},
+			keys:   map[string]models.IdempotencyKey{},
+
+			credentials: map[uint]models.Credential{},
+			tokens:      map[string]models.UserToken{},
+			identities:  map[identityKey]models.Identity{},
+		},
+	}
+}
+
+func (s *memoryStore) Appts() ApptStore {
+	return &memoryApptStore{memoryModelStore{s: s, model: apptType}}
+}
+
+func (s *memoryStore) Users() UserStore {
+	return &memoryModelStore{s: s, model: reflect.TypeOf(models.User{}), cascade: userCascade}
+}
+
+func (s *memoryStore) Trainers() TrainerStore {
+	return &memoryModelStore{s: s, model: reflect.TypeOf(models.Trainer{}), cascade: trainerCascade}
+}
+
+func (s *memoryStore) APIKeys() APIKeyStore {
+	return &memoryAPIKeyStore{memoryModelStore{s: s, model: reflect.TypeOf(models.APIKey{})}}
+}
+
+func (s *memoryStore) FeedTokens() FeedTokenStore {
+	return &memoryFeedTokenStore{memoryModelStore{s: s, model: reflect.TypeOf(models.FeedToken{})}}
+}
+
+func (s *memoryStore) BusyCalendars() BusyCalendarStore {
+	return &memoryBusyCalendarStore{memoryModelStore{s: s, model: reflect.TypeOf(models.BusyCalendar{})}}
+}
+
+func (s *memoryStore) TimeOff() TimeOffStore {
+	return &memoryTimeOffStore{memoryModelStore{s: s, model: reflect.TypeOf(models.TimeOff{})}}
+}
+
+func (s *memoryStore) Accounts() AccountStore {
+	return &memoryAccountStore{s}
+}
+
+func (s *memoryStore) Audit() AuditStore {
+	return &memoryAuditStore{s}
+}
+
+func (s *memoryStore) IdempotencyKeys() IdempotencyKeyStore {
+	return &memoryIdempotencyKeyStore{s}
+}
+
+// Transaction runs fn against a copy of the data, which replaces the original if fn succeeds.
+func (s *memoryStore) Transaction(fn func(tx Store) error) error {
+	return s.locked(func(data *memoryData) error {
+		copied := data.clone()
+		if err := fn(&memoryStore{data: copied, clock: s.clock}); err != nil {
+			return err
+		}
+
+		*data = *copied
+		return nil
+	})
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// locked runs fn with the store's data, holding the lock unless within a transaction.
+func (s *memoryStore) locked(fn func(data *memoryData) error) error {
+	if s.mu != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+
+	return fn(s.data)
+}
+
+func (d *memoryData) clone() *memoryData {
+	copied := &memoryData{
+		tables: make(map[reflect.Type]*memoryTable, len(d.tables)),
+		keys:   make(map[string]models.IdempotencyKey, len(d.keys)),
+
+		credentials: make(map[uint]models.Credential, len(d.credentials)),
+		tokens:      make(map[string]models.UserToken, len(d.tokens)),
+		identities:  make(map[identityKey]models.Identity, len(d.identities)),
+		audit:       make([]models.AuditEntry, len(d.audit)),
+
+		apptVersions: make([]models.ApptVersion, len(d.apptVersions)),
+	}
+
+	copy(copied.audit, d.audit)
+	copy(copied.apptVersions, d.apptVersions)
+
+	for typ, table := range d.tables {
+		rows := make(map[uint]interface{}, len(table.rows))
+		for id, row := range table.rows {
+			rows[id] = row
+		}
+		copied.tables[typ] = &memoryTable{rows: rows, nextID: table.nextID}
+	}
+
+	for key, stored := range d.keys {
+		copied.keys[key] = stored
+	}
+
+	for userID, c := range d.credentials {
+		copied.credentials[userID] = c
+	}
+
+	for hash, t := range d.tokens {
+		copied.tokens[hash] = t
+	}
+
+	for key, i := range d.identities {
+		copied.identities[key] = i
+	}
+
+	return copied
+}
+
+// table returns the table for the model type, creating it if needed.
+func (d *memoryData) table(typ reflect.Type) *memoryTable {
+	table, ok := d.tables[typ]
+	if !ok {
+		table = &memoryTable{rows: map[uint]interface{}{}}
+		d.tables[typ] = table
+	}
+
+	return table
+}
+
+// get returns the stored value of the row with the given ID, ignoring deleted rows unless
+// withDeleted is set.
+func (t *memoryTable) get(id uint, withDeleted bool) (reflect.Value, bool) {
+	row, ok := t.rows[id]
+	if !ok {
+		return reflect.Value{}, false
+	}
+
+	value := reflect.ValueOf(row)
+	if !withDeleted && deleted(value) {
+		return reflect.Value{}, false
+	}
+
+	return value, true
+}
+
+// sorted returns the rows ordered by ID, leaving out deleted rows unless withDeleted is set.
+func (t *memoryTable) sorted(withDeleted bool) []reflect.Value {
+	ids := make([]uint, 0, len(t.rows))
+	for id := range t.rows {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	values := make([]reflect.Value, 0, len(ids))
+	for _, id := range ids {
+		if value, ok := t.get(id, withDeleted); ok {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// set replaces the row with a copy of stored whose named field is set to value.
+func (t *memoryTable) set(stored reflect.Value, name string, value interface{}) reflect.Value {
+	row := reflect.New(stored.Type()).Elem()
+	row.Set(stored)
+	row.FieldByName(name).Set(reflect.ValueOf(value))
+
+	t.rows[uint(row.FieldByName("ID").Uint())] = row.Interface()
+	return row
+}
+
+// deleted reports whether a model was soft deleted, as GORM does for models with a DeletedAt.
+func deleted(model reflect.Value) bool {
+	field := model.FieldByName("DeletedAt")
+	if !field.IsValid() {
+		return false
+	}
+
+	return field.Interface().(gorm.DeletedAt).Valid
+}
+
+var (
+	apptType = reflect.TypeOf(models.Appt{})
+	userType = reflect.TypeOf(models.User{})
+)
+
+// recordVersion records the row as its appt's version from now. Rows of other models have no
+// versions.
+func (d *memoryData) recordVersion(row reflect.Value, now time.Time) {
+	appt, ok := row.Interface().(models.Appt)
+	if !ok {
+		return
+	}
+
+	var id uint = 1
+	if n := len(d.apptVersions); n > 0 {
+		id = d.apptVersions[n-1].ID + 1
+	}
+
+	v := models.ApptVersion{
+		ID:         id,
+		ApptID:     appt.ID,
+		Version:    appt.Version,
+		StartTime:  appt.StartTime,
+		EndTime:    appt.EndTime,
+		UserID:     appt.UserID,
+		TrainerID:  appt.TrainerID,
+		Attended:   appt.Attended,
+		CreatedAt:  appt.CreatedAt,
+		UpdatedAt:  appt.UpdatedAt,
+		DeletedAt:  deletedAt(appt.DeletedAt),
+		RecordedAt: now,
+	}
+	d.apptVersions = append(d.apptVersions, v)
+}
+
+// deletedAt returns the time a model was deleted, or nil if it wasn't.
+func deletedAt(deleted gorm.DeletedAt) *time.Time {
+	if !deleted.Valid {
+		return nil
+	}
+
+	return &deleted.Time
+}
+
+// slotTaken reports whether another appt that isn't deleted has appt's trainer and start time.
+func (d *memoryData) slotTaken(appt models.Appt) bool {
+	for _, stored := range d.table(apptType).sorted(false) {
+		existing := stored.Interface().(models.Appt)
+		if existing.TrainerID == appt.TrainerID &&
+			existing.StartTime.Equal(appt.StartTime) &&
+			existing.ID != appt.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// usernameTaken reports whether another user that isn't deleted has user's username. Users
+// without one don't take part, like in idx_users_username.
+func (d *memoryData) usernameTaken(user models.User) bool {
+	if user.Username == "" {
+		return false
+	}
+
+	for _, stored := range d.table(userType).sorted(false) {
+		existing := stored.Interface().(models.User)
+		if existing.Username == user.Username && existing.ID != user.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkUnique returns ErrDuplicate if the row would break a unique index of the GORM store's
+// schema. Like those, it only considers rows that aren't deleted.
+func (d *memoryData) checkUnique(row reflect.Value) error {
+	switch model := row.Interface().(type) {
+	case models.Appt:
+		if d.slotTaken(model) {
+			return fmt.Errorf("%w: appt %d's slot is taken", ErrDuplicate, model.ID)
+		}
+	case models.User:
+		if d.usernameTaken(model) {
+			return fmt.Errorf("%w: username %q is taken", ErrDuplicate, model.Username)
+		}
+	}
+
+	return nil
+}
+
+type memoryModelStore struct {
+	s *memoryStore
+
+	model   reflect.Type
+	cascade *cascade
+	// withDeleted includes deleted models in Get and List.
+	withDeleted bool
+}
+
+func (s *memoryModelStore) Get(id uint, model interface{}) error {
+	modelValue := reflect.ValueOf(model).Elem()
+	return s.s.locked(func(data *memoryData) error {
+		stored, ok := data.table(modelValue.Type()).get(id, s.withDeleted)
+		if !ok {
+			return ErrNotFound
+		}
+
+		modelValue.Set(stored)
+		return nil
+	})
+}
+
+func (s *memoryModelStore) List(filter Filter, models interface{}) error {
+	sliceValue := reflect.ValueOf(models).Elem()
+	modelType := sliceValue.Type().Elem()
+	return s.s.locked(func(data *memoryData) error {
+		found := reflect.MakeSlice(sliceValue.Type(), 0, 0)
+		for _, stored := range data.table(modelType).sorted(s.withDeleted) {
+			ok, err := matches(stored, filter)
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				found = reflect.Append(found, stored)
+			}
+		}
+
+		sliceValue.Set(found)
+		return nil
+	})
+}
+
+func (s *memoryModelStore) Create(model interface{}) error {
+	modelValue := reflect.ValueOf(model).Elem()
+	return s.s.locked(func(data *memoryData) error {
+		table := data.table(modelValue.Type())
+
+		idField := modelValue.FieldByName("ID")
+		id := uint(idField.Uint())
+		if id == 0 {
+			id = table.nextID + 1
+		} else if _, ok := table.rows[id]; ok {
+			return fmt.Errorf("%w: %s %d", ErrDuplicate, modelValue.Type().Name(), id)
+		}
+
+		// Like in the partial unique indexes, a row created deleted takes no part.
+		if !deleted(modelValue) {
+			if err := data.checkUnique(modelValue); err != nil {
+				return err
+			}
+		}
+
+		if id > table.nextID {
+			table.nextID = id
+		}
+
+		now := s.s.clock.Now()
+		idField.SetUint(uint64(id))
+		setIfZero(modelValue, "CreatedAt", now)
+		setIfZero(modelValue, "UpdatedAt", now)
+		if version := modelValue.FieldByName("Version"); version.IsValid() && version.Uint() == 0 {
+			version.SetUint(1)
+		}
+
+		table.rows[id] = modelValue.Interface()
+		data.recordVersion(modelValue, now)
+		return nil
+	})
+}
+
+func (s *memoryModelStore) Update(model interface{}, version uint) error {
+	modelValue := reflect.ValueOf(model).Elem()
+	return s.s.locked(func(data *memoryData) error {
+		table := data.table(modelValue.Type())
+
+		id := uint(modelValue.FieldByName("ID").Uint())
+		stored, ok := table.get(id, false)
+		if !ok || stored.FieldByName("Version").Uint() != uint64(version) {
+			return ErrConflict
+		}
+
+		if err := data.checkUnique(modelValue); err != nil {
+			return err
+		}
+
+		// Like the GORM store, the creation and deletion times can't be updated.
+		modelValue.FieldByName("CreatedAt").Set(stored.FieldByName("CreatedAt"))
+		modelValue.FieldByName("DeletedAt").Set(stored.FieldByName("DeletedAt"))
+		now := s.s.clock.Now()
+		modelValue.FieldByName("UpdatedAt").Set(reflect.ValueOf(now))
+		modelValue.FieldByName("Version").SetUint(uint64(version + 1))
+
+		table.rows[id] = modelValue.Interface()
+		data.recordVersion(modelValue, now)
+		return nil
+	})
+}
+
+func (s *memoryModelStore) Delete(model interface{}, version uint) error {
+	modelValue := reflect.ValueOf(model).Elem()
+	return s.s.locked(func(data *memoryData) error {
+		table := data.table(modelValue.Type())
+
+		id := uint(modelValue.FieldByName("ID").Uint())
+		stored, ok := table.get(id, false)
+		if !ok || stored.FieldByName("Version").Uint() != uint64(version) {
+			return ErrConflict
+		}
+
+		deletedAt := gorm.DeletedAt{Time: s.s.clock.Now(), Valid: true}
+		data.recordVersion(table.set(stored, "DeletedAt", deletedAt), deletedAt.Time)
+
+		if s.cascade != nil {
+			appts := data.table(apptType)
+			for _, appt := range appts.sorted(false) {
+				if columnID(appt, s.cascade.column) == id {
+					data.recordVersion(appts.set(appt, "DeletedAt", deletedAt), deletedAt.Time)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *memoryModelStore) Restore(model interface{}, version uint) error {
+	modelValue := reflect.ValueOf(model).Elem()
+	return s.s.locked(func(data *memoryData) error {
+		table := data.table(modelValue.Type())
+
+		id := uint(modelValue.FieldByName("ID").Uint())
+		stored, ok := table.get(id, true)
+		if !ok || !deleted(stored) || stored.FieldByName("Version").Uint() != uint64(version) {
+			return ErrConflict
+		}
+
+		if err := data.checkUnique(stored); err != nil {
+			return err
+		}
+
+		if s.cascade != nil {
+			s.restoreAppts(data, id, stored.FieldByName("DeletedAt").Interface().(gorm.DeletedAt))
+		}
+
+		now := s.s.clock.Now()
+		row := restored(table, stored, now)
+		data.recordVersion(row, now)
+		modelValue.Set(row)
+		return nil
+	})
+}
+
+// restoreAppts restores the appts deleted along with the user or trainer with the given ID,
+// leaving those whose slot has been taken since or whose other party is deleted.
+func (s *memoryModelStore) restoreAppts(data *memoryData, id uint, deletedAt gorm.DeletedAt) {
+	appts := data.table(apptType)
+	others := data.table(reflect.TypeOf(s.cascade.other).Elem())
+	for _, stored := range appts.sorted(true) {
+		appt := stored.Interface().(models.Appt)
+		if columnID(stored, s.cascade.column) != id || !appt.DeletedAt.Time.Equal(deletedAt.Time) {
+			continue
+		}
+
+		if _, ok := others.get(columnID(stored, s.cascade.otherColumn), false); !ok {
+			continue
+		}
+
+		if data.slotTaken(appt) {
+			continue
+		}
+
+		now := s.s.clock.Now()
+		data.recordVersion(restored(appts, stored, now), now)
+	}
+}
+
+// restored clears the deletion of the stored row, bumping its version, and returns the new row.
+func restored(table *memoryTable, stored reflect.Value, now time.Time) reflect.Value {
+	row := table.set(stored, "DeletedAt", gorm.DeletedAt{})
+	row = table.set(row, "UpdatedAt", now)
+	return table.set(row, "Version", uint(row.FieldByName("Version").Uint()+1))
+}
+
+func (s *memoryModelStore) Purge(before time.Time) (int64, error) {
+	var purged int64
+	err := s.s.locked(func(data *memoryData) error {
+		table := data.table(s.model)
+		ids := map[uint]bool{}
+		for id, row := range table.rows {
+			deletedAt := reflect.ValueOf(row).FieldByName("DeletedAt").Interface().(gorm.DeletedAt)
+			if deletedAt.Valid && deletedAt.Time.Before(before) {
+				delete(table.rows, id)
+				ids[id] = true
+			}
+		}
+
+		purgedAppts := map[uint]bool{}
+		if s.model == apptType {
+			purgedAppts = ids
+		}
+
+		if s.cascade != nil {
+			appts := data.table(apptType)
+			for id, row := range appts.rows {
+				if ids[columnID(reflect.ValueOf(row), s.cascade.column)] {
+					delete(appts.rows, id)
+					purgedAppts[id] = true
+				}
+			}
+		}
+
+		versions := data.apptVersions[:0]
+		for _, v := range data.apptVersions {
+			if !purgedAppts[v.ApptID] {
+				versions = append(versions, v)
+			}
+		}
+		data.apptVersions = versions
+
+		// As the databases' foreign keys do, remove purged users' credentials, tokens and
+		// identities, and purged trainers' identities, busy calendars and time off.
+		if s.model == reflect.TypeOf(models.User{}) {
+			for id := range ids {
+				delete(data.credentials, id)
+			}
+			for hash, t := range data.tokens {
+				if ids[t.UserID] {
+					delete(data.tokens, hash)
+				}
+			}
+		}
+		if s.model == reflect.TypeOf(models.Trainer{}) {
+			for _, model := range []reflect.Type{reflect.TypeOf(models.BusyCalendar{}), reflect.TypeOf(models.TimeOff{})} {
+				rows := data.table(model)
+				for id, row := range rows.rows {
+					if ids[columnID(reflect.ValueOf(row), "trainer_id")] {
+						delete(rows.rows, id)
+					}
+				}
+			}
+		}
+		for key, i := range data.identities {
+			var owner *uint
+			switch s.model {
+			case reflect.TypeOf(models.User{}):
+				owner = i.UserID
+			case reflect.TypeOf(models.Trainer{}):
+				owner = i.TrainerID
+			}
+			if owner != nil && ids[*owner] {
+				delete(data.identities, key)
+			}
+		}
+
+		purged = int64(len(ids))
+		return nil
+	})
+
+	return purged, err
+}
+
+func (s *memoryModelStore) WithDeleted() ModelStore {
+	withDeleted := *s
+	withDeleted.withDeleted = true
+	return &withDeleted
+}
+
+func setIfZero(model reflect.Value, name string, t time.Time) {
+	field := model.FieldByName(name)
+	if field.IsValid() && field.Interface().(time.Time).IsZero() {
+		field.Set(reflect.ValueOf(t))
+	}
+}
+
+// columnNames maps column names to field names the same way GORM does.
+var columnNames = schema.NamingStrategy{}
+
+// matches reports whether model satisfies every condition in the filter.
+func matches(model reflect.Value, filter Filter) (bool, error) {
+	for _, c := range filter {
+		field, err := column(model, c.Column)
+		if err != nil {
+			return false, err
+		}
+
+		ok, err := compare(field, c.Op, c.Value)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", c.Column, err)
+		}
+
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func column(model reflect.Value, name string) (reflect.Value, error) {
+	modelType := model.Type()
+	for i := 0; i < modelType.NumField(); i++ {
+		field := modelType.Field(i)
+		if !field.Anonymous && field.IsExported() && columnNames.ColumnName("", field.Name) == name {
+			return model.Field(i), nil
+		}
+	}
+
+	// Fields of embedded structs such as gorm.Model are shadowed by the model's own.
+	for i := 0; i < modelType.NumField(); i++ {
+		if modelType.Field(i).Anonymous && model.Field(i).Kind() == reflect.Struct {
+			if field, err := column(model.Field(i), name); err == nil {
+				return field, nil
+			}
+		}
+	}
+
+	return reflect.Value{}, fmt.Errorf("unknown column %q", name)
+}
+
+// columnID returns the value of a column holding an ID, such as an appt's user_id.
+func columnID(model reflect.Value, name string) uint {
+	field, err := column(model, name)
+	if err != nil {
+		panic(err)
+	}
+
+	return uint(field.Uint())
+}
+
+func compare(field reflect.Value, op string, value interface{}) (bool, error) {
+	if op == "in" {
+		values := reflect.ValueOf(value)
+		if values.Kind() != reflect.Slice {
+			return false, fmt.Errorf("in needs a slice, got %T", value)
+		}
+
+		for i := 0; i < values.Len(); i++ {
+			ok, err := compare(field, "=", values.Index(i).Interface())
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+
+		return false, nil
+	}
+
+	cmp, err := order(field, value)
+	if err != nil {
+		return false, err
+	}
+
+	switch op {
+	case "=":
+		return cmp == 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	default:
+		return false, fmt.Errorf("unknown operator %q", op)
+	}
+}
+
+// order compares the field with value, converting a string value, as from a query parameter, to
+// the field's type. It returns -1, 0 or 1 as the field is less than, equal to or greater than it.
+func order(field reflect.Value, value interface{}) (int, error) {
+	switch f := field.Interface().(type) {
+	case time.Time:
+		t, ok := value.(time.Time)
+		if !ok {
+			s, isString := value.(string)
+			if !isString {
+				return 0, fmt.Errorf("cannot compare time with %T", value)
+			}
+
+			var err error
+			t, err = time.Parse(time.RFC3339, s)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		switch {
+		case f.Before(t):
+			return -1, nil
+		case f.After(t):
+			return 1, nil
+		default:
+			return 0, nil
+		}
+	case string:
+		s := fmt.Sprint(value)
+		switch {
+		case f < s:
+			return -1, nil
+		case f > s:
+			return 1, nil
+		default:
+			return 0, nil
+		}
+	}
+
+	switch field.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(fmt.Sprint(value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		switch f := field.Uint(); {
+		case f < n:
+			return -1, nil
+		case f > n:
+			return 1, nil
+		default:
+			return 0, nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(fmt.Sprint(value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		switch f := field.Int(); {
+		case f < n:
+			return -1, nil
+		case f > n:
+			return 1, nil
+		default:
+			return 0, nil
+		}
+	}
+
+	return 0, fmt.Errorf("cannot compare %s", field.Type())
+}
+
+type memoryApptStore struct {
+	memoryModelStore
+}
+
+func (s *memoryApptStore) Available(appt models.Appt) (bool, error) {
+	available := true
+	err := s.s.locked(func(data *memoryData) error {
+		available = !data.slotTaken(appt)
+		return nil
+	})
+
+	return available, err
+}
+
+func (s *memoryApptStore) History(id uint, versions *[]models.ApptVersion) error {
+	return s.s.locked(func(data *memoryData) error {
+		found := []models.ApptVersion{}
+		for _, v := range data.apptVersions {
+			if v.ApptID == id {
+				found = append(found, v)
+			}
+		}
+
+		if len(found) == 0 {
+			return ErrNotFound
+		}
+
+		*versions = found
+		return nil
+	})
+}
+
+func (s *memoryApptStore) Versions(filter Filter, versions *[]models.ApptVersion) error {
+	return s.s.locked(func(data *memoryData) error {
+		found := []models.ApptVersion{}
+		for _, v := range data.apptVersions {
+			ok, err := matches(reflect.ValueOf(v), filter)
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				found = append(found, v)
+			}
+		}
+		sort.SliceStable(found, func(i, j int) bool { return found[i].ApptID < found[j].ApptID })
+
+		*versions = found
+		return nil
+	})
+}
+
+func (s *memoryApptStore) AsOf(t time.Time) ModelStore {
+	return &memoryApptsAsOf{s: s.s, at: t}
+}
+
+// memoryApptsAsOf reconstructs appts from their latest versions recorded at or before at.
+type memoryApptsAsOf struct {
+	s  *memoryStore
+	at time.Time
+	// withDeleted includes appts that were deleted at the time.
+	withDeleted bool
+}
+
+// appts returns the appts as they were, ordered by ID.
+func (s *memoryApptsAsOf) appts(data *memoryData) []models.Appt {
+	latest := map[uint]models.ApptVersion{}
+	for _, v := range data.apptVersions {
+		if !v.RecordedAt.After(s.at) {
+			latest[v.ApptID] = v
+		}
+	}
+
+	appts := make([]models.Appt, 0, len(latest))
+	for _, v := range latest {
+		if v.DeletedAt == nil || s.withDeleted {
+			appts = append(appts, ApptAt(v))
+		}
+	}
+	sort.Slice(appts, func(i, j int) bool { return appts[i].ID < appts[j].ID })
+
+	return appts
+}
+
+func (s *memoryApptsAsOf) Get(id uint, model interface{}) error {
+	return s.s.locked(func(data *memoryData) error {
+		for _, appt := range s.appts(data) {
+			if appt.ID == id {
+				*model.(*models.Appt) = appt
+				return nil
+			}
+		}
+
+		return ErrNotFound
+	})
+}
+
+func (s *memoryApptsAsOf) List(filter Filter, appts interface{}) error {
+	return s.s.locked(func(data *memoryData) error {
+		found := []models.Appt{}
+		for _, appt := range s.appts(data) {
+			ok, err := matches(reflect.ValueOf(appt), filter)
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				found = append(found, appt)
+			}
+		}
+
+		*appts.(*[]models.Appt) = found
+		return nil
+	})
+}
+
+func (s *memoryApptsAsOf) Create(interface{}) error        { return ErrReadOnly }
+func (s *memoryApptsAsOf) Update(interface{}, uint) error  { return ErrReadOnly }
+func (s *memoryApptsAsOf) Delete(interface{}, uint) error  { return ErrReadOnly }
+func (s *memoryApptsAsOf) Restore(interface{}, uint) error { return ErrReadOnly }
+func (s *memoryApptsAsOf) Purge(time.Time) (int64, error)  { return 0, ErrReadOnly }
+
+func (s *memoryApptsAsOf) WithDeleted() ModelStore {
+	withDeleted := *s
+	withDeleted.withDeleted = true
+	return &withDeleted
+}
+
+type memoryIdempotencyKeyStore struct {
+	s *memoryStore
+}
+
+func (s *memoryIdempotencyKeyStore) Get(key string) (*models.IdempotencyKey, error) {
+	var found *models.IdempotencyKey
+	err := s.s.locked(func(data *memoryData) error {
+		stored, ok := data.keys[key]
+		if !ok {
+			return ErrNotFound
+		}
+
+		found = &stored
+		return nil
+	})
+
+	return found, err
+}
+
+func (s *memoryIdempotencyKeyStore) Create(key *models.IdempotencyKey) error {
+	return s.s.locked(func(data *memoryData) error {
+		if _, ok := data.keys[key.Key]; ok {
+			return fmt.Errorf("%w: idempotency key %q", ErrDuplicate, key.Key)
+		}
+
+		data.keys[key.Key] = *key
+		return nil
+	})
+}
+
+func (s *memoryIdempotencyKeyStore) Save(key *models.IdempotencyKey) error {
+	return s.s.locked(func(data *memoryData) error {
+		data.keys[key.Key] = *key
+		return nil
+	})
+}
+
+func (s *memoryIdempotencyKeyStore) Delete(key string) error {
+	return s.s.locked(func(data *memoryData) error {
+		delete(data.keys, key)
+		return nil
+	})
+}
+
+func (s *memoryIdempotencyKeyStore) DeleteBefore(t time.Time) error {
+	return s.s.locked(func(data *memoryData) error {
+		for key, stored := range data.keys {
+			if stored.CreatedAt.Before(t) {
+				delete(data.keys, key)
+			}
+		}
+
+		return nil
+	})
+}
+
+type memoryAPIKeyStore struct {
+	memoryModelStore
+}
+
+func (s *memoryAPIKeyStore) Create(key *models.APIKey) error {
+	return s.s.locked(func(data *memoryData) error {
+		for _, stored := range data.table(s.model).sorted(true) {
+			if stored.Interface().(models.APIKey).Hash == key.Hash {
+				return fmt.Errorf("%w: api key hash", ErrDuplicate)
+			}
+		}
+
+		// The lock is already held, so create through a store that doesn't take it again.
+		return (&memoryModelStore{s: &memoryStore{data: data, clock: s.s.clock}}).Create(key)
+	})
+}
+
+func (s *memoryAPIKeyStore) List(keys *[]models.APIKey) error {
+	return s.memoryModelStore.List(nil, keys)
+}
+
+func (s *memoryAPIKeyStore) GetByHash(hash string) (*models.APIKey, error) {
+	var found *models.APIKey
+	err := s.s.locked(func(data *memoryData) error {
+		for _, stored := range data.table(s.model).sorted(false) {
+			if key := stored.Interface().(models.APIKey); key.Hash == hash {
+				found = &key
+				return nil
+			}
+		}
+
+		return ErrNotFound
+	})
+
+	return found, err
+}
+
+func (s *memoryAPIKeyStore) Delete(id uint) error {
+	return s.s.locked(func(data *memoryData) error {
+		table := data.table(s.model)
+		stored, ok := table.get(id, false)
+		if !ok {
+			return ErrNotFound
+		}
+
+		table.set(stored, "DeletedAt", gorm.DeletedAt{Time: s.s.clock.Now(), Valid: true})
+		return nil
+	})
+}
+
+type memoryFeedTokenStore struct {
+	memoryModelStore
+}
+
+func (s *memoryFeedTokenStore) Create(token *models.FeedToken) error {
+	return s.s.locked(func(data *memoryData) error {
+		for _, stored := range data.table(s.model).sorted(true) {
+			if stored.Interface().(models.FeedToken).Hash == token.Hash {
+				return fmt.Errorf("%w: feed token hash", ErrDuplicate)
+			}
+		}
+
+		// The lock is already held, so create through a store that doesn't take it again.
+		return (&memoryModelStore{s: &memoryStore{data: data, clock: s.s.clock}}).Create(token)
+	})
+}
+
+func (s *memoryFeedTokenStore) List(owner string, ownerID uint, tokens *[]models.FeedToken) error {
+	filter := Filter{{Column: "owner", Op: "=", Value: owner}, {Column: "owner_id", Op: "=", Value: ownerID}}
+	return s.memoryModelStore.List(filter, tokens)
+}
+
+func (s *memoryFeedTokenStore) GetByHash(hash string) (*models.FeedToken, error) {
+	var found *models.FeedToken
+	err := s.s.locked(func(data *memoryData) error {
+		for _, stored := range data.table(s.model).sorted(false) {
+			if token := stored.Interface().(models.FeedToken); token.Hash == hash {
+				found = &token
+				return nil
+			}
+		}
+
+		return ErrNotFound
+	})
+
+	return found, err
+}
+
+func (s *memoryFeedTokenStore) Delete(id uint) error {
+	return s.s.locked(func(data *memoryData) error {
+		table := data.table(s.model)
+		stored, ok := table.get(id, false)
+		if !ok {
+			return ErrNotFound
+		}
+
+		table.set(stored, "DeletedAt", gorm.DeletedAt{Time: s.s.clock.Now(), Valid: true})
+		return nil
+	})
+}
+
+type memoryBusyCalendarStore struct {
+	memoryModelStore
+}
+
+func (s *memoryBusyCalendarStore) Create(cal *models.BusyCalendar) error {
+	return s.memoryModelStore.Create(cal)
+}
+
+func (s *memoryBusyCalendarStore) Get(id uint) (*models.BusyCalendar, error) {
+	var cal models.BusyCalendar
+	if err := s.memoryModelStore.Get(id, &cal); err != nil {
+		return nil, err
+	}
+
+	return &cal, nil
+}
+
+func (s *memoryBusyCalendarStore) List(filter Filter, cals *[]models.BusyCalendar) error {
+	return s.memoryModelStore.List(filter, cals)
+}
+
+func (s *memoryBusyCalendarStore) Save(cal *models.BusyCalendar) error {
+	return s.s.locked(func(data *memoryData) error {
+		table := data.table(s.model)
+		if _, ok := table.get(cal.ID, false); !ok {
+			return ErrNotFound
+		}
+
+		cal.UpdatedAt = s.s.clock.Now()
+		table.rows[cal.ID] = *cal
+		return nil
+	})
+}
+
+func (s *memoryBusyCalendarStore) Delete(id uint) error {
+	return s.s.locked(func(data *memoryData) error {
+		table := data.table(s.model)
+		stored, ok := table.get(id, false)
+		if !ok {
+			return ErrNotFound
+		}
+
+		table.set(stored, "DeletedAt", gorm.DeletedAt{Time: s.s.clock.Now(), Valid: true})
+		return nil
+	})
+}
+
+type memoryTimeOffStore struct {
+	memoryModelStore
+}
+
+func (s *memoryTimeOffStore) Get(trainerID uint, name string) (*models.TimeOff, error) {
+	var found *models.TimeOff
+	err := s.s.locked(func(data *memoryData) error {
+		for _, stored := range data.table(s.model).sorted(false) {
+			if t := stored.Interface().(models.TimeOff); t.TrainerID == trainerID && t.Name == name {
+				found = &t
+				return nil
+			}
+		}
+
+		return ErrNotFound
+	})
+
+	return found, err
+}
+
+func (s *memoryTimeOffStore) List(filter Filter, timeOff *[]models.TimeOff) error {
+	return s.memoryModelStore.List(filter, timeOff)
+}
+
+func (s *memoryTimeOffStore) Create(t *models.TimeOff) error {
+	return s.s.locked(func(data *memoryData) error {
+		for _, stored := range data.table(s.model).sorted(false) {
+			if existing := stored.Interface().(models.TimeOff); existing.TrainerID == t.TrainerID && existing.Name == t.Name {
+				return fmt.Errorf("%w: time off name", ErrDuplicate)
+			}
+		}
+
+		// The lock is already held, so create through a store that doesn't take it again.
+		t.Version = 1
+		return (&memoryModelStore{s: &memoryStore{data: data, clock: s.s.clock}}).Create(t)
+	})
+}
+
+func (s *memoryTimeOffStore) Update(t *models.TimeOff, version uint) error {
+	return s.s.locked(func(data *memoryData) error {
+		table := data.table(s.model)
+		stored, ok := table.get(t.ID, false)
+		if !ok || stored.Interface().(models.TimeOff).Version != version {
+			return ErrConflict
+		}
+
+		t.CreatedAt = stored.Interface().(models.TimeOff).CreatedAt
+		t.UpdatedAt = s.s.clock.Now()
+		t.Version = version + 1
+		table.rows[t.ID] = *t
+		return nil
+	})
+}
+
+func (s *memoryTimeOffStore) Delete(id uint) error {
+	return s.s.locked(func(data *memoryData) error {
+		table := data.table(s.model)
+		if _, ok := table.get(id, false); !ok {
+			return ErrNotFound
+		}
+
+		delete(table.rows, id)
+		return nil
+	})
+}
+
+type memoryAccountStore struct {
+	s *memoryStore
+}
+
+func (s *memoryAccountStore) GetCredential(userID uint) (*models.Credential, error) {
+	var found *models.Credential
+	err := s.s.locked(func(data *memoryData) error {
+		c, ok := data.credentials[userID]
+		if !ok {
+			return ErrNotFound
+		}
+
+		found = &c
+		return nil
+	})
+
+	return found, err
+}
+
+func (s *memoryAccountStore) SaveCredential(c *models.Credential) error {
+	return s.s.locked(func(data *memoryData) error {
+		now := s.s.clock.Now()
+		if existing, ok := data.credentials[c.UserID]; ok {
+			c.CreatedAt = existing.CreatedAt
+		} else if c.CreatedAt.IsZero() {
+			c.CreatedAt = now
+		}
+		c.UpdatedAt = now
+
+		data.credentials[c.UserID] = *c
+		return nil
+	})
+}
+
+func (s *memoryAccountStore) CreateToken(t *models.UserToken) error {
+	return s.s.locked(func(data *memoryData) error {
+		if _, ok := data.tokens[t.Hash]; ok {
+			return fmt.Errorf("%w: token hash", ErrDuplicate)
+		}
+
+		if t.CreatedAt.IsZero() {
+			t.CreatedAt = s.s.clock.Now()
+		}
+
+		data.tokens[t.Hash] = *t
+		return nil
+	})
+}
+
+func (s *memoryAccountStore) GetToken(kind, hash string) (*models.UserToken, error) {
+	var found *models.UserToken
+	err := s.s.locked(func(data *memoryData) error {
+		t, ok := data.tokens[hash]
+		if !ok || t.Kind != kind {
+			return ErrNotFound
+		}
+
+		found = &t
+		return nil
+	})
+
+	return found, err
+}
+
+func (s *memoryAccountStore) UseToken(hash string) error {
+	return s.s.locked(func(data *memoryData) error {
+		t, ok := data.tokens[hash]
+		if !ok || t.UsedAt != nil {
+			return ErrConflict
+		}
+
+		now := s.s.clock.Now()
+		t.UsedAt = &now
+		data.tokens[hash] = t
+		return nil
+	})
+}
+
+func (s *memoryAccountStore) RevokeTokens(userID uint, kind string) error {
+	return s.s.locked(func(data *memoryData) error {
+		now := s.s.clock.Now()
+		for hash, t := range data.tokens {
+			if t.UserID == userID && t.Kind == kind && t.UsedAt == nil {
+				t.UsedAt = &now
+				data.tokens[hash] = t
+			}
+		}
+
+		return nil
+	})
+}
+
+// identityKey identifies an identity by its issuer and subject.
+type identityKey struct {
+	issuer, subject string
+}
+
+func (s *memoryAccountStore) GetIdentity(issuer, subject string) (*models.Identity, error) {
+	var found *models.Identity
+	err := s.s.locked(func(data *memoryData) error {
+		i, ok := data.identities[identityKey{issuer, subject}]
+		if !ok {
+			return ErrNotFound
+		}
+
+		found = &i
+		return nil
+	})
+
+	return found, err
+}
+
+func (s *memoryAccountStore) CreateIdentity(i *models.Identity) error {
+	return s.s.locked(func(data *memoryData) error {
+		key := identityKey{i.Issuer, i.Subject}
+		if _, ok := data.identities[key]; ok {
+			return fmt.Errorf("%w: identity", ErrDuplicate)
+		}
+
+		if i.CreatedAt.IsZero() {
+			i.CreatedAt = s.s.clock.Now()
+		}
+
+		data.identities[key] = *i
+		return nil
+	})
+}
+
+type memoryAuditStore struct {
+	s *memoryStore
+}
+
+func (s *memoryAuditStore) Append(e *models.AuditEntry) error {
+	return s.s.locked(func(data *memoryData) error {
+		e.ID = uint(len(data.audit) + 1)
+		if e.CreatedAt.IsZero() {
+			e.CreatedAt = s.s.clock.Now()
+		}
+
+		data.audit = append(data.audit, *e)
+		return nil
+	})
+}
+
+func (s *memoryAuditStore) List(filter Filter, entries *[]models.AuditEntry) error {
+	return s.s.locked(func(data *memoryData) error {
+		found := []models.AuditEntry{}
+		for _, e := range data.audit {
+			ok, err := matches(reflect.ValueOf(e), filter)
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				found = append(found, e)
+			}
+		}
+
+		*entries = found
+		return nil
+	})
+}
@@ -0,0 +1,239 @@
+// Package store defines the storage the server depends on, independent of the database behind
+// it.
+package store
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/marcuscarr/appts/models"
+)
+
+var (
+	// ErrNotFound is returned when no model has the requested ID or key.
+	ErrNotFound = errors.New("record not found")
+	// ErrConflict is returned when a write expected a version other than the stored one.
+	ErrConflict = errors.New("version conflict")
+	// ErrDuplicate is returned when a write would break a uniqueness rule, such as a trainer
+	// having two appts starting at the same time.
+	ErrDuplicate = errors.New("duplicate")
+	// ErrReadOnly is returned by writes to a view of the past.
+	ErrReadOnly = errors.New("read only")
+)
+
+// Condition compares a column with a value. Op is one of =, <, <=, >, >= or in; for in, Value
+// is a slice.
+type Condition struct {
+	Column string
+	Op     string
+	Value  interface{}
+}
+
+// Filter selects the models whose columns satisfy every condition.
+type Filter []Condition
+
+// ModelStore is the storage common to every resource. Model arguments are pointers to the
+// store's model type, and models is a pointer to a slice of it.
+type ModelStore interface {
+	// Get loads the model with the given ID into model.
+	Get(id uint, model interface{}) error
+	// List loads the models matching the filter into models, ordered by ID.
+	List(filter Filter, models interface{}) error
+	// Create inserts model. If its ID is set it is kept and later IDs are allocated after it.
+	Create(model interface{}) error
+	// Update overwrites the stored model if it is still at the given version, and sets the
+	// model's version to the next one. Otherwise it returns ErrConflict.
+	Update(model interface{}, version uint) error
+	// Delete soft deletes the model with model's ID if it is still at the given version.
+	// Otherwise it returns ErrConflict. Deleted models are left out of Get and List, and can't
+	// be updated or deleted again.
+	Delete(model interface{}, version uint) error
+	// Restore undoes the deletion of the model with model's ID if it is still deleted and at the
+	// given version, loads it into model and sets its version to the next one. Otherwise it
+	// returns ErrConflict, or ErrDuplicate if the restored model would break a uniqueness rule.
+	Restore(model interface{}, version uint) error
+	// Purge permanently removes the models deleted before t and returns how many it removed.
+	Purge(before time.Time) (int64, error)
+	// WithDeleted returns a view of the storage whose Get and List include deleted models.
+	WithDeleted() ModelStore
+}
+
+// UserStore and TrainerStore cascade to appts. Deleting a user or trainer deletes their appts
+// at the same time, and restoring one restores the appts deleted with it, except those whose
+// slot has since been taken or whose other party is still deleted. Purging one purges all of
+// their appts, and purging a trainer their busy calendars and time off.
+type UserStore interface {
+	ModelStore
+}
+
+type TrainerStore interface {
+	ModelStore
+}
+
+// cascade describes how deleting a user or trainer carries over to their appts.
+type cascade struct {
+	// column is the appts column referring to the user or trainer.
+	column string
+	// other is the model of the appt's other party, which must not be deleted for the appt to
+	// be restored, and otherColumn the appts column referring to it.
+	other       interface{}
+	otherColumn string
+}
+
+var (
+	userCascade    = &cascade{column: "user_id", other: &models.Trainer{}, otherColumn: "trainer_id"}
+	trainerCascade = &cascade{column: "trainer_id", other: &models.User{}, otherColumn: "user_id"}
+)
+
+// ApptStore keeps a version of an appt for every change to it, including those cascaded from its
+// user or trainer. Purging an appt purges its versions.
+type ApptStore interface {
+	ModelStore
+	// Available reports whether appt's trainer has no other appt starting at the same time.
+	// The appt itself is ignored so that an update that keeps its time doesn't conflict.
+	Available(appt models.Appt) (bool, error)
+	// History loads the versions of the appt with the given ID into versions, oldest first. It
+	// returns ErrNotFound if the appt has none.
+	History(id uint, versions *[]models.ApptVersion) error
+	// Versions loads the versions of any appt that match filter, on the versions' columns, into
+	// versions, ordered by appt and then oldest first.
+	Versions(filter Filter, versions *[]models.ApptVersion) error
+	// AsOf returns a view of the appts as they were at t. Its Get and List reconstruct them
+	// from their versions, and its writes return ErrReadOnly.
+	AsOf(t time.Time) ModelStore
+}
+
+// ApptAt returns the appt as it was at the version.
+func ApptAt(v models.ApptVersion) models.Appt {
+	appt := models.Appt{
+		ID:        v.ApptID,
+		StartTime: v.StartTime,
+		EndTime:   v.EndTime,
+		UserID:    v.UserID,
+		TrainerID: v.TrainerID,
+		Attended:  v.Attended,
+		Version:   v.Version,
+	}
+	appt.Model = gorm.Model{ID: v.ApptID, CreatedAt: v.CreatedAt, UpdatedAt: v.UpdatedAt}
+	if v.DeletedAt != nil {
+		appt.DeletedAt = gorm.DeletedAt{Time: *v.DeletedAt, Valid: true}
+	}
+
+	return appt
+}
+
+type IdempotencyKeyStore interface {
+	Get(key string) (*models.IdempotencyKey, error)
+	// Create inserts the key, failing if it already exists.
+	Create(key *models.IdempotencyKey) error
+	Save(key *models.IdempotencyKey) error
+	Delete(key string) error
+	// DeleteBefore removes keys created before t.
+	DeleteBefore(t time.Time) error
+}
+
+// APIKeyStore stores API keys, which are looked up by the hash of the key.
+type APIKeyStore interface {
+	Create(key *models.APIKey) error
+	// List loads the keys that haven't been deleted, ordered by ID.
+	List(keys *[]models.APIKey) error
+	// GetByHash returns the key with the given hash, unless it has been deleted.
+	GetByHash(hash string) (*models.APIKey, error)
+	// Delete revokes the key with the given ID.
+	Delete(id uint) error
+}
+
+// FeedTokenStore stores the tokens of calendar feeds, which are looked up by the hash of the
+// token.
+type FeedTokenStore interface {
+	Create(token *models.FeedToken) error
+	// List loads the tokens of the owner's calendar that haven't been deleted, ordered by ID.
+	List(owner string, ownerID uint, tokens *[]models.FeedToken) error
+	// GetByHash returns the token with the given hash, unless it has been deleted.
+	GetByHash(hash string) (*models.FeedToken, error)
+	// Delete revokes the token with the given ID.
+	Delete(id uint) error
+}
+
+// BusyCalendarStore stores trainers' busy calendars.
+type BusyCalendarStore interface {
+	Create(cal *models.BusyCalendar) error
+	// Get returns the calendar with the given ID, unless it has been deleted.
+	Get(id uint) (*models.BusyCalendar, error)
+	// List loads the calendars matching the filter that haven't been deleted, ordered by ID.
+	List(filter Filter, cals *[]models.BusyCalendar) error
+	// Save overwrites the stored calendar.
+	Save(cal *models.BusyCalendar) error
+	// Delete removes the calendar with the given ID.
+	Delete(id uint) error
+}
+
+// TimeOffStore stores the time trainers have blocked off.
+type TimeOffStore interface {
+	// Get returns the trainer's time off with the given name.
+	Get(trainerID uint, name string) (*models.TimeOff, error)
+	// List loads the time off matching the filter into timeOff, ordered by ID.
+	List(filter Filter, timeOff *[]models.TimeOff) error
+	// Create returns ErrDuplicate if the trainer already has time off with the same name.
+	Create(t *models.TimeOff) error
+	// Update overwrites the stored time off if it is still at the given version, and sets its
+	// version to the next one. Otherwise it returns ErrConflict.
+	Update(t *models.TimeOff, version uint) error
+	// Delete permanently removes the time off with the given ID.
+	Delete(id uint) error
+}
+
+// AccountStore stores users' credentials, the tokens issued to them, and the identities they
+// log in with.
+type AccountStore interface {
+	// GetCredential returns the user's credential, or ErrNotFound if they have no password.
+	GetCredential(userID uint) (*models.Credential, error)
+	// SaveCredential creates or replaces the user's credential.
+	SaveCredential(c *models.Credential) error
+
+	CreateToken(t *models.UserToken) error
+	// GetToken returns the token of the kind with the hash, whether or not it has been used.
+	GetToken(kind, hash string) (*models.UserToken, error)
+	// UseToken marks the token used. It returns ErrConflict if it already was, so that each token
+	// is only used once.
+	UseToken(hash string) error
+	// RevokeTokens marks every unused token of the kind issued to the user as used.
+	RevokeTokens(userID uint, kind string) error
+
+	// GetIdentity returns the identity at the issuer with the subject, or ErrNotFound if it isn't
+	// linked to anyone.
+	GetIdentity(issuer, subject string) (*models.Identity, error)
+	// CreateIdentity links an identity. It returns ErrDuplicate if the identity already is.
+	CreateIdentity(i *models.Identity) error
+}
+
+// AuditStore keeps the audit log. Entries can be appended and listed, but never changed or
+// removed, not even when the models they describe are purged.
+type AuditStore interface {
+	// Append adds the entry, setting its ID and, if unset, its creation time.
+	Append(e *models.AuditEntry) error
+	// List loads the entries matching the filter into entries, ordered by ID.
+	List(filter Filter, entries *[]models.AuditEntry) error
+}
+
+// Store gives access to the storage for every resource.
+type Store interface {
+	Appts() ApptStore
+	Users() UserStore
+	Trainers() TrainerStore
+	IdempotencyKeys() IdempotencyKeyStore
+	APIKeys() APIKeyStore
+	FeedTokens() FeedTokenStore
+	BusyCalendars() BusyCalendarStore
+	TimeOff() TimeOffStore
+	Accounts() AccountStore
+	Audit() AuditStore
+
+	// Transaction runs fn with a Store whose operations happen in a single transaction, which is
+	// committed if fn returns nil and rolled back otherwise. Transactions may be nested.
+	Transaction(fn func(tx Store) error) error
+
+	Close() error
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/marcuscarr/appts/server"
+)
+
+// fieldMap is a flag giving field renames as from=to, and may be repeated.
+type fieldMap map[string]string
+
+func (m fieldMap) String() string {
+	var pairs []string
+	for from, to := range m {
+		pairs = append(pairs, from+"="+to)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (m fieldMap) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("expected from=to, got %q", pair)
+		}
+		m[parts[0]] = parts[1]
+	}
+
+	return nil
+}
+
+// transferFlags adds the flags shared by import and export to fs.
+func transferFlags(fs *flag.FlagSet, opts *server.TransferOptions) {
+	opts.Fields = fieldMap{}
+	fs.StringVar(&opts.Resource, "resource", "", "users, trainers or appointments")
+	fs.StringVar(&opts.Format, "format", "", "json, jsonl or csv (default from the file extension)")
+	fs.Var(fieldMap(opts.Fields), "map", "rename a field, as from=to; may be repeated")
+}
+
+// importData runs the import subcommand: appts import -resource R [flags] FILE
+func importData(config *server.Config, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: appts import -resource R [-format F] [-map from=to ...] FILE")
+		fmt.Fprintln(fs.Output(), "\nCreates a row for each record in FILE, or standard input if FILE is -.")
+		fs.PrintDefaults()
+	}
+
+	var opts server.TransferOptions
+	transferFlags(fs, &opts)
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var r io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		r = f
+		if opts.Format == "" {
+			opts.Format = server.TransferFormat(name)
+		}
+	}
+
+	s, err := server.OpenStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	result, err := server.Import(s, r, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, rowErr := range result.Errors {
+		fmt.Fprintln(os.Stderr, rowErr)
+	}
+	fmt.Printf("Imported %d %s, %d failed\n", result.Imported, opts.Resource, len(result.Errors))
+
+	if len(result.Errors) > 0 {
+		s.Close()
+		os.Exit(1)
+	}
+}
+
+// exportData runs the export subcommand: appts export -resource R [flags] [-o FILE]
+func exportData(config *server.Config, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: appts export -resource R [-format F] [-map from=to ...] [-o FILE]")
+		fmt.Fprintln(fs.Output(), "\nWrites every row of the resource to FILE, or standard output.")
+		fs.PrintDefaults()
+	}
+
+	var opts server.TransferOptions
+	transferFlags(fs, &opts)
+	output := fs.String("o", "", "file to write (default standard output)")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if opts.Format == "" {
+		opts.Format = server.TransferFormat(*output)
+	}
+	if opts.Format == "" {
+		opts.Format = server.FormatJSON
+	}
+
+	s, err := server.OpenStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	n, err := server.Export(s, w, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d %s\n", n, opts.Resource)
+}